@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"fileserver/internal/backup"
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/dirstore"
+	"fileserver/internal/importer"
+	"fileserver/internal/logging"
+	"fileserver/internal/storage"
+	"fileserver/internal/usage"
+)
+
+// subcommands はサーバーを起動せずに実行する管理用サブコマンド（`fileserver <名前> ...`）です。
+// 戻り値はプロセスの終了コードです。
+var subcommands = map[string]func(args []string) int{
+	"import":  runImport,
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
+// loadCLIConfig はサブコマンド用に設定を読み込み、ロガーを組みます（サーバー起動時と同じ手順）。
+func loadCLIConfig() (*config.Config, error) {
+	setupLogger(logging.ParseLevel(os.Getenv(config.EnvPrefix + "LOG_LEVEL")))
+	config.WarnLegacyEnv()
+
+	cfg, err := config.Load(config.ResolvePath(), defaultConfigYAML)
+	if err != nil {
+		return nil, err
+	}
+	setupLogger(logging.ParseLevel(cfg.LogLevel))
+	return cfg, nil
+}
+
+// runImport は既存のディレクトリツリーを設定済みディレクトリへ一括で取り込みます。
+// 中断しても同じコマンドを再実行すれば取り込み済みのファイルを飛ばして続きから再開します。
+func runImport(args []string) int {
+	fset := flag.NewFlagSet("import", flag.ContinueOnError)
+	uploader := fset.String("uploader", "", "アップロード者として記録するユーザーIDまたはユーザー名（省略時は system）")
+	dryRun := fset.Bool("dry-run", false, "コピー・登録せず、取り込まれる件数とサイズだけを表示する")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "使い方: fileserver import [-uploader ユーザー] [-dry-run] <取り込み元> <取り込み先ディレクトリ>")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 2 {
+		fset.Usage()
+		return 2
+	}
+
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		slog.Error("設定の読み込みに失敗しました", "error", err)
+		return 1
+	}
+	db, err := database.Initialize(cfg.Database.Path, cfg.Database.MaxConnections)
+	if err != nil {
+		slog.Error("データベースの初期化に失敗しました", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			slog.Error("データベースのクローズに失敗しました", "error", err)
+		}
+	}()
+
+	// Ctrl+C 等では処理中のファイルを片付けてから止める（再実行で続きから再開できる）。
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 取り込み先はサーバーと同じく、管理画面での追加・削除を反映したデータベースのディレクトリ定義で判定する。
+	dirs, err := dirstore.New(db).Load(ctx, cfg.Directories())
+	if err != nil {
+		slog.Error("ディレクトリ定義の読み込みに失敗しました", "error", err)
+		return 1
+	}
+	cfg.SetDirectories(dirs)
+
+	storageManager := storage.NewManager(cfg, db)
+	storageManager.SetUsageRecorder(usage.NewTracker(cfg, db))
+	imp := importer.New(cfg, db, storageManager)
+
+	uploaderID, uploaderName, err := imp.ResolveUploader(ctx, *uploader)
+	if err != nil {
+		slog.Error("アップロード者を解決できません", "error", err)
+		return 1
+	}
+
+	opts := importer.Options{
+		Source:       fset.Arg(0),
+		Directory:    fset.Arg(1),
+		UploaderID:   uploaderID,
+		UploaderName: uploaderName,
+		DryRun:       *dryRun,
+	}
+	slog.Info("取り込みを開始します", "source", opts.Source, "directory", opts.Directory, "uploader", uploaderName, "dry_run", opts.DryRun)
+	result, err := imp.Run(ctx, opts)
+	slog.Info("取り込みを終了しました", "imported", result.Imported, "skipped", result.Skipped, "failed", result.Failed, "bytes", result.Bytes)
+	if err != nil {
+		slog.Error("取り込みを中断しました。再実行すると続きから再開します", "error", err)
+		return 1
+	}
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runBackup はDBのスナップショット（VACUUM INTO）とアップロードファイルを dest へバックアップします。
+// 稼働中のサーバーに対して実行でき、2回目以降は変更されたファイルだけをコピーします（増分）。
+func runBackup(args []string) int {
+	fset := flag.NewFlagSet("backup", flag.ContinueOnError)
+	keep := fset.Int("keep", 0, "残すスナップショットの世代数（0は削除しない）。古い世代と参照されない実体を削除する")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "使い方: fileserver backup [-keep 世代数] <バックアップ先>")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 || *keep < 0 {
+		fset.Usage()
+		return 2
+	}
+	dest := fset.Arg(0)
+
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		slog.Error("設定の読み込みに失敗しました", "error", err)
+		return 1
+	}
+	db, err := database.Initialize(cfg.Database.Path, cfg.Database.MaxConnections)
+	if err != nil {
+		slog.Error("データベースの初期化に失敗しました", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			slog.Error("データベースのクローズに失敗しました", "error", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("バックアップを開始します", "dest", dest)
+	result, err := backup.Create(ctx, db, cfg.Storage.UploadPath, dest)
+	if err != nil {
+		slog.Error("バックアップに失敗しました", "error", err)
+		return 1
+	}
+	slog.Info("バックアップが完了しました", "snapshot", result.Snapshot, "files", result.Files, "bytes", result.Bytes,
+		"new_objects", result.NewObjects, "new_bytes", result.NewBytes)
+
+	if *keep > 0 {
+		snapshots, objects, err := backup.Prune(dest, *keep)
+		if err != nil {
+			slog.Error("古いバックアップの削除に失敗しました", "error", err)
+			return 1
+		}
+		slog.Info("古いバックアップを削除しました", "snapshots", snapshots, "objects", objects)
+	}
+	return 0
+}
+
+// runRestore はバックアップを検証したうえで、DBとアップロードファイルを復元します。
+// 検証に失敗した場合は何も書き込みません。サーバーを停止してから実行してください。
+func runRestore(args []string) int {
+	fset := flag.NewFlagSet("restore", flag.ContinueOnError)
+	snapshot := fset.String("snapshot", "", "復元するスナップショットID（省略時は最新）")
+	verifyOnly := fset.Bool("verify-only", false, "検証だけを行い、復元しない")
+	force := fset.Bool("force", false, "既存のDB・ファイルを上書きする")
+	list := fset.Bool("list", false, "スナップショットの一覧を表示する")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "使い方: fileserver restore [-snapshot ID] [-verify-only] [-force] [-list] <バックアップ先>")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+	dest := fset.Arg(0)
+
+	cfg, err := loadCLIConfig()
+	if err != nil {
+		slog.Error("設定の読み込みに失敗しました", "error", err)
+		return 1
+	}
+
+	if *list {
+		ids, err := backup.Snapshots(dest)
+		if err != nil {
+			slog.Error("スナップショット一覧の取得に失敗しました", "error", err)
+			return 1
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return 0
+	}
+
+	if *verifyOnly {
+		id, m, err := backup.Verify(dest, *snapshot)
+		if err != nil {
+			slog.Error("バックアップの検証に失敗しました", "snapshot", id, "error", err)
+			return 1
+		}
+		slog.Info("バックアップを検証しました", "snapshot", id, "files", len(m.Files), "created_at", m.CreatedAt)
+		return 0
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	id, _, err := backup.Restore(ctx, dest, *snapshot, cfg.Database.Path, cfg.Storage.UploadPath, *force)
+	if err != nil {
+		slog.Error("復元に失敗しました", "snapshot", id, "error", err)
+		return 1
+	}
+	return 0
+}
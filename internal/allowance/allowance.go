@@ -0,0 +1,294 @@
+// Package allowance はユーザーごとの1日・1か月あたりの転送量（アップロード・ダウンロード別）の
+// 集計と上限の判定を提供します。転送量は実際に送受信したバイト数を transfer_usage に加算して数えます。
+package allowance
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"fileserver/internal/config"
+)
+
+// 転送の向き（transfer_usage.direction の値）。
+const (
+	Upload   = "upload"
+	Download = "download"
+)
+
+// 日次・月次の期間キーの書式。月次のキーは同じ月の日次のキーより辞書順で前に来るため、
+// 今月のキーより前のものを消せば前月以前の行だけを消せます。
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// Tracker は転送量の加算・残量の判定・利用状況の取得を担います。
+type Tracker struct {
+	config *config.Config
+	db     *sql.DB
+	now    func() time.Time
+}
+
+// Usage は1つの期間の上限と使用量です（/api/user 用）。
+type Usage struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// DirectionStatus は1つの向きの日次・月次の利用状況です。上限の無い期間は省略します。
+type DirectionStatus struct {
+	Daily   *Usage `json:"daily,omitempty"`
+	Monthly *Usage `json:"monthly,omitempty"`
+}
+
+// Status はユーザーの転送量の利用状況です。上限の無い向きは省略します。
+type Status struct {
+	Upload   *DirectionStatus `json:"upload,omitempty"`
+	Download *DirectionStatus `json:"download,omitempty"`
+}
+
+// Quota はリクエスト1本に許される転送量です。
+type Quota struct {
+	UserID    string
+	Direction string
+	// Remaining は残りの転送可能量（バイト）です。
+	Remaining int64
+	// Period は残りを決めている期間（"1日" または "1か月"）です。
+	Period string
+	// ResetsAt は Period の期間が切り替わって再び転送できるようになる時刻です。
+	ResetsAt time.Time
+}
+
+// window は上限が設定された期間1つ分です。
+type window struct {
+	label    string
+	key      string
+	limit    int64
+	resetsAt time.Time
+}
+
+// NewTracker は Tracker を作成します。
+func NewTracker(cfg *config.Config, db *sql.DB) *Tracker {
+	return &Tracker{config: cfg, db: db, now: time.Now}
+}
+
+// Enabled は転送量の上限が設定されているかを返します。
+func (t *Tracker) Enabled() bool {
+	return t.config.Allowance.Enabled()
+}
+
+// limitsFor は roles を持つユーザーの上限と、上限の対象外（管理者）かを返します。
+// ロール指定に当てはまる場合は項目ごとに最も緩いもの（0 は無制限）を使います。
+func (t *Tracker) limitsFor(roles []string) (limits config.AllowanceLimits, exempt bool) {
+	if t.config.HasAdminRole(roles) {
+		return config.AllowanceLimits{}, true
+	}
+
+	matched := false
+	for _, r := range t.config.Allowance.Roles {
+		if !slices.Contains(roles, r.Role) {
+			continue
+		}
+		if !matched {
+			limits = r.AllowanceLimits
+			matched = true
+			continue
+		}
+		limits.UploadDaily = looser(limits.UploadDaily, r.UploadDaily)
+		limits.UploadMonthly = looser(limits.UploadMonthly, r.UploadMonthly)
+		limits.DownloadDaily = looser(limits.DownloadDaily, r.DownloadDaily)
+		limits.DownloadMonthly = looser(limits.DownloadMonthly, r.DownloadMonthly)
+	}
+	if matched {
+		return limits, false
+	}
+	return t.config.Allowance.AllowanceLimits, false
+}
+
+// looser は2つの上限のうち緩い方を返します（0 は無制限）。
+func looser(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// windows は now 時点で direction に上限が設定された期間を返します。
+func windows(now time.Time, direction string, limits config.AllowanceLimits) []window {
+	daily, monthly := limits.UploadDaily, limits.UploadMonthly
+	if direction == Download {
+		daily, monthly = limits.DownloadDaily, limits.DownloadMonthly
+	}
+
+	y, m, d := now.Date()
+	var ws []window
+	if daily > 0 {
+		ws = append(ws, window{"1日", now.Format(dayFormat), daily, time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())})
+	}
+	if monthly > 0 {
+		ws = append(ws, window{"1か月", now.Format(monthFormat), monthly, time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())})
+	}
+	return ws
+}
+
+// used は userID の period・direction の転送量を返します。
+func (t *Tracker) used(ctx context.Context, userID, period, direction string) (int64, error) {
+	var n int64
+	err := t.db.QueryRowContext(ctx,
+		"SELECT bytes FROM transfer_usage WHERE user_id = ? AND period = ? AND direction = ?",
+		userID, period, direction).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("転送量の取得に失敗しました: %w", err)
+	}
+	return n, nil
+}
+
+// Check は userID（ロール roles）が direction に転送できる残りを返します。
+// 上限の対象外か、その向きに上限が無い場合は nil を返します。
+func (t *Tracker) Check(ctx context.Context, userID string, roles []string, direction string) (*Quota, error) {
+	limits, exempt := t.limitsFor(roles)
+	if exempt {
+		return nil, nil
+	}
+	ws := windows(t.now(), direction, limits)
+	if len(ws) == 0 {
+		return nil, nil
+	}
+
+	var q *Quota
+	for _, w := range ws {
+		used, err := t.used(ctx, userID, w.key, direction)
+		if err != nil {
+			return nil, err
+		}
+		remaining := max(w.limit-used, 0)
+		// 残りが同じ（どちらも使い切った）場合は、後に戻る方を再開時刻にする。
+		if q == nil || remaining < q.Remaining || (remaining == q.Remaining && w.resetsAt.After(q.ResetsAt)) {
+			q = &Quota{UserID: userID, Direction: direction, Remaining: remaining, Period: w.label, ResetsAt: w.resetsAt}
+		}
+	}
+	return q, nil
+}
+
+// Record は userID が direction に n バイト転送したことを日次・月次の両方に加算します。
+// 上限の無い期間も数えておき、後から上限を設定した場合にもその期間の使用量を反映できるようにします。
+func (t *Tracker) Record(ctx context.Context, userID, direction string, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	now := t.now()
+	for _, period := range []string{now.Format(dayFormat), now.Format(monthFormat)} {
+		if _, err := t.db.ExecContext(ctx, `
+			INSERT INTO transfer_usage (user_id, period, direction, bytes) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, period, direction) DO UPDATE SET bytes = bytes + excluded.bytes`,
+			userID, period, direction, n); err != nil {
+			return fmt.Errorf("転送量の記録に失敗しました: %w", err)
+		}
+	}
+	return nil
+}
+
+// Status は userID（ロール roles）の利用状況を返します。上限の対象外か、上限が1つも無い場合は nil を返します。
+func (t *Tracker) Status(ctx context.Context, userID string, roles []string) (*Status, error) {
+	limits, exempt := t.limitsFor(roles)
+	if exempt || !limits.Any() {
+		return nil, nil
+	}
+
+	now := t.now()
+	direction := func(dir string) (*DirectionStatus, error) {
+		ws := windows(now, dir, limits)
+		if len(ws) == 0 {
+			return nil, nil
+		}
+		ds := &DirectionStatus{}
+		for _, w := range ws {
+			used, err := t.used(ctx, userID, w.key, dir)
+			if err != nil {
+				return nil, err
+			}
+			u := &Usage{Limit: w.limit, Used: used, Remaining: max(w.limit-used, 0), ResetsAt: w.resetsAt}
+			if w.key == now.Format(dayFormat) {
+				ds.Daily = u
+			} else {
+				ds.Monthly = u
+			}
+		}
+		return ds, nil
+	}
+
+	var s Status
+	var err error
+	if s.Upload, err = direction(Upload); err != nil {
+		return nil, err
+	}
+	if s.Download, err = direction(Download); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Prune は今月より前の転送量を削除します。削除した行数を返します。
+func (t *Tracker) Prune(ctx context.Context) (int64, error) {
+	res, err := t.db.ExecContext(ctx,
+		"DELETE FROM transfer_usage WHERE period < ?", t.now().Format(monthFormat))
+	if err != nil {
+		return 0, fmt.Errorf("古い転送量の削除に失敗しました: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// Allow は n バイトの転送が残りに収まるかを判定し、収まらない場合は 429 を書き込んで false を返します。
+// q が nil（上限なし）の場合は常に true です。
+func (q *Quota) Allow(w http.ResponseWriter, n int64) bool {
+	if q == nil || n <= q.Remaining && q.Remaining > 0 {
+		return true
+	}
+	q.Reject(w)
+	return false
+}
+
+// Reject は転送量の上限による 429 と、再び転送できるようになるまでの秒数（Retry-After）を書き込みます。
+func (q *Quota) Reject(w http.ResponseWriter) {
+	retry := max(int64(time.Until(q.ResetsAt).Seconds()+0.999), 1)
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	http.Error(w, q.Message(), http.StatusTooManyRequests)
+}
+
+// Message は上限に達した（またはリクエストが残りに収まらない）ことを利用者へ伝えるメッセージです。
+// HTTPの応答以外（URLからの取り込みジョブの結果等）で伝える場合にも使います。
+func (q *Quota) Message() string {
+	verb := "アップロード"
+	if q.Direction == Download {
+		verb = "ダウンロード"
+	}
+	if q.Remaining > 0 {
+		// 残りはあるがリクエストが収まらない場合は、残量も伝える。
+		return fmt.Sprintf("%sあたりの%s量の残り（%d バイト）を超えています", q.Period, verb, q.Remaining)
+	}
+	return fmt.Sprintf("%sあたりの%s量の上限に達しました", q.Period, verb)
+}
+
+type contextKey struct{}
+
+// NewContext は q を持つ context を返します（ミドルウェアからハンドラーへ渡すため）。
+func NewContext(ctx context.Context, q *Quota) context.Context {
+	return context.WithValue(ctx, contextKey{}, q)
+}
+
+// FromContext は ctx に入っている Quota を返します。無い場合は nil（上限なし）です。
+func FromContext(ctx context.Context) *Quota {
+	q, _ := ctx.Value(contextKey{}).(*Quota)
+	return q
+}
@@ -0,0 +1,140 @@
+package allowance
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+)
+
+func newTestTracker(t *testing.T, a config.AllowanceConfig) *Tracker {
+	t.Helper()
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tr := NewTracker(&config.Config{Storage: config.StorageConfig{AdminRoleID: "admin"}, Allowance: a}, db)
+	now := time.Date(2026, 10, 31, 22, 0, 0, 0, time.Local)
+	tr.now = func() time.Time { return now }
+	return tr
+}
+
+// ロール指定は既定の上限の代わりに使い、複数当てはまれば項目ごとに最も緩いものを使うこと。管理者は対象外になること。
+func TestLimitsFor(t *testing.T) {
+	tr := newTestTracker(t, config.AllowanceConfig{
+		AllowanceLimits: config.AllowanceLimits{UploadDaily: 100, DownloadDaily: 100},
+		Roles: []config.RoleAllowance{
+			{Role: "member", AllowanceLimits: config.AllowanceLimits{UploadDaily: 200, DownloadDaily: 0, DownloadMonthly: 1000}},
+			{Role: "supporter", AllowanceLimits: config.AllowanceLimits{UploadDaily: 500, DownloadMonthly: 3000}},
+		},
+	})
+	for _, tt := range []struct {
+		roles  []string
+		want   config.AllowanceLimits
+		exempt bool
+	}{
+		{nil, config.AllowanceLimits{UploadDaily: 100, DownloadDaily: 100}, false},
+		{[]string{"member"}, config.AllowanceLimits{UploadDaily: 200, DownloadMonthly: 1000}, false},
+		{[]string{"member", "supporter"}, config.AllowanceLimits{UploadDaily: 500, DownloadMonthly: 3000}, false},
+		{[]string{"admin", "member"}, config.AllowanceLimits{}, true},
+	} {
+		got, exempt := tr.limitsFor(tt.roles)
+		if got != tt.want || exempt != tt.exempt {
+			t.Errorf("limitsFor(%v) = %+v, %v, want %+v, %v", tt.roles, got, exempt, tt.want, tt.exempt)
+		}
+	}
+}
+
+// 転送量は日次・月次の両方に加算され、残りの少ない期間で判定されること。
+func TestCheckAndRecord(t *testing.T) {
+	tr := newTestTracker(t, config.AllowanceConfig{
+		AllowanceLimits: config.AllowanceLimits{DownloadDaily: 1000, DownloadMonthly: 1500},
+	})
+	ctx := context.Background()
+
+	if q, err := tr.Check(ctx, "u1", nil, Upload); err != nil || q != nil {
+		t.Fatalf("上限の無い向きの Check = %+v, %v", q, err)
+	}
+	if err := tr.Record(ctx, "u1", Download, 800); err != nil {
+		t.Fatal(err)
+	}
+	q, err := tr.Check(ctx, "u1", nil, Download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Remaining != 200 || q.Period != "1日" || !q.ResetsAt.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Check = %+v", q)
+	}
+
+	// 翌日は日次が戻り、月次の残りで判定される。
+	tr.now = func() time.Time { return time.Date(2026, 11, 1, 0, 1, 0, 0, time.Local) }
+	if q, err = tr.Check(ctx, "u1", nil, Download); err != nil || q.Remaining != 1000 {
+		t.Errorf("翌日の Check = %+v, %v", q, err)
+	}
+	tr.now = func() time.Time { return time.Date(2026, 10, 1, 9, 0, 0, 0, time.Local) }
+	if err := tr.Record(ctx, "u1", Download, 700); err != nil {
+		t.Fatal(err)
+	}
+	tr.now = func() time.Time { return time.Date(2026, 10, 2, 9, 0, 0, 0, time.Local) }
+	if q, err = tr.Check(ctx, "u1", nil, Download); err != nil || q.Remaining != 0 || q.Period != "1か月" {
+		t.Errorf("月次を使い切った後の Check = %+v, %v", q, err)
+	}
+
+	st, err := tr.Status(ctx, "u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Upload != nil || st.Download.Daily.Used != 0 || st.Download.Monthly.Used != 1500 || st.Download.Monthly.Remaining != 0 {
+		t.Errorf("Status = %+v", st)
+	}
+	if st, err := tr.Status(ctx, "root", []string{"admin"}); err != nil || st != nil {
+		t.Errorf("管理者の Status = %+v, %v", st, err)
+	}
+}
+
+// 前月以前の転送量だけが削除されること。
+func TestPrune(t *testing.T) {
+	tr := newTestTracker(t, config.AllowanceConfig{})
+	ctx := context.Background()
+	for _, now := range []time.Time{
+		time.Date(2026, 9, 30, 12, 0, 0, 0, time.Local),
+		time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local),
+	} {
+		tr.now = func() time.Time { return now }
+		if err := tr.Record(ctx, "u1", Upload, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := tr.Prune(ctx)
+	if err != nil || n != 2 {
+		t.Errorf("Prune = %d, %v, want 2", n, err)
+	}
+	if used, _ := tr.used(ctx, "u1", "2026-10", Upload); used != 10 {
+		t.Errorf("今月の転送量 = %d", used)
+	}
+}
+
+// 残りに収まらない転送は 429 と Retry-After で拒否されること。
+func TestQuotaAllow(t *testing.T) {
+	var nilQuota *Quota
+	if !nilQuota.Allow(httptest.NewRecorder(), 1<<40) {
+		t.Error("上限なしの転送が拒否された")
+	}
+
+	q := &Quota{Direction: Download, Remaining: 100, Period: "1日", ResetsAt: time.Now().Add(90 * time.Second)}
+	if !q.Allow(httptest.NewRecorder(), 100) {
+		t.Error("残りちょうどの転送が拒否された")
+	}
+	rec := httptest.NewRecorder()
+	if q.Allow(rec, 101) {
+		t.Fatal("残りを超える転送が通った")
+	}
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "90" {
+		t.Errorf("code = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,515 @@
+// Package backup は稼働中のサーバーでも安全に取れるバックアップと、その検証付きリストアを提供します。
+//
+// バックアップ先のレイアウト:
+//
+//	<dest>/objects/<sha256の先頭2文字>/<sha256>   アップロードファイルの実体（内容アドレス）
+//	<dest>/snapshots/<ID>/fileserver.db           VACUUM INTO によるDBのスナップショット
+//	<dest>/snapshots/<ID>/manifest.json           パス・サイズ・更新日時・SHA-256の一覧
+//
+// 実体はハッシュで共有されるため、2回目以降は新しい・変更された内容だけがコピーされます（増分）。
+// manifest.json はスナップショットの最後に書き込み、これが無いスナップショットは未完了として無視します。
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fileserver/internal/storage"
+)
+
+const (
+	manifestVersion  = 1
+	manifestFilename = "manifest.json"
+	dbFilename       = "fileserver.db"
+	snapshotIDFormat = "20060102T150405Z"
+)
+
+var (
+	// ErrNoSnapshot はバックアップ先に完了したスナップショットが無い場合のエラーです。
+	ErrNoSnapshot = errors.New("スナップショットが見つかりません")
+	// ErrVerifyFailed はアーカイブの内容がマニフェストと一致しない場合のエラーです。
+	ErrVerifyFailed = errors.New("バックアップの検証に失敗しました")
+	// ErrTargetNotEmpty はリストア先に既存のデータがある場合のエラーです（-force で上書き）。
+	ErrTargetNotEmpty = errors.New("リストア先に既存のデータがあります")
+)
+
+// Entry はマニフェストに記録する1ファイルです。Path はアップロードディレクトリからの相対パスです。
+type Entry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Manifest はスナップショット1つの内容一覧です。
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Database  Entry     `json:"database"`
+	Files     []Entry   `json:"files"`
+}
+
+// Result はバックアップの結果です。
+type Result struct {
+	Snapshot   string `json:"snapshot"`
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	NewObjects int    `json:"new_objects"` // 今回新たにコピーした実体の数（増分）
+	NewBytes   int64  `json:"new_bytes"`
+}
+
+// Create は db と uploadPath のスナップショットを dest に作成します。
+// ファイルを先に、DBを後に取るため、バックアップ中のアップロードはメタデータだけが
+// 含まれることがあります（一覧はディスク基準のため表示には影響しません）。
+// 前回のマニフェストとサイズ・更新日時が一致するファイルはハッシュを再計算しません。
+func Create(ctx context.Context, db *sql.DB, uploadPath, dest string) (*Result, error) {
+	id := time.Now().UTC().Format(snapshotIDFormat)
+	snapDir := filepath.Join(dest, "snapshots", id)
+	if _, err := os.Stat(snapDir); err == nil {
+		return nil, fmt.Errorf("スナップショット %s は既に存在します", id)
+	}
+	if err := os.MkdirAll(snapDir, 0750); err != nil {
+		return nil, fmt.Errorf("バックアップ先の作成に失敗しました: %w", err)
+	}
+	// 失敗時はスナップショットを残さない（コピー済みの実体は次回の増分に使えるため残す）。
+	completed := false
+	defer func() {
+		if !completed {
+			_ = os.RemoveAll(snapDir)
+		}
+	}()
+
+	previous := make(map[string]Entry)
+	if prev, err := latestSnapshot(dest); err == nil {
+		if m, err := readManifest(dest, prev); err == nil {
+			for _, e := range m.Files {
+				previous[e.Path] = e
+			}
+		}
+	}
+
+	result := &Result{Snapshot: id}
+	manifest := Manifest{Version: manifestVersion, Files: make([]Entry, 0)}
+
+	err := filepath.WalkDir(uploadPath, func(p string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// 走査中に削除されたファイルは取り逃してよい。
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// 作業ファイル（進行中のチャンクアップロード）は完了していないため含めない。
+		if d.IsDir() || !d.Type().IsRegular() || storage.IsWorkFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(uploadPath, p)
+		if err != nil {
+			return err
+		}
+		entry := Entry{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime().UTC()}
+
+		if prev, ok := previous[entry.Path]; ok && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) && objectExists(dest, prev.SHA256) {
+			entry.SHA256 = prev.SHA256
+		} else {
+			hash, copied, err := storeObject(dest, p)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			entry.SHA256 = hash
+			if copied {
+				result.NewObjects++
+				result.NewBytes += entry.Size
+			}
+		}
+		manifest.Files = append(manifest.Files, entry)
+		result.Files++
+		result.Bytes += entry.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("アップロードファイルのバックアップに失敗しました: %w", err)
+	}
+
+	// VACUUM INTO は読み取りトランザクション内で一貫したコピーを作るため、
+	// WALモードで稼働中のDBからでも書き込みを止めずに取得できる。
+	dbPath := filepath.Join(snapDir, dbFilename)
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", dbPath); err != nil {
+		return nil, fmt.Errorf("データベースのスナップショットに失敗しました: %w", err)
+	}
+	dbHash, dbSize, err := hashFile(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Database = Entry{Path: dbFilename, Size: dbSize, SHA256: dbHash}
+	manifest.CreatedAt = time.Now().UTC()
+
+	if err := writeManifest(snapDir, &manifest); err != nil {
+		return nil, err
+	}
+	completed = true
+	return result, nil
+}
+
+// Snapshots は完了したスナップショットのIDを古い順に返します。
+func Snapshots(dest string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dest, "snapshots"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("スナップショット一覧の取得に失敗しました: %w", err)
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dest, "snapshots", e.Name(), manifestFilename)); err == nil {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Prune は新しい順に keep 個を残して古いスナップショットを削除し、
+// どのスナップショットからも参照されなくなった実体を削除します。
+// 未完了のスナップショット（マニフェストの無いもの）も削除します。
+func Prune(dest string, keep int) (snapshots, objects int, err error) {
+	if keep < 1 {
+		return 0, 0, fmt.Errorf("残す世代数は1以上を指定してください")
+	}
+	ids, err := Snapshots(dest)
+	if err != nil {
+		return 0, 0, err
+	}
+	complete := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		complete[id] = true
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dest, "snapshots"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, fmt.Errorf("スナップショット一覧の取得に失敗しました: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && !complete[e.Name()] {
+			if err := os.RemoveAll(filepath.Join(dest, "snapshots", e.Name())); err != nil {
+				return snapshots, 0, fmt.Errorf("未完了スナップショットの削除に失敗しました: %w", err)
+			}
+		}
+	}
+
+	if len(ids) > keep {
+		for _, id := range ids[:len(ids)-keep] {
+			if err := os.RemoveAll(filepath.Join(dest, "snapshots", id)); err != nil {
+				return snapshots, 0, fmt.Errorf("スナップショットの削除に失敗しました: %w", err)
+			}
+			snapshots++
+		}
+		ids = ids[len(ids)-keep:]
+	}
+
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		m, err := readManifest(dest, id)
+		if err != nil {
+			// 参照を確定できないまま実体を消すと残した世代が壊れるため、回収は行わない。
+			return snapshots, 0, err
+		}
+		for _, e := range m.Files {
+			referenced[e.SHA256] = true
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(dest, "objects"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		objects++
+		return nil
+	})
+	if err != nil {
+		return snapshots, objects, fmt.Errorf("不要な実体の削除に失敗しました: %w", err)
+	}
+	return snapshots, objects, nil
+}
+
+// Verify はスナップショットの DB と全ファイルの実体をハッシュで検証します。
+// snapshot が空の場合は最新のスナップショットを検証します。
+func Verify(dest, snapshot string) (string, *Manifest, error) {
+	if snapshot == "" {
+		latest, err := latestSnapshot(dest)
+		if err != nil {
+			return "", nil, err
+		}
+		snapshot = latest
+	}
+	m, err := readManifest(dest, snapshot)
+	if err != nil {
+		return snapshot, nil, err
+	}
+
+	if err := verifyFile(filepath.Join(dest, "snapshots", snapshot, dbFilename), m.Database); err != nil {
+		return snapshot, m, fmt.Errorf("%w: データベース: %w", ErrVerifyFailed, err)
+	}
+	for _, e := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return snapshot, m, fmt.Errorf("%w: 不正なパス %q", ErrVerifyFailed, e.Path)
+		}
+		if err := verifyFile(objectPath(dest, e.SHA256), e); err != nil {
+			return snapshot, m, fmt.Errorf("%w: %s: %w", ErrVerifyFailed, e.Path, err)
+		}
+	}
+	return snapshot, m, nil
+}
+
+// Restore はスナップショットを検証したうえで dbPath と uploadPath へ復元します。
+// 検証に失敗した場合は何も書き込みません。リストア先にDBまたはファイルがある場合は
+// force が true の場合のみ上書きします（マニフェストに無い既存ファイルは残します）。
+// サーバーを停止した状態で実行してください。
+func Restore(ctx context.Context, dest, snapshot, dbPath, uploadPath string, force bool) (string, *Manifest, error) {
+	snapshot, m, err := Verify(dest, snapshot)
+	if err != nil {
+		return snapshot, nil, err
+	}
+
+	if !force {
+		if _, err := os.Stat(dbPath); err == nil {
+			return snapshot, nil, fmt.Errorf("%w: %s", ErrTargetNotEmpty, dbPath)
+		}
+		if entries, err := os.ReadDir(uploadPath); err == nil && len(entries) > 0 {
+			return snapshot, nil, fmt.Errorf("%w: %s", ErrTargetNotEmpty, uploadPath)
+		}
+	}
+
+	for _, e := range m.Files {
+		if err := ctx.Err(); err != nil {
+			return snapshot, nil, err
+		}
+		target := filepath.Join(uploadPath, filepath.FromSlash(e.Path))
+		if err := copyFile(objectPath(dest, e.SHA256), target); err != nil {
+			return snapshot, nil, fmt.Errorf("%s の復元に失敗しました: %w", e.Path, err)
+		}
+		if err := os.Chtimes(target, e.ModTime, e.ModTime); err != nil {
+			return snapshot, nil, fmt.Errorf("%s の更新日時の設定に失敗しました: %w", e.Path, err)
+		}
+	}
+
+	if err := copyFile(filepath.Join(dest, "snapshots", snapshot, dbFilename), dbPath); err != nil {
+		return snapshot, nil, fmt.Errorf("データベースの復元に失敗しました: %w", err)
+	}
+	// 旧DBのWALが残っていると、復元したDBに古い変更が再適用されてしまう。
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return snapshot, nil, fmt.Errorf("古いWALファイルの削除に失敗しました: %w", err)
+		}
+	}
+	slog.Info("バックアップを復元しました", "snapshot", snapshot, "files", len(m.Files))
+	return snapshot, m, nil
+}
+
+// latestSnapshot は最新の完了したスナップショットのIDを返します。
+func latestSnapshot(dest string) (string, error) {
+	ids, err := Snapshots(dest)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", ErrNoSnapshot
+	}
+	return ids[len(ids)-1], nil
+}
+
+func readManifest(dest, snapshot string) (*Manifest, error) {
+	if !filepath.IsLocal(snapshot) || strings.ContainsAny(snapshot, `/\`) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, snapshot)
+	}
+	// #nosec G304 - バックアップ先配下のスナップショットID（区切り文字を含まないことを検証済み）
+	data, err := os.ReadFile(filepath.Join(dest, "snapshots", snapshot, manifestFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, snapshot)
+		}
+		return nil, fmt.Errorf("マニフェストの読み込みに失敗しました: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("マニフェストの解析に失敗しました: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("未対応のマニフェスト形式です: version=%d", m.Version)
+	}
+	return &m, nil
+}
+
+// writeManifest はマニフェストを書き込みます。途中で止まっても完了と誤認しないよう一時ファイルからリネームします。
+func writeManifest(snapDir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("マニフェストの作成に失敗しました: %w", err)
+	}
+	tmp := filepath.Join(snapDir, manifestFilename+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("マニフェストの書き込みに失敗しました: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(snapDir, manifestFilename)); err != nil {
+		return fmt.Errorf("マニフェストの書き込みに失敗しました: %w", err)
+	}
+	return nil
+}
+
+func objectPath(dest, hash string) string {
+	prefix := hash
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(dest, "objects", prefix, hash)
+}
+
+func objectExists(dest, hash string) bool {
+	_, err := os.Stat(objectPath(dest, hash))
+	return err == nil
+}
+
+// storeObject は src を内容アドレスの実体として保存し、ハッシュを返します。
+// 同じ内容の実体が既にあればコピーせず copied=false を返します。
+func storeObject(dest, src string) (hash string, copied bool, err error) {
+	objDir := filepath.Join(dest, "objects")
+	if err := os.MkdirAll(objDir, 0750); err != nil {
+		return "", false, fmt.Errorf("バックアップ先の作成に失敗しました: %w", err)
+	}
+	// ハッシュが分かるまで保存先が決まらないため、一時ファイルへコピーしながらハッシュを取る。
+	tmp, err := os.CreateTemp(objDir, ".tmp-*")
+	if err != nil {
+		return "", false, fmt.Errorf("一時ファイルの作成に失敗しました: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() //nolint:errcheck // リネーム済みなら存在しないため失敗してよい
+
+	// #nosec G304 - アップロードディレクトリを走査して得たパス
+	in, err := os.Open(src)
+	if err != nil {
+		_ = tmp.Close()
+		return "", false, err
+	}
+	defer func() { _ = in.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), in); err != nil {
+		_ = tmp.Close()
+		return "", false, fmt.Errorf("ファイルのコピーに失敗しました: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return "", false, fmt.Errorf("ファイルの同期に失敗しました: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", false, fmt.Errorf("ファイルのクローズに失敗しました: %w", err)
+	}
+
+	hash = hex.EncodeToString(h.Sum(nil))
+	if objectExists(dest, hash) {
+		return hash, false, nil
+	}
+	target := objectPath(dest, hash)
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return "", false, fmt.Errorf("バックアップ先の作成に失敗しました: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", false, fmt.Errorf("実体の保存に失敗しました: %w", err)
+	}
+	return hash, true, nil
+}
+
+func hashFile(p string) (string, int64, error) {
+	// #nosec G304 - バックアップ先配下のパス
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = f.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("ハッシュ計算に失敗しました: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func verifyFile(p string, want Entry) error {
+	hash, size, err := hashFile(p)
+	if err != nil {
+		return err
+	}
+	if size != want.Size || hash != want.SHA256 {
+		return fmt.Errorf("内容が一致しません (size=%d, sha256=%s)", size, hash)
+	}
+	return nil
+}
+
+// copyFile は src を dst へ一時ファイル経由でコピーします（途中で止まっても dst を壊さない）。
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	// #nosec G304 - バックアップ先配下のパス
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	tmp := dst + ".restore-tmp"
+	// #nosec G304 - リストア先はマニフェストの相対パス（IsLocal を検証済み）から組み立てたもの
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
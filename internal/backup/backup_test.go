@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fileserver/internal/database"
+)
+
+type fixture struct {
+	db         *sql.DB
+	dbPath     string
+	uploadPath string
+	dest       string
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	dir := t.TempDir()
+	f := &fixture{
+		dbPath:     filepath.Join(dir, "fileserver.db"),
+		uploadPath: filepath.Join(dir, "uploads"),
+		dest:       filepath.Join(dir, "backup"),
+	}
+	db, err := database.Initialize(f.dbPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	f.db = db
+	return f
+}
+
+func (f *fixture) write(t *testing.T, rel, content string) {
+	t.Helper()
+	p := filepath.Join(f.uploadPath, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// スナップショット ID は秒単位のため、連続して取るテストでは間を空ける。
+func (f *fixture) create(t *testing.T) *Result {
+	t.Helper()
+	if ids, _ := Snapshots(f.dest); len(ids) > 0 {
+		time.Sleep(1100 * time.Millisecond)
+	}
+	r, err := Create(context.Background(), f.db, f.uploadPath, f.dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// 2回目は変更・追加されたファイルだけを実体としてコピーし、作業ファイルは含めないこと。
+func TestCreateIncremental(t *testing.T) {
+	f := newFixture(t)
+	f.write(t, "public/a.txt", "aaa")
+	f.write(t, "public/b.txt", "bbb")
+	f.write(t, "public/dup.txt", "aaa")
+	f.write(t, "public/x_upload.temp", "partial")
+
+	r := f.create(t)
+	if r.Files != 3 || r.NewObjects != 2 {
+		t.Errorf("1回目 = %+v, want 3 files / 2 new objects（同じ内容は1つの実体）", r)
+	}
+
+	f.write(t, "public/c.txt", "ccc")
+	r = f.create(t)
+	if r.Files != 4 || r.NewObjects != 1 {
+		t.Errorf("2回目 = %+v, want 4 files / 1 new object", r)
+	}
+
+	ids, err := Snapshots(f.dest)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("snapshots = %v, err = %v", ids, err)
+	}
+	if _, _, err := Verify(f.dest, ""); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+// 復元はDBとファイル（更新日時含む）を戻し、既存データがあれば force なしでは拒否すること。
+func TestRestore(t *testing.T) {
+	f := newFixture(t)
+	f.write(t, "public/a.txt", "aaa")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(f.uploadPath, "public/a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.db.Exec(
+		"INSERT INTO users (id, provider, subject, username) VALUES ('1', 'discord', '1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	f.create(t)
+
+	target := t.TempDir()
+	dbPath := filepath.Join(target, "restored.db")
+	uploadPath := filepath.Join(target, "uploads")
+	if _, _, err := Restore(context.Background(), f.dest, "", dbPath, uploadPath, false); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(uploadPath, "public", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+
+	restored, err := database.Initialize(dbPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var username string
+	if err := restored.QueryRow("SELECT username FROM users WHERE id = '1'").Scan(&username); err != nil || username != "alice" {
+		t.Errorf("復元したDBのユーザー = %q, err = %v", username, err)
+	}
+
+	if _, _, err := Restore(context.Background(), f.dest, "", dbPath, uploadPath, false); !errors.Is(err, ErrTargetNotEmpty) {
+		t.Errorf("既存データへの復元で err = %v, want ErrTargetNotEmpty", err)
+	}
+	if _, _, err := Restore(context.Background(), f.dest, "", dbPath, uploadPath, true); err != nil {
+		t.Errorf("force での復元に失敗: %v", err)
+	}
+}
+
+// 実体が壊れている場合は検証で失敗し、何も書き込まないこと。
+func TestRestoreRejectsCorruptArchive(t *testing.T) {
+	f := newFixture(t)
+	f.write(t, "public/a.txt", "aaa")
+	f.create(t)
+
+	_, m, err := Verify(f.dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objectPath(f.dest, m.Files[0].SHA256), []byte("tampered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	_, _, err = Restore(context.Background(), f.dest, "", filepath.Join(target, "db"), filepath.Join(target, "uploads"), false)
+	if !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("err = %v, want ErrVerifyFailed", err)
+	}
+	if entries, _ := os.ReadDir(target); len(entries) != 0 {
+		t.Errorf("検証失敗時に書き込まれた: %v", entries)
+	}
+}
+
+// 古い世代を削除し、残した世代から参照されない実体だけを回収すること。
+func TestPrune(t *testing.T) {
+	f := newFixture(t)
+	f.write(t, "public/old.txt", "old")
+	f.create(t)
+	if err := os.Remove(filepath.Join(f.uploadPath, "public/old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	f.write(t, "public/new.txt", "new")
+	f.create(t)
+
+	snapshots, objects, err := Prune(f.dest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshots != 1 || objects != 1 {
+		t.Errorf("Prune = (%d, %d), want (1, 1)", snapshots, objects)
+	}
+	if _, _, err := Verify(f.dest, ""); err != nil {
+		t.Errorf("残した世代が壊れた: %v", err)
+	}
+}
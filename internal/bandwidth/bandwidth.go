@@ -0,0 +1,320 @@
+// Package bandwidth はアップロード・ダウンロードの転送帯域の制限（トークンバケット）と、
+// ユーザーごとの転送速度の計測を提供します。
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+)
+
+// maxPiece は1回に待ち合わせて通すバイト数の上限です。
+// トークンバケットの容量（1秒分）より大きな読み書きを分けて通すために使います。
+const maxPiece = 32 * 1024
+
+// meterWindow は転送速度を平均する秒数です。
+const meterWindow = 5
+
+// Manager は全体・ユーザーごとのトークンバケットと、ユーザーごとの転送速度を管理します。
+type Manager struct {
+	config *config.Config
+	global *rate.Limiter // nil は無制限
+	users  map[string]*userState
+	mu     sync.Mutex
+}
+
+// userState はユーザー1人分のトークンバケットと計測値です。フィールドは Manager.mu を持って扱います。
+type userState struct {
+	limiter  *rate.Limiter // nil は無制限
+	username string
+	upload   meter
+	download meter
+	limit    int64
+	active   int  // 進行中の転送数
+	exempt   bool // 全体の上限の対象外（管理者）
+}
+
+// UserThroughput はユーザー1人分の現在の転送速度です（管理者API用）。
+type UserThroughput struct {
+	UserID                 string  `json:"user_id"`
+	Username               string  `json:"username"`
+	UploadBytesPerSecond   float64 `json:"upload_bytes_per_second"`
+	DownloadBytesPerSecond float64 `json:"download_bytes_per_second"`
+	Limit                  int64   `json:"limit"` // 1人あたりの上限（0 は無制限）
+	Active                 int     `json:"active"`
+	Exempt                 bool    `json:"exempt"`
+}
+
+// New は設定に従って帯域を管理するマネージャーを作成します。
+func New(cfg *config.Config) *Manager {
+	m := &Manager{
+		config: cfg,
+		users:  make(map[string]*userState),
+	}
+	if cfg.Bandwidth.Global > 0 {
+		m.global = newLimiter(cfg.Bandwidth.Global)
+	}
+	return m
+}
+
+// newLimiter は毎秒 limit バイトのトークンバケットを作ります。容量は1秒分（最低 maxPiece）です。
+func newLimiter(limit int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(limit), int(max(limit, maxPiece)))
+}
+
+// limitFor は roles を持つユーザー1人あたりの上限（0 は無制限）と、全体の上限の対象外かを返します。
+func (m *Manager) limitFor(roles []string) (limit int64, exempt bool) {
+	b := m.config.Bandwidth
+	if m.config.HasAdminRole(roles) {
+		return b.Admin, b.Admin == 0
+	}
+
+	matched := false
+	for _, r := range b.Roles {
+		if !slices.Contains(roles, r.Role) {
+			continue
+		}
+		if r.Limit == 0 {
+			return 0, false
+		}
+		if !matched || r.Limit > limit {
+			limit = r.Limit
+		}
+		matched = true
+	}
+	if matched {
+		return limit, false
+	}
+	return b.PerUser, false
+}
+
+// Begin は user の転送を1本始めます。roles はユーザーのロールで、上限の決定に使います。
+// 転送が終わったら返り値の End を呼びます。
+func (m *Manager) Begin(user *models.User, roles []string) *Transfer {
+	limit, exempt := m.limitFor(roles)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.users[user.ID]
+	if !ok {
+		s = &userState{}
+		m.users[user.ID] = s
+	}
+	s.username = user.Username
+	s.exempt = exempt
+	if !ok || s.limit != limit {
+		// ロールの変更で上限が変わった場合は、進行中の転送も含めて新しい上限にする。
+		s.limit = limit
+		if limit > 0 && s.limiter != nil {
+			s.limiter.SetLimit(rate.Limit(limit))
+			s.limiter.SetBurst(int(max(limit, maxPiece)))
+		} else if limit > 0 {
+			s.limiter = newLimiter(limit)
+		} else {
+			s.limiter = nil
+		}
+	}
+	s.active++
+
+	t := &Transfer{m: m, state: s, user: s.limiter}
+	if !exempt {
+		t.global = m.global
+	}
+	return t
+}
+
+// Throughput はユーザーごとの現在の転送速度を返します。
+// 進行中の転送が無く、計測期間を過ぎて速度が0になったユーザーはここで取り除きます。
+func (m *Manager) Throughput() []UserThroughput {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	users := make([]UserThroughput, 0, len(m.users))
+	for id, s := range m.users {
+		if s.active == 0 && s.upload.idle(now) && s.download.idle(now) {
+			delete(m.users, id)
+			continue
+		}
+		users = append(users, UserThroughput{
+			UserID:                 id,
+			Username:               s.username,
+			UploadBytesPerSecond:   s.upload.rate(now),
+			DownloadBytesPerSecond: s.download.rate(now),
+			Limit:                  s.limit,
+			Active:                 s.active,
+			Exempt:                 s.exempt,
+		})
+	}
+	slices.SortFunc(users, func(a, b UserThroughput) int {
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	return users
+}
+
+// Transfer はリクエスト1本分の転送です。
+type Transfer struct {
+	m      *Manager
+	state  *userState
+	user   *rate.Limiter // nil は無制限
+	global *rate.Limiter // nil は無制限（または対象外）
+}
+
+// Reader は r から読んだ分を上り（アップロード）として数え、上限に合わせて読み取りを待たせます。
+func (t *Transfer) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &reader{t: t, ctx: ctx, r: r}
+}
+
+// Writer は w へ書いた分を下り（ダウンロード）として数え、上限に合わせて書き込みを待たせます。
+func (t *Transfer) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &writer{t: t, ctx: ctx, w: w}
+}
+
+// End は転送の終了を記録します。
+func (t *Transfer) End() {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.state.active--
+}
+
+// wait は n バイト分のトークンを全体・ユーザーの両方のバケットから待ちます。
+func (t *Transfer) wait(ctx context.Context, n int) error {
+	if t.user != nil {
+		if err := t.user.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if t.global != nil {
+		return t.global.WaitN(ctx, n)
+	}
+	return nil
+}
+
+// limited は上限の対象かを返します（対象外なら読み書きを分けずに通す）。
+func (t *Transfer) limited() bool {
+	return t.user != nil || t.global != nil
+}
+
+// record は転送した量を計測値に加えます。
+func (t *Transfer) record(n int, upload bool) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	if upload {
+		t.state.upload.add(int64(n), now)
+	} else {
+		t.state.download.add(int64(n), now)
+	}
+}
+
+type reader struct {
+	t   *Transfer
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if !r.t.limited() {
+		n, err := r.r.Read(p)
+		r.t.record(n, true)
+		return n, err
+	}
+	if len(p) > maxPiece {
+		p = p[:maxPiece]
+	}
+	n, err := r.r.Read(p)
+	r.t.record(n, true)
+	if n > 0 {
+		// 読んだ後に待つことで、読み取りの遅れとしてクライアントへ押し返す。
+		if waitErr := r.t.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	t   *Transfer
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.t.limited() {
+		n, err := w.w.Write(p)
+		w.t.record(n, false)
+		return n, err
+	}
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), maxPiece)]
+		if err := w.t.wait(w.ctx, len(piece)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(piece)
+		written += n
+		w.t.record(n, false)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// meter は直近 meterWindow 秒の転送量を1秒単位で数えます。
+type meter struct {
+	buckets [meterWindow]int64
+	second  int64 // バケットを進めた最後の Unix 秒
+	last    int64 // 最後に転送があった Unix 秒
+}
+
+// advance は now の秒まで進め、過ぎた秒のバケットを空にします。
+func (m *meter) advance(now time.Time) {
+	sec := now.Unix()
+	if sec-m.second >= meterWindow {
+		m.buckets = [meterWindow]int64{}
+	} else {
+		for s := m.second + 1; s <= sec; s++ {
+			m.buckets[s%meterWindow] = 0
+		}
+	}
+	if sec > m.second {
+		m.second = sec
+	}
+}
+
+func (m *meter) add(n int64, now time.Time) {
+	m.advance(now)
+	m.buckets[m.second%meterWindow] += n
+	m.last = m.second
+}
+
+// rate は数え終わった直近の秒の平均速度（バイト/秒）を返します（途中の今の秒は含めない）。
+func (m *meter) rate(now time.Time) float64 {
+	m.advance(now)
+	var total int64
+	for i, n := range m.buckets {
+		if int64(i) != m.second%meterWindow {
+			total += n
+		}
+	}
+	return float64(total) / (meterWindow - 1)
+}
+
+// idle は計測期間中に転送が無かったかを返します。
+func (m *meter) idle(now time.Time) bool {
+	return now.Unix()-m.last >= meterWindow
+}
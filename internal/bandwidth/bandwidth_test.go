@@ -0,0 +1,116 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+)
+
+func newTestManager(b config.BandwidthConfig) *Manager {
+	return New(&config.Config{
+		Storage:   config.StorageConfig{AdminRoleID: "admin"},
+		Bandwidth: b,
+	})
+}
+
+// 1人あたりの上限はロール指定を優先し、複数当てはまれば最も緩いものを使うこと。管理者は別枠になること。
+func TestLimitFor(t *testing.T) {
+	m := newTestManager(config.BandwidthConfig{
+		PerUser: 100,
+		Roles: []config.RoleBandwidth{
+			{Role: "member", Limit: 200},
+			{Role: "supporter", Limit: 500},
+			{Role: "staff", Limit: 0},
+		},
+	})
+	for _, tt := range []struct {
+		roles      []string
+		wantLimit  int64
+		wantExempt bool
+	}{
+		{nil, 100, false},
+		{[]string{"member"}, 200, false},
+		{[]string{"member", "supporter"}, 500, false},
+		{[]string{"member", "staff"}, 0, false},
+		{[]string{"admin", "member"}, 0, true},
+	} {
+		limit, exempt := m.limitFor(tt.roles)
+		if limit != tt.wantLimit || exempt != tt.wantExempt {
+			t.Errorf("limitFor(%v) = %d, %v, want %d, %v", tt.roles, limit, exempt, tt.wantLimit, tt.wantExempt)
+		}
+	}
+
+	m.config.Bandwidth.Admin = 1000
+	if limit, exempt := m.limitFor([]string{"admin"}); limit != 1000 || exempt {
+		t.Errorf("管理者の別枠 = %d, %v", limit, exempt)
+	}
+}
+
+// 上限を超える書き込み・読み取りは待たされ、転送量が計測されること。
+func TestTransferThrottles(t *testing.T) {
+	m := newTestManager(config.BandwidthConfig{PerUser: maxPiece})
+	user := &models.User{ID: "u1", Username: "alice"}
+	transfer := m.Begin(user, nil)
+
+	var buf bytes.Buffer
+	start := time.Now()
+	// 容量（1秒分）を使い切った後の1秒分は待たされる。
+	if _, err := transfer.Writer(context.Background(), &buf).Write(make([]byte, 2*maxPiece)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("2秒分の書き込みが %v で終わった", elapsed)
+	}
+	if buf.Len() != 2*maxPiece {
+		t.Errorf("書き込んだ量 = %d", buf.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.Copy(io.Discard, transfer.Reader(ctx, strings.NewReader(strings.Repeat("x", 2*maxPiece)))); err == nil {
+		t.Error("キャンセル後の読み取りが待たずに通った")
+	}
+
+	got := m.Throughput()
+	if len(got) != 1 || got[0].Username != "alice" || got[0].Active != 1 || got[0].Limit != maxPiece {
+		t.Fatalf("Throughput = %+v", got)
+	}
+	transfer.End()
+}
+
+// 上限の対象外なら待たずに通し、転送量だけを数えること。
+func TestTransferExempt(t *testing.T) {
+	m := newTestManager(config.BandwidthConfig{Global: 1})
+	transfer := m.Begin(&models.User{ID: "root"}, []string{"admin"})
+	defer transfer.End()
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, transfer.Reader(context.Background(), bytes.NewReader(make([]byte, 1<<20))))
+	if err != nil || n != 1<<20 {
+		t.Fatalf("n = %d, err = %v", n, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("管理者の転送が全体の上限で待たされた")
+	}
+}
+
+// 速度は数え終わった秒の平均で、計測期間を過ぎると0になること。
+func TestMeter(t *testing.T) {
+	var mt meter
+	base := time.Unix(1000, 0)
+	for i := range 4 {
+		mt.add(1000, base.Add(time.Duration(i)*time.Second))
+	}
+	if got := mt.rate(base.Add(4 * time.Second)); got != 1000 {
+		t.Errorf("rate = %v, want 1000", got)
+	}
+	if got := mt.rate(base.Add(time.Minute)); got != 0 || !mt.idle(base.Add(time.Minute)) {
+		t.Errorf("途絶えた後の rate = %v", got)
+	}
+}
@@ -4,9 +4,12 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -31,11 +34,20 @@ func ResolvePath() string {
 // Config はアプリケーション設定を表します。
 type Config struct {
 	// LogLevel はログレベル（debug / info / warn / error）。既定は info。
-	LogLevel string         `yaml:"log_level"`
-	Auth     AuthConfig     `yaml:"auth"`
-	Database DatabaseConfig `yaml:"database"`
-	Server   ServerConfig   `yaml:"server"`
-	Storage  StorageConfig  `yaml:"storage"`
+	LogLevel  string          `yaml:"log_level"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Scan      ScanConfig      `yaml:"scan"`
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+	Allowance AllowanceConfig `yaml:"allowance"`
+	Share     ShareConfig     `yaml:"share"`
+	SignedURL SignedURLConfig `yaml:"signed_url"`
+
+	// dirMu は起動後に管理者APIで差し替える Storage.Directories を保護します。
+	// 差し替えは丸ごと置き換えるため、Directories で得たスライスは以後も変わりません。
+	dirMu sync.RWMutex
 }
 
 // ServerConfig はサーバー設定を表します。
@@ -109,9 +121,14 @@ type StorageConfig struct {
 	UploadSessionTTL     time.Duration     `yaml:"upload_session_ttl"`
 	CleanupInterval      time.Duration     `yaml:"cleanup_interval"`
 	MaxConcurrentUploads int               `yaml:"max_concurrent_uploads"`
+	// MaxBatchFiles は一括アップロード（/files/upload/batch）の1リクエストで送れるファイル数の上限です。
+	MaxBatchFiles int `yaml:"max_batch_files"`
 	// ChunkUploadEnabled は未指定(nil)を「有効」として扱うためポインタにしています。
 	// boolのままだと省略時にゼロ値(false)となり、チャンクアップロードが黙って無効化される。
 	ChunkUploadEnabled *bool `yaml:"chunk_upload_enabled"`
+	// WatchPollInterval は watch: true のディレクトリを定期走査する間隔です。
+	// inotify が使えない環境（Linux以外・NAS共有のネットワークFS等）ではこれが唯一の検出手段になります。
+	WatchPollInterval time.Duration `yaml:"watch_poll_interval"`
 }
 
 // ChunkUploadOn はチャンクアップロードを有効にすべきかを返します（未指定は有効）。
@@ -119,6 +136,147 @@ func (s *StorageConfig) ChunkUploadOn() bool {
 	return s.ChunkUploadEnabled == nil || *s.ChunkUploadEnabled
 }
 
+// ScanConfig はアップロードされたファイルのマルウェアスキャン設定を表します。
+// Type が空の場合はスキャンしません（従来動作）。
+type ScanConfig struct {
+	// Type は "clamd"（ClamAVデーモンへ INSTREAM で送る）または "exec"（外部コマンド）。
+	Type string `yaml:"type"`
+	// ClamdAddress は clamd の接続先です（"tcp://host:3310" または "unix:///run/clamav/clamd.ctl"）。
+	ClamdAddress string `yaml:"clamd_address,omitempty"`
+	// Command は exec で実行するコマンドと引数です。"{file}" はスキャン対象のパスに置き換わり、
+	// 含まれない場合は末尾に追加されます。終了コード 0=問題なし / 1=検出 / それ以外=スキャン失敗。
+	Command []string `yaml:"command,omitempty"`
+	// QuarantinePath は検出したファイルの隔離先です。アップロードディレクトリの外に置きます。
+	// 未指定の場合はアップロードディレクトリと同じ階層の "quarantine" を使います。
+	QuarantinePath string `yaml:"quarantine_path,omitempty"`
+	// Timeout は1ファイルのスキャンにかける上限時間です。
+	Timeout time.Duration `yaml:"timeout"`
+	// FailClosed はスキャン自体に失敗した（clamd 停止・タイムアウト等）ファイルも隔離するかを表します。
+	// false の場合は公開したまま一覧に「スキャン失敗」と表示します。
+	FailClosed bool `yaml:"fail_closed"`
+}
+
+// BandwidthConfig はアップロード・ダウンロードの転送帯域の上限（バイト/秒）を表します。0 は無制限です。
+// 上限はトークンバケットで適用し、ユーザーの同時の転送（上り・下りとも）を合わせて数えます。
+type BandwidthConfig struct {
+	// Global は管理者以外の全ユーザーの転送を合わせた上限です。
+	Global int64 `yaml:"global"`
+	// PerUser はユーザー1人あたりの上限です。Roles に当てはまるユーザーはそちらを使います。
+	PerUser int64 `yaml:"per_user"`
+	// Admin は管理者1人あたりの上限です。0 の場合、管理者は Global も含めて制限されません。
+	Admin int64 `yaml:"admin"`
+	// Roles はロールごとの1人あたりの上限です。複数当てはまる場合は最も緩いもの（0 は無制限）を使います。
+	Roles []RoleBandwidth `yaml:"roles,omitempty"`
+}
+
+// RoleBandwidth はロール1つ分の帯域の上限です。
+type RoleBandwidth struct {
+	Role  string `yaml:"role"`
+	Limit int64  `yaml:"limit"`
+}
+
+// Enabled は帯域の上限が1つでも設定されているかを返します。
+func (b *BandwidthConfig) Enabled() bool {
+	if b.Global > 0 || b.PerUser > 0 || b.Admin > 0 {
+		return true
+	}
+	for _, r := range b.Roles {
+		if r.Limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowanceConfig はユーザーごとの1日・1か月あたりの転送量（バイト）の上限を表します。0 は無制限です。
+// 日・月の区切りはサーバーのローカル時刻で数え、管理者は対象外です。
+type AllowanceConfig struct {
+	AllowanceLimits `yaml:",inline"`
+	// Roles はロールごとの上限です。Roles に当てはまるユーザーは既定の上限の代わりにこちらを使い、
+	// 複数当てはまる場合は項目ごとに最も緩いもの（0 は無制限）を使います。
+	Roles []RoleAllowance `yaml:"roles,omitempty"`
+}
+
+// AllowanceLimits はアップロード・ダウンロードそれぞれの日次・月次の上限です。
+type AllowanceLimits struct {
+	UploadDaily     int64 `yaml:"upload_daily"`
+	UploadMonthly   int64 `yaml:"upload_monthly"`
+	DownloadDaily   int64 `yaml:"download_daily"`
+	DownloadMonthly int64 `yaml:"download_monthly"`
+}
+
+// RoleAllowance はロール1つ分の転送量の上限です。
+type RoleAllowance struct {
+	Role            string `yaml:"role"`
+	AllowanceLimits `yaml:",inline"`
+}
+
+// Any は上限が1つでも設定されているかを返します。
+func (l AllowanceLimits) Any() bool {
+	return l.UploadDaily > 0 || l.UploadMonthly > 0 || l.DownloadDaily > 0 || l.DownloadMonthly > 0
+}
+
+// negative は負の値が含まれているかを返します。
+func (l AllowanceLimits) negative() bool {
+	return l.UploadDaily < 0 || l.UploadMonthly < 0 || l.DownloadDaily < 0 || l.DownloadMonthly < 0
+}
+
+// Enabled は転送量の上限が1つでも設定されているかを返します。
+func (a *AllowanceConfig) Enabled() bool {
+	if a.Any() {
+		return true
+	}
+	for _, r := range a.Roles {
+		if r.Any() {
+			return true
+		}
+	}
+	return false
+}
+
+// ShareConfig はログインできない人とファイルをやり取りする共有リンク（/s/{token}）とアップロードリンク（/d/{token}）の設定を表します。
+type ShareConfig struct {
+	// Enabled は共有リンクの作成と配信を有効にします。ギルド外への公開になるため既定は無効です。
+	Enabled bool `yaml:"enabled"`
+	// MaxExpiry は共有リンクの有効期間の上限です。期間を指定しないリンクにはこの期間を使います。
+	// 0 は上限なし（期間を指定しないリンクは無期限）です。
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+	// DropEnabled はログインできない人からファイルを受け取るアップロードリンク（/d/{token}）を有効にします。
+	// Enabled とは独立に有効にでき、既定は無効です。有効期間の上限は MaxExpiry を共用します。
+	DropEnabled bool `yaml:"drop_enabled"`
+}
+
+// SignedURLConfig はCookieなしで使える短命の署名付きダウンロードURL（/files/signed/...）の設定を表します。
+// スクリプト・メディアプレイヤー・Discordのメッセージへの埋め込みのためのもので、URLごとの記録は残しません。
+type SignedURLConfig struct {
+	// Enabled は署名付きURLの発行と配信を有効にします。既定は無効です。
+	Enabled bool `yaml:"enabled"`
+	// Secret は署名の鍵です（32文字以上）。空の場合は起動ごとにランダムな鍵を生成するため、
+	// 再起動すると発行済みのURLはすべて無効になります。
+	Secret string `yaml:"secret"`
+	// DefaultExpiry は有効期間を指定しないURLの有効期間です。既定は15分です。
+	DefaultExpiry time.Duration `yaml:"default_expiry"`
+	// MaxExpiry は指定できる有効期間の上限です。既定は1時間です。
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+}
+
+// minSignedURLSecret は signed_url.secret に求める最小の長さです（HMAC-SHA256 の出力長に合わせた32バイト）。
+const minSignedURLSecret = 32
+
+// Enabled はスキャンが有効かを返します。
+func (s *ScanConfig) Enabled() bool {
+	return s.Type != ""
+}
+
+// QuarantinePath は隔離先ディレクトリを返します。
+// 環境変数でアップロード先が変わっても追従するよう、既定値は参照時に導出します。
+func (c *Config) QuarantinePath() string {
+	if c.Scan.QuarantinePath != "" {
+		return c.Scan.QuarantinePath
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.Storage.UploadPath)), "quarantine")
+}
+
 // DirectoryConfig はディレクトリ設定を表します。
 type DirectoryConfig struct {
 	Path string `yaml:"path"`
@@ -126,6 +284,52 @@ type DirectoryConfig struct {
 	// Grants はこのディレクトリへのアクセス付与一覧です。
 	// ロール単位・メンバー単位で、それぞれに許可する操作を個別に指定できます。
 	Grants []GrantConfig `yaml:"grants"`
+	// Subdirectories は配下のパスごとの付与です。配下のパスは最も近い（最も具体的な）規則の付与に従い、
+	// 規則の無いパスは親から引き継ぎます。user_private には指定できません。
+	Subdirectories []SubdirectoryConfig `yaml:"subdirectories,omitempty"`
+	// Watch はAPIを経由せず置かれたファイル（rsync・NAS共有等）を検出して
+	// file_metadata へ登録し、アップロードとして通知するかを表します。
+	Watch bool `yaml:"watch,omitempty"`
+	// AllowedExtensions / DeniedExtensions はアップロードを許可・拒否する拡張子です（"jpg"・".tar.gz" 等）。
+	// 許可リストが空なら拒否リスト以外をすべて許可します。拒否リストが優先されます。
+	AllowedExtensions []string `yaml:"allowed_extensions,omitempty"`
+	DeniedExtensions  []string `yaml:"denied_extensions,omitempty"`
+	// AllowedMIMETypes / DeniedMIMETypes はファイルの内容から判定したMIMEタイプで許可・拒否します
+	// （"image/png"・"image/*" 等）。クライアントが送る Content-Type は信用しません。
+	AllowedMIMETypes []string `yaml:"allowed_mime_types,omitempty"`
+	DeniedMIMETypes  []string `yaml:"denied_mime_types,omitempty"`
+	// MaxFileSize はこのディレクトリへの1ファイルの上限（バイト）です。0 は storage の上限のみ適用します。
+	MaxFileSize int64 `yaml:"max_file_size,omitempty"`
+	// Retention は書き込み後にファイルを削除・変更できない期間（WORM）です。アップロード者・管理者も例外ではありません。
+	// 保持期限は登録時に記録され、後から設定を短くしても既存ファイルの期限は縮みません。0 は保持しません。
+	Retention time.Duration `yaml:"retention,omitempty"`
+	// OnConflict は同じ名前のファイルが既にある場合の既定の扱いです（ConflictRename・ConflictReplace・ConflictReject）。
+	// アップロードごとに指定があればそちらを優先します。空は ConflictRename です。
+	OnConflict string `yaml:"on_conflict,omitempty"`
+}
+
+// SubdirectoryConfig はトップレベルのディレクトリ配下のパスへの付与です。
+type SubdirectoryConfig struct {
+	// Path はトップレベルのディレクトリからの相対パスです（"secret"・"clients/acme" 等）。
+	Path   string        `yaml:"path" json:"path"`
+	Grants []GrantConfig `yaml:"grants" json:"grants"`
+	// Inherit が true なら親から引き継いだ付与に Grants を加え（広げる）、false なら Grants で置き換えます（狭める・入れ替える）。
+	Inherit bool `yaml:"inherit,omitempty" json:"inherit,omitempty"`
+}
+
+// 同じ名前のファイルが既にある場合の扱いです。
+const (
+	// ConflictRename は「report (2).pdf」のように番号を付けて両方を残します。
+	ConflictRename = "rename"
+	// ConflictReplace は既存の同名ファイルを新しいファイルで置き換えます。
+	ConflictReplace = "replace"
+	// ConflictReject はアップロードを拒否します。
+	ConflictReject = "reject"
+)
+
+// ValidConflictPolicy は on_conflict に指定できる値かを返します。
+func ValidConflictPolicy(policy string) bool {
+	return policy == ConflictRename || policy == ConflictReplace || policy == ConflictReject
 }
 
 // GrantConfig はディレクトリへのアクセス付与1件を表します。
@@ -134,10 +338,34 @@ type DirectoryConfig struct {
 //   - User: Discordのユーザーid（特定メンバー個人への付与）
 //
 // Permissions には "read" / "write" / "delete" のうち許可する操作を列挙します。
+// Deny が true の付与は、列挙した操作を対象から取り除きます。同じパスに効く付与の中では
+// 拒否が許可より優先されます（"*" や個人指定の許可も、ロールへの拒否で取り消されます）。
 type GrantConfig struct {
-	Role        string   `yaml:"role,omitempty"`
-	User        string   `yaml:"user,omitempty"`
-	Permissions []string `yaml:"permissions"`
+	Role        string   `yaml:"role,omitempty" json:"role,omitempty"`
+	User        string   `yaml:"user,omitempty" json:"user,omitempty"`
+	Permissions []string `yaml:"permissions" json:"permissions"`
+	Deny        bool     `yaml:"deny,omitempty" json:"deny,omitempty"`
+}
+
+// validPermissions は grants の permissions に指定できる操作です。
+var validPermissions = map[string]bool{"read": true, "write": true, "delete": true}
+
+// validateGrants は付与の並びを検証します。prefix はエラーメッセージ中の位置（"grants" 等）です。
+func validateGrants(prefix string, grants []GrantConfig) error {
+	for i, g := range grants {
+		if (g.Role == "") == (g.User == "") {
+			return fmt.Errorf("%s[%d]: role と user のどちらか一方を指定してください", prefix, i)
+		}
+		if len(g.Permissions) == 0 {
+			return fmt.Errorf("%s[%d]: permissions が未設定です", prefix, i)
+		}
+		for _, p := range g.Permissions {
+			if !validPermissions[p] {
+				return fmt.Errorf("%s[%d]: permissions が不正です: %q（\"read\"・\"write\"・\"delete\" のいずれかを指定してください）", prefix, i, p)
+			}
+		}
+	}
+	return nil
 }
 
 // Load は設定ファイルを読み込み、環境変数で上書きします。
@@ -198,8 +426,13 @@ const (
 	defaultChunkSize            = 20 * 1024 * 1024         // 20MB
 	defaultMaxChunkFileSize     = 500 * 1024 * 1024 * 1024 // 500GB
 	defaultMaxConcurrentUploads = 3
+	defaultMaxBatchFiles        = 1000
 	defaultUploadSessionTTL     = 48 * time.Hour
 	defaultCleanupInterval      = time.Hour
+	defaultWatchPollInterval    = time.Minute
+	defaultScanTimeout          = 5 * time.Minute
+	defaultSignedURLExpiry      = 15 * time.Minute
+	defaultSignedURLMaxExpiry   = time.Hour
 )
 
 // applyDefaults は未設定（ゼロ値）の項目に既定値を入れます。
@@ -237,12 +470,29 @@ func applyDefaults(cfg *Config) {
 	if cfg.Storage.MaxConcurrentUploads <= 0 {
 		cfg.Storage.MaxConcurrentUploads = defaultMaxConcurrentUploads
 	}
+	if cfg.Storage.MaxBatchFiles <= 0 {
+		cfg.Storage.MaxBatchFiles = defaultMaxBatchFiles
+	}
 	if cfg.Storage.UploadSessionTTL <= 0 {
 		cfg.Storage.UploadSessionTTL = defaultUploadSessionTTL
 	}
 	if cfg.Storage.CleanupInterval <= 0 {
 		cfg.Storage.CleanupInterval = defaultCleanupInterval
 	}
+	if cfg.Storage.WatchPollInterval <= 0 {
+		cfg.Storage.WatchPollInterval = defaultWatchPollInterval
+	}
+
+	if cfg.Scan.Timeout <= 0 {
+		cfg.Scan.Timeout = defaultScanTimeout
+	}
+
+	if cfg.SignedURL.DefaultExpiry <= 0 {
+		cfg.SignedURL.DefaultExpiry = defaultSignedURLExpiry
+	}
+	if cfg.SignedURL.MaxExpiry <= 0 {
+		cfg.SignedURL.MaxExpiry = defaultSignedURLMaxExpiry
+	}
 }
 
 // Validate は設定の不備を起動時に検出します。
@@ -279,15 +529,79 @@ func (c *Config) Validate() error {
 	if len(c.Storage.Directories) == 0 {
 		return fmt.Errorf("storage.directories が空です（最低1つのディレクトリを定義してください）")
 	}
+	seen := make(map[string]bool, len(c.Storage.Directories))
 	for i, d := range c.Storage.Directories {
-		if d.Path == "" {
-			return fmt.Errorf("storage.directories[%d].path が未設定です", i)
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("storage.directories[%d]: %w", i, err)
 		}
+		if seen[d.Path] {
+			return fmt.Errorf("storage.directories[%d]: path が重複しています: %q", i, d.Path)
+		}
+		seen[d.Path] = true
+	}
+
+	switch c.Scan.Type {
+	case "":
+	case "clamd":
+		if c.Scan.ClamdAddress == "" {
+			return fmt.Errorf("scan.type が clamd の場合は scan.clamd_address を指定してください")
+		}
+	case "exec":
+		if len(c.Scan.Command) == 0 {
+			return fmt.Errorf("scan.type が exec の場合は scan.command を指定してください")
+		}
+	default:
+		return fmt.Errorf("scan.type が不正です: %q（\"clamd\" または \"exec\" を指定してください）", c.Scan.Type)
+	}
+	if c.Scan.Enabled() && isWithin(c.QuarantinePath(), c.Storage.UploadPath) {
+		return fmt.Errorf("scan.quarantine_path はアップロードディレクトリの外に置いてください（一覧・ダウンロードから見えてしまうため）")
+	}
+
+	b := c.Bandwidth
+	if b.Global < 0 || b.PerUser < 0 || b.Admin < 0 {
+		return fmt.Errorf("bandwidth の上限に負の値は指定できません（無制限は 0）")
+	}
+	for i, r := range b.Roles {
+		if r.Role == "" {
+			return fmt.Errorf("bandwidth.roles[%d].role が未設定です", i)
+		}
+		if r.Limit < 0 {
+			return fmt.Errorf("bandwidth.roles[%d].limit が負の値です", i)
+		}
+	}
+
+	if c.Allowance.negative() {
+		return fmt.Errorf("allowance の上限に負の値は指定できません（無制限は 0）")
+	}
+	for i, r := range c.Allowance.Roles {
+		if r.Role == "" {
+			return fmt.Errorf("allowance.roles[%d].role が未設定です", i)
+		}
+		if r.negative() {
+			return fmt.Errorf("allowance.roles[%d] に負の値は指定できません", i)
+		}
+	}
+
+	if c.Share.MaxExpiry < 0 {
+		return fmt.Errorf("share.max_expiry が負の値です（上限なしは 0）")
+	}
+
+	if s := c.SignedURL.Secret; s != "" && len(s) < minSignedURLSecret {
+		return fmt.Errorf("signed_url.secret が短すぎます（%d文字以上を指定してください）", minSignedURLSecret)
+	}
+	if c.SignedURL.DefaultExpiry > c.SignedURL.MaxExpiry {
+		return fmt.Errorf("signed_url.default_expiry（%s）が signed_url.max_expiry（%s）を超えています", c.SignedURL.DefaultExpiry, c.SignedURL.MaxExpiry)
 	}
 
 	return nil
 }
 
+// isWithin は path が dir 自身またはその配下かを返します。
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
 // requireAll は空文字の項目があれば、どれが足りないかを示すエラーを返します。
 func requireAll(fields map[string]string) error {
 	missing := make([]string, 0, len(fields))
@@ -303,16 +617,53 @@ func requireAll(fields map[string]string) error {
 	return fmt.Errorf("必須の設定が未設定です: %s", strings.Join(missing, ", "))
 }
 
+// Directories は現在のディレクトリ設定を返します。管理者APIで差し替えられても、返したスライスは変わりません。
+// 呼び出し側は要素を書き換えないでください（差し替えは SetDirectories で行います）。
+func (c *Config) Directories() []DirectoryConfig {
+	c.dirMu.RLock()
+	defer c.dirMu.RUnlock()
+	return c.Storage.Directories
+}
+
+// SetDirectories はディレクトリ設定を丸ごと差し替えます。検証は呼び出し側で済ませておくこと。
+func (c *Config) SetDirectories(dirs []DirectoryConfig) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	c.Storage.Directories = dirs
+}
+
 // GetDirectoryConfig はディレクトリパスから設定を取得します。
 func (c *Config) GetDirectoryConfig(path string) *DirectoryConfig {
-	for i := range c.Storage.Directories {
-		if c.Storage.Directories[i].Path == path {
-			return &c.Storage.Directories[i]
+	dirs := c.Directories()
+	for i := range dirs {
+		if dirs[i].Path == path {
+			return &dirs[i]
 		}
 	}
 	return nil
 }
 
+// ConflictPolicy は directory（配下パスも可）へのアップロードで同名ファイルがある場合の既定の扱いを返します。
+// トップレベルのディレクトリ設定で決まり、未設定なら ConflictRename です。
+func (c *Config) ConflictPolicy(directory string) string {
+	root, _, _ := strings.Cut(directory, "/")
+	if d := c.GetDirectoryConfig(root); d != nil && d.OnConflict != "" {
+		return d.OnConflict
+	}
+	return ConflictRename
+}
+
+// WatchedDirectories は watch: true が指定されたディレクトリ設定を返します。
+func (c *Config) WatchedDirectories() []DirectoryConfig {
+	var dirs []DirectoryConfig
+	for _, d := range c.Directories() {
+		if d.Watch {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
 // HasAdminRole は与えられたロール集合に管理者ロールが含まれるかを返します。
 // 管理者ロール（admin_role_id）が未設定の場合は常にfalseを返します。
 func (c *Config) HasAdminRole(roles []string) bool {
@@ -327,40 +678,152 @@ func (c *Config) HasAdminRole(roles []string) bool {
 	return false
 }
 
-// StaticPermissions はロールに依存しない付与（"*" と 指定ユーザー）から
-// 得られる許可操作の集合を返します。ロール取得の前に評価でき、
-// 公開ディレクトリや個人指定はロール取得の失敗に影響されません。
-func (d *DirectoryConfig) StaticPermissions(userID string) map[string]bool {
-	result := make(map[string]bool)
-	for _, g := range d.Grants {
-		if g.Role == "*" || (g.User != "" && g.User == userID) {
-			for _, p := range g.Permissions {
-				result[p] = true
-			}
+// Validate はディレクトリ1件の設定を検証します。起動時の Validate と、管理者APIでの変更の両方で使います。
+func (d *DirectoryConfig) Validate() error {
+	if d.Path == "" {
+		return fmt.Errorf("path が未設定です")
+	}
+	if d.Path == "." || d.Path == ".." || strings.ContainsAny(d.Path, "/\\") {
+		return fmt.Errorf("path が不正です: %q（トップレベルのディレクトリ名を指定してください）", d.Path)
+	}
+	if d.Type != "" && d.Type != "user_private" {
+		return fmt.Errorf("type が不正です: %q（個人用は \"user_private\"、それ以外は省略してください）", d.Type)
+	}
+	if d.MaxFileSize < 0 {
+		return fmt.Errorf("max_file_size が負の値です")
+	}
+	if d.Retention < 0 {
+		return fmt.Errorf("retention が負の値です")
+	}
+	if d.OnConflict != "" && !ValidConflictPolicy(d.OnConflict) {
+		return fmt.Errorf("on_conflict が不正です: %q（\"rename\"・\"replace\"・\"reject\" のいずれかを指定してください）", d.OnConflict)
+	}
+	for _, t := range append(append([]string{}, d.AllowedMIMETypes...), d.DeniedMIMETypes...) {
+		if !strings.Contains(t, "/") {
+			return fmt.Errorf("MIMEタイプが不正です: %q（\"image/png\" や \"image/*\" の形式で指定してください）", t)
 		}
 	}
-	return result
+	if err := validateGrants("grants", d.Grants); err != nil {
+		return err
+	}
+	return d.validateSubdirectories()
 }
 
-// RolePermissions は保有ロール集合にマッチする付与から得られる許可操作の集合を返します。
-func (d *DirectoryConfig) RolePermissions(roleSet map[string]bool) map[string]bool {
-	result := make(map[string]bool)
-	for _, g := range d.Grants {
-		if g.Role != "" && g.Role != "*" && roleSet[g.Role] {
-			for _, p := range g.Permissions {
-				result[p] = true
+// validateSubdirectories は配下のパスへの付与を検証します。
+func (d *DirectoryConfig) validateSubdirectories() error {
+	if len(d.Subdirectories) > 0 && d.Type == "user_private" {
+		return fmt.Errorf("user_private には subdirectories を指定できません")
+	}
+	seen := make(map[string]bool, len(d.Subdirectories))
+	for j, s := range d.Subdirectories {
+		if s.Path == "" || s.Path == "." || path.Clean(s.Path) != s.Path || path.IsAbs(s.Path) ||
+			s.Path == ".." || strings.HasPrefix(s.Path, "../") || strings.Contains(s.Path, "\\") {
+			return fmt.Errorf("subdirectories[%d].path が不正です: %q（\"secret\" や \"clients/acme\" のような相対パスを指定してください）", j, s.Path)
+		}
+		if seen[s.Path] {
+			return fmt.Errorf("subdirectories[%d].path が重複しています: %q", j, s.Path)
+		}
+		seen[s.Path] = true
+		if err := validateGrants(fmt.Sprintf("subdirectories[%d].grants", j), s.Grants); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GrantsFor は配下のパス subpath（トップレベルからの相対パス。空はトップレベル自身）に効く付与を返します。
+// トップレベルから1階層ずつ下り、規則のあるパスでは付与を置き換え（inherit なら加え）ていくため、
+// 最も具体的な規則が優先され、規則の無いパスは最も近い親の付与を引き継ぎます。
+func (d *DirectoryConfig) GrantsFor(subpath string) []GrantConfig {
+	grants := d.Grants
+	if subpath == "" || len(d.Subdirectories) == 0 {
+		return grants
+	}
+	parts := strings.Split(subpath, "/")
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		for _, s := range d.Subdirectories {
+			if s.Path != prefix {
+				continue
+			}
+			if s.Inherit {
+				grants = append(slices.Clone(grants), s.Grants...)
+			} else {
+				grants = s.Grants
 			}
+			break
+		}
+	}
+	return grants
+}
+
+// matchesStatic は付与がロールに依存せずユーザーに効く（"*" か本人の指定）かを返します。
+func (g GrantConfig) matchesStatic(userID string) bool {
+	return g.Role == "*" || (g.User != "" && g.User == userID)
+}
+
+// matchesRole は付与が保有ロール集合のいずれかに効くかを返します（"*" は含みません）。
+func (g GrantConfig) matchesRole(roleSet map[string]bool) bool {
+	return g.Role != "" && g.Role != "*" && roleSet[g.Role]
+}
+
+// collect は配下のパス subpath に効く付与のうち match にかかるものの、許可と拒否の操作の集合を返します。
+func (d *DirectoryConfig) collect(subpath string, match func(GrantConfig) bool) (allow, deny map[string]bool) {
+	allow, deny = make(map[string]bool), make(map[string]bool)
+	for _, g := range d.GrantsFor(subpath) {
+		if !match(g) {
+			continue
+		}
+		target := allow
+		if g.Deny {
+			target = deny
+		}
+		for _, p := range g.Permissions {
+			target[p] = true
 		}
 	}
-	return result
+	return allow, deny
+}
+
+// StaticPermissions はロールに依存しない付与（"*" と 指定ユーザー）だけで確定する、
+// 配下のパス subpath での許可操作の集合を返します。ロール取得の前に評価でき、
+// 公開ディレクトリや個人指定はロール取得の失敗に影響されません。
+// 保有ロールが分からないため、いずれかのロールへ拒否されている操作は含めません
+// （常に EffectivePermissions の部分集合です）。
+func (d *DirectoryConfig) StaticPermissions(subpath, userID string) map[string]bool {
+	allow, deny := d.collect(subpath, func(g GrantConfig) bool {
+		return g.matchesStatic(userID) || (g.Deny && g.Role != "")
+	})
+	for p := range deny {
+		delete(allow, p)
+	}
+	return allow
+}
+
+// RolePermissions は保有ロール集合にマッチする付与から得られる、配下のパス subpath での許可操作の集合を返します。
+// 保有ロールへの拒否は取り除きますが、"*"・個人指定の付与は考慮しません（EffectivePermissions を参照）。
+func (d *DirectoryConfig) RolePermissions(subpath string, roleSet map[string]bool) map[string]bool {
+	allow, deny := d.collect(subpath, func(g GrantConfig) bool { return g.matchesRole(roleSet) })
+	for p := range deny {
+		delete(allow, p)
+	}
+	return allow
+}
+
+// DeniedPermissions はユーザーID（"*"・個人指定）と保有ロールへの拒否の付与で、
+// 配下のパス subpath で明示的に拒否されている操作の集合を返します。
+func (d *DirectoryConfig) DeniedPermissions(subpath, userID string, roleSet map[string]bool) map[string]bool {
+	_, deny := d.collect(subpath, func(g GrantConfig) bool { return g.matchesStatic(userID) || g.matchesRole(roleSet) })
+	return deny
 }
 
 // EffectivePermissions はユーザーID（"*"・個人指定）と保有ロールの双方を考慮した、
-// このディレクトリでの実効的な許可操作の集合を返します。
-func (d *DirectoryConfig) EffectivePermissions(userID string, roleSet map[string]bool) map[string]bool {
-	perms := d.StaticPermissions(userID)
-	for p := range d.RolePermissions(roleSet) {
-		perms[p] = true
+// 配下のパス subpath（空はトップレベル自身）での実効的な許可操作の集合を返します。
+// いずれかの付与で拒否された操作は、他の付与で許可されていても含みません。
+func (d *DirectoryConfig) EffectivePermissions(subpath, userID string, roleSet map[string]bool) map[string]bool {
+	allow, deny := d.collect(subpath, func(g GrantConfig) bool { return g.matchesStatic(userID) || g.matchesRole(roleSet) })
+	for p := range deny {
+		delete(allow, p)
 	}
-	return perms
+	return allow
 }
@@ -58,8 +58,11 @@ func TestMinimalConfigGetsSafeDefaults(t *testing.T) {
 		{"storage.chunk_size", cfg.Storage.ChunkSize, int64(defaultChunkSize)},
 		{"storage.max_chunk_file_size", cfg.Storage.MaxChunkFileSize, int64(defaultMaxChunkFileSize)},
 		{"storage.max_concurrent_uploads", cfg.Storage.MaxConcurrentUploads, defaultMaxConcurrentUploads},
+		{"storage.max_batch_files", cfg.Storage.MaxBatchFiles, defaultMaxBatchFiles},
 		{"storage.upload_session_ttl", cfg.Storage.UploadSessionTTL, time.Duration(defaultUploadSessionTTL)},
 		{"storage.cleanup_interval", cfg.Storage.CleanupInterval, time.Duration(defaultCleanupInterval)},
+		{"storage.watch_poll_interval", cfg.Storage.WatchPollInterval, time.Duration(defaultWatchPollInterval)},
+		{"scan.timeout", cfg.Scan.Timeout, time.Duration(defaultScanTimeout)},
 	}
 	for _, c := range checks {
 		if c.got != c.want {
@@ -189,3 +192,306 @@ storage:
 		t.Errorf("OIDCのissuer未設定を検出できていない: %v", err)
 	}
 }
+
+// スキャンは方式ごとの必須項目を検証し、隔離先がアップロードディレクトリ内なら拒否すること。
+func TestValidateScan(t *testing.T) {
+	cases := []struct {
+		name, yaml, wantErr string
+	}{
+		{"clamd without address", "scan:\n  type: clamd\n", "clamd_address"},
+		{"exec without command", "scan:\n  type: exec\n", "scan.command"},
+		{"unknown type", "scan:\n  type: virustotal\n", "scan.type"},
+		{"quarantine inside uploads", "scan:\n  type: clamd\n  clamd_address: tcp://127.0.0.1:3310\n  quarantine_path: ./data/uploads/q\n", "quarantine_path"},
+		{"ok", "scan:\n  type: clamd\n  clamd_address: tcp://127.0.0.1:3310\n", ""},
+	}
+	for _, c := range cases {
+		_, err := loadFrom(t, minimalYAML+c.yaml)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: 予期しないエラー: %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: err = %v, %q を含むべき", c.name, err, c.wantErr)
+		}
+	}
+}
+
+// 隔離先の既定はアップロードディレクトリと同じ階層（環境変数での変更に追従する）。
+func TestQuarantinePathDefault(t *testing.T) {
+	cfg := &Config{Storage: StorageConfig{UploadPath: "/app/data/uploads"}}
+	if got := cfg.QuarantinePath(); got != filepath.Join("/app/data", "quarantine") {
+		t.Errorf("QuarantinePath() = %q", got)
+	}
+}
+
+func TestValidateDirectoryRules(t *testing.T) {
+	if _, err := loadFrom(t, minimalYAML+"      allowed_mime_types: [\"image\"]\n"); err == nil || !strings.Contains(err.Error(), "MIMEタイプ") {
+		t.Errorf("\"/\" を含まないMIMEタイプを検出できていない: %v", err)
+	}
+	if _, err := loadFrom(t, minimalYAML+"      max_file_size: -1\n"); err == nil || !strings.Contains(err.Error(), "max_file_size") {
+		t.Errorf("負の max_file_size を検出できていない: %v", err)
+	}
+	if _, err := loadFrom(t, minimalYAML+"      retention: -1h\n"); err == nil || !strings.Contains(err.Error(), "retention") {
+		t.Errorf("負の retention を検出できていない: %v", err)
+	}
+	if _, err := loadFrom(t, minimalYAML+"      on_conflict: overwrite\n"); err == nil || !strings.Contains(err.Error(), "on_conflict") {
+		t.Errorf("不正な on_conflict を検出できていない: %v", err)
+	}
+	cfg, err := loadFrom(t, minimalYAML+"      allowed_extensions: [jpg, png]\n      allowed_mime_types: [\"image/*\"]\n      max_file_size: 1048576\n      on_conflict: reject\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cfg.GetDirectoryConfig("public"); len(d.AllowedExtensions) != 2 || d.MaxFileSize != 1048576 {
+		t.Errorf("ディレクトリの制限が読み込まれていない: %+v", d)
+	}
+	if got := cfg.ConflictPolicy("public/sub"); got != ConflictReject {
+		t.Errorf("ConflictPolicy(public/sub) = %q, want %q", got, ConflictReject)
+	}
+	if got := cfg.ConflictPolicy("unknown"); got != ConflictRename {
+		t.Errorf("未設定のディレクトリの ConflictPolicy = %q, want %q", got, ConflictRename)
+	}
+}
+
+func TestValidateBandwidth(t *testing.T) {
+	cases := []struct {
+		name, yaml, wantErr string
+	}{
+		{"negative global", "bandwidth:\n  global: -1\n", "bandwidth"},
+		{"role without name", "bandwidth:\n  roles:\n    - limit: 1024\n", "bandwidth.roles[0].role"},
+		{"negative role limit", "bandwidth:\n  roles:\n    - role: \"1\"\n      limit: -5\n", "bandwidth.roles[0].limit"},
+		{"ok", "bandwidth:\n  global: 10485760\n  per_user: 1048576\n  roles:\n    - role: \"1\"\n      limit: 0\n", ""},
+	}
+	for _, c := range cases {
+		cfg, err := loadFrom(t, minimalYAML+c.yaml)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: 予期しないエラー: %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: err = %v, %q を含むべき", c.name, err, c.wantErr)
+		case c.wantErr == "" && !cfg.Bandwidth.Enabled():
+			t.Errorf("%s: 上限が有効になっていない: %+v", c.name, cfg.Bandwidth)
+		}
+	}
+}
+
+func TestValidateAllowance(t *testing.T) {
+	cases := []struct {
+		name, yaml, wantErr string
+	}{
+		{"negative daily", "allowance:\n  upload_daily: -1\n", "allowance"},
+		{"role without name", "allowance:\n  roles:\n    - download_daily: 1024\n", "allowance.roles[0].role"},
+		{"negative role limit", "allowance:\n  roles:\n    - role: \"1\"\n      upload_monthly: -5\n", "allowance.roles[0]"},
+		{"ok", "allowance:\n  download_daily: 1073741824\n  roles:\n    - role: \"1\"\n      upload_monthly: 10737418240\n", ""},
+	}
+	for _, c := range cases {
+		cfg, err := loadFrom(t, minimalYAML+c.yaml)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: 予期しないエラー: %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: err = %v, %q を含むべき", c.name, err, c.wantErr)
+		case c.wantErr == "" && (cfg.Allowance.DownloadDaily != 1<<30 || cfg.Allowance.Roles[0].UploadMonthly != 10<<30):
+			t.Errorf("%s: 上限が読み込まれていない: %+v", c.name, cfg.Allowance)
+		}
+	}
+}
+
+func TestValidateSignedURL(t *testing.T) {
+	cases := []struct {
+		name, yaml, wantErr string
+	}{
+		{"short secret", "signed_url:\n  enabled: true\n  secret: \"short\"\n", "signed_url.secret"},
+		{"default over max", "signed_url:\n  default_expiry: 2h\n", "signed_url.default_expiry"},
+		{"ok", "signed_url:\n  enabled: true\n  secret: \"0123456789abcdef0123456789abcdef\"\n", ""},
+	}
+	for _, c := range cases {
+		cfg, err := loadFrom(t, minimalYAML+c.yaml)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: 予期しないエラー: %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: err = %v, %q を含むべき", c.name, err, c.wantErr)
+		case c.wantErr == "" && (cfg.SignedURL.DefaultExpiry != 15*time.Minute || cfg.SignedURL.MaxExpiry != time.Hour):
+			t.Errorf("%s: 既定の有効期間が入っていない: %+v", c.name, cfg.SignedURL)
+		}
+	}
+}
+
+// 配下のパスは最も具体的な規則の付与に従い、規則の無いパスは最も近い親から引き継ぐこと。
+// inherit なら親の付与に加え、そうでなければ置き換えること。
+func TestSubdirectoryGrants(t *testing.T) {
+	cfg, err := loadFrom(t, minimalYAML+`      subdirectories:
+        - path: "secret"
+          grants:
+            - role: "staff"
+              permissions: ["read"]
+        - path: "secret/drafts"
+          inherit: true
+          grants:
+            - user: "u1"
+              permissions: ["read", "write"]
+        - path: "uploads"
+          inherit: true
+          grants:
+            - role: "*"
+              permissions: ["write"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cfg.GetDirectoryConfig("public")
+	staff := map[string]bool{"staff": true}
+
+	cases := []struct {
+		subpath, userID string
+		roles           map[string]bool
+		want            []string
+	}{
+		{"", "u2", nil, []string{"read"}},
+		{"other/deep", "u2", nil, []string{"read"}},
+		{"secret", "u2", nil, nil},
+		{"secret/x", "u2", staff, []string{"read"}},
+		{"secret/drafts", "u1", nil, []string{"read", "write"}},
+		{"secret/drafts/a", "u2", staff, []string{"read"}},
+		{"secret/drafts", "u2", nil, nil},
+		{"uploads/2026", "u2", nil, []string{"read", "write"}},
+	}
+	for _, c := range cases {
+		got := d.EffectivePermissions(c.subpath, c.userID, c.roles)
+		if len(got) != len(c.want) {
+			t.Errorf("EffectivePermissions(%q, %q) = %v, want %v", c.subpath, c.userID, got, c.want)
+			continue
+		}
+		for _, p := range c.want {
+			if !got[p] {
+				t.Errorf("EffectivePermissions(%q, %q) = %v, want %v", c.subpath, c.userID, got, c.want)
+			}
+		}
+	}
+
+	for _, bad := range []string{"../x", "/abs", "a//b", "", "dup"} {
+		yaml := minimalYAML + "      subdirectories:\n        - path: \"" + bad + "\"\n"
+		if bad == "dup" {
+			yaml += "        - path: \"dup\"\n"
+		}
+		if _, err := loadFrom(t, yaml); err == nil || !strings.Contains(err.Error(), "subdirectories") {
+			t.Errorf("subdirectories.path %q: err = %v", bad, err)
+		}
+	}
+}
+
+// 拒否（deny）は同じパスに効くどの許可より優先され、"*"・個人指定の許可もロールへの拒否で取り消されること。
+// inherit では親の拒否も引き継ぎ、置き換える規則なら親の拒否は効かないこと。
+// StaticPermissions はどの保有ロールでも EffectivePermissions の部分集合であること。
+func TestDenyGrants(t *testing.T) {
+	cfg, err := loadFrom(t, minimalYAML+`        - role: "members"
+          permissions: ["read", "write"]
+        - role: "muted"
+          deny: true
+          permissions: ["read", "write"]
+        - user: "vip"
+          permissions: ["read", "write", "delete"]
+        - user: "banned"
+          deny: true
+          permissions: ["read"]
+        - role: "readonly"
+          deny: true
+          permissions: ["write"]
+      subdirectories:
+        - path: "lounge"
+          inherit: true
+          grants:
+            - role: "muted"
+              permissions: ["read"]
+        - path: "appeals"
+          grants:
+            - role: "muted"
+              permissions: ["read"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cfg.GetDirectoryConfig("public")
+	roles := func(names ...string) map[string]bool {
+		set := make(map[string]bool)
+		for _, n := range names {
+			set[n] = true
+		}
+		return set
+	}
+
+	cases := []struct {
+		name, subpath, userID string
+		roles                 map[string]bool
+		want                  []string
+	}{
+		{"メンバー", "", "u1", roles("members"), []string{"read", "write"}},
+		{"ロールへの拒否は * と他ロールの許可を取り消す", "", "u1", roles("members", "muted"), nil},
+		{"ロールへの拒否は個人指定の許可も取り消す", "", "vip", roles("muted"), []string{"delete"}},
+		{"個人への拒否はロールの許可を取り消す", "", "banned", roles("members"), []string{"write"}},
+		{"拒否は列挙した操作だけ", "", "u1", roles("members", "readonly"), []string{"read"}},
+		{"inherit は親の拒否も引き継ぐ", "lounge", "u1", roles("muted"), nil},
+		{"置き換える規則では親の拒否は効かない", "appeals/2026", "u1", roles("muted"), []string{"read"}},
+		{"置き換える規則では親の許可も効かない", "appeals", "vip", nil, nil},
+	}
+	for _, c := range cases {
+		got := d.EffectivePermissions(c.subpath, c.userID, c.roles)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: EffectivePermissions = %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for _, p := range c.want {
+			if !got[p] {
+				t.Errorf("%s: EffectivePermissions = %v, want %v", c.name, got, c.want)
+			}
+		}
+	}
+
+	if got := d.DeniedPermissions("", "u1", roles("members", "muted")); !got["read"] || !got["write"] || got["delete"] {
+		t.Errorf("DeniedPermissions = %v, want read, write", got)
+	}
+	if got := d.RolePermissions("", roles("members", "readonly")); !got["read"] || got["write"] {
+		t.Errorf("RolePermissions = %v, want read", got)
+	}
+	// "*" の read はロールへの拒否があるため、ロールを見るまで確定しない。
+	if got := d.StaticPermissions("", "u1"); len(got) != 0 {
+		t.Errorf("StaticPermissions(u1) = %v, want 空", got)
+	}
+	if got := d.StaticPermissions("", "vip"); !got["delete"] || got["read"] {
+		t.Errorf("StaticPermissions(vip) = %v, want delete のみ", got)
+	}
+	for _, sub := range []string{"", "lounge", "appeals"} {
+		for _, user := range []string{"u1", "vip", "banned"} {
+			for _, rs := range []map[string]bool{nil, roles("members"), roles("muted"), roles("members", "muted", "readonly")} {
+				eff := d.EffectivePermissions(sub, user, rs)
+				for p := range d.StaticPermissions(sub, user) {
+					if !eff[p] {
+						t.Errorf("StaticPermissions(%q, %q) の %s が EffectivePermissions(%v) に無い", sub, user, p, rs)
+					}
+				}
+			}
+		}
+	}
+}
+
+// grants は role と user のどちらか一方と、正しい permissions を持つこと（subdirectories 内も同じ）。
+func TestValidateGrants(t *testing.T) {
+	cases := []struct {
+		name, yaml, wantErr string
+	}{
+		{"role と user の両方", "        - role: \"r\"\n          user: \"u\"\n          permissions: [\"read\"]\n", "grants[1]"},
+		{"どちらも無い", "        - deny: true\n          permissions: [\"read\"]\n", "role と user"},
+		{"permissions が空", "        - role: \"r\"\n          deny: true\n", "permissions が未設定"},
+		{"不正な操作", "        - user: \"u\"\n          permissions: [\"admin\"]\n", "permissions が不正"},
+		{"subdirectories 内", "      subdirectories:\n        - path: \"x\"\n          grants:\n            - role: \"r\"\n              permissions: [\"Read\"]\n", "subdirectories[0].grants[0]"},
+		{"ok", "        - role: \"r\"\n          deny: true\n          permissions: [\"write\", \"delete\"]\n", ""},
+	}
+	for _, c := range cases {
+		_, err := loadFrom(t, minimalYAML+c.yaml)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: 予期しないエラー: %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: err = %v, %q を含むべき", c.name, err, c.wantErr)
+		}
+	}
+}
@@ -186,6 +186,9 @@ func applyEnvOverrides(cfg *Config) error {
 	if err := envInt("STORAGE_MAX_CONCURRENT_UPLOADS", &cfg.Storage.MaxConcurrentUploads); err != nil {
 		return err
 	}
+	if err := envInt("STORAGE_MAX_BATCH_FILES", &cfg.Storage.MaxBatchFiles); err != nil {
+		return err
+	}
 	if err := envBoolPtr("STORAGE_CHUNK_UPLOAD_ENABLED", &cfg.Storage.ChunkUploadEnabled); err != nil {
 		return err
 	}
@@ -195,11 +198,70 @@ func applyEnvOverrides(cfg *Config) error {
 	if err := envDuration("STORAGE_CLEANUP_INTERVAL", &cfg.Storage.CleanupInterval); err != nil {
 		return err
 	}
+	if err := envDuration("STORAGE_WATCH_POLL_INTERVAL", &cfg.Storage.WatchPollInterval); err != nil {
+		return err
+	}
+
+	envString("SCAN_TYPE", &cfg.Scan.Type)
+	envString("SCAN_CLAMD_ADDRESS", &cfg.Scan.ClamdAddress)
+	envString("SCAN_QUARANTINE_PATH", &cfg.Scan.QuarantinePath)
+	if err := envDuration("SCAN_TIMEOUT", &cfg.Scan.Timeout); err != nil {
+		return err
+	}
+	if err := envBool("SCAN_FAIL_CLOSED", &cfg.Scan.FailClosed); err != nil {
+		return err
+	}
+
+	if err := envInt64("BANDWIDTH_GLOBAL", &cfg.Bandwidth.Global); err != nil {
+		return err
+	}
+	if err := envInt64("BANDWIDTH_PER_USER", &cfg.Bandwidth.PerUser); err != nil {
+		return err
+	}
+	if err := envInt64("BANDWIDTH_ADMIN", &cfg.Bandwidth.Admin); err != nil {
+		return err
+	}
+
+	if err := envInt64("ALLOWANCE_UPLOAD_DAILY", &cfg.Allowance.UploadDaily); err != nil {
+		return err
+	}
+	if err := envInt64("ALLOWANCE_UPLOAD_MONTHLY", &cfg.Allowance.UploadMonthly); err != nil {
+		return err
+	}
+	if err := envInt64("ALLOWANCE_DOWNLOAD_DAILY", &cfg.Allowance.DownloadDaily); err != nil {
+		return err
+	}
+	if err := envInt64("ALLOWANCE_DOWNLOAD_MONTHLY", &cfg.Allowance.DownloadMonthly); err != nil {
+		return err
+	}
+
+	if err := envBool("SHARE_ENABLED", &cfg.Share.Enabled); err != nil {
+		return err
+	}
+	if err := envDuration("SHARE_MAX_EXPIRY", &cfg.Share.MaxExpiry); err != nil {
+		return err
+	}
+	if err := envBool("SHARE_DROP_ENABLED", &cfg.Share.DropEnabled); err != nil {
+		return err
+	}
+
+	if err := envBool("SIGNED_URL_ENABLED", &cfg.SignedURL.Enabled); err != nil {
+		return err
+	}
+	if err := envDuration("SIGNED_URL_DEFAULT_EXPIRY", &cfg.SignedURL.DefaultExpiry); err != nil {
+		return err
+	}
+	if err := envDuration("SIGNED_URL_MAX_EXPIRY", &cfg.SignedURL.MaxExpiry); err != nil {
+		return err
+	}
 
 	// 認証情報（値は環境変数から取らず、ファイル経由のみ）
 	if err := envSecretFile("BOT_TOKEN", &cfg.Auth.Provider.BotToken); err != nil {
 		return err
 	}
+	if err := envSecretFile("SIGNED_URL_SECRET", &cfg.SignedURL.Secret); err != nil {
+		return err
+	}
 	return envSecretFile("CLIENT_SECRET", &cfg.Auth.Provider.ClientSecret)
 }
 
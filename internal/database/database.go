@@ -102,6 +102,15 @@ func createTables(db *sql.DB) error {
 		uploader_id TEXT,
 		uploader_name TEXT,
 		hash TEXT,
+		scan_status TEXT,
+		scan_signature TEXT,
+		scanned_at DATETIME,
+		retain_until DATETIME,
+		legal_hold INTEGER NOT NULL DEFAULT 0,
+		legal_hold_reason TEXT,
+		legal_hold_by TEXT,
+		legal_hold_at DATETIME,
+		source_url TEXT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		UNIQUE(directory, filename),
 		FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE SET NULL
@@ -121,9 +130,219 @@ func createTables(db *sql.DB) error {
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		PRIMARY KEY (provider, subject)
 	);
+
+	-- ストレージ使用量の集計（scope: directory / user_private / uploader）。
+	-- アップロード・削除のたびに増分更新し、再集計で全体を作り直す。
+	CREATE TABLE IF NOT EXISTS storage_usage (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		files INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope, key)
+	);
+
+	-- 使用量の日次スナップショット（増加傾向の表示用）。
+	CREATE TABLE IF NOT EXISTS storage_usage_history (
+		date TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		bytes INTEGER NOT NULL,
+		files INTEGER NOT NULL,
+		PRIMARY KEY (date, scope, key)
+	);
+
+	-- マルウェアとして隔離したファイル（管理者のみ閲覧）。
+	-- 実体は scan.quarantine_path 配下の stored_name に置き、元の場所へ戻せるよう情報を残す。
+	CREATE TABLE IF NOT EXISTS quarantine (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		directory TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		stored_name TEXT NOT NULL UNIQUE,
+		size INTEGER NOT NULL,
+		hash TEXT,
+		uploader_id TEXT,
+		uploader_name TEXT,
+		scan_status TEXT NOT NULL,
+		signature TEXT,
+		quarantined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+
+	-- 進行中のチャンク/tus アップロード。データ本体は保存先の <upload_id>_<ファイル名>.temp に置く。
+	-- uploaded_chunks は受信済みチャンクのビットマップ（チャンク i は i/8 バイト目の 1<<(i%8)）。
+	-- ユーザー削除で消すと一時ファイルだけが残るため外部キーは張らず、期限切れで掃除する。
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		upload_id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		directory TEXT NOT NULL,
+		protocol TEXT NOT NULL DEFAULT '',
+		file_sha256 TEXT,
+		on_conflict TEXT NOT NULL DEFAULT '',
+		total_size INTEGER NOT NULL,
+		chunk_size INTEGER NOT NULL,
+		total_chunks INTEGER NOT NULL,
+		uploaded_chunks BLOB NOT NULL,
+		uploaded_size INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_user_id ON upload_sessions(user_id);
+
+	-- ユーザーごとの転送量（allowance の日次・月次の上限用）。
+	-- period は日次が YYYY-MM-DD、月次が YYYY-MM（サーバーのローカル時刻）、direction は upload / download。
+	CREATE TABLE IF NOT EXISTS transfer_usage (
+		user_id TEXT NOT NULL,
+		period TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, period, direction)
+	);
+
+	-- 共有リンク（/s/{token}）。filename が空ならフォルダ（directory 直下のファイル）を共有する。
+	-- expires_at が NULL なら無期限、max_downloads が 0 なら回数無制限、password_hash が空ならパスワードなし。
+	CREATE TABLE IF NOT EXISTS share_links (
+		token TEXT PRIMARY KEY,
+		directory TEXT NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		password_hash TEXT NOT NULL DEFAULT '',
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		download_count INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		revoked_at DATETIME,
+		revoked_by TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_share_links_created_by ON share_links(created_by);
+
+	-- アップロードリンク（/d/{token}）。訪問者は directory へアップロードだけできる。
+	-- expires_at が NULL なら無期限、max_bytes・max_files が 0 なら無制限。used_* は確定したアップロードの合計。
+	CREATE TABLE IF NOT EXISTS drop_links (
+		token TEXT PRIMARY KEY,
+		directory TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		max_bytes INTEGER NOT NULL DEFAULT 0,
+		used_bytes INTEGER NOT NULL DEFAULT 0,
+		max_files INTEGER NOT NULL DEFAULT 0,
+		used_files INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		revoked_at DATETIME,
+		revoked_by TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_drop_links_created_by ON drop_links(created_by);
+
+	-- アップロードリンクで受信中のファイルの予約（上限の判定に含める）。確定・中止で消す。
+	-- upload_id はチャンクアップロードのセッション（空は1リクエストで送るアップロード）。
+	CREATE TABLE IF NOT EXISTS drop_reservations (
+		id TEXT PRIMARY KEY,
+		token TEXT NOT NULL,
+		upload_id TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_drop_reservations_token ON drop_reservations(token);
+
+	-- メンバー共有。ファイル（filename）またはフォルダ（filename が空。配下を含む）を、
+	-- ユーザー（grantee_type = 'user'、grantee はユーザーID）またはロール（'role'）へ read / write で共有する。
+	CREATE TABLE IF NOT EXISTS member_shares (
+		id TEXT PRIMARY KEY,
+		directory TEXT NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		grantee_type TEXT NOT NULL,
+		grantee TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE(directory, filename, grantee_type, grantee, permission)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_member_shares_grantee ON member_shares(grantee_type, grantee);
+	CREATE INDEX IF NOT EXISTS idx_member_shares_created_by ON member_shares(created_by);
+
+	-- ディレクトリと付与の定義。初回起動時に config.yaml の storage.directories を取り込み、
+	-- 以降は管理者APIで変更する。grants・subdirectories は JSON、position は一覧の順序。
+	CREATE TABLE IF NOT EXISTS directories (
+		path TEXT PRIMARY KEY,
+		type TEXT NOT NULL DEFAULT '',
+		grants TEXT NOT NULL DEFAULT '[]',
+		subdirectories TEXT NOT NULL DEFAULT '[]',
+		position INTEGER NOT NULL,
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		deleted_at DATETIME
+	);
 	`
 
 	ctx := context.Background()
-	_, err := db.ExecContext(ctx, schema)
-	return err
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		return err
+	}
+
+	// CREATE TABLE IF NOT EXISTS は既存テーブルへ列を足さないため、後から増えた列は個別に追加する。
+	if err := addMissingColumns(ctx, db, "upload_sessions", []columnDef{
+		{"on_conflict", "TEXT NOT NULL DEFAULT ''"},
+	}); err != nil {
+		return err
+	}
+	return addMissingColumns(ctx, db, "file_metadata", []columnDef{
+		{"scan_status", "TEXT"},
+		{"scan_signature", "TEXT"},
+		{"scanned_at", "DATETIME"},
+		{"retain_until", "DATETIME"},
+		{"legal_hold", "INTEGER NOT NULL DEFAULT 0"},
+		{"legal_hold_reason", "TEXT"},
+		{"legal_hold_by", "TEXT"},
+		{"legal_hold_at", "DATETIME"},
+		{"source_url", "TEXT"},
+	})
+}
+
+// columnDef は後から追加する列の名前と型です。
+type columnDef struct {
+	name, decl string
+}
+
+// addMissingColumns は table に無い列だけを ALTER TABLE で追加します。
+func addMissingColumns(ctx context.Context, db *sql.DB, table string, columns []columnDef) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("%s の列情報の取得に失敗しました: %w", table, err)
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		// 識別子はプレースホルダにできないが、呼び出し側の固定値のみを渡している。
+		// #nosec G202 -- table/column はコード中の定数
+		if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+c.name+" "+c.decl); err != nil {
+			return fmt.Errorf("%s.%s の追加に失敗しました: %w", table, c.name, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// 列が増える前に作られた既存DBでも、起動時に不足列が追加されること。
+func TestInitializeAddsMissingColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE file_metadata (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		directory TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		uploader_id TEXT,
+		uploader_name TEXT,
+		hash TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(directory, filename)
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec("INSERT INTO file_metadata (directory, filename) VALUES ('public', 'a.txt')"); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := Initialize(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status sql.NullString
+	if err := db.QueryRow("SELECT scan_status FROM file_metadata WHERE filename = 'a.txt'").Scan(&status); err != nil {
+		t.Fatalf("scan_status 列が追加されていない: %v", err)
+	}
+
+	// 2回目の起動（列が揃っている状態）でも失敗しないこと。
+	db.Close()
+	db2, err := Initialize(path, 1)
+	if err != nil {
+		t.Fatalf("再初期化に失敗: %v", err)
+	}
+	db2.Close()
+}
@@ -0,0 +1,179 @@
+// Package dirstore はトップレベルのディレクトリとその付与（grants）の永続化ストアを提供します。
+// config.yaml の storage.directories のうち未登録の path を取り込み、管理者APIでの変更をここへ保存します。
+// 種類・付与・subdirectories 以外の設定（watch・ファイルの種類の制限・retention・on_conflict 等）は
+// 引き続き config.yaml の同じ path の定義から読みます。
+package dirstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"fileserver/internal/config"
+)
+
+// ErrNotFound はディレクトリの定義が存在しない場合に返されます。
+var ErrNotFound = errors.New("ディレクトリが見つかりません")
+
+// Store は *sql.DB を用いたディレクトリ定義のストアです。
+type Store struct {
+	db *sql.DB
+}
+
+// New は Store を作成します。
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Load は保存済みのディレクトリ定義を一覧の順序で返します。
+// seed（config.yaml の storage.directories）のうちデータベースに無い path は取り込んで末尾に加えます。
+// 管理者APIで削除した path は取り込み直さず、種類・付与がデータベースと異なる path とあわせて
+// config.yaml の定義を無視したことを警告します。
+// 返す各ディレクトリの種類・付与以外の設定は、seed の同じ path の定義から引き継ぎます。
+func (s *Store) Load(ctx context.Context, seed []config.DirectoryConfig) ([]config.DirectoryConfig, error) {
+	if err := s.seed(ctx, seed); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT path, type, grants, subdirectories, deleted_at IS NOT NULL FROM directories ORDER BY position, path")
+	if err != nil {
+		return nil, fmt.Errorf("ディレクトリ定義の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	base := make(map[string]config.DirectoryConfig, len(seed))
+	for _, d := range seed {
+		base[d.Path] = d
+	}
+	dirs := make([]config.DirectoryConfig, 0)
+	for rows.Next() {
+		var (
+			path, typ, grants, subdirs string
+			deleted                    bool
+		)
+		if err := rows.Scan(&path, &typ, &grants, &subdirs, &deleted); err != nil {
+			return nil, fmt.Errorf("ディレクトリ定義の読み取りに失敗しました: %w", err)
+		}
+		d, inSeed := base[path]
+		if inSeed {
+			if deleted {
+				slog.Warn("管理者APIで削除されたディレクトリのため config.yaml の定義を無視します", "path", path)
+			} else if g, sd, err := encode(d); err == nil && (d.Type != typ || g != grants || sd != subdirs) {
+				slog.Warn("config.yaml の type・grants・subdirectories はデータベースの定義と異なるため無視します", "path", path)
+			}
+		}
+		if deleted {
+			continue
+		}
+		d.Path, d.Type = path, typ
+		d.Grants, d.Subdirectories = nil, nil
+		if err := json.Unmarshal([]byte(grants), &d.Grants); err != nil {
+			return nil, fmt.Errorf("ディレクトリ '%s' の grants のJSONデコードに失敗しました: %w", path, err)
+		}
+		if err := json.Unmarshal([]byte(subdirs), &d.Subdirectories); err != nil {
+			return nil, fmt.Errorf("ディレクトリ '%s' の subdirectories のJSONデコードに失敗しました: %w", path, err)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, rows.Err()
+}
+
+// seed は dirs のうちデータベースに行の無い path を dirs の順で一覧の末尾に加えます。
+// 削除済みの行も残っているため、管理者APIで削除した path は取り込み直しません。
+func (s *Store) seed(ctx context.Context, dirs []config.DirectoryConfig) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() //nolint:errcheck // コミット後のRollbackはエラーになるが無害
+
+	var added []string
+	for _, d := range dirs {
+		grants, subdirs, err := encode(d)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO directories (path, type, grants, subdirectories, position, updated_by)
+			VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM directories), 'config')
+			ON CONFLICT(path) DO NOTHING
+		`, d.Path, d.Type, grants, subdirs)
+		if err != nil {
+			return fmt.Errorf("ディレクトリ定義の取り込みに失敗しました: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			added = append(added, d.Path)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ディレクトリ定義の取り込みに失敗しました: %w", err)
+	}
+	if len(added) > 0 {
+		slog.Info("config.yaml のディレクトリ定義をデータベースへ取り込みました", "paths", added)
+	}
+	return nil
+}
+
+// Put はディレクトリの種類・付与・subdirectories を保存します（無いか削除済みなら一覧の末尾に追加）。
+func (s *Store) Put(ctx context.Context, d config.DirectoryConfig, actor string) error {
+	grants, subdirs, err := encode(d)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO directories (path, type, grants, subdirectories, position, updated_by, updated_at)
+		VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM directories), ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(path) DO UPDATE SET
+			type = excluded.type,
+			grants = excluded.grants,
+			subdirectories = excluded.subdirectories,
+			position = CASE WHEN directories.deleted_at IS NULL THEN directories.position ELSE excluded.position END,
+			updated_by = excluded.updated_by,
+			updated_at = CURRENT_TIMESTAMP,
+			deleted_at = NULL
+	`, d.Path, d.Type, grants, subdirs, actor)
+	if err != nil {
+		return fmt.Errorf("ディレクトリ定義の保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// Delete はディレクトリの定義を削除します。ディレクトリ内のファイルは削除しません。
+// config.yaml に同じ path が残っていても取り込み直さないよう、行は削除済みとして残します。
+func (s *Store) Delete(ctx context.Context, path, actor string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE directories SET deleted_at = CURRENT_TIMESTAMP, updated_by = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE path = ? AND deleted_at IS NULL
+	`, actor, path)
+	if err != nil {
+		return fmt.Errorf("ディレクトリ定義の削除に失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// encode は付与と subdirectories を保存用のJSONにします（空は "[]"）。
+func encode(d config.DirectoryConfig) (string, string, error) {
+	grants := d.Grants
+	if grants == nil {
+		grants = []config.GrantConfig{}
+	}
+	subdirs := d.Subdirectories
+	if subdirs == nil {
+		subdirs = []config.SubdirectoryConfig{}
+	}
+	g, err := json.Marshal(grants)
+	if err != nil {
+		return "", "", fmt.Errorf("grants のJSONエンコードに失敗しました: %w", err)
+	}
+	sd, err := json.Marshal(subdirs)
+	if err != nil {
+		return "", "", fmt.Errorf("subdirectories のJSONエンコードに失敗しました: %w", err)
+	}
+	return string(g), string(sd), nil
+}
@@ -0,0 +1,96 @@
+package dirstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db)
+}
+
+// seed は未登録の path だけを取り込み、保存した付与が seed より優先されること。
+// 種類・付与以外の設定は seed の同じ path の定義から引き継ぎ、追加は末尾・削除は ErrNotFound で判別できること。
+// 削除した path は seed に残っていても取り込み直さず、Put で末尾に戻せること。
+func TestLoadPutDelete(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	seed := []config.DirectoryConfig{
+		{Path: "team", MaxFileSize: 1024, Grants: []config.GrantConfig{{Role: "r1", Permissions: []string{"read"}}}},
+		{Path: "private", Type: "user_private"},
+	}
+
+	dirs, err := s.Load(ctx, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dirs[0].Grants, seed[0].Grants) || dirs[0].MaxFileSize != 1024 || dirs[1].Type != "user_private" {
+		t.Fatalf("取り込み直後 = %+v", dirs)
+	}
+
+	team := dirs[0]
+	team.Grants = []config.GrantConfig{{User: "u1", Permissions: []string{"read", "write"}}}
+	team.Subdirectories = []config.SubdirectoryConfig{{Path: "secret", Grants: []config.GrantConfig{{User: "u2", Permissions: []string{"read"}}}}}
+	if err := s.Put(ctx, team, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, config.DirectoryConfig{Path: "added"}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 取り込み済みの path は seed の付与を使わず、後から config.yaml に加えた path は末尾に取り込む。
+	seed = append(seed, config.DirectoryConfig{Path: "later"})
+	dirs, err = s.Load(ctx, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 4 || dirs[0].Path != "team" || dirs[2].Path != "added" || dirs[3].Path != "later" {
+		t.Fatalf("保存後の一覧 = %+v", dirs)
+	}
+	if !reflect.DeepEqual(dirs[0].Grants, team.Grants) || !reflect.DeepEqual(dirs[0].Subdirectories, team.Subdirectories) {
+		t.Errorf("保存した付与 = %+v, %+v", dirs[0].Grants, dirs[0].Subdirectories)
+	}
+	if dirs[0].MaxFileSize != 1024 {
+		t.Errorf("seed から引き継ぐ設定 = %d, want 1024", dirs[0].MaxFileSize)
+	}
+
+	if err := s.Delete(ctx, "added", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "added", "admin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("存在しない定義の削除 = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "later", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err = s.Load(ctx, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 || dirs[0].Path != "team" || dirs[1].Path != "private" {
+		t.Fatalf("削除後の一覧 = %+v", dirs)
+	}
+
+	if err := s.Put(ctx, config.DirectoryConfig{Path: "later"}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err = s.Load(ctx, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 3 || dirs[2].Path != "later" {
+		t.Errorf("削除後に追加し直した一覧 = %+v", dirs)
+	}
+}
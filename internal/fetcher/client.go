@@ -0,0 +1,85 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxRedirects は取得元のリダイレクトを追う最大回数です。
+	maxRedirects = 5
+	// connectTimeout は取得元への接続（TLSハンドシェイクを含む）と応答ヘッダーを待つ時間です。
+	connectTimeout = 30 * time.Second
+)
+
+// ErrBlockedAddress は取得元がループバック・プライベートアドレスなど、サーバー内部向けのアドレスに解決された場合のエラーです。
+var ErrBlockedAddress = errors.New("内部ネットワークのアドレスからは取り込めません")
+
+// blockedPrefixes は IsPrivate・IsLoopback などで判定できない、取り込みを拒否する特殊用途のアドレス範囲です。
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // 「このネットワーク」
+	netip.MustParsePrefix("100.64.0.0/10"),   // CGNAT 共有アドレス
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF プロトコル割り当て
+	netip.MustParsePrefix("198.18.0.0/15"),   // ベンチマーク用
+	netip.MustParsePrefix("240.0.0.0/4"),     // 予約済み（ブロードキャストを含む）
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64（IPv4 の内部アドレスに変換され得る）
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // ローカル用 NAT64
+	netip.MustParsePrefix("2002::/16"),       // 6to4（IPv4 アドレスを埋め込む）
+	netip.MustParsePrefix("fec0::/10"),       // 廃止済みのサイトローカル
+	netip.MustParsePrefix("::ffff:0:0:0/96"), // IPv4 変換アドレス
+}
+
+// checkAddr は接続先アドレスがサーバー内部向けでないかを判定します。
+func checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return ErrBlockedAddress
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
+
+// newClient は接続直前に解決済みのアドレスを check で検査する HTTP クライアントを作成します。
+// 名前解決の結果ではなく実際に接続するアドレスを見るため、DNS の応答を差し替える攻撃（DNS リバインディング）や
+// 内部アドレスへのリダイレクトも同じ判定で拒否できます。環境変数のプロキシ設定は使いません
+// （プロキシ経由では接続先アドレスを検査できないため）。
+func newClient(check func(netip.Addr) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: connectTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("接続先アドレスを判定できません: %w", err)
+			}
+			return check(ap.Addr())
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: connectTimeout,
+			ForceAttemptHTTP2:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("リダイレクトが多すぎます（最大 %d 回）", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrInvalidURL
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,390 @@
+// Package fetcher はURLで指定されたファイルをサーバー側で取得し、ディレクトリへ取り込みます。
+// 取得はバックグラウンドのジョブとして行い、進捗は作成時に渡したコールバックへ通知します。
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/config"
+	"fileserver/internal/filetype"
+	"fileserver/internal/models"
+	"fileserver/internal/scanner"
+	"fileserver/internal/storage"
+)
+
+// ジョブの状態です。
+const (
+	StatusRunning     = "running"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+	StatusQuarantined = "quarantined"
+)
+
+const (
+	// progressInterval は進捗を通知する最短間隔です（SSEを受信量の細かい変化で埋めないため）。
+	progressInterval = time.Second
+	// jobRetention は終了したジョブを結果の問い合わせ用に残しておく期間です。
+	jobRetention = time.Hour
+	// defaultFilename は URL からも応答からもファイル名が決まらない場合の名前です。
+	defaultFilename = "download"
+)
+
+var (
+	// ErrInvalidURL は http/https 以外のURLや、認証情報を含むURLの場合のエラーです。
+	ErrInvalidURL = errors.New("取り込めないURLです（http または https のURLを指定してください）")
+	// ErrInvalidFilename は保存名にパス区切りなどが含まれる場合のエラーです。
+	ErrInvalidFilename = errors.New("無効なファイル名です")
+	// ErrJobNotFound は指定されたジョブが無い（または他のユーザーのジョブである）場合のエラーです。
+	ErrJobNotFound = errors.New("取り込みジョブが見つかりません")
+)
+
+// Job は1件の取り込みの状態です。Total は取得元が Content-Length を返さない場合は0です。
+type Job struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ID         string     `json:"job_id"`
+	UserID     string     `json:"-"`
+	Username   string     `json:"-"`
+	URL        string     `json:"url"`
+	Directory  string     `json:"directory"`
+	Filename   string     `json:"filename,omitempty"` // 完了後は保存名（UUID付き）
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	ScanStatus string     `json:"scan_status,omitempty"`
+	Received   int64      `json:"received"`
+	Total      int64      `json:"total"`
+
+	quota *allowance.Quota // 開始時点のアップロード量の残り（nil は上限なし）
+}
+
+// Manager は取り込みジョブを実行・管理します。
+type Manager struct {
+	config    *config.Config
+	storage   *storage.Manager
+	uploads   *storage.UploadManager
+	scan      *scanner.Manager
+	allowance *allowance.Tracker
+	notify    func(Job)
+	client    *http.Client
+	jobs      map[string]*Job
+	mu        sync.Mutex
+}
+
+// New は Manager を作成します。notify はジョブの開始・進捗・終了のたびに呼ばれます（nil可）。
+// 同時に実行できる取り込みは、ユーザーごとの同時アップロード数の上限と共有します。
+func New(cfg *config.Config, sm *storage.Manager, um *storage.UploadManager, scan *scanner.Manager, notify func(Job)) *Manager {
+	if notify == nil {
+		notify = func(Job) {}
+	}
+	return &Manager{
+		config:  cfg,
+		storage: sm,
+		uploads: um,
+		scan:    scan,
+		notify:  notify,
+		client:  newClient(checkAddr),
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// SetAllowanceTracker は取り込んだバイト数をアップロードの転送量として数える Tracker を設定します。
+func (m *Manager) SetAllowanceTracker(t *allowance.Tracker) {
+	m.allowance = t
+}
+
+// Start は rawURL から directory への取り込みを開始し、開始時点のジョブを返します。
+// filename が空の場合は Content-Disposition、URLのパスの順に保存名を決めます。
+// quota（nil は上限なし）を超える応答は途中で打ち切ります。
+// directory への書き込み権限・転送量の残りの確認とディレクトリの作成は呼び出し側で行ってください。
+func (m *Manager) Start(user *models.User, rawURL, directory, filename string, quota *allowance.Quota) (Job, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return Job{}, ErrInvalidURL
+	}
+	if filename != "" {
+		if sanitizeFilename(filename) != filename {
+			return Job{}, ErrInvalidFilename
+		}
+		if err := filetype.For(m.config, directory).CheckName(filename); err != nil {
+			return Job{}, err
+		}
+	}
+	if err := m.uploads.ReserveSlot(user.ID); err != nil {
+		return Job{}, err
+	}
+
+	job := &Job{
+		StartedAt: time.Now(),
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Username:  user.Username,
+		URL:       u.String(),
+		Directory: directory,
+		Filename:  filename,
+		Status:    StatusRunning,
+		quota:     quota,
+	}
+	m.mu.Lock()
+	m.pruneLocked()
+	m.jobs[job.ID] = job
+	snapshot := *job
+	m.mu.Unlock()
+
+	slog.Info("URLからの取り込みを開始しました", "job_id", job.ID, "user_id", user.ID, "url", job.URL, "directory", directory)
+	m.notify(snapshot)
+	go m.run(job)
+	return snapshot, nil
+}
+
+// Get はユーザー自身のジョブの現在の状態を返します。
+func (m *Manager) Get(jobID, userID string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[jobID]
+	if !ok || job.UserID != userID {
+		return Job{}, ErrJobNotFound
+	}
+	return *job, nil
+}
+
+// pruneLocked は終了から jobRetention を過ぎたジョブを削除します。呼び出し側は m.mu を保持している必要があります。
+func (m *Manager) pruneLocked() {
+	cutoff := time.Now().Add(-jobRetention)
+	for id, job := range m.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// update はジョブを更新して通知します。
+func (m *Manager) update(job *Job, fn func(*Job)) {
+	m.mu.Lock()
+	fn(job)
+	snapshot := *job
+	m.mu.Unlock()
+	m.notify(snapshot)
+}
+
+// run はジョブを最後まで実行し、結果を記録します。
+func (m *Manager) run(job *Job) {
+	defer m.uploads.ReleaseSlot(job.UserID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Storage.UploadSessionTTL)
+	defer cancel()
+
+	filename, outcome, err := m.fetch(ctx, job)
+	m.update(job, func(j *Job) {
+		now := time.Now()
+		j.FinishedAt = &now
+		j.ScanStatus = outcome.Status
+		switch {
+		case err != nil:
+			j.Status = StatusFailed
+			j.Error = err.Error()
+		case outcome.Quarantined:
+			j.Status = StatusQuarantined
+			j.Filename = filename
+		default:
+			j.Status = StatusCompleted
+			j.Filename = filename
+		}
+	})
+	if err != nil {
+		slog.Warn("URLからの取り込みに失敗しました", "job_id", job.ID, "url", job.URL, "error", err)
+		return
+	}
+	slog.Info("URLからの取り込みが完了しました", "job_id", job.ID, "directory", job.Directory, "filename", filename, "scan_status", outcome.Status)
+}
+
+// fetch は取得元からダウンロードして保存し、保存名とスキャン結果を返します。
+func (m *Manager) fetch(ctx context.Context, job *Job) (string, scanner.Outcome, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+	if err != nil {
+		return "", scanner.Outcome{}, ErrInvalidURL
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", scanner.Outcome{}, fmt.Errorf("取得元に接続できません: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }() //nolint:errcheck // 読み取り専用
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", scanner.Outcome{}, fmt.Errorf("取得元がエラーを返しました（%s）", resp.Status)
+	}
+
+	rules := filetype.For(m.config, job.Directory)
+	maxSize := m.config.Storage.MaxChunkFileSize
+	checkSize := func(size int64) error {
+		if size > maxSize {
+			return fmt.Errorf("ファイルサイズが制限を超えています（最大: %d MB）", maxSize/(1024*1024))
+		}
+		if job.quota != nil && size > job.quota.Remaining {
+			return errors.New(job.quota.Message())
+		}
+		return rules.CheckSize(size)
+	}
+	if resp.ContentLength > 0 {
+		if err := checkSize(resp.ContentLength); err != nil {
+			return "", scanner.Outcome{}, err
+		}
+	}
+
+	name := job.Filename
+	if name == "" {
+		name = responseFilename(resp)
+		if err := rules.CheckName(name); err != nil {
+			return "", scanner.Outcome{}, err
+		}
+	}
+	m.update(job, func(j *Job) {
+		j.Filename = name
+		j.Total = max(resp.ContentLength, 0)
+	})
+
+	tempPath := filepath.Join(m.config.Storage.UploadPath, job.Directory, job.ID+"_fetch.temp")
+	received, err := m.download(tempPath, resp.Body, job, checkSize)
+	m.recordTransfer(job, received)
+	if err == nil && resp.ContentLength > 0 && received != resp.ContentLength {
+		err = fmt.Errorf("受信したサイズが Content-Length と一致しません（%d / %d バイト）", received, resp.ContentLength)
+	}
+	if err == nil {
+		err = rules.CheckFile(tempPath)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			slog.Error("一時ファイルの削除に失敗しました", "path", tempPath, "error", removeErr)
+		}
+		return "", scanner.Outcome{}, err
+	}
+
+	// 検査を終えるまで見えないよう、作業ファイルのままスキャンしてから保存名へ移す。
+	var outcome scanner.Outcome
+	if m.scan != nil && m.scan.Enabled() {
+		outcome, err = m.scan.Inspect(ctx, job.Directory, name, tempPath, job.UserID, job.Username)
+		if err != nil {
+			return "", outcome, err
+		}
+		if outcome.Quarantined {
+			return name, outcome, nil
+		}
+	}
+
+	// 同名ファイルの扱いはディレクトリの既定（on_conflict）に従う。
+	saved, err := m.storage.Place(ctx, tempPath, job.Directory, name, m.config.ConflictPolicy(job.Directory))
+	if err != nil {
+		_ = os.Remove(tempPath) //nolint:errcheck // 保存に失敗したため残っていても使わない
+		return "", outcome, fmt.Errorf("ファイルの保存に失敗しました: %w", err)
+	}
+	stored := saved.Filename
+
+	// メタデータ保存の失敗は取り込み自体を失敗させない（本体は保存済み）。
+	if err := m.storage.SaveFileMetadata(job.Directory, stored, job.UserID, job.Username); err != nil {
+		slog.Warn("メタデータの保存に失敗しました", "job_id", job.ID, "error", err)
+	} else if err := m.storage.SetSourceURL(job.Directory, stored, job.URL); err != nil {
+		slog.Warn("取得元URLの保存に失敗しました", "job_id", job.ID, "error", err)
+	}
+	if m.scan != nil {
+		m.scan.Record(ctx, job.Directory, stored, outcome)
+	}
+	m.storage.RemoveReplaced(ctx, saved)
+	return stored, outcome, nil
+}
+
+// recordTransfer は取得元から受信した n バイトをユーザーのアップロードの転送量に加算します。
+// 途中で打ち切った取り込みも、受信した分は数えます。
+func (m *Manager) recordTransfer(job *Job, n int64) {
+	if m.allowance == nil || !m.allowance.Enabled() {
+		return
+	}
+	if err := m.allowance.Record(context.Background(), job.UserID, allowance.Upload, n); err != nil {
+		slog.Error("転送量の記録に失敗しました", "job_id", job.ID, "user_id", job.UserID, "error", err)
+	}
+}
+
+// download は body を path へ書き込み、受信バイト数を返します。
+// 受信量が checkSize の制限を超えた時点で中止します。
+func (m *Manager) download(path string, body io.Reader, job *Job, checkSize func(int64) error) (int64, error) {
+	// #nosec G304 - path はアップロードディレクトリとジョブIDから組み立てたもの
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("一時ファイルの作成に失敗しました: %w", err)
+	}
+
+	var (
+		received   int64
+		lastNotify = time.Now()
+		buf        = make([]byte, 256*1024)
+	)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			received += int64(n)
+			if err := checkSize(received); err != nil {
+				_ = f.Close() //nolint:errcheck // 書き込みを中止する
+				return received, err
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				_ = f.Close() //nolint:errcheck // 書き込みエラーを優先して返す
+				return received, fmt.Errorf("ファイル書き込みエラー: %w", err)
+			}
+			if time.Since(lastNotify) >= progressInterval {
+				lastNotify = time.Now()
+				m.update(job, func(j *Job) { j.Received = received })
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			_ = f.Close() //nolint:errcheck // 読み取りエラーを優先して返す
+			return received, fmt.Errorf("取得元からの受信に失敗しました: %w", readErr)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return received, fmt.Errorf("ファイル書き込みエラー: %w", err)
+	}
+	m.update(job, func(j *Job) { j.Received = received })
+	return received, nil
+}
+
+// responseFilename は Content-Disposition、最終的なURL（リダイレクト後）のパスの順に保存名を決めます。
+func responseFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name := sanitizeFilename(params["filename"]); name != "" {
+			return name
+		}
+	}
+	if name, err := url.PathUnescape(path.Base(resp.Request.URL.Path)); err == nil {
+		if name = sanitizeFilename(name); name != "" {
+			return name
+		}
+	}
+	return defaultFilename
+}
+
+// sanitizeFilename はパス区切りを含む名前から末尾の要素だけを取り出します。
+// 名前として使えない場合（"."・".." など）は空文字列を返します。
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+	if name == "." || name == ".." || name == "/" || strings.ContainsRune(name, 0) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,215 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/storage"
+)
+
+func newTestManager(t *testing.T) (*Manager, *storage.Manager, <-chan Job) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath:           filepath.Join(dir, "uploads"),
+		Directories:          []config.DirectoryConfig{{Path: "public"}},
+		MaxChunkFileSize:     1 << 20,
+		MaxConcurrentUploads: 1,
+		UploadSessionTTL:     time.Minute,
+	}}
+	if err := os.MkdirAll(filepath.Join(cfg.Storage.UploadPath, "public"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(
+		"INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', '1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := storage.NewManager(cfg, db)
+	done := make(chan Job, 1)
+	m := New(cfg, sm, storage.NewUploadManager(cfg, db), nil, func(j Job) {
+		if j.FinishedAt != nil {
+			done <- j
+		}
+	})
+	m.SetAllowanceTracker(allowance.NewTracker(cfg, db))
+	return m, sm, done
+}
+
+func waitJob(t *testing.T, done <-chan Job) Job {
+	t.Helper()
+	select {
+	case j := <-done:
+		return j
+	case <-time.After(10 * time.Second):
+		t.Fatal("取り込みが終わらない")
+		return Job{}
+	}
+}
+
+// 取得したファイルが保存され、取得元URLがメタデータに記録されること。
+func TestFetchStoresFileWithSourceURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report.txt"`)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	m, sm, done := newTestManager(t)
+	m.client = newClient(func(netip.Addr) error { return nil })
+	user := &models.User{ID: "u1", Username: "alice"}
+
+	job, err := m.Start(user, srv.URL+"/files/ignored.bin", "public", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同時アップロード数の上限（1）を取り込み中のジョブが使っている。
+	if _, err := m.Start(user, srv.URL, "public", "", nil); !errors.Is(err, storage.ErrMaxConcurrentUploads) {
+		t.Errorf("上限超過の開始で err = %v, want ErrMaxConcurrentUploads", err)
+	}
+
+	result := waitJob(t, done)
+	if result.Status != StatusCompleted || result.Received != 5 || !strings.HasSuffix(result.Filename, "_report.txt") {
+		t.Fatalf("ジョブの結果 = %+v", result)
+	}
+	if got, err := m.Get(job.ID, "u1"); err != nil || got.Status != StatusCompleted {
+		t.Errorf("Get = %+v, err = %v", got, err)
+	}
+	if _, err := m.Get(job.ID, "u2"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("他のユーザーのジョブで err = %v, want ErrJobNotFound", err)
+	}
+
+	files, err := sm.ListFiles("public")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("ListFiles = %+v, err = %v", files, err)
+	}
+	if files[0].SourceURL != srv.URL+"/files/ignored.bin" || files[0].Uploader != "alice" {
+		t.Errorf("メタデータ = %+v", files[0])
+	}
+}
+
+// ループバックへの取り込みは既定のクライアントで拒否されること。
+func TestFetchBlocksLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("secret"))
+	}))
+	defer srv.Close()
+
+	m, _, done := newTestManager(t)
+	if _, err := m.Start(&models.User{ID: "u1"}, srv.URL+"/admin", "public", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	result := waitJob(t, done)
+	if result.Status != StatusFailed || !strings.Contains(result.Error, ErrBlockedAddress.Error()) {
+		t.Errorf("ジョブの結果 = %+v", result)
+	}
+
+	if _, err := m.Start(&models.User{ID: "u1"}, "file:///etc/passwd", "public", "", nil); !errors.Is(err, ErrInvalidURL) {
+		t.Errorf("file URL で err = %v, want ErrInvalidURL", err)
+	}
+}
+
+// 上限を超える応答は Content-Length が無くても途中で打ち切り、作業ファイルを残さないこと。
+func TestFetchEnforcesSizeLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		chunk := make([]byte, 64*1024)
+		for range 32 {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	m, _, done := newTestManager(t)
+	m.client = newClient(func(netip.Addr) error { return nil })
+	if _, err := m.Start(&models.User{ID: "u1"}, srv.URL+"/big.iso", "public", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	result := waitJob(t, done)
+	if result.Status != StatusFailed || !strings.Contains(result.Error, "制限を超えています") {
+		t.Fatalf("ジョブの結果 = %+v", result)
+	}
+	entries, _ := os.ReadDir(filepath.Join(m.config.Storage.UploadPath, "public"))
+	if len(entries) != 0 {
+		t.Errorf("作業ファイルが残っている: %v", entries)
+	}
+}
+
+// 取り込んだ量はアップロードの転送量に数え、残りを超える応答は Content-Length が無くても打ち切ること。
+func TestFetchChargesAllowance(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small.txt" {
+			_, _ = w.Write([]byte(strings.Repeat("s", 60)))
+			return
+		}
+		w.(http.Flusher).Flush() // Content-Length を付けずに送る
+		_, _ = w.Write([]byte(strings.Repeat("b", 1000)))
+	}))
+	defer srv.Close()
+
+	m, _, done := newTestManager(t)
+	m.client = newClient(func(netip.Addr) error { return nil })
+	m.config.Allowance.UploadDaily = 100
+	ctx := context.Background()
+	user := &models.User{ID: "u1", Username: "alice"}
+
+	quota, err := m.allowance.Check(ctx, "u1", nil, allowance.Upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(user, srv.URL+"/small.txt", "public", "", quota); err != nil {
+		t.Fatal(err)
+	}
+	if result := waitJob(t, done); result.Status != StatusCompleted {
+		t.Fatalf("残りに収まる取り込みの結果 = %+v", result)
+	}
+
+	quota, err = m.allowance.Check(ctx, "u1", nil, allowance.Upload)
+	if err != nil || quota.Remaining != 40 {
+		t.Fatalf("取り込み後の残り = %+v, err = %v, want 40", quota, err)
+	}
+	if _, err := m.Start(user, srv.URL+"/big.bin", "public", "", quota); err != nil {
+		t.Fatal(err)
+	}
+	if result := waitJob(t, done); result.Status != StatusFailed || !strings.Contains(result.Error, "残り（40 バイト）を超えています") {
+		t.Fatalf("残りを超える取り込みの結果 = %+v", result)
+	}
+	if quota, err = m.allowance.Check(ctx, "u1", nil, allowance.Upload); err != nil || quota.Remaining != 0 {
+		t.Errorf("打ち切った後の残り = %+v, err = %v, want 0（受信した分は数える）", quota, err)
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"::1":              true,
+		"::ffff:127.0.0.1": true,
+		"fd00::1":          true,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	} {
+		if got := checkAddr(netip.MustParseAddr(addr)) != nil; got != blocked {
+			t.Errorf("checkAddr(%s) blocked = %v, want %v", addr, got, blocked)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package filetype はディレクトリごとのファイル種別（拡張子・MIMEタイプ）とサイズの制限を判定します。
+// MIMEタイプはクライアントが送る Content-Type ではなく、ファイル先頭の内容から判定します。
+package filetype
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"fileserver/internal/config"
+)
+
+// sniffLen は http.DetectContentType が参照する先頭バイト数です。
+const sniffLen = 512
+
+var (
+	// ErrTypeNotAllowed はディレクトリで許可されていない種類のファイルの場合のエラーです。
+	ErrTypeNotAllowed = errors.New("このディレクトリにはアップロードできない種類のファイルです")
+	// ErrTooLarge はディレクトリのファイルサイズ上限を超えている場合のエラーです。
+	ErrTooLarge = errors.New("ファイルサイズがこのディレクトリの上限を超えています")
+)
+
+// Rules は1つのディレクトリに適用する制限です。ゼロ値は何も制限しません。
+type Rules struct {
+	allowedExtensions []string
+	deniedExtensions  []string
+	allowedMIMETypes  []string
+	deniedMIMETypes   []string
+	maxFileSize       int64
+}
+
+// For は directory（"user/alice" や "archive/2019" のような配下パスも可）に適用する制限を返します。
+// 制限はトップレベルのディレクトリ設定で決まります。
+func For(cfg *config.Config, directory string) Rules {
+	root, _, _ := strings.Cut(directory, "/")
+	d := cfg.GetDirectoryConfig(root)
+	if d == nil {
+		return Rules{}
+	}
+	return Rules{
+		allowedExtensions: normalizeExtensions(d.AllowedExtensions),
+		deniedExtensions:  normalizeExtensions(d.DeniedExtensions),
+		allowedMIMETypes:  normalizeMIMETypes(d.AllowedMIMETypes),
+		deniedMIMETypes:   normalizeMIMETypes(d.DeniedMIMETypes),
+		maxFileSize:       d.MaxFileSize,
+	}
+}
+
+// CheckName はファイル名の拡張子を判定します。拒否リストが許可リストより優先されます。
+func (r Rules) CheckName(filename string) error {
+	name := strings.ToLower(filename)
+	for _, ext := range r.deniedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return fmt.Errorf("%w（%s は拒否されています）", ErrTypeNotAllowed, ext)
+		}
+	}
+	if len(r.allowedExtensions) == 0 {
+		return nil
+	}
+	for _, ext := range r.allowedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w（許可されている拡張子: %s）", ErrTypeNotAllowed, strings.Join(r.allowedExtensions, ", "))
+}
+
+// CheckSize はファイルサイズを判定します。
+func (r Rules) CheckSize(size int64) error {
+	if r.maxFileSize > 0 && size > r.maxFileSize {
+		return fmt.Errorf("%w（最大: %d MB）", ErrTooLarge, r.maxFileSize/(1024*1024))
+	}
+	return nil
+}
+
+// HasContentRules はMIMEタイプの制限があるか（内容の判定が必要か）を返します。
+func (r Rules) HasContentRules() bool {
+	return len(r.allowedMIMETypes) > 0 || len(r.deniedMIMETypes) > 0
+}
+
+// CheckContent は rd の先頭から判定したMIMEタイプを検査し、判定したタイプを返します。
+// rd は先頭の最大512バイトだけ読み進めます（呼び出し側で必要なら巻き戻してください）。
+func (r Rules) CheckContent(rd io.Reader) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(rd, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("ファイルの読み取りに失敗しました: %w", err)
+	}
+	detected := DetectMIMEType(buf[:n])
+	return detected, r.CheckMIMEType(detected)
+}
+
+// CheckFile は保存済みファイル path の内容からMIMEタイプを判定して検査します。
+func (r Rules) CheckFile(path string) error {
+	if !r.HasContentRules() {
+		return nil
+	}
+	f, err := os.Open(path) // #nosec G304 -- アップロードディレクトリ配下の保存済みファイル
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }() //nolint:errcheck // 読み取り専用
+	_, err = r.CheckContent(f)
+	return err
+}
+
+// CheckMIMEType はMIMEタイプ（パラメータ無し）を判定します。拒否リストが許可リストより優先されます。
+func (r Rules) CheckMIMEType(mimeType string) error {
+	if matchMIME(r.deniedMIMETypes, mimeType) {
+		return fmt.Errorf("%w（%s は拒否されています）", ErrTypeNotAllowed, mimeType)
+	}
+	if len(r.allowedMIMETypes) > 0 && !matchMIME(r.allowedMIMETypes, mimeType) {
+		return fmt.Errorf("%w（判定された種類: %s）", ErrTypeNotAllowed, mimeType)
+	}
+	return nil
+}
+
+// DetectMIMEType は内容の先頭から判定したMIMEタイプを、charset 等のパラメータを除いて返します。
+func DetectMIMEType(head []byte) string {
+	detected := http.DetectContentType(head)
+	if mediaType, _, err := mime.ParseMediaType(detected); err == nil {
+		return mediaType
+	}
+	return detected
+}
+
+// matchMIME は mimeType がパターン（"image/png" または "image/*"）のいずれかに一致するかを返します。
+func matchMIME(patterns []string, mimeType string) bool {
+	for _, p := range patterns {
+		if p == mimeType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeExtensions は拡張子を小文字・先頭ドット付き（".tar.gz" 等）に揃えます。
+func normalizeExtensions(exts []string) []string {
+	out := make([]string, 0, len(exts))
+	for _, e := range exts {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func normalizeMIMETypes(types []string) []string {
+	out := make([]string, 0, len(types))
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
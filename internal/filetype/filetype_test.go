@@ -0,0 +1,87 @@
+package filetype
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"fileserver/internal/config"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func testConfig() *config.Config {
+	return &config.Config{Storage: config.StorageConfig{Directories: []config.DirectoryConfig{
+		{Path: "images", AllowedExtensions: []string{"JPG", ".png"}, AllowedMIMETypes: []string{"image/*"}, MaxFileSize: 1024},
+		{Path: "docs", DeniedExtensions: []string{"exe", ".tar.gz"}, DeniedMIMETypes: []string{"application/zip"}},
+		{Path: "user", Type: "user_private", AllowedExtensions: []string{"txt"}},
+		{Path: "public"},
+	}}}
+}
+
+func TestCheckName(t *testing.T) {
+	cfg := testConfig()
+	cases := []struct {
+		dir, name string
+		ok        bool
+	}{
+		{"images", "photo.jpg", true},
+		{"images", "PHOTO.PNG", true},
+		{"images", "notes.txt", false},
+		{"images/2024", "notes.txt", false}, // 配下のディレクトリにもトップレベルの制限が効く
+		{"docs", "setup.EXE", false},
+		{"docs", "backup.tar.gz", false},
+		{"docs", "report.pdf", true},
+		{"user/alice", "a.txt", true},
+		{"user/alice", "a.bin", false},
+		{"public", "anything.exe", true},
+		{"unknown", "anything.exe", true},
+	}
+	for _, c := range cases {
+		err := For(cfg, c.dir).CheckName(c.name)
+		if (err == nil) != c.ok {
+			t.Errorf("CheckName(%q, %q) = %v, want ok=%v", c.dir, c.name, err, c.ok)
+		}
+		if err != nil && !errors.Is(err, ErrTypeNotAllowed) {
+			t.Errorf("CheckName(%q, %q) のエラーが ErrTypeNotAllowed でない: %v", c.dir, c.name, err)
+		}
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	cfg := testConfig()
+	if err := For(cfg, "images").CheckSize(1024); err != nil {
+		t.Errorf("上限ちょうどで拒否された: %v", err)
+	}
+	if err := For(cfg, "images").CheckSize(1025); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("上限超過で err = %v, want ErrTooLarge", err)
+	}
+	if err := For(cfg, "docs").CheckSize(1 << 40); err != nil {
+		t.Errorf("上限なしのディレクトリで拒否された: %v", err)
+	}
+}
+
+// 種類は拡張子ではなく内容から判定すること（画像に偽装したテキストを弾く）。
+func TestCheckContent(t *testing.T) {
+	images := For(testConfig(), "images")
+	if !images.HasContentRules() {
+		t.Fatal("HasContentRules = false")
+	}
+	if got, err := images.CheckContent(bytes.NewReader(pngHeader)); err != nil || got != "image/png" {
+		t.Errorf("PNG: (%q, %v)", got, err)
+	}
+	if got, err := images.CheckContent(bytes.NewReader([]byte("just text, renamed to .png"))); !errors.Is(err, ErrTypeNotAllowed) || got != "text/plain" {
+		t.Errorf("テキスト: (%q, %v), want text/plain を拒否", got, err)
+	}
+
+	docs := For(testConfig(), "docs")
+	if _, err := docs.CheckContent(bytes.NewReader([]byte("PK\x03\x04\x14\x00"))); !errors.Is(err, ErrTypeNotAllowed) {
+		t.Errorf("ZIP: err = %v, want 拒否", err)
+	}
+	if _, err := docs.CheckContent(bytes.NewReader(nil)); err != nil {
+		t.Errorf("空ファイル: %v", err)
+	}
+	if For(testConfig(), "public").HasContentRules() {
+		t.Error("制限の無いディレクトリで HasContentRules = true")
+	}
+}
@@ -2,31 +2,56 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"fileserver/internal/bandwidth"
 	"fileserver/internal/config"
+	"fileserver/internal/models"
+	"fileserver/internal/scanner"
 	"fileserver/internal/storage"
+	"fileserver/internal/usage"
+
+	"github.com/go-chi/chi/v5"
 )
 
 // AdminHandler は管理者機能のHTTPハンドラーです。
 type AdminHandler struct {
-	config        *config.Config
-	uploadManager *storage.UploadManager
-	pageTmpl      *template.Template
+	config         *config.Config
+	storageManager *storage.Manager
+	uploadManager  *storage.UploadManager
+	usageTracker   *usage.Tracker
+	scanManager    *scanner.Manager
+	bandwidth      *bandwidth.Manager
+	pageTmpl       *template.Template
 }
 
 // NewAdminHandler は新しい管理者ハンドラーを作成します。
 // pageTmpl は起動時に一度だけパースした管理者ページのテンプレートです。
-func NewAdminHandler(cfg *config.Config, uploadManager *storage.UploadManager, pageTmpl *template.Template) *AdminHandler {
+func NewAdminHandler(cfg *config.Config, storageManager *storage.Manager, uploadManager *storage.UploadManager, usageTracker *usage.Tracker, scanManager *scanner.Manager, pageTmpl *template.Template) *AdminHandler {
 	return &AdminHandler{
-		config:        cfg,
-		uploadManager: uploadManager,
-		pageTmpl:      pageTmpl,
+		config:         cfg,
+		storageManager: storageManager,
+		uploadManager:  uploadManager,
+		usageTracker:   usageTracker,
+		scanManager:    scanManager,
+		pageTmpl:       pageTmpl,
 	}
 }
 
+// SetBandwidthManager は転送速度の表示に使う帯域マネージャーを設定します。
+func (h *AdminHandler) SetBandwidthManager(m *bandwidth.Manager) {
+	h.bandwidth = m
+}
+
 // AdminPage は管理者ページを表示します。
 func (h *AdminHandler) AdminPage(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
@@ -43,46 +68,156 @@ func (h *AdminHandler) AdminPage(w http.ResponseWriter, r *http.Request) {
 type UploadSessionInfo struct {
 	UploadID       string  `json:"upload_id"`
 	UserID         string  `json:"user_id"`
+	Username       string  `json:"username,omitempty"`
 	Filename       string  `json:"filename"`
 	Directory      string  `json:"directory"`
+	Protocol       string  `json:"protocol,omitempty"`
 	CreatedAt      string  `json:"created_at"`
 	UpdatedAt      string  `json:"updated_at"`
 	ExpiresAt      string  `json:"expires_at"`
 	TotalSize      int64   `json:"total_size"`
 	ChunkSize      int64   `json:"chunk_size"`
 	Progress       float64 `json:"progress"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
 	TotalChunks    int     `json:"total_chunks"`
 	UploadedChunks int     `json:"uploaded_chunks"`
 }
 
-// GetUploadSessions は現在進行中のアップロードセッション一覧を返します。
+// GetUploadSessions は現在進行中のアップロードセッション一覧を、ユーザー名と直近の受信速度を添えて返します。
 func (h *AdminHandler) GetUploadSessions(w http.ResponseWriter, r *http.Request) {
 	sessions := h.uploadManager.GetAllUploadSessions()
 
+	userIDs := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		userIDs = append(userIDs, session.UserID)
+	}
+	slices.Sort(userIDs)
+	usernames, err := h.uploadManager.Usernames(r.Context(), slices.Compact(userIDs))
+	if err != nil {
+		// 名前が引けなくても一覧自体は返せるため、ユーザーIDのみで表示する。
+		slog.WarnContext(r.Context(), "ユーザー名の取得に失敗しました", "error", err)
+	}
+
 	infos := make([]UploadSessionInfo, 0, len(sessions))
 	for _, session := range sessions {
-		progress := float64(len(session.UploadedChunks)) / float64(session.TotalChunks) * 100
-
-		info := UploadSessionInfo{
-			UploadID:       session.UploadID,
-			UserID:         session.UserID,
-			Filename:       session.Filename,
-			Directory:      session.Directory,
-			TotalSize:      session.TotalSize,
-			ChunkSize:      session.ChunkSize,
-			TotalChunks:    session.TotalChunks,
-			UploadedChunks: len(session.UploadedChunks),
-			Progress:       progress,
-			CreatedAt:      session.CreatedAt.Format("2006-01-02 15:04:05"),
-			UpdatedAt:      session.UpdatedAt.Format("2006-01-02 15:04:05"),
-			ExpiresAt:      session.ExpiresAt.Format("2006-01-02 15:04:05"),
-		}
+		info := uploadSessionInfo(session)
+		info.Username = usernames[session.UserID]
 		infos = append(infos, info)
 	}
 
 	writeJSON(w, http.StatusOK, infos)
 }
 
+// uploadSessionInfo はセッションをAPIレスポンス用の形に変換します。
+func uploadSessionInfo(session *models.UploadSession) UploadSessionInfo {
+	progress := float64(len(session.UploadedChunks)) / float64(session.TotalChunks) * 100
+	if session.Protocol == models.UploadProtocolTus && session.TotalSize > 0 {
+		// tus は全体を1チャンクとして扱うため、受信バイト数で進捗を出す。
+		progress = float64(session.ReceivedBytes()) / float64(session.TotalSize) * 100
+	}
+
+	return UploadSessionInfo{
+		UploadID:       session.UploadID,
+		UserID:         session.UserID,
+		Filename:       session.Filename,
+		Directory:      session.Directory,
+		Protocol:       session.Protocol,
+		TotalSize:      session.TotalSize,
+		ChunkSize:      session.ChunkSize,
+		TotalChunks:    session.TotalChunks,
+		UploadedChunks: len(session.UploadedChunks),
+		Progress:       progress,
+		BytesPerSecond: session.BytesPerSecond,
+		CreatedAt:      session.CreatedAt.Format("2006-01-02 15:04:05"),
+		UpdatedAt:      session.UpdatedAt.Format("2006-01-02 15:04:05"),
+		ExpiresAt:      session.ExpiresAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// AbortUploadSession は所有者に関わらずアップロードセッションを中止し、受信済みのデータを削除します。
+func (h *AdminHandler) AbortUploadSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := h.uploadManager.AbortUpload(r.Context(), chi.URLParam(r, "upload_id"), user.Username)
+	if err != nil {
+		writeChunkError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"upload_id": session.UploadID,
+		"user_id":   session.UserID,
+	})
+}
+
+// SetUploadSessionExpiry はアップロードセッションの有効期限を現在から ttl 後に変更します（延長・短縮）。
+func (h *AdminHandler) SetUploadSessionExpiry(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		http.Error(w, "ttlは正の期間（例: 24h）で指定してください", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.uploadManager.SetUploadExpiry(r.Context(), chi.URLParam(r, "upload_id"), ttl, user.Username)
+	if err != nil {
+		writeChunkError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, uploadSessionInfo(session))
+}
+
+// PurgeUploadSessions はユーザーのアップロードセッションのうち、期限切れか idle（既定 1h）以上進捗の無いものをまとめて中止します。
+func (h *AdminHandler) PurgeUploadSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Idle   string `json:"idle"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "必須パラメータが不足しています", http.StatusBadRequest)
+		return
+	}
+	idle := time.Hour
+	if req.Idle != "" {
+		d, err := time.ParseDuration(req.Idle)
+		if err != nil || d < 0 {
+			http.Error(w, "idleは0以上の期間（例: 30m）で指定してください", http.StatusBadRequest)
+			return
+		}
+		idle = d
+	}
+
+	purged := h.uploadManager.PurgeUserUploads(r.Context(), req.UserID, idle, user.Username)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"user_id": req.UserID,
+		"purged":  purged,
+	})
+}
+
 // GetUploadStats はアップロード統計情報を返します。
 func (h *AdminHandler) GetUploadStats(w http.ResponseWriter, r *http.Request) {
 	sessions := h.uploadManager.GetAllUploadSessions()
@@ -94,13 +229,7 @@ func (h *AdminHandler) GetUploadStats(w http.ResponseWriter, r *http.Request) {
 	for _, session := range sessions {
 		userUploads[session.UserID]++
 		totalSize += session.TotalSize
-
-		// 末尾チャンクは端数のため、チャンク数×サイズが総サイズを超え得る。総サイズで頭打ちにする。
-		uploadedSize := int64(len(session.UploadedChunks)) * session.ChunkSize
-		if uploadedSize > session.TotalSize {
-			uploadedSize = session.TotalSize
-		}
-		totalUploadedSize += uploadedSize
+		totalUploadedSize += session.ReceivedBytes()
 	}
 
 	stats := map[string]interface{}{
@@ -114,3 +243,224 @@ func (h *AdminHandler) GetUploadStats(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, stats)
 }
+
+// GetBandwidth は帯域の上限と、ユーザーごとの現在の転送速度（上り・下り）を返します。
+func (h *AdminHandler) GetBandwidth(w http.ResponseWriter, r *http.Request) {
+	b := h.config.Bandwidth
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"global_limit":   b.Global,
+		"per_user_limit": b.PerUser,
+		"admin_limit":    b.Admin,
+		"users":          h.bandwidth.Throughput(),
+	})
+}
+
+// GetUsage はストレージ使用量（ディレクトリ別・個人フォルダ別・アップロード者別）を返します。
+func (h *AdminHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	report, err := h.usageTracker.Report(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "使用量取得エラー", "error", err)
+		http.Error(w, "使用量の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// GetUsageHistory は使用量の日次推移を返します。
+// scope は directory / user_private / uploader（既定 directory）、days は 1〜365（既定 30）です。
+func (h *AdminHandler) GetUsageHistory(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	switch scope {
+	case "":
+		scope = usage.ScopeDirectory
+	case usage.ScopeDirectory, usage.ScopeUserPrivate, usage.ScopeUploader:
+	default:
+		http.Error(w, "無効なscopeです", http.StatusBadRequest)
+		return
+	}
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "daysは1〜365で指定してください", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	points, err := h.usageTracker.History(r.Context(), scope, days)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "使用量履歴取得エラー", "error", err)
+		http.Error(w, "使用量履歴の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scope":  scope,
+		"days":   days,
+		"points": points,
+	})
+}
+
+// RecountUsage はファイルシステムを走査する使用量の再集計をバックグラウンドで開始し、202を返します。
+// 大きなツリーでは時間がかかるため、リクエストの中では待ちません。完了は GET /api/admin/usage の
+// recounting が偽に戻ることで分かります。実行中は409を返します。
+func (h *AdminHandler) RecountUsage(w http.ResponseWriter, r *http.Request) {
+	if h.usageTracker.Recounting() {
+		http.Error(w, "使用量を再集計中です", http.StatusConflict)
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		if err := h.usageTracker.Recount(ctx); err != nil {
+			slog.ErrorContext(ctx, "使用量再集計エラー", "error", err)
+			return
+		}
+		if err := h.usageTracker.Snapshot(ctx); err != nil {
+			slog.WarnContext(ctx, "使用量スナップショットの保存に失敗しました", "error", err)
+		}
+		slog.InfoContext(ctx, "使用量を再集計しました")
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"success": true,
+		"message": "使用量の再集計を開始しました",
+	})
+}
+
+// GetQuarantine は隔離されたファイルの一覧を返します。
+func (h *AdminHandler) GetQuarantine(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.scanManager.List(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "隔離一覧取得エラー", "error", err)
+		http.Error(w, "隔離一覧の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scan_enabled": h.scanManager.Enabled(),
+		"entries":      entries,
+	})
+}
+
+// ReleaseQuarantine は隔離を解除してファイルを元のディレクトリへ戻します（誤検知の救済）。
+func (h *AdminHandler) ReleaseQuarantine(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+	entry, err := h.scanManager.Release(r.Context(), id)
+	if err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "隔離を解除しました", "id", id, "directory", entry.Directory, "filename", entry.Filename)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"directory": entry.Directory,
+		"filename":  entry.Filename,
+	})
+}
+
+// DeleteQuarantine は隔離されたファイルを完全に削除します。
+func (h *AdminHandler) DeleteQuarantine(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+	entry, err := h.scanManager.Delete(r.Context(), id)
+	if err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "隔離ファイルを削除しました", "id", id, "directory", entry.Directory, "filename", entry.Filename)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// GetLegalHolds はリーガルホールド中のファイルの一覧を返します。
+func (h *AdminHandler) GetLegalHolds(w http.ResponseWriter, r *http.Request) {
+	held, err := h.storageManager.LegalHolds(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "リーガルホールド一覧取得エラー", "error", err)
+		http.Error(w, "リーガルホールド一覧の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files": held,
+	})
+}
+
+// SetLegalHold はファイルのリーガルホールドを設定・解除します。
+// 監査ログに残すため、設定・解除のいずれも理由を必須とします。
+func (h *AdminHandler) SetLegalHold(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Directory string `json:"directory"`
+		Filename  string `json:"filename"`
+		Reason    string `json:"reason"`
+		Hold      bool   `json:"hold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Directory == "" || req.Filename == "" || req.Reason == "" {
+		http.Error(w, "必須パラメータが不足しています", http.StatusBadRequest)
+		return
+	}
+	req.Directory, ok = cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+	if strings.Contains(req.Filename, "..") || strings.ContainsAny(req.Filename, "/\\") {
+		http.Error(w, "無効なファイル名です", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storageManager.SetLegalHold(r.Context(), req.Directory, req.Filename, req.Hold, req.Reason, user.Username); err != nil {
+		if errors.Is(err, storage.ErrNotIndexed) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "リーガルホールド設定エラー", "error", err)
+		http.Error(w, "リーガルホールドの設定に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"directory":  req.Directory,
+		"filename":   req.Filename,
+		"legal_hold": req.Hold,
+	})
+}
+
+// quarantineID はURLパスの {id} を取り出します。不正な場合は400を書き込み、ok=falseを返します。
+func quarantineID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "無効なIDです", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeQuarantineError は隔離操作のエラーを適切なHTTPステータスに変換して応答します。
+func writeQuarantineError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, scanner.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, scanner.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		slog.ErrorContext(r.Context(), "隔離操作エラー", "error", err)
+		http.Error(w, "隔離ファイルの操作に失敗しました", http.StatusInternalServerError)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"time"
 
+	"fileserver/internal/allowance"
 	"fileserver/internal/authprovider"
 	"fileserver/internal/config"
 	"fileserver/internal/models"
@@ -24,6 +25,7 @@ type AuthHandler struct {
 	provider       authprovider.Provider
 	sseHandler     *SSEHandler
 	storageManager *storage.Manager
+	allowance      *allowance.Tracker
 }
 
 // NewAuthHandler は新しいAuthHandlerインスタンスを作成します。
@@ -41,6 +43,11 @@ func (h *AuthHandler) SetSSEHandler(sse *SSEHandler) {
 	h.sseHandler = sse
 }
 
+// SetAllowanceTracker は /api/user で転送量の残りを返すための Tracker を設定します。
+func (h *AuthHandler) SetAllowanceTracker(t *allowance.Tracker) {
+	h.allowance = t
+}
+
 // Login はOAuth2/OIDCログインの開始を処理します。
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	p := h.provider
@@ -212,10 +219,16 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 
 // currentUserResponse は /api/user の応答です。
 // models.User の各フィールドに加え、フロントが管理者用UI（adminリンク等）を
-// 出し分けられるよう is_admin を含めます。
+// 出し分けられるよう is_admin と share_enabled・drop_enabled・signed_url_enabled
+// （共有リンク・アップロードリンク・署名付きURLを作成できるか）を含めます。
+// 転送量の上限がある場合は残りを transfer_allowance に含めます。
 type currentUserResponse struct {
 	*models.User
-	IsAdmin bool `json:"is_admin"`
+	IsAdmin           bool              `json:"is_admin"`
+	ShareEnabled      bool              `json:"share_enabled"`
+	DropEnabled       bool              `json:"drop_enabled"`
+	SignedURLEnabled  bool              `json:"signed_url_enabled"`
+	TransferAllowance *allowance.Status `json:"transfer_allowance,omitempty"`
 }
 
 // GetCurrentUser は現在認証されているユーザー情報を返します。
@@ -228,13 +241,22 @@ func (h *AuthHandler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	// 管理者判定はAdminMiddlewareと同じくロール取得＋設定照合で行う。
 	// ロール取得失敗時は権限を広げないよう非管理者として扱う。
 	isAdmin := false
-	if roles, err := h.provider.GetUserRoles(r.Context(), user.Subject); err != nil {
+	roles, err := h.provider.GetUserRoles(r.Context(), user.Subject)
+	if err != nil {
 		slog.WarnContext(r.Context(), "管理者判定のためのロール取得に失敗しました（非管理者として扱います）", "error", err, "user_id", user.ID)
 	} else {
 		isAdmin = h.config.HasAdminRole(roles)
 	}
 
-	writeJSON(w, http.StatusOK, currentUserResponse{User: user, IsAdmin: isAdmin})
+	resp := currentUserResponse{User: user, IsAdmin: isAdmin, ShareEnabled: h.config.Share.Enabled, DropEnabled: h.config.Share.DropEnabled,
+		SignedURLEnabled: h.config.SignedURL.Enabled}
+	if h.allowance != nil && h.allowance.Enabled() {
+		// 残りの表示に失敗してもユーザー情報は返す。
+		if resp.TransferAllowance, err = h.allowance.Status(r.Context(), user.ID, roles); err != nil {
+			slog.WarnContext(r.Context(), "転送量の取得に失敗しました", "error", err, "user_id", user.ID)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (h *AuthHandler) upsertUser(userID string, info *authprovider.UserInfo) error {
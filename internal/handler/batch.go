@@ -0,0 +1,499 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルは多数のファイルを1リクエストで受け取る一括アップロードのハンドラーを含みます。
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fileserver/internal/config"
+	"fileserver/internal/filetype"
+	"fileserver/internal/models"
+	"fileserver/internal/scanner"
+	"fileserver/internal/storage"
+)
+
+// 一括アップロードの進め方（mode フィールド）。
+const (
+	// batchBestEffort は受け付けられるファイルだけを保存します（既定）。
+	batchBestEffort = "best_effort"
+	// batchAllOrNothing は全ファイルを受け付けられる場合だけ保存し、1件でも失敗すれば全件を取り消します。
+	batchAllOrNothing = "all_or_nothing"
+)
+
+// 一括アップロードの各ファイルの結果（batchFileResult.Status）。
+const (
+	batchUploaded    = "uploaded"
+	batchFailed      = "failed"
+	batchCancelled   = "cancelled" // all_or_nothing で他のファイルの失敗により取り消した
+	batchQuarantined = "quarantined"
+)
+
+// maxBatchPathDepth は相対パスの階層数の上限です。
+const maxBatchPathDepth = 32
+
+// maxBatchFieldSize はファイル以外のフィールド1つの大きさの上限です。
+const maxBatchFieldSize = 4096
+
+// batchFileResult は一括アップロードのファイル1件分の結果です。
+type batchFileResult struct {
+	Path       string `json:"path"`                // クライアントが指定した相対パス
+	Directory  string `json:"directory,omitempty"` // 保存先（サブディレクトリを含む）
+	Filename   string `json:"filename,omitempty"`  // 保存名
+	Size       int64  `json:"size"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Code       int    `json:"code,omitempty"` // 単独のアップロードなら返るHTTPステータス
+	ScanStatus string `json:"scan_status,omitempty"`
+}
+
+// batchUploadResponse は一括アップロードの応答です。
+type batchUploadResponse struct {
+	Success  bool               `json:"success"`
+	Mode     string             `json:"mode"`
+	Uploaded int                `json:"uploaded"`
+	Failed   int                `json:"failed"`
+	Files    []*batchFileResult `json:"files"`
+}
+
+// batchItem は受信と検査を終え、保存名への移動を待つファイル1件です。
+type batchItem struct {
+	result    *batchFileResult
+	tempPath  string
+	directory string
+	name      string
+	policy    string
+	outcome   scanner.Outcome
+	saved     *storage.SavedFile
+}
+
+// batchUpload は一括アップロード1リクエスト分の状態です。
+type batchUpload struct {
+	h          *FileHandler
+	ctx        context.Context
+	user       *models.User
+	directory  string
+	mode       string
+	onConflict string
+	canWrite   map[string]bool // サブディレクトリごとの書き込み権限（ディレクトリごとに1回だけ確認）
+	canDelete  map[string]bool // replace で置き換える場合の削除権限（必要になった時点でディレクトリごとに1回だけ確認）
+	created    []string        // 作成したサブディレクトリ
+	pending    []*batchItem    // all_or_nothing で保存を待つファイル
+	results    []*batchFileResult
+}
+
+// UploadBatch は multipart/form-data の1リクエストで複数のファイルを受け取り、ファイルごとの結果を返します。
+// 認証・在籍確認・権限確認は1回だけ行い、各ファイルは受け取った順にストリームのまま保存します。
+// file パートの直前の path フィールドがそのファイルの相対パスになり、必要なサブディレクトリを作ります。
+// directory・mode・on_conflict は最初の file パートより前に置きます。
+func (h *FileHandler) UploadBatch(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "multipart/form-data で送信してください", http.StatusBadRequest)
+		return
+	}
+
+	b := &batchUpload{
+		h: h, ctx: r.Context(), user: user, results: make([]*batchFileResult, 0),
+		canWrite: make(map[string]bool), canDelete: make(map[string]bool),
+	}
+	started := false
+	var path string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "一括アップロードの読み取りエラー", "error", err, "user_id", user.ID)
+			if started {
+				b.cancel("リクエストが途中で終わったため取り消しました")
+				b.finish()
+			}
+			http.Error(w, "リクエストの読み取りに失敗しました", http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := readBatchField(part)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			switch part.FormName() {
+			case "directory":
+				b.directory = value
+			case "mode":
+				b.mode = value
+			case "on_conflict":
+				b.onConflict = value
+			case "path":
+				path = value
+			}
+			continue
+		}
+
+		if !started {
+			if !b.start(w) {
+				return
+			}
+			started = true
+		}
+		relPath := path
+		if relPath == "" {
+			relPath = part.FileName()
+		}
+		path = ""
+		accepted := b.receive(part, relPath)
+		if err := part.Close(); err != nil {
+			slog.WarnContext(r.Context(), "パートのクローズに失敗しました", "error", err)
+		}
+		// all_or_nothing では1件でも失敗すれば残りを受け取る意味が無いため、ここで打ち切る。
+		if !accepted && b.mode == batchAllOrNothing {
+			break
+		}
+	}
+
+	if !started {
+		http.Error(w, "ファイルが指定されていません", http.StatusBadRequest)
+		return
+	}
+	if b.mode == batchAllOrNothing && b.failed() {
+		b.cancel("他のファイルを保存できなかったため取り消しました")
+	}
+	b.commitPending()
+	resp := b.finish()
+
+	slog.InfoContext(r.Context(), "一括アップロード", "user_id", user.ID, "directory", b.directory, "mode", b.mode,
+		"uploaded", resp.Uploaded, "failed", resp.Failed)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readBatchField はファイル以外のフィールドの値を読みます。
+func readBatchField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxBatchFieldSize+1))
+	if err != nil {
+		return "", fmt.Errorf("フィールド %s の読み取りに失敗しました", part.FormName())
+	}
+	if len(value) > maxBatchFieldSize {
+		return "", fmt.Errorf("フィールド %s が長すぎます", part.FormName())
+	}
+	return string(value), nil
+}
+
+// splitBatchPath は一括アップロードの相対パス（区切りは "/" または "\"）を検証し、
+// サブディレクトリとファイル名に分けます。
+func splitBatchPath(p string) (subdir, name string, err error) {
+	parts := strings.Split(strings.Trim(strings.ReplaceAll(p, "\\", "/"), "/"), "/")
+	if len(parts) > maxBatchPathDepth {
+		return "", "", fmt.Errorf("パスの階層が深すぎます（最大: %d）", maxBatchPathDepth)
+	}
+	for _, s := range parts {
+		if strings.TrimSpace(s) == "" || s == "." || s == ".." || strings.ContainsRune(s, 0) {
+			return "", "", fmt.Errorf("無効なパスです: %q", p)
+		}
+	}
+	return filepath.Join(parts[:len(parts)-1]...), parts[len(parts)-1], nil
+}
+
+// start は最初のファイルを受け取る前に、リクエスト全体の指定と書き込み権限を確認します。
+// 受け付けられない場合は400/403/500を書き込み、false を返します。
+func (b *batchUpload) start(w http.ResponseWriter) bool {
+	if b.mode == "" {
+		b.mode = batchBestEffort
+	}
+	if b.mode != batchBestEffort && b.mode != batchAllOrNothing {
+		http.Error(w, "mode が不正です（best_effort・all_or_nothing のいずれかを指定してください）", http.StatusBadRequest)
+		return false
+	}
+	if b.onConflict != "" && !config.ValidConflictPolicy(b.onConflict) {
+		http.Error(w, "on_conflict が不正です（rename・replace・reject のいずれかを指定してください）", http.StatusBadRequest)
+		return false
+	}
+	if b.directory == "" {
+		http.Error(w, "ディレクトリが指定されていません（directory は最初の file より前に置いてください）", http.StatusBadRequest)
+		return false
+	}
+	directory, ok := cleanDir(w, b.directory)
+	if !ok {
+		return false
+	}
+	b.directory = directory
+
+	hasPermission, err := b.h.permissionChecker.CheckPermission(b.user.ID, directory, "write")
+	if err != nil {
+		slog.ErrorContext(b.ctx, "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	if !hasPermission {
+		http.Error(w, "書き込み権限がありません", http.StatusForbidden)
+		return false
+	}
+
+	// user配下は初回アップロード時に個別ディレクトリを作る（事前作成しない方針）。
+	if strings.HasPrefix(directory, "user/") {
+		if err := b.h.storageManager.EnsureUserDirectory(b.user.GetDirectoryName()); err != nil {
+			slog.ErrorContext(b.ctx, "ユーザーディレクトリ作成エラー", "error", err)
+			http.Error(w, "ユーザーディレクトリの作成に失敗しました", http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// receive はファイル1件を受信して検査します。best_effort ではそのまま保存し、
+// all_or_nothing では保存を commitPending まで待たせます。受け付けられなかった場合は false を返します。
+func (b *batchUpload) receive(part io.Reader, relPath string) bool {
+	res := &batchFileResult{Path: relPath}
+	b.results = append(b.results, res)
+	sm := b.h.storageManager
+
+	if limit := b.h.config.Storage.MaxBatchFiles; len(b.results) > limit {
+		return b.fail(res, http.StatusRequestEntityTooLarge, fmt.Sprintf("一度に送れるファイル数（%d）を超えています", limit))
+	}
+	subdir, name, err := splitBatchPath(relPath)
+	if err != nil {
+		return b.fail(res, http.StatusBadRequest, err.Error())
+	}
+	directory := filepath.Join(b.directory, subdir)
+	res.Directory = directory
+	// subdirectories の規則で親より狭められたパスへは書き込ませない。
+	canWrite, ok := b.allowed(res, b.canWrite, directory, "write")
+	if !ok {
+		return false
+	}
+	if !canWrite {
+		return b.fail(res, http.StatusForbidden, "書き込み権限がありません")
+	}
+
+	rules := filetype.For(b.h.config, directory)
+	if err := rules.CheckName(name); err != nil {
+		return b.failWith(res, err)
+	}
+	policy, ok := b.conflictPolicy(res, directory, name)
+	if !ok {
+		return false
+	}
+
+	created, err := sm.MakeDirectories(directory)
+	b.created = append(b.created, created...)
+	if err != nil {
+		slog.ErrorContext(b.ctx, "サブディレクトリの作成エラー", "directory", directory, "error", err)
+		return b.fail(res, http.StatusInternalServerError, "ディレクトリの作成に失敗しました")
+	}
+
+	// 上限を1バイト超えた時点で受信をやめる（残りは次のパートへ進む際に読み捨てられる）。
+	maxSize := b.h.config.Storage.MaxFileSize
+	tempPath, size, err := sm.Receive(directory, io.LimitReader(part, maxSize+1))
+	if err != nil {
+		slog.ErrorContext(b.ctx, "ファイル保存エラー", "path", relPath, "error", err)
+		return b.fail(res, http.StatusInternalServerError, "ファイルの保存に失敗しました")
+	}
+	res.Size = size
+	if size > maxSize {
+		sm.RemoveReceived(tempPath)
+		return b.fail(res, http.StatusRequestEntityTooLarge, fmt.Sprintf("ファイルサイズが制限を超えています（最大: %d MB）", maxSize/(1024*1024)))
+	}
+	// 種類はクライアントの Content-Type ではなく、受信した内容の先頭から判定する。
+	ruleErr := rules.CheckSize(size)
+	if ruleErr == nil {
+		ruleErr = rules.CheckFile(tempPath)
+	}
+	if ruleErr != nil {
+		sm.RemoveReceived(tempPath)
+		return b.failWith(res, ruleErr)
+	}
+	// 検査を終えるまで見えないよう、作業ファイルのままスキャンする（隔離した場合は作業ファイルが残らない）。
+	outcome, err := inspect(b.ctx, b.h.scanManager, directory, name, tempPath, b.user)
+	res.ScanStatus = outcome.Status
+	if err != nil {
+		slog.ErrorContext(b.ctx, "ファイルの検査エラー", "path", relPath, "error", err)
+		return b.fail(res, http.StatusInternalServerError, "ファイルを隔離できなかったため保存しませんでした")
+	}
+	if outcome.Quarantined {
+		res.Status = batchQuarantined
+		res.Error, res.Code = quarantineError(outcome)
+		return false
+	}
+
+	item := &batchItem{result: res, tempPath: tempPath, directory: directory, name: name, policy: policy, outcome: outcome}
+	if b.mode == batchAllOrNothing {
+		b.pending = append(b.pending, item)
+		return true
+	}
+	if !b.place(item) {
+		return false
+	}
+	b.register(item)
+	return true
+}
+
+// conflictPolicy は同じ名前のファイルに対して受け付けられるかを判定し、適用する扱いを返します。
+// アップロードごとに replace を指定して既存ファイルを置き換える場合は削除権限も必要です。
+func (b *batchUpload) conflictPolicy(res *batchFileResult, directory, name string) (string, bool) {
+	policy := b.onConflict
+	if policy == "" {
+		policy = b.h.config.ConflictPolicy(directory)
+	}
+	existing, err := b.h.storageManager.CheckConflict(b.ctx, directory, name, policy)
+	if err != nil {
+		return "", b.failWith(res, err)
+	}
+	if len(existing) > 0 && b.onConflict == config.ConflictReplace {
+		canDelete, ok := b.allowed(res, b.canDelete, directory, "delete")
+		if !ok {
+			return "", false
+		}
+		if !canDelete {
+			return "", b.fail(res, http.StatusForbidden, "同名のファイルを置き換えるには削除権限が必要です")
+		}
+	}
+	return policy, true
+}
+
+// allowed は directory での permission の有無を返し、cache に控えます。
+// 確認に失敗した場合は res を失敗（500）にして ok=false を返します。
+func (b *batchUpload) allowed(res *batchFileResult, cache map[string]bool, directory, permission string) (allowed, ok bool) {
+	if allowed, cached := cache[directory]; cached {
+		return allowed, true
+	}
+	allowed, err := b.h.permissionChecker.CheckPermission(b.user.ID, filepath.ToSlash(directory), permission)
+	if err != nil {
+		slog.ErrorContext(b.ctx, "権限チェックエラー", "error", err)
+		return false, b.fail(res, http.StatusInternalServerError, "権限の確認に失敗しました")
+	}
+	cache[directory] = allowed
+	return allowed, true
+}
+
+// place は受信済みのファイルを保存名へ移します。移せなかった場合は作業ファイルを消して false を返します。
+func (b *batchUpload) place(item *batchItem) bool {
+	saved, err := b.h.storageManager.Place(b.ctx, item.tempPath, item.directory, item.name, item.policy)
+	if err != nil {
+		b.h.storageManager.RemoveReceived(item.tempPath)
+		return b.failWith(item.result, err)
+	}
+	item.saved = saved
+	item.result.Filename = saved.Filename
+	item.result.Size = saved.Size
+	return true
+}
+
+// register は保存したファイルのメタデータとスキャン結果を登録し、置き換え対象を削除します。
+func (b *batchUpload) register(item *batchItem) {
+	sm, res := b.h.storageManager, item.result
+
+	// メタデータ保存の失敗はアップロード自体を失敗させない（本体は保存済み）。
+	if err := sm.SaveFileMetadata(item.directory, item.saved.Filename, b.user.ID, b.user.Username); err != nil {
+		slog.WarnContext(b.ctx, "メタデータの保存に失敗しました", "error", err)
+	}
+	recordScan(b.ctx, b.h.scanManager, item.directory, item.saved.Filename, item.outcome)
+	sm.RemoveReplaced(context.WithoutCancel(b.ctx), item.saved)
+	res.Status = batchUploaded
+}
+
+// commitPending は all_or_nothing で保存を待たせていたファイルを保存・登録します。
+// 保存名への移動で1件でも失敗した場合（同時に同じ名前のファイルが置かれた等）は、移動済みのものも含めて全件を取り消します。
+func (b *batchUpload) commitPending() {
+	for i, item := range b.pending {
+		if b.place(item) {
+			continue
+		}
+		for _, done := range b.pending[:i] {
+			if err := os.Remove(filepath.Join(b.h.config.Storage.UploadPath, done.saved.Path)); err != nil {
+				slog.ErrorContext(b.ctx, "取り消したファイルの削除に失敗しました", "path", done.saved.Path, "error", err)
+			}
+			done.result.Filename = ""
+		}
+		b.pending = append(b.pending[:i], b.pending[i+1:]...)
+		b.cancel("他のファイルを保存できなかったため取り消しました")
+		return
+	}
+	for _, item := range b.pending {
+		b.register(item)
+	}
+	b.pending = nil
+}
+
+// cancel は保存を待たせているファイルをすべて取り消します（all_or_nothing 用）。
+func (b *batchUpload) cancel(reason string) {
+	for _, item := range b.pending {
+		if item.saved == nil {
+			b.h.storageManager.RemoveReceived(item.tempPath)
+		}
+		item.result.Status = batchCancelled
+		item.result.Error = reason
+	}
+	b.pending = nil
+}
+
+// failed はこれまでに受け付けられなかったファイルがあるかを返します。
+func (b *batchUpload) failed() bool {
+	for _, res := range b.results {
+		if res.Status == batchFailed || res.Status == batchQuarantined {
+			return true
+		}
+	}
+	return false
+}
+
+// finish は空のまま残ったサブディレクトリを削除し、保存したファイルをまとめて1件のSSEイベントで通知して、応答を組み立てます。
+func (b *batchUpload) finish() batchUploadResponse {
+	b.h.storageManager.RemoveDirectories(b.created)
+
+	resp := batchUploadResponse{Mode: b.mode, Files: b.results}
+	var uploaded []*batchFileResult
+	for _, res := range b.results {
+		if res.Status == batchUploaded {
+			uploaded = append(uploaded, res)
+		}
+	}
+	resp.Uploaded = len(uploaded)
+	resp.Failed = len(b.results) - resp.Uploaded
+	resp.Success = resp.Failed == 0
+
+	// 隔離したファイルは公開しないため、イベントにも含めない。
+	if b.h.sseHandler != nil && len(uploaded) > 0 {
+		b.h.sseHandler.BroadcastBatchUpload(b.user, b.directory, uploaded)
+	}
+	return resp
+}
+
+// fail は res を失敗として記録し、false を返します。
+func (b *batchUpload) fail(res *batchFileResult, code int, message string) bool {
+	res.Status = batchFailed
+	res.Code = code
+	res.Error = message
+	return false
+}
+
+// failWith は保存・検査のエラーを単独のアップロードと同じステータスに変換して res に記録し、false を返します。
+func (b *batchUpload) failWith(res *batchFileResult, err error) bool {
+	switch {
+	case errors.Is(err, filetype.ErrTooLarge):
+		return b.fail(res, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, filetype.ErrTypeNotAllowed):
+		return b.fail(res, http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, storage.ErrNameConflict):
+		return b.fail(res, http.StatusConflict, err.Error())
+	case errors.Is(err, storage.ErrRetained), errors.Is(err, storage.ErrLegalHold):
+		return b.fail(res, http.StatusLocked, "同名のファイルを置き換えられません: "+err.Error())
+	default:
+		slog.ErrorContext(b.ctx, "一括アップロードのファイル保存エラー", "path", res.Path, "error", err)
+		return b.fail(res, http.StatusInternalServerError, "ファイルの保存に失敗しました")
+	}
+}
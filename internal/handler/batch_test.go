@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/storage"
+)
+
+func TestSplitBatchPath(t *testing.T) {
+	cases := []struct {
+		in, subdir, name string
+		wantErr          bool
+	}{
+		{"a.jpg", "", "a.jpg", false},
+		{"photos/2024/a.jpg", filepath.Join("photos", "2024"), "a.jpg", false},
+		{`photos\a.jpg`, "photos", "a.jpg", false},
+		{"/photos/a.jpg", "photos", "a.jpg", false},
+		{"../a.jpg", "", "", true},
+		{"photos/./a.jpg", "", "", true},
+		{"photos//a.jpg", "", "", true},
+		{"", "", "", true},
+	}
+	for _, c := range cases {
+		subdir, name, err := splitBatchPath(c.in)
+		if (err != nil) != c.wantErr || subdir != c.subdir || name != c.name {
+			t.Errorf("splitBatchPath(%q) = %q, %q, %v", c.in, subdir, name, err)
+		}
+	}
+}
+
+// newBatchTestHandler は全員が書き込める public（.exe は拒否。public/secret は staff のみ）を持つ FileHandler を作ります。
+func newBatchTestHandler(t *testing.T) *FileHandler {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath:    filepath.Join(dir, "uploads"),
+		MaxFileSize:   1 << 20,
+		MaxBatchFiles: 10,
+		Directories: []config.DirectoryConfig{{
+			Path:             "public",
+			Grants:           []config.GrantConfig{{Role: "*", Permissions: []string{"read", "write"}}},
+			DeniedExtensions: []string{".exe"},
+			Subdirectories: []config.SubdirectoryConfig{
+				{Path: "secret", Grants: []config.GrantConfig{{Role: "staff", Permissions: []string{"read", "write"}}}},
+			},
+		}},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	return NewFileHandler(cfg, sm, nil, permission.NewChecker(cfg, &memberProvider{}, sm, db))
+}
+
+func postBatch(t *testing.T, h *FileHandler, mode string, files map[string]string, order []string) batchUploadResponse {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("directory", "public")
+	mw.WriteField("mode", mode)
+	for _, p := range order {
+		mw.WriteField("path", p)
+		fw, _ := mw.CreateFormFile("file", filepath.Base(p))
+		fw.Write([]byte(files[p]))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/files/upload/batch", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	rec := httptest.NewRecorder()
+	h.UploadBatch(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp batchUploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// best_effort は受け付けられないファイルだけを失敗にし、残りをサブディレクトリへ保存すること。
+func TestUploadBatchBestEffort(t *testing.T) {
+	h := newBatchTestHandler(t)
+	resp := postBatch(t, h, batchBestEffort,
+		map[string]string{"album/a.txt": "a", "album/sub/b.txt": "b", "album/c.exe": "c"},
+		[]string{"album/a.txt", "album/sub/b.txt", "album/c.exe"})
+
+	if resp.Success || resp.Uploaded != 2 || resp.Failed != 1 {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if res := resp.Files[2]; res.Status != batchFailed || res.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("拒否したファイルの結果 = %+v", res)
+	}
+	if res := resp.Files[1]; res.Directory != filepath.Join("public", "album", "sub") || res.Status != batchUploaded {
+		t.Errorf("サブディレクトリのファイルの結果 = %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(h.config.Storage.UploadPath, "public", "album", "sub", resp.Files[1].Filename)); err != nil {
+		t.Errorf("保存されていない: %v", err)
+	}
+}
+
+// all_or_nothing は1件でも失敗すれば、受信済みのファイルと作成したサブディレクトリを残さないこと。
+func TestUploadBatchAllOrNothing(t *testing.T) {
+	h := newBatchTestHandler(t)
+	resp := postBatch(t, h, batchAllOrNothing,
+		map[string]string{"album/a.txt": "a", "album/c.exe": "c", "album/d.txt": "d"},
+		[]string{"album/a.txt", "album/c.exe", "album/d.txt"})
+
+	if resp.Success || resp.Uploaded != 0 || len(resp.Files) != 2 {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if resp.Files[0].Status != batchCancelled || resp.Files[1].Status != batchFailed {
+		t.Errorf("結果 = %+v, %+v", resp.Files[0], resp.Files[1])
+	}
+	if _, err := os.Stat(filepath.Join(h.config.Storage.UploadPath, "public", "album")); !os.IsNotExist(err) {
+		t.Errorf("作成したサブディレクトリが残っている: %v", err)
+	}
+
+	resp = postBatch(t, h, batchAllOrNothing,
+		map[string]string{"album/a.txt": "a", "album/d.txt": "d"},
+		[]string{"album/a.txt", "album/d.txt"})
+	if !resp.Success || resp.Uploaded != 2 {
+		t.Errorf("全件受け付けられる場合の resp = %+v", resp)
+	}
+}
+
+// 書き込めないサブディレクトリへのファイルは、バッチの保存先に書き込めても 403 で拒否すること。
+func TestUploadBatchChecksSubdirectoryPermission(t *testing.T) {
+	h := newBatchTestHandler(t)
+	resp := postBatch(t, h, batchBestEffort,
+		map[string]string{"secret/x.txt": "x", "secret/deep/y.txt": "y", "open/z.txt": "z"},
+		[]string{"secret/x.txt", "secret/deep/y.txt", "open/z.txt"})
+
+	if resp.Uploaded != 1 || resp.Files[2].Status != batchUploaded {
+		t.Fatalf("resp = %+v", resp)
+	}
+	for _, res := range resp.Files[:2] {
+		if res.Status != batchFailed || res.Code != http.StatusForbidden {
+			t.Errorf("書き込めないサブディレクトリの結果 = %+v", res)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(h.config.Storage.UploadPath, "public", "secret")); len(entries) != 0 {
+		t.Errorf("書き込めないサブディレクトリに保存されている: %v", entries)
+	}
+}
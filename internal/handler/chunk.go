@@ -3,16 +3,24 @@
 package handler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"fileserver/internal/config"
+	"fileserver/internal/filetype"
+	"fileserver/internal/models"
 	"fileserver/internal/permission"
+	"fileserver/internal/scanner"
 	"fileserver/internal/storage"
 
 	"github.com/go-chi/chi/v5"
@@ -30,6 +38,34 @@ func validUploadID(w http.ResponseWriter, uploadID string) bool {
 	return true
 }
 
+// statusChecksumMismatch はチェックサム不一致を表す「460 Checksum Mismatch」です。
+// tus の checksum 拡張が定めるステータスを、チャンクAPIでも同じ意味で使います。
+const statusChecksumMismatch = 460
+
+// chunkChecksum はチャンクのSHA-256を X-Chunk-SHA256（16進）または Digest（"sha-256=base64"、RFC 3230）から取り出します。
+// どちらも無ければ nil を返します。
+func chunkChecksum(r *http.Request) ([]byte, error) {
+	if v := strings.TrimSpace(r.Header.Get("X-Chunk-SHA256")); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("X-Chunk-SHA256 が不正です")
+		}
+		return sum, nil
+	}
+	for _, digest := range strings.Split(r.Header.Get("Digest"), ",") {
+		algo, encoded, ok := strings.Cut(strings.TrimSpace(digest), "=")
+		if !ok || !strings.EqualFold(algo, "sha-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Digest の sha-256 が不正です")
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
 // writeChunkError はストレージ層のエラーを適切なHTTPステータスに変換して応答します。
 func writeChunkError(w http.ResponseWriter, err error) {
 	switch {
@@ -37,7 +73,20 @@ func writeChunkError(w http.ResponseWriter, err error) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 	case errors.Is(err, storage.ErrPermissionDenied):
 		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrOffsetMismatch):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrUploadBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		http.Error(w, err.Error(), statusChecksumMismatch)
+	case errors.Is(err, storage.ErrNameConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrRetained), errors.Is(err, storage.ErrLegalHold):
+		http.Error(w, "同名のファイルを置き換えられません: "+err.Error(), http.StatusLocked)
+	case errors.Is(err, storage.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 	case errors.Is(err, storage.ErrInvalidChunk),
+		errors.Is(err, storage.ErrChunkRead),
 		errors.Is(err, storage.ErrIncompleteUpload),
 		errors.Is(err, storage.ErrSizeMismatch),
 		errors.Is(err, storage.ErrMaxConcurrentUploads):
@@ -49,20 +98,34 @@ func writeChunkError(w http.ResponseWriter, err error) {
 
 // ChunkHandler はチャンク分割されたファイルアップロードのHTTPリクエストを処理します。
 type ChunkHandler struct {
+	config            *config.Config
 	storageManager    *storage.Manager
 	uploadManager     *storage.UploadManager
 	permissionChecker *permission.Checker
+	scanManager       *scanner.Manager
+	sseHandler        *SSEHandler
 }
 
 // NewChunkHandler は新しいチャンクアップロードハンドラーを作成します。
-func NewChunkHandler(sm *storage.Manager, um *storage.UploadManager, pc *permission.Checker) *ChunkHandler {
+func NewChunkHandler(cfg *config.Config, sm *storage.Manager, um *storage.UploadManager, pc *permission.Checker) *ChunkHandler {
 	return &ChunkHandler{
+		config:            cfg,
 		storageManager:    sm,
 		uploadManager:     um,
 		permissionChecker: pc,
 	}
 }
 
+// SetScanManager はアップロード完了時にファイルを検査するスキャンマネージャーを設定します。
+func (h *ChunkHandler) SetScanManager(sm *scanner.Manager) {
+	h.scanManager = sm
+}
+
+// SetSSEHandler はアップロードの完了を通知するSSEハンドラーを設定します。
+func (h *ChunkHandler) SetSSEHandler(sse *SSEHandler) {
+	h.sseHandler = sse
+}
+
 // InitChunkUpload は新しいチャンク分割アップロードセッションを初期化します。
 // 権限を検証し、アップロードセッションを作成し、アップロードIDを返します。
 func (h *ChunkHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +139,10 @@ func (h *ChunkHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
 		Directory string `json:"directory"`
 		FileSize  int64  `json:"file_size"`
 		ChunkSize int64  `json:"chunk_size"`
+		// FileSHA256 はファイル全体のSHA-256（16進、任意）。指定すると完了時に照合する。
+		FileSHA256 string `json:"file_sha256"`
+		// OnConflict は同名ファイルがある場合の扱い（rename / replace / reject、任意）。
+		OnConflict string `json:"on_conflict"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -88,31 +155,19 @@ func (h *ChunkHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req.Directory, ok = cleanDir(w, req.Directory)
-	if !ok {
-		return
+	if req.FileSHA256 != "" {
+		if sum, err := hex.DecodeString(req.FileSHA256); err != nil || len(sum) != sha256.Size {
+			http.Error(w, "file_sha256 が不正です（SHA-256の16進文字列で指定してください）", http.StatusBadRequest)
+			return
+		}
 	}
 
-	hasPermission, err := h.permissionChecker.CheckPermission(user.ID, req.Directory, "write")
-	if err != nil {
-		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
-		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
-		return
-	}
-	if !hasPermission {
-		http.Error(w, "書き込み権限がありません", http.StatusForbidden)
+	var policy string
+	req.Directory, policy, ok = h.prepareUpload(w, r, user, req.Filename, req.Directory, req.FileSize, req.OnConflict)
+	if !ok {
 		return
 	}
 
-	// user配下は初回アップロード時に個別ディレクトリを作る（事前作成しない方針）。
-	if strings.HasPrefix(req.Directory, "user/") {
-		if ensureErr := h.storageManager.EnsureUserDirectory(user.GetDirectoryName()); ensureErr != nil {
-			slog.ErrorContext(r.Context(), "ユーザーディレクトリ作成エラー", "error", ensureErr)
-			http.Error(w, "ユーザーディレクトリの作成に失敗しました", http.StatusInternalServerError)
-			return
-		}
-	}
-
 	// 切り上げ除算でチャンク数を求める。
 	totalChunks := int((req.FileSize + req.ChunkSize - 1) / req.ChunkSize)
 	session, err := h.uploadManager.CreateUploadSession(
@@ -122,6 +177,8 @@ func (h *ChunkHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
 		req.FileSize,
 		req.ChunkSize,
 		totalChunks,
+		req.FileSHA256,
+		policy,
 	)
 	if err != nil {
 		slog.ErrorContext(r.Context(), "アップロード初期化エラー", "error", err)
@@ -140,6 +197,53 @@ func (h *ChunkHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// prepareUpload はアップロードセッションを作る前の共通検査（パス・書き込み権限・ディレクトリの種別/サイズ制限・同名ファイル）を行い、
+// 必要なら個人ディレクトリを作成して、正規化したディレクトリと同名ファイルの扱いを返します。不正な場合は応答を書き込み、ok=falseを返します。
+func (h *ChunkHandler) prepareUpload(w http.ResponseWriter, r *http.Request, user *models.User, filename, directory string, size int64, onConflict string) (string, string, bool) {
+	directory, ok := cleanDir(w, directory)
+	if !ok {
+		return "", "", false
+	}
+
+	hasPermission, err := h.permissionChecker.CheckPermission(user.ID, directory, "write")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return "", "", false
+	}
+	if !hasPermission {
+		http.Error(w, "書き込み権限がありません", http.StatusForbidden)
+		return "", "", false
+	}
+
+	// 種類（拡張子）とサイズは受信前に弾く。内容による判定は結合後（完了時）に行う。
+	rules := filetype.For(h.config, directory)
+	if err := rules.CheckName(filename); err != nil {
+		writeFileRuleError(w, err)
+		return "", "", false
+	}
+	if err := rules.CheckSize(size); err != nil {
+		writeFileRuleError(w, err)
+		return "", "", false
+	}
+
+	// user配下は初回アップロード時に個別ディレクトリを作る（事前作成しない方針）。
+	if strings.HasPrefix(directory, "user/") {
+		if ensureErr := h.storageManager.EnsureUserDirectory(user.GetDirectoryName()); ensureErr != nil {
+			slog.ErrorContext(r.Context(), "ユーザーディレクトリ作成エラー", "error", ensureErr)
+			http.Error(w, "ユーザーディレクトリの作成に失敗しました", http.StatusInternalServerError)
+			return "", "", false
+		}
+	}
+
+	// reject の同名ファイルは受信を始める前に断る（完了時にも改めて判定する）。
+	policy, ok := resolveConflictPolicy(w, r, h.config, h.storageManager, h.permissionChecker, user.ID, directory, filename, onConflict)
+	if !ok {
+		return "", "", false
+	}
+	return directory, policy, true
+}
+
 // UploadChunk は進行中のアップロードのための単一のチャンクデータを受信して保存します。
 func (h *ChunkHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 	user, ok := userFromContext(w, r)
@@ -170,22 +274,23 @@ func (h *ChunkHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ReadAllで全体を読むため、1チャンク分でボディを打ち切りメモリ枯渇を防ぐ。
-	r.Body = http.MaxBytesReader(w, r.Body, session.ChunkSize)
-
-	chunkData, err := io.ReadAll(r.Body)
+	checksum, err := chunkChecksum(r)
 	if err != nil {
-		http.Error(w, "チャンクデータが大きすぎるか読み取りに失敗しました", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := h.uploadManager.SaveChunk(uploadID, user.ID, chunkIndex, chunkData); err != nil {
+	// ボディはメモリに溜めず一時ファイルへ直接書き込む。超過の検出（ErrInvalidChunk）に
+	// 1バイト余分に読めるよう上限を1チャンク+1にし、それ以上は読ませずに接続を閉じさせる。
+	r.Body = http.MaxBytesReader(w, r.Body, session.ChunkSize+1)
+
+	if err := h.uploadManager.SaveChunk(uploadID, user.ID, chunkIndex, r.Body, checksum); err != nil {
 		slog.ErrorContext(r.Context(), "チャンク保存エラー", "upload_id", uploadID, "chunk_index", chunkIndex, "error", err)
 		writeChunkError(w, err)
 		return
 	}
 
-	slog.DebugContext(r.Context(), "チャンク保存成功", "upload_id", uploadID, "chunk_index", chunkIndex, "size", len(chunkData))
+	slog.DebugContext(r.Context(), "チャンク保存成功", "upload_id", uploadID, "chunk_index", chunkIndex)
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"success":     true,
@@ -242,29 +347,114 @@ func (h *ChunkHandler) CompleteChunkUpload(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	savedFile, err := h.uploadManager.CompleteUpload(uploadID, user.ID)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "アップロード完了エラー", "upload_id", uploadID, "error", err)
-		writeChunkError(w, err)
+	savedFile, outcome, ok := h.completeUpload(w, r, user, uploadID)
+	if !ok {
 		return
 	}
 
-	directory := filepath.Dir(savedFile.Path)
-
-	// メタデータ保存の失敗は完了を失敗させない（本体は保存済み）。
-	if err := h.storageManager.SaveFileMetadata(directory, savedFile.Filename, user.ID, user.Username); err != nil {
-		slog.WarnContext(r.Context(), "メタデータの保存に失敗しました", "error", err)
-	}
-
 	slog.InfoContext(r.Context(), "チャンクアップロード完了", "upload_id", uploadID, "final_path", savedFile.Path)
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	resp := map[string]interface{}{
 		"success":  true,
 		"message":  "アップロードが完了しました",
 		"path":     savedFile.Path,
 		"filename": savedFile.Filename,
 		"size":     savedFile.Size,
+	}
+	if outcome.Status != "" {
+		resp["scan_status"] = outcome.Status
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// completeUpload は受信済みのセッションを確定し、内容の制限検査・スキャン・メタデータ登録を行います（チャンクAPI・tus 共通）。
+// 制限検査とスキャンは結合した一時ファイルに対して行い、通ったものだけを保存名へ移します。
+// 失敗した場合は応答を書き込み、ok=falseを返します。
+func (h *ChunkHandler) completeUpload(w http.ResponseWriter, r *http.Request, user *models.User, uploadID string) (*storage.SavedFile, scanner.Outcome, bool) {
+	var (
+		received *storage.SavedFile
+		ruleErr  error
+		scanErr  error
+		outcome  scanner.Outcome
+	)
+	savedFile, err := h.uploadManager.CompleteUpload(uploadID, user.ID, func(session *models.UploadSession, tempPath string) error {
+		received = &storage.SavedFile{
+			Filename: session.Filename,
+			Path:     filepath.Join(session.Directory, session.Filename),
+			Size:     session.TotalSize,
+		}
+		// 内容から判定した種類が制限に合わなければ、保存名へ移さずに破棄する。
+		rules := filetype.For(h.config, session.Directory)
+		if ruleErr = rules.CheckSize(session.TotalSize); ruleErr == nil {
+			ruleErr = rules.CheckFile(tempPath)
+		}
+		if ruleErr != nil {
+			return ruleErr
+		}
+		if outcome, scanErr = inspect(r.Context(), h.scanManager, session.Directory, session.Filename, tempPath, user); scanErr != nil {
+			return scanErr
+		}
+		if outcome.Quarantined {
+			return errQuarantined
+		}
+		return nil
 	})
+	switch {
+	case err == nil:
+	case ruleErr != nil:
+		slog.InfoContext(r.Context(), "ディレクトリの制限によりアップロードを拒否しました", "upload_id", uploadID, "path", received.Path, "error", ruleErr)
+		h.broadcastFinished(user, uploadID, received, storage.UploadFailed)
+		writeFileRuleError(w, ruleErr)
+		return nil, outcome, false
+	case scanErr != nil:
+		slog.ErrorContext(r.Context(), "ファイルの検査エラー", "upload_id", uploadID, "path", received.Path, "error", scanErr)
+		h.broadcastFinished(user, uploadID, received, storage.UploadFailed)
+		http.Error(w, "ファイルを隔離できなかったため保存しませんでした", http.StatusInternalServerError)
+		return nil, outcome, false
+	case outcome.Quarantined:
+		h.broadcastFinished(user, uploadID, received, storage.UploadFailed)
+		message, code := quarantineError(outcome)
+		http.Error(w, message, code)
+		return nil, outcome, false
+	default:
+		slog.ErrorContext(r.Context(), "アップロード完了エラー", "upload_id", uploadID, "error", err)
+		writeChunkError(w, err)
+		return nil, outcome, false
+	}
+
+	directory := filepath.Dir(savedFile.Path)
+
+	// メタデータ保存の失敗は完了を失敗させない（本体は保存済み）。
+	if err := h.storageManager.SaveFileMetadata(directory, savedFile.Filename, user.ID, user.Username); err != nil {
+		slog.WarnContext(r.Context(), "メタデータの保存に失敗しました", "error", err)
+	}
+	recordScan(r.Context(), h.scanManager, directory, savedFile.Filename, outcome)
+	h.storageManager.RemoveReplaced(context.WithoutCancel(r.Context()), savedFile)
+	h.broadcastFinished(user, uploadID, savedFile, storage.UploadCompleted)
+	return savedFile, outcome, true
+}
+
+// broadcastFinished は確定したセッションの結果（completed / failed）を進捗イベントで通知し、
+// 保存できた場合は通常のアップロードと同じ file_upload イベントも送ります。
+// 確定後の拒否・隔離ではセッションが残らないため、見ている側の進捗表示を終わらせるのに必要です。
+func (h *ChunkHandler) broadcastFinished(user *models.User, uploadID string, saved *storage.SavedFile, state string) {
+	if h.sseHandler == nil {
+		return
+	}
+	directory := filepath.Dir(saved.Path)
+	h.sseHandler.BroadcastUploadProgress(storage.UploadEvent{
+		UploadID:     uploadID,
+		UserID:       user.ID,
+		Directory:    directory,
+		Filename:     saved.Filename,
+		State:        state,
+		TotalSize:    saved.Size,
+		ReceivedSize: saved.Size,
+		Percent:      100,
+	}, user.Username)
+	if state == storage.UploadCompleted {
+		h.sseHandler.BroadcastFileUpload(user, directory, saved.Filename, saved.Size)
+	}
 }
 
 // CancelChunkUpload は進行中のチャンク分割アップロードを中止し、一時ファイルをクリーンアップします。
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChunkChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("chunk"))
+
+	r := httptest.NewRequest("POST", "/", nil)
+	if got, err := chunkChecksum(r); got != nil || err != nil {
+		t.Errorf("ヘッダー無し: (%x, %v)", got, err)
+	}
+
+	r.Header.Set("X-Chunk-SHA256", hex.EncodeToString(sum[:]))
+	if got, err := chunkChecksum(r); err != nil || string(got) != string(sum[:]) {
+		t.Errorf("X-Chunk-SHA256: (%x, %v)", got, err)
+	}
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Digest", "md5=AAAA, SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	if got, err := chunkChecksum(r); err != nil || string(got) != string(sum[:]) {
+		t.Errorf("Digest: (%x, %v)", got, err)
+	}
+
+	r.Header.Set("X-Chunk-SHA256", "abcd")
+	if _, err := chunkChecksum(r); err == nil {
+		t.Error("長さの足りない X-Chunk-SHA256 でエラーにならない")
+	}
+}
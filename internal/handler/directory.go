@@ -0,0 +1,254 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルは管理者によるトップレベルのディレクトリと付与（grants）の変更を扱います。
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sync"
+
+	"fileserver/internal/config"
+	"fileserver/internal/dirstore"
+	"fileserver/internal/logging"
+	"fileserver/internal/permission"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DirectoryHandler はディレクトリと付与の一覧・変更・削除を処理します（管理者用）。
+// 変更はデータベースへ保存したうえで設定を差し替え、再起動なしに権限チェックへ反映します。
+type DirectoryHandler struct {
+	config            *config.Config
+	store             *dirstore.Store
+	storageManager    *storage.Manager
+	permissionChecker *permission.Checker
+	sseHandler        *SSEHandler
+
+	mu sync.Mutex // 変更を直列化する（差し替え前後の権限の比較が他の変更と混ざらないように）
+}
+
+// NewDirectoryHandler は新しいディレクトリ管理ハンドラーを作成します。
+func NewDirectoryHandler(cfg *config.Config, store *dirstore.Store, sm *storage.Manager, pc *permission.Checker) *DirectoryHandler {
+	return &DirectoryHandler{
+		config:            cfg,
+		store:             store,
+		storageManager:    sm,
+		permissionChecker: pc,
+	}
+}
+
+// SetSSEHandler は変更の影響を受けるユーザーへ権限の更新を通知するSSEハンドラーを設定します。
+func (h *DirectoryHandler) SetSSEHandler(sse *SSEHandler) {
+	h.sseHandler = sse
+}
+
+// directoryDefinition はAPIで扱うディレクトリの定義です（種類・付与・subdirectories）。
+// ファイルの種類の制限・retention 等の設定は config.yaml で管理し、APIでは変更しません。
+type directoryDefinition struct {
+	Path           string                      `json:"path"`
+	Type           string                      `json:"type,omitempty"`
+	Grants         []config.GrantConfig        `json:"grants"`
+	Subdirectories []config.SubdirectoryConfig `json:"subdirectories"`
+}
+
+func newDirectoryDefinition(d config.DirectoryConfig) directoryDefinition {
+	def := directoryDefinition{Path: d.Path, Type: d.Type, Grants: d.Grants, Subdirectories: d.Subdirectories}
+	if def.Grants == nil {
+		def.Grants = []config.GrantConfig{}
+	}
+	if def.Subdirectories == nil {
+		def.Subdirectories = []config.SubdirectoryConfig{}
+	}
+	return def
+}
+
+// ListDirectories は現在のディレクトリと付与の一覧を返します。
+func (h *DirectoryHandler) ListDirectories(w http.ResponseWriter, _ *http.Request) {
+	dirs := h.config.Directories()
+	defs := make([]directoryDefinition, 0, len(dirs))
+	for _, d := range dirs {
+		defs = append(defs, newDirectoryDefinition(d))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"directories": defs,
+	})
+}
+
+// PutDirectory はディレクトリの付与と subdirectories を置き換えます。存在しないディレクトリは作成して一覧の末尾に加えます。
+// type は作成時にだけ指定でき、既存のディレクトリの type は変更できません。user_private のディレクトリは変更できません。
+func (h *DirectoryHandler) PutDirectory(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	path, err := url.PathUnescape(chi.URLParam(r, "directory"))
+	if err != nil {
+		http.Error(w, "無効なディレクトリパスです", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Type           string                      `json:"type"`
+		Grants         []config.GrantConfig        `json:"grants"`
+		Subdirectories []config.SubdirectoryConfig `json:"subdirectories"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dirs := h.config.Directories()
+	i := slices.IndexFunc(dirs, func(d config.DirectoryConfig) bool { return d.Path == path })
+	d := config.DirectoryConfig{Path: path, Type: req.Type}
+	if i >= 0 {
+		if dirs[i].Type == "user_private" {
+			http.Error(w, "user_private のディレクトリは変更できません", http.StatusBadRequest)
+			return
+		}
+		if req.Type != "" && req.Type != dirs[i].Type {
+			http.Error(w, "既存のディレクトリの type は変更できません", http.StatusBadRequest)
+			return
+		}
+		d = dirs[i]
+	}
+	d.Grants, d.Subdirectories = req.Grants, req.Subdirectories
+	if err := d.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 実体を先に作っておき、作れない場合は定義も変えない。
+	if err := h.storageManager.InitializeDirectory(d); err != nil {
+		slog.ErrorContext(r.Context(), "ディレクトリ作成エラー", "error", err)
+		http.Error(w, "ディレクトリの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	next := slices.Clone(dirs)
+	if i >= 0 {
+		next[i] = d
+	} else {
+		next = append(next, d)
+	}
+	if err := h.replace(r.Context(), next, func() error { return h.store.Put(r.Context(), d, user.ID) }); err != nil {
+		slog.ErrorContext(r.Context(), "ディレクトリ定義保存エラー", "error", err)
+		http.Error(w, "ディレクトリの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	logging.Audit(r.Context(), "directory_updated", "directory", path, "created", i < 0,
+		"grants", len(d.Grants), "subdirectories", len(d.Subdirectories), "actor", user.ID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"directory": newDirectoryDefinition(d),
+	})
+}
+
+// DeleteDirectory はディレクトリの定義を削除します。ディレクトリ内のファイルは削除しません。
+// user_private のディレクトリと、最後の1つのディレクトリは削除できません。
+func (h *DirectoryHandler) DeleteDirectory(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	path, err := url.PathUnescape(chi.URLParam(r, "directory"))
+	if err != nil {
+		http.Error(w, "無効なディレクトリパスです", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dirs := h.config.Directories()
+	i := slices.IndexFunc(dirs, func(d config.DirectoryConfig) bool { return d.Path == path })
+	switch {
+	case i < 0:
+		http.Error(w, dirstore.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	case dirs[i].Type == "user_private":
+		http.Error(w, "user_private のディレクトリは削除できません", http.StatusBadRequest)
+		return
+	case len(dirs) == 1:
+		http.Error(w, "最後のディレクトリは削除できません", http.StatusConflict)
+		return
+	}
+
+	next := slices.Delete(slices.Clone(dirs), i, i+1)
+	err = h.replace(r.Context(), next, func() error { return h.store.Delete(r.Context(), path, user.ID) })
+	if errors.Is(err, dirstore.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ディレクトリ定義削除エラー", "error", err)
+		http.Error(w, "ディレクトリの削除に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	logging.Audit(r.Context(), "directory_deleted", "directory", path, "actor", user.ID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"directory": path,
+	})
+}
+
+// accessState はあるユーザーの一覧用ディレクトリと読み取りの絞り込みで、変更の前後の比較に使います。
+type accessState struct {
+	dirs   []permission.AccessibleDirectory
+	filter *permission.ReadFilter
+}
+
+func (h *DirectoryHandler) accessStates() map[string]accessState {
+	states := make(map[string]accessState)
+	if h.sseHandler == nil {
+		return states
+	}
+	for _, userID := range h.sseHandler.ConnectedUserIDs() {
+		dirs, err := h.permissionChecker.GetAccessibleDirectories(userID)
+		if err != nil {
+			continue
+		}
+		filter, err := h.permissionChecker.ReadFilterFor(userID)
+		if err != nil {
+			continue
+		}
+		states[userID] = accessState{dirs: dirs, filter: filter}
+	}
+	return states
+}
+
+// replace は persist で保存してから設定を next に差し替え、権限が変わった接続中のユーザーへ
+// SSEHandler.RefreshUserFilter で通知します。保存に失敗した場合は差し替えません。
+func (h *DirectoryHandler) replace(_ context.Context, next []config.DirectoryConfig, persist func() error) error {
+	before := h.accessStates()
+	if err := persist(); err != nil {
+		return err
+	}
+	h.config.SetDirectories(next)
+
+	if h.sseHandler == nil {
+		return nil
+	}
+	after := h.accessStates()
+	for _, userID := range h.sseHandler.ConnectedUserIDs() {
+		// 比較できなかったユーザーも、取りこぼさないよう通知する。
+		b, okBefore := before[userID]
+		a, okAfter := after[userID]
+		if !okBefore || !okAfter || !reflect.DeepEqual(a, b) {
+			h.sseHandler.RefreshUserFilter(userID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/dirstore"
+	"fileserver/internal/permission"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 付与の変更・ディレクトリの追加と削除が再起動なしに権限チェックへ反映され、
+// user_private と最後のディレクトリは変更・削除できないこと。
+func TestDirectoryHandler(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath: filepath.Join(dir, "uploads"),
+		Directories: []config.DirectoryConfig{
+			{Path: "team", Grants: []config.GrantConfig{{User: "u1", Permissions: []string{"read"}}}},
+			{Path: "private", Type: "user_private"},
+		},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store := dirstore.New(db)
+	dirs, err := store.Load(t.Context(), cfg.Directories())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetDirectories(dirs)
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	pc := permission.NewChecker(cfg, &memberProvider{members: map[string]bool{"u1": true, "u2": true}}, sm, db)
+	h := NewDirectoryHandler(cfg, store, sm, pc)
+
+	r := chi.NewRouter()
+	r.Put("/api/admin/directories/{directory}", h.PutDirectory)
+	r.Delete("/api/admin/directories/{directory}", h.DeleteDirectory)
+
+	if rec := doAs(r, "admin", http.MethodPut, "/api/admin/directories/team", `{"grants":[{"user":"u2","permissions":["read","write"]}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("付与の変更: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range []struct {
+		user, perm string
+		want       bool
+	}{
+		{"u1", "read", false},
+		{"u2", "read", true},
+		{"u2", "write", true},
+	} {
+		if got, err := pc.CheckPermission(c.user, "team", c.perm); err != nil || got != c.want {
+			t.Errorf("CheckPermission(%s, team, %s) = %v, %v, want %v", c.user, c.perm, got, err, c.want)
+		}
+	}
+
+	if rec := doAs(r, "admin", http.MethodPut, "/api/admin/directories/new", `{"grants":[{"user":"u1","permissions":["read"]}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("追加: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got, err := pc.CheckPermission("u1", "new", "read"); err != nil || !got {
+		t.Errorf("追加したディレクトリ: %v, %v", got, err)
+	}
+	if saved, err := store.Load(t.Context(), nil); err != nil || len(saved) != 3 {
+		t.Errorf("保存された定義 = %+v, %v", saved, err)
+	}
+
+	for _, c := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPut, "/api/admin/directories/private", `{"grants":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/admin/directories/..", `{"grants":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/admin/directories/team", `{"subdirectories":[{"path":"../x"}]}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/admin/directories/team", `{"type":"user_private","grants":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/admin/directories/typo", `{"type":"user-private","grants":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/admin/directories/people", `{"type":"user_private","grants":[]}`, http.StatusOK},
+		{http.MethodDelete, "/api/admin/directories/private", "", http.StatusBadRequest},
+		{http.MethodDelete, "/api/admin/directories/missing", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/admin/directories/new", "", http.StatusOK},
+	} {
+		if rec := doAs(r, "admin", c.method, c.target, c.body); rec.Code != c.want {
+			t.Errorf("%s %s: status = %d, want %d (%s)", c.method, c.target, rec.Code, c.want, rec.Body.String())
+		}
+	}
+	if d := cfg.GetDirectoryConfig("new"); d != nil {
+		t.Errorf("削除後も設定に残っている: %+v", d)
+	}
+	if d := cfg.GetDirectoryConfig("people"); d == nil || d.Type != "user_private" {
+		t.Errorf("type を指定して作成したディレクトリ = %+v", d)
+	}
+	if d := cfg.GetDirectoryConfig("typo"); d != nil {
+		t.Errorf("不正な type で作成された: %+v", d)
+	}
+
+	cfg.SetDirectories(cfg.Directories()[:1])
+	if rec := doAs(r, "admin", http.MethodDelete, "/api/admin/directories/team", ""); rec.Code != http.StatusConflict {
+		t.Errorf("最後のディレクトリの削除: status = %d, want 409", rec.Code)
+	}
+}
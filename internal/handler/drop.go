@@ -0,0 +1,576 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルはログインできない人からファイルを受け取るアップロードリンクを扱います。
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/config"
+	"fileserver/internal/filetype"
+	"fileserver/internal/models"
+	"fileserver/internal/share"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxDropLabelLength はアップロードリンクの説明の最大文字数です。
+const maxDropLabelLength = 200
+
+// dropContextKey は Resolve が解決したアップロードリンクをコンテキストに格納するキーです。
+type dropContextKey struct{}
+
+// DropHandler はアップロードリンクの作成・一覧・取り消しと、/d/{token} でのアップロードの受け付けを処理します。
+// 訪問者に許すのはアップロードだけで、アップロード先の一覧やファイルのダウンロードは提供しません。
+// 受信・確定・スキャン・通知はチャンクアップロードと共通にするため、ChunkHandler を通して行います。
+type DropHandler struct {
+	config   *config.Config
+	db       *sql.DB
+	store    *share.Store
+	chunk    *ChunkHandler
+	provider authprovider.Provider
+	pageTmpl *template.Template
+}
+
+// NewDropHandler は新しいアップロードリンクハンドラーを作成します。
+// pageTmpl は起動時に一度だけパースしたアップロードページのテンプレートです。
+func NewDropHandler(cfg *config.Config, db *sql.DB, store *share.Store, chunk *ChunkHandler,
+	provider authprovider.Provider, pageTmpl *template.Template) *DropHandler {
+	return &DropHandler{
+		config:   cfg,
+		db:       db,
+		store:    store,
+		chunk:    chunk,
+		provider: provider,
+		pageTmpl: pageTmpl,
+	}
+}
+
+// dropLinkResponse はAPIレスポンス用のアップロードリンクです。
+type dropLinkResponse struct {
+	*share.Drop
+	URL string `json:"url"`
+}
+
+func newDropLinkResponses(drops []*share.Drop) []dropLinkResponse {
+	resp := make([]dropLinkResponse, 0, len(drops))
+	for _, drop := range drops {
+		resp = append(resp, dropLinkResponse{Drop: drop, URL: "/d/" + drop.Token})
+	}
+	return resp
+}
+
+// CreateDrop はアップロードリンクを作成します。アップロード先の書き込み権限が必要です。
+// expires_in の扱いは共有リンクと同じで、省略した場合は share.max_expiry の期間、max_expiry を超える期間は400です。
+func (h *DropHandler) CreateDrop(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Directory string `json:"directory"`
+		Label     string `json:"label"`
+		ExpiresIn string `json:"expires_in"` // "24h" 等。空は max_expiry
+		MaxBytes  int64  `json:"max_bytes"`
+		MaxFiles  int    `json:"max_files"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.Directory == "" {
+		http.Error(w, "ディレクトリが指定されていません", http.StatusBadRequest)
+		return
+	}
+	req.Directory, ok = cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+	if req.MaxBytes < 0 || req.MaxFiles < 0 {
+		http.Error(w, "max_bytes・max_files に負の値は指定できません", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Label) > maxDropLabelLength {
+		http.Error(w, fmt.Sprintf("label は%d文字以内で指定してください", maxDropLabelLength), http.StatusBadRequest)
+		return
+	}
+
+	ttl := h.config.Share.MaxExpiry
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in が不正です（例: 24h）", http.StatusBadRequest)
+			return
+		}
+		if h.config.Share.MaxExpiry > 0 && d > h.config.Share.MaxExpiry {
+			http.Error(w, "expires_in が有効期間の上限（"+h.config.Share.MaxExpiry.String()+"）を超えています", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	hasPermission, err := h.chunk.permissionChecker.CheckPermission(user.ID, req.Directory, "write")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !hasPermission {
+		http.Error(w, "書き込み権限がありません", http.StatusForbidden)
+		return
+	}
+
+	// #nosec G703 - directory は cleanDir で ".." を除去済み
+	info, err := os.Stat(filepath.Join(h.config.Storage.UploadPath, req.Directory))
+	if err != nil || !info.IsDir() {
+		http.Error(w, "アップロード先のディレクトリが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	drop, err := h.store.CreateDrop(r.Context(), share.DropParams{
+		Directory: req.Directory,
+		Label:     req.Label,
+		CreatedBy: user.ID,
+		TTL:       ttl,
+		MaxBytes:  req.MaxBytes,
+		MaxFiles:  req.MaxFiles,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "アップロードリンク作成エラー", "error", err)
+		http.Error(w, "アップロードリンクの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	drop.CreatedByName = user.Username
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"drop":    dropLinkResponse{Drop: drop, URL: "/d/" + drop.Token},
+	})
+}
+
+// ListDrops は自分が作成したアップロードリンクを新しい順に返します。
+func (h *DropHandler) ListDrops(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	h.writeDrops(w, r, user.ID)
+}
+
+// AdminListDrops は全員のアップロードリンクを新しい順に返します（管理者用）。
+func (h *DropHandler) AdminListDrops(w http.ResponseWriter, r *http.Request) {
+	h.writeDrops(w, r, "")
+}
+
+func (h *DropHandler) writeDrops(w http.ResponseWriter, r *http.Request, createdBy string) {
+	drops, err := h.store.ListDrops(r.Context(), createdBy)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "アップロードリンク一覧取得エラー", "error", err)
+		http.Error(w, "アップロードリンクの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"drops":   newDropLinkResponses(drops),
+	})
+}
+
+// RevokeDrop は自分が作成したアップロードリンクを取り消します。
+func (h *DropHandler) RevokeDrop(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	token := chi.URLParam(r, "token")
+	drop, err := h.store.GetDrop(r.Context(), token)
+	// 他人のリンクは存在を明かさないよう、存在しない場合と同じ404にする。
+	if errors.Is(err, share.ErrNotFound) || (err == nil && drop.CreatedBy != user.ID) {
+		http.Error(w, "アップロードリンクが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "アップロードリンク取得エラー", "error", err)
+		http.Error(w, "アップロードリンクの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	h.revoke(w, r, token, user.ID)
+}
+
+// AdminRevokeDrop は任意のアップロードリンクを取り消します（管理者用）。
+func (h *DropHandler) AdminRevokeDrop(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	h.revoke(w, r, chi.URLParam(r, "token"), user.ID)
+}
+
+func (h *DropHandler) revoke(w http.ResponseWriter, r *http.Request, token, actor string) {
+	if err := h.store.RevokeDrop(r.Context(), token, actor); err != nil {
+		switch {
+		case errors.Is(err, share.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, share.ErrRevoked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			slog.ErrorContext(r.Context(), "アップロードリンク取り消しエラー", "error", err)
+			http.Error(w, "アップロードリンクの取り消しに失敗しました", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"token":   token,
+	})
+}
+
+// Resolve は /d/{token} のアップロードリンクを検証するミドルウェアです（認証不要のルートに付けます）。
+// 存在しないリンクは404、期限切れ・取り消し済み・上限に達したリンクと、作成者が在籍や書き込み権限を
+// 失ったリンクは410を返します。通ったリクエストには作成者をユーザーとして格納し、
+// アップロードの記録・通知と転送量・帯域の上限を作成者の分として扱わせます。
+func (h *DropHandler) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drop, err := h.store.GetDrop(r.Context(), chi.URLParam(r, "token"))
+		if errors.Is(err, share.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "アップロードリンク取得エラー", "error", err)
+			http.Error(w, "アップロードリンクの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if err := drop.Usable(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+
+		creator, ok := linkCreator(w, r, h.db, h.provider, h.chunk.permissionChecker, drop.CreatedBy, drop.Directory, "", "write")
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), models.UserContextKey, creator)
+		ctx = context.WithValue(ctx, dropContextKey{}, drop)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// DropPage はアップロードリンクのページを表示します。アップロード先のファイルは表示しません。
+func (h *DropHandler) DropPage(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+
+	data := map[string]interface{}{
+		"ServiceName":  h.config.Server.ServiceName,
+		"Drop":         drop,
+		"MaxFileSize":  h.config.Storage.MaxFileSize,
+		"ChunkEnabled": h.config.Storage.ChunkUploadOn(),
+		"ChunkSize":    h.config.Storage.ChunkSize,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := h.pageTmpl.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "テンプレートのレンダリングに失敗しました", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// reserve はアップロードリンクの上限から size バイト・1ファイル分を予約します。上限を超える場合は413を書き込みます。
+func (h *DropHandler) reserve(w http.ResponseWriter, r *http.Request, drop *share.Drop, size int64) (string, bool) {
+	reservation, err := h.store.Reserve(r.Context(), drop.Token, size)
+	if errors.Is(err, share.ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "アップロードの予約エラー", "error", err)
+		http.Error(w, "アップロードの受け付けに失敗しました", http.StatusInternalServerError)
+		return "", false
+	}
+	return reservation, true
+}
+
+// release は確定しなかったアップロードの予約を解放します。失敗しても予約は Prune で解放されるためログのみ行います。
+func (h *DropHandler) release(r *http.Request, reservation string) {
+	if err := h.store.Release(context.WithoutCancel(r.Context()), reservation); err != nil {
+		slog.WarnContext(r.Context(), "アップロードの予約の解放に失敗しました", "error", err)
+	}
+}
+
+// commit は保存できたアップロードをリンクの使用量に加えます。本体は保存済みのため、失敗してもログのみ行います。
+func (h *DropHandler) commit(r *http.Request, drop *share.Drop, reservation string, size int64) {
+	if err := h.store.Commit(context.WithoutCancel(r.Context()), drop.Token, reservation, size); err != nil {
+		slog.ErrorContext(r.Context(), "アップロードリンクの使用量の記録エラー", "error", err)
+	}
+}
+
+// Upload は1リクエストで送られたファイル（multipart の file）を受け取ります。
+// 訪問者は既存のファイルを見られないため、同名のファイルは常に番号を付けて両方を残します（置き換え・拒否はしない）。
+func (h *DropHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+	creator, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	const multipartOverhead = 1 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, h.config.Storage.MaxFileSize+multipartOverhead)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "ファイルの取得に失敗しました", http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			slog.ErrorContext(r.Context(), "ファイルのクローズに失敗しました", "error", closeErr)
+		}
+	}()
+	if header.Size > h.config.Storage.MaxFileSize {
+		http.Error(w, fmt.Sprintf("ファイルサイズが制限を超えています（最大: %d MB）", h.config.Storage.MaxFileSize/(1024*1024)), http.StatusBadRequest)
+		return
+	}
+
+	directory, policy, ok := h.chunk.prepareUpload(w, r, creator, header.Filename, drop.Directory, header.Size, config.ConflictRename)
+	if !ok {
+		return
+	}
+	rules := filetype.For(h.config, directory)
+	if rules.HasContentRules() {
+		if _, err := rules.CheckContent(file); err != nil {
+			writeFileRuleError(w, err)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			slog.ErrorContext(r.Context(), "ファイルの巻き戻しに失敗しました", "error", err)
+			http.Error(w, "ファイルの読み取りに失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	reservation, ok := h.reserve(w, r, drop, header.Size)
+	if !ok {
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			h.release(r, reservation)
+		}
+	}()
+
+	// 検査を終えるまで見えないよう、作業ファイルとして受信してから保存名へ移す。
+	sm := h.chunk.storageManager
+	tempPath, _, err := sm.Receive(directory, file)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファイル保存エラー", "error", err)
+		http.Error(w, "ファイルの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	outcome, ok := inspectReceived(w, r, h.chunk.scanManager, directory, header.Filename, tempPath, creator)
+	if !ok {
+		return
+	}
+	savedFile, err := sm.Place(r.Context(), tempPath, directory, header.Filename, policy)
+	if err != nil {
+		sm.RemoveReceived(tempPath)
+		slog.ErrorContext(r.Context(), "ファイル保存エラー", "error", err)
+		http.Error(w, "ファイルの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if err := sm.SaveFileMetadata(directory, savedFile.Filename, creator.ID, creator.Username); err != nil {
+		slog.WarnContext(r.Context(), "メタデータの保存に失敗しました", "error", err)
+	}
+	recordScan(r.Context(), h.chunk.scanManager, directory, savedFile.Filename, outcome)
+	h.commit(r, drop, reservation, savedFile.Size)
+	committed = true
+
+	slog.InfoContext(r.Context(), "アップロードリンクからのアップロード", "user_id", creator.ID, "filename", savedFile.Filename,
+		"directory", directory, "size", savedFile.Size, "ip", r.RemoteAddr)
+	if h.chunk.sseHandler != nil {
+		h.chunk.sseHandler.BroadcastFileUpload(creator, directory, savedFile.Filename, savedFile.Size)
+	}
+	writeDropUploaded(w, savedFile, outcome.Status)
+}
+
+// writeDropUploaded はアップロードリンクからのアップロードの結果を書き込みます。
+// アップロード先を明かさないよう、保存したパスは含めません。
+func writeDropUploaded(w http.ResponseWriter, saved *storage.SavedFile, scanStatus string) {
+	resp := map[string]interface{}{
+		"success":  true,
+		"filename": saved.Filename,
+		"size":     saved.Size,
+	}
+	if scanStatus != "" {
+		resp["scan_status"] = scanStatus
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// InitChunkUpload はアップロードリンクからのチャンクアップロードを始めます。
+// ファイル1件分を予約してからセッションを作り、以後のチャンクはこのリンクに結び付いたセッションにだけ受け付けます。
+func (h *DropHandler) InitChunkUpload(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+	creator, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Filename   string `json:"filename"`
+		FileSize   int64  `json:"file_size"`
+		ChunkSize  int64  `json:"chunk_size"`
+		FileSHA256 string `json:"file_sha256"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.Filename == "" || req.FileSize <= 0 || req.ChunkSize <= 0 {
+		http.Error(w, "必須パラメータが不足しています", http.StatusBadRequest)
+		return
+	}
+	if req.FileSize > h.config.Storage.MaxFileSize {
+		http.Error(w, fmt.Sprintf("ファイルサイズが制限を超えています（最大: %d MB）", h.config.Storage.MaxFileSize/(1024*1024)), http.StatusBadRequest)
+		return
+	}
+	if req.FileSHA256 != "" {
+		if sum, err := hex.DecodeString(req.FileSHA256); err != nil || len(sum) != sha256.Size {
+			http.Error(w, "file_sha256 が不正です（SHA-256の16進文字列で指定してください）", http.StatusBadRequest)
+			return
+		}
+	}
+
+	directory, policy, ok := h.chunk.prepareUpload(w, r, creator, req.Filename, drop.Directory, req.FileSize, config.ConflictRename)
+	if !ok {
+		return
+	}
+	reservation, ok := h.reserve(w, r, drop, req.FileSize)
+	if !ok {
+		return
+	}
+
+	totalChunks := int((req.FileSize + req.ChunkSize - 1) / req.ChunkSize)
+	session, err := h.chunk.uploadManager.CreateUploadSession(creator.ID, req.Filename, directory,
+		req.FileSize, req.ChunkSize, totalChunks, req.FileSHA256, policy)
+	if err != nil {
+		h.release(r, reservation)
+		slog.ErrorContext(r.Context(), "アップロード初期化エラー", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.store.Bind(r.Context(), reservation, session.UploadID); err != nil {
+		h.release(r, reservation)
+		if cancelErr := h.chunk.uploadManager.CancelUpload(session.UploadID, creator.ID); cancelErr != nil {
+			slog.WarnContext(r.Context(), "アップロードセッションの中止に失敗しました", "upload_id", session.UploadID, "error", cancelErr)
+		}
+		slog.ErrorContext(r.Context(), "アップロード初期化エラー", "error", err)
+		http.Error(w, "アップロードの受け付けに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "アップロードリンクからのチャンクアップロード初期化", "upload_id", session.UploadID,
+		"user_id", creator.ID, "filename", req.Filename, "directory", directory, "ip", r.RemoteAddr)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"upload_id":    session.UploadID,
+		"total_chunks": totalChunks,
+		"chunk_size":   req.ChunkSize,
+	})
+}
+
+// boundReservation は upload_id がこのリンクで始めたアップロードかを確かめ、予約IDを返します。
+// 作成者が自分で始めた他のアップロードを訪問者が操作できないよう、それ以外は404を書き込みます。
+func (h *DropHandler) boundReservation(w http.ResponseWriter, r *http.Request, drop *share.Drop) (string, string, bool) {
+	uploadID := chi.URLParam(r, "upload_id")
+	if !validUploadID(w, uploadID) {
+		return "", "", false
+	}
+	reservation, err := h.store.Reservation(r.Context(), drop.Token, uploadID)
+	if errors.Is(err, share.ErrNotFound) {
+		http.Error(w, storage.ErrSessionNotFound.Error(), http.StatusNotFound)
+		return "", "", false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "アップロードの予約の取得エラー", "error", err)
+		http.Error(w, "アップロードの確認に失敗しました", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return uploadID, reservation, true
+}
+
+// UploadChunk はアップロードリンクで始めたアップロードのチャンクを受け取ります。
+func (h *DropHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+	if _, _, ok := h.boundReservation(w, r, drop); !ok {
+		return
+	}
+	h.chunk.UploadChunk(w, r)
+}
+
+// CompleteChunkUpload はアップロードリンクで始めたアップロードを確定し、リンクの使用量に加えます。
+func (h *DropHandler) CompleteChunkUpload(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+	creator, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	uploadID, reservation, ok := h.boundReservation(w, r, drop)
+	if !ok {
+		return
+	}
+
+	savedFile, outcome, ok := h.chunk.completeUpload(w, r, creator, uploadID)
+	if !ok {
+		// チャンクの不足等でセッションが残っていれば再試行できるため、予約はセッションが消えた場合だけ解放する。
+		if _, err := h.chunk.uploadManager.GetUploadSession(uploadID); errors.Is(err, storage.ErrSessionNotFound) {
+			h.release(r, reservation)
+		}
+		return
+	}
+	h.commit(r, drop, reservation, savedFile.Size)
+
+	slog.InfoContext(r.Context(), "アップロードリンクからのアップロード", "user_id", creator.ID, "filename", savedFile.Filename,
+		"directory", filepath.Dir(savedFile.Path), "size", savedFile.Size, "ip", r.RemoteAddr)
+	writeDropUploaded(w, savedFile, outcome.Status)
+}
+
+// CancelChunkUpload はアップロードリンクで始めたアップロードを中止し、予約を解放します。
+func (h *DropHandler) CancelChunkUpload(w http.ResponseWriter, r *http.Request) {
+	drop := r.Context().Value(dropContextKey{}).(*share.Drop)
+	creator, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	uploadID, reservation, ok := h.boundReservation(w, r, drop)
+	if !ok {
+		return
+	}
+	if err := h.chunk.uploadManager.CancelUpload(uploadID, creator.ID); err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+		slog.ErrorContext(r.Context(), "アップロードキャンセルエラー", "upload_id", uploadID, "error", err)
+		writeChunkError(w, err)
+		return
+	}
+	h.release(r, reservation)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "アップロードをキャンセルしました",
+	})
+}
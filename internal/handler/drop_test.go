@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/share"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newDropTestRouter は全員が書き込める inbox を用意し、/d/{token} でアップロードを受け付けるルーターを作ります。
+func newDropTestRouter(t *testing.T) (*DropHandler, *config.Config, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath:           filepath.Join(dir, "uploads"),
+		MaxFileSize:          1 << 20,
+		MaxChunkFileSize:     1 << 20,
+		MaxConcurrentUploads: 10,
+		UploadSessionTTL:     time.Hour,
+		ChunkSize:            4,
+		Directories: []config.DirectoryConfig{{
+			Path:   "inbox",
+			Grants: []config.GrantConfig{{Role: "*", Permissions: []string{"read", "write"}}},
+		}},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', 'u1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadPath, "inbox", "secret.txt"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &memberProvider{members: map[string]bool{"u1": true}}
+	pc := permission.NewChecker(cfg, provider, sm, db)
+	chunk := NewChunkHandler(cfg, sm, storage.NewUploadManager(cfg, db), pc)
+	tmpl := template.Must(template.New("drop").Parse(`{{.Drop.CreatedByName}}`))
+	h := NewDropHandler(cfg, db, share.New(db), chunk, provider, tmpl)
+
+	r := chi.NewRouter()
+	r.Route("/d/{token}", func(r chi.Router) {
+		r.Use(h.Resolve)
+		r.Get("/", h.DropPage)
+		r.Post("/", h.Upload)
+		r.Post("/chunk/init", h.InitChunkUpload)
+		r.Post("/chunk/upload/{upload_id}", h.UploadChunk)
+		r.Post("/chunk/complete/{upload_id}", h.CompleteChunkUpload)
+		r.Delete("/chunk/cancel/{upload_id}", h.CancelChunkUpload)
+	})
+	return h, cfg, r
+}
+
+// createTestDrop は alice としてアップロードリンクを作成し、そのトークンを返します。
+func createTestDrop(t *testing.T, h *DropHandler, body string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/drops", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	rec := httptest.NewRecorder()
+	h.CreateDrop(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("作成: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Drop struct {
+			Token string `json:"token"`
+			URL   string `json:"url"`
+		} `json:"drop"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Drop.URL != "/d/"+resp.Drop.Token {
+		t.Errorf("url = %q", resp.Drop.URL)
+	}
+	return resp.Drop.Token
+}
+
+func postDropFile(router http.Handler, token, filename, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", filename) //nolint:errcheck // bytes.Buffer への書き込みは失敗しない
+	fw.Write([]byte(content))                    //nolint:errcheck // 同上
+	mw.Close()                                   //nolint:errcheck // 同上
+	req := httptest.NewRequest(http.MethodPost, "/d/"+token+"/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func sendDrop(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// アップロードは作成者の名義で保存し、同名のファイルは置き換えずに残すこと。
+// ファイル数の上限を超えるアップロードは413、上限に達したリンクは410を返すこと。
+func TestDropUploadLimit(t *testing.T) {
+	h, cfg, router := newDropTestRouter(t)
+	token := createTestDrop(t, h, `{"directory":"inbox","max_files":2}`)
+
+	if rec := sendDrop(router, http.MethodGet, "/d/"+token+"/", ""); rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+		t.Fatalf("ページ: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	rec := postDropFile(router, token, "secret.txt", "from outside")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "inbox") {
+		t.Fatalf("アップロード: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := os.ReadFile(filepath.Join(cfg.Storage.UploadPath, "inbox", "secret.txt")); string(got) != "secret" { //nolint:errcheck // 内容の比較で判定する
+		t.Errorf("既存のファイルが置き換えられた: %q", got)
+	}
+
+	// 受信中の予約も上限に含めるため、チャンクアップロードを始めた時点で2件目になる。
+	rec = sendDrop(router, http.MethodPost, "/d/"+token+"/chunk/init", `{"filename":"b.txt","file_size":6,"chunk_size":4}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("チャンクの初期化: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if rec := postDropFile(router, token, "c.txt", "over"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("上限を超えるアップロード: status = %d, want 413", rec.Code)
+	}
+
+	var started struct {
+		UploadID string `json:"upload_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range []string{"chun", "ks"} {
+		path := "/d/" + token + "/chunk/upload/" + started.UploadID + "?chunk_index=" + string(rune('0'+i))
+		if rec := sendDrop(router, http.MethodPost, path, part); rec.Code != http.StatusOK {
+			t.Fatalf("チャンク %d: status = %d, body = %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec = sendDrop(router, http.MethodPost, "/d/"+token+"/chunk/complete/"+started.UploadID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("完了: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var completed struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &completed); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := h.chunk.storageManager.Metadata("inbox", completed.Filename)
+	if err != nil || meta.UploaderID != "u1" {
+		t.Errorf("メタデータ = %+v, %v", meta, err)
+	}
+	if rec := sendDrop(router, http.MethodGet, "/d/"+token+"/", ""); rec.Code != http.StatusGone {
+		t.Errorf("上限に達したリンク: status = %d, want 410", rec.Code)
+	}
+}
+
+// 作成者が自分で始めたアップロードは、アップロードリンクからは操作できないこと。
+func TestDropRejectsForeignUpload(t *testing.T) {
+	h, _, router := newDropTestRouter(t)
+	token := createTestDrop(t, h, `{"directory":"inbox"}`)
+
+	session, err := h.chunk.uploadManager.CreateUploadSession("u1", "own.txt", "inbox", 4, 4, 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := sendDrop(router, http.MethodPost, "/d/"+token+"/chunk/upload/"+session.UploadID+"?chunk_index=0", "data"); rec.Code != http.StatusNotFound {
+		t.Errorf("チャンク: status = %d, want 404", rec.Code)
+	}
+	if rec := sendDrop(router, http.MethodDelete, "/d/"+token+"/chunk/cancel/"+session.UploadID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("中止: status = %d, want 404", rec.Code)
+	}
+	if _, err := h.chunk.uploadManager.GetUploadSession(session.UploadID); err != nil {
+		t.Errorf("作成者のセッションが消えた: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルはURLを指定したサーバー側での取り込み（/files/fetch）のハンドラーを含みます。
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/fetcher"
+	"fileserver/internal/filetype"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// SetFetcher はURLからの取り込みを実行するマネージャーを設定します。
+func (h *FileHandler) SetFetcher(f *fetcher.Manager) {
+	h.fetcher = f
+}
+
+// FetchURL はURLからディレクトリへの取り込みジョブを開始し、202でジョブを返します。
+// 取得はバックグラウンドで行い、進捗は SSE の fetch_progress イベントで本人にのみ通知します。
+func (h *FileHandler) FetchURL(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL       string `json:"url"`
+		Directory string `json:"directory"`
+		Filename  string `json:"filename"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" || req.Directory == "" {
+		http.Error(w, "必須パラメータが不足しています", http.StatusBadRequest)
+		return
+	}
+
+	directory, ok := cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+
+	hasPermission, err := h.permissionChecker.CheckPermission(user.ID, directory, "write")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !hasPermission {
+		http.Error(w, "書き込み権限がありません", http.StatusForbidden)
+		return
+	}
+
+	if strings.HasPrefix(directory, "user/") {
+		if ensureErr := h.storageManager.EnsureUserDirectory(user.GetDirectoryName()); ensureErr != nil {
+			slog.ErrorContext(r.Context(), "ユーザーディレクトリ作成エラー", "error", ensureErr)
+			http.Error(w, "ユーザーディレクトリの作成に失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 取り込む量はアップロードと同じく転送量に数える（使い切っている場合は Allowance ミドルウェアが拒否済み）。
+	job, err := h.fetcher.Start(user, req.URL, directory, req.Filename, allowance.FromContext(r.Context()))
+	switch {
+	case err == nil:
+	case errors.Is(err, filetype.ErrTypeNotAllowed):
+		writeFileRuleError(w, err)
+		return
+	case errors.Is(err, fetcher.ErrInvalidURL),
+		errors.Is(err, fetcher.ErrInvalidFilename),
+		errors.Is(err, storage.ErrMaxConcurrentUploads):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		slog.ErrorContext(r.Context(), "取り込み開始エラー", "error", err)
+		http.Error(w, "取り込みの開始に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GetFetchJob は自分が開始した取り込みジョブの状態を返します。
+func (h *FileHandler) GetFetchJob(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.fetcher.Get(chi.URLParam(r, "job_id"), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
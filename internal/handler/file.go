@@ -3,6 +3,8 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -12,8 +14,12 @@ import (
 	"strconv"
 	"strings"
 
+	"fileserver/internal/allowance"
 	"fileserver/internal/config"
+	"fileserver/internal/fetcher"
+	"fileserver/internal/filetype"
 	"fileserver/internal/permission"
+	"fileserver/internal/scanner"
 	"fileserver/internal/storage"
 )
 
@@ -24,6 +30,8 @@ type FileHandler struct {
 	uploadManager     *storage.UploadManager
 	permissionChecker *permission.Checker
 	sseHandler        *SSEHandler
+	scanManager       *scanner.Manager
+	fetcher           *fetcher.Manager
 }
 
 // NewFileHandler は指定された依存関係で新しいファイルハンドラーを作成します。
@@ -41,6 +49,11 @@ func (h *FileHandler) SetSSEHandler(sse *SSEHandler) {
 	h.sseHandler = sse
 }
 
+// SetScanManager はアップロード直後にファイルを検査するスキャンマネージャーを設定します。
+func (h *FileHandler) SetScanManager(sm *scanner.Manager) {
+	h.scanManager = sm
+}
+
 // Upload は設定された最大ファイルサイズまでの通常のファイルアップロードを処理します。
 // 権限を検証し、ファイルを保存し、SSE経由でアップロードイベントをブロードキャストします。
 func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
@@ -101,7 +114,53 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	savedFile, err := h.storageManager.SaveFile(file, header.Filename, directory)
+	// ディレクトリごとの制限。種類はクライアントの Content-Type ではなく内容の先頭から判定する。
+	rules := filetype.For(h.config, directory)
+	if err := rules.CheckName(header.Filename); err != nil {
+		writeFileRuleError(w, err)
+		return
+	}
+	if err := rules.CheckSize(header.Size); err != nil {
+		writeFileRuleError(w, err)
+		return
+	}
+	policy, ok := resolveConflictPolicy(w, r, h.config, h.storageManager, h.permissionChecker, user.ID, directory, header.Filename, r.FormValue("on_conflict"))
+	if !ok {
+		return
+	}
+	if rules.HasContentRules() {
+		if _, err := rules.CheckContent(file); err != nil {
+			writeFileRuleError(w, err)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			slog.ErrorContext(r.Context(), "ファイルの巻き戻しに失敗しました", "error", err)
+			http.Error(w, "ファイルの読み取りに失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 検査を終えるまで一覧・ダウンロードから見えないよう、作業ファイルとして受信してから保存名へ移す。
+	tempPath, _, err := h.storageManager.Receive(directory, file)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファイル保存エラー", "error", err)
+		http.Error(w, "ファイルの保存に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	// 隔離したファイルは公開しないため、アップロードイベントも流さない。
+	outcome, ok := inspectReceived(w, r, h.scanManager, directory, header.Filename, tempPath, user)
+	if !ok {
+		return
+	}
+
+	savedFile, err := h.storageManager.Place(r.Context(), tempPath, directory, header.Filename, policy)
+	if err != nil {
+		h.storageManager.RemoveReceived(tempPath)
+	}
+	if errors.Is(err, storage.ErrNameConflict) || errors.Is(err, storage.ErrRetained) || errors.Is(err, storage.ErrLegalHold) {
+		writeConflictError(w, r, err)
+		return
+	}
 	if err != nil {
 		slog.ErrorContext(r.Context(), "ファイル保存エラー", "error", err)
 		http.Error(w, "ファイルの保存に失敗しました", http.StatusInternalServerError)
@@ -112,6 +171,9 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	if err := h.storageManager.SaveFileMetadata(directory, savedFile.Filename, user.ID, user.Username); err != nil {
 		slog.WarnContext(r.Context(), "メタデータの保存に失敗しました", "error", err)
 	}
+	recordScan(r.Context(), h.scanManager, directory, savedFile.Filename, outcome)
+	// 置き換えは新しいファイルが検査を通ってから行う（隔離した場合は既存ファイルを残す）。
+	h.storageManager.RemoveReplaced(context.WithoutCancel(r.Context()), savedFile)
 
 	slog.InfoContext(r.Context(), "ファイルアップロード成功", "user_id", user.ID, "filename", header.Filename, "directory", directory, "size", header.Size)
 
@@ -119,12 +181,16 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		h.sseHandler.BroadcastFileUpload(user, directory, savedFile.Filename, savedFile.Size)
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	resp := map[string]interface{}{
 		"success":  true,
 		"filename": savedFile.Filename,
 		"size":     savedFile.Size,
 		"path":     savedFile.Path,
-	})
+	}
+	if outcome.Status != "" {
+		resp["scan_status"] = outcome.Status
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // ListFiles は指定されたディレクトリ内のファイル一覧を返します。
@@ -184,7 +250,8 @@ func (h *FileHandler) Download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hasPermission, err := h.permissionChecker.CheckPermission(user.ID, directory, "read")
+	// ファイル単位でメンバー共有されたものも読めるよう、ファイル名込みで確認する。
+	hasPermission, err := h.permissionChecker.CheckFilePermission(user.ID, directory, filename, "read")
 	if err != nil {
 		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
 		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
@@ -196,63 +263,13 @@ func (h *FileHandler) Download(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filePath := filepath.Join(h.config.Storage.UploadPath, directory, filename)
-
-	// #nosec G703 - directory/filename は decodePathParams で ".." を除去済み
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "ファイルが見つかりません", http.StatusNotFound)
-			return
-		}
-		slog.ErrorContext(r.Context(), "ファイル情報取得エラー", "error", err)
-		http.Error(w, "ファイル情報の取得に失敗しました", http.StatusInternalServerError)
-		return
+	// 転送量の上限は実際に送る部分の大きさで判定する。
+	admit := func(w http.ResponseWriter, _, length int64) bool {
+		return allowance.FromContext(r.Context()).Allow(w, length)
 	}
-
-	// #nosec G304,G703 - filePath は decodePathParams で検証済みの入力から構築される
-	file, err := os.Open(filePath)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "ファイルオープンエラー", "error", err)
-		http.Error(w, "ファイルのオープンに失敗しました", http.StatusInternalServerError)
+	if !serveFile(w, r, filePath, filename, admit) {
 		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			slog.ErrorContext(r.Context(), "ファイルのクローズに失敗しました", "error", err)
-		}
-	}()
-
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", contentDispositionAttachment(filename))
-
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		// 単一レンジのみ対応する（複数レンジ/multipartは未サポート）。
-		ranges, err := parseRange(rangeHeader, fileInfo.Size())
-		if err != nil || len(ranges) != 1 {
-			http.Error(w, "無効なRangeヘッダーです", http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-
-		start, end := ranges[0][0], ranges[0][1]
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileInfo.Size()))
-		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
-		w.WriteHeader(http.StatusPartialContent)
-
-		if _, err := file.Seek(start, 0); err != nil {
-			slog.ErrorContext(r.Context(), "ファイルシークに失敗しました", "error", err)
-			return
-		}
-		if _, err := io.CopyN(w, file, end-start+1); err != nil {
-			slog.ErrorContext(r.Context(), "ファイル転送に失敗しました", "error", err)
-		}
-	} else {
-		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
-		if _, err := io.Copy(w, file); err != nil {
-			slog.ErrorContext(r.Context(), "ファイル転送に失敗しました", "error", err)
-		}
-	}
 
 	slog.InfoContext(r.Context(), "ファイルダウンロード", "user_id", user.ID, "filename", filename, "directory", directory)
 
@@ -285,7 +302,11 @@ func (h *FileHandler) DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.storageManager.DeleteFile(directory, filename); err != nil {
+	if err := h.storageManager.DeleteFile(r.Context(), directory, filename); err != nil {
+		if errors.Is(err, storage.ErrRetained) || errors.Is(err, storage.ErrLegalHold) {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
 		slog.ErrorContext(r.Context(), "ファイル削除エラー", "error", err)
 		http.Error(w, "ファイルの削除に失敗しました", http.StatusInternalServerError)
 		return
@@ -333,6 +354,76 @@ func (h *FileHandler) ListDirectories(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// serveFile は filePath のファイルを添付ファイルとして返します。単一の Range リクエストに対応します。
+// admit は送る直前に送る範囲（先頭位置と長さ）で呼ばれ、false を返すと何も送りません（応答は admit が書きます）。
+// ファイルの送信を始めた場合に true を返します。filePath は呼び出し側で検証済みであること。
+func serveFile(w http.ResponseWriter, r *http.Request, filePath, filename string, admit func(w http.ResponseWriter, start, length int64) bool) bool {
+	// #nosec G703 - filePath は呼び出し側で検証済み
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "ファイルが見つかりません", http.StatusNotFound)
+			return false
+		}
+		slog.ErrorContext(r.Context(), "ファイル情報取得エラー", "error", err)
+		http.Error(w, "ファイル情報の取得に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+
+	// #nosec G304,G703 - filePath は呼び出し側で検証済み
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファイルオープンエラー", "error", err)
+		http.Error(w, "ファイルのオープンに失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			slog.ErrorContext(r.Context(), "ファイルのクローズに失敗しました", "error", err)
+		}
+	}()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDispositionAttachment(filename))
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		// 単一レンジのみ対応する（複数レンジ/multipartは未サポート）。
+		ranges, err := parseRange(rangeHeader, fileInfo.Size())
+		if err != nil || len(ranges) != 1 {
+			http.Error(w, "無効なRangeヘッダーです", http.StatusRequestedRangeNotSatisfiable)
+			return false
+		}
+
+		start, end := ranges[0][0], ranges[0][1]
+		if !admit(w, start, end-start+1) {
+			return false
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileInfo.Size()))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+
+		if _, err := file.Seek(start, 0); err != nil {
+			slog.ErrorContext(r.Context(), "ファイルシークに失敗しました", "error", err)
+			return false
+		}
+		if _, err := io.CopyN(w, file, end-start+1); err != nil {
+			slog.ErrorContext(r.Context(), "ファイル転送に失敗しました", "error", err)
+		}
+	} else {
+		if !admit(w, 0, fileInfo.Size()) {
+			return false
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+		if _, err := io.Copy(w, file); err != nil {
+			slog.ErrorContext(r.Context(), "ファイル転送に失敗しました", "error", err)
+		}
+	}
+
+	return true
+}
+
 // contentDispositionAttachment は RFC 6266 準拠の Content-Disposition 値を組み立てます。
 // ダウンロードファイル名に含まれるクオート・制御文字でヘッダを撹乱されないよう、
 // ASCIIフォールバックを無害化しつつ、元の名前は filename*（UTF-8）で正確に伝えます。
@@ -3,14 +3,22 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
 
+	"fileserver/internal/config"
+	"fileserver/internal/filetype"
 	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/scanner"
+	"fileserver/internal/storage"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -72,3 +80,107 @@ func decodePathParams(w http.ResponseWriter, r *http.Request) (directory, filena
 	}
 	return directory, filename, true
 }
+
+// writeFileRuleError はディレクトリの種別・サイズ制限の違反を413/415に変換して応答します。
+func writeFileRuleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, filetype.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, filetype.ErrTypeNotAllowed):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, "ファイルの検査に失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// resolveConflictPolicy はアップロードごとの on_conflict 指定（空はディレクトリの既定）を検証し、
+// 同じ名前のファイルに対して受け付けられるかを受信前に判定して、適用する扱いを返します。
+// アップロードごとに replace を指定して既存ファイルを置き換える場合は delete 権限も必要です（ディレクトリの既定が replace なら書き込み権限だけでよい）。
+// 受け付けられない場合は 400/403/409/423 を書き込み、ok=falseを返します。
+func resolveConflictPolicy(w http.ResponseWriter, r *http.Request, cfg *config.Config, sm *storage.Manager, pc *permission.Checker,
+	userID, directory, filename, requested string) (string, bool) {
+	policy := requested
+	if policy == "" {
+		policy = cfg.ConflictPolicy(directory)
+	} else if !config.ValidConflictPolicy(policy) {
+		http.Error(w, "on_conflict が不正です（rename・replace・reject のいずれかを指定してください）", http.StatusBadRequest)
+		return "", false
+	}
+
+	existing, err := sm.CheckConflict(r.Context(), directory, filename, policy)
+	if err != nil {
+		writeConflictError(w, r, err)
+		return "", false
+	}
+	if len(existing) > 0 && requested == config.ConflictReplace {
+		canDelete, err := pc.CheckPermission(userID, directory, "delete")
+		if err != nil {
+			slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+			http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+			return "", false
+		}
+		if !canDelete {
+			http.Error(w, "同名のファイルを置き換えるには削除権限が必要です", http.StatusForbidden)
+			return "", false
+		}
+	}
+	return policy, true
+}
+
+// writeConflictError は同名ファイルの扱いによる拒否を409（reject）・423（置き換え対象が保持中）に変換して応答します。
+func writeConflictError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNameConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrRetained), errors.Is(err, storage.ErrLegalHold):
+		http.Error(w, "同名のファイルを置き換えられません: "+err.Error(), http.StatusLocked)
+	default:
+		slog.ErrorContext(r.Context(), "同名ファイルの確認エラー", "error", err)
+		http.Error(w, "ファイルの保存に失敗しました", http.StatusInternalServerError)
+	}
+}
+
+// inspectReceived は保存名へ移す前の作業ファイル path をスキャンします（スキャン無効時は何もしない）。
+// ファイルを隔離した場合は422（検出）または503（fail_closed でのスキャン失敗）、隔離できなかった場合は500を書き込み、
+// ok=falseを返します。いずれの場合も作業ファイルは残りません。
+func inspectReceived(w http.ResponseWriter, r *http.Request, sm *scanner.Manager, directory, filename, path string, uploader *models.User) (scanner.Outcome, bool) {
+	outcome, err := inspect(r.Context(), sm, directory, filename, path, uploader)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファイルの検査エラー", "directory", directory, "filename", filename, "error", err)
+		http.Error(w, "ファイルを隔離できなかったため保存しませんでした", http.StatusInternalServerError)
+		return outcome, false
+	}
+	if outcome.Quarantined {
+		message, code := quarantineError(outcome)
+		http.Error(w, message, code)
+		return outcome, false
+	}
+	return outcome, true
+}
+
+// inspect は inspectReceived のうち応答を書き込まない部分です（一括アップロード・チャンクの完了用）。
+func inspect(ctx context.Context, sm *scanner.Manager, directory, filename, path string, uploader *models.User) (scanner.Outcome, error) {
+	if sm == nil || !sm.Enabled() {
+		return scanner.Outcome{}, nil
+	}
+	// クライアントが応答を待たずに切断しても、受信済みファイルの検査は最後まで行う。
+	return sm.Inspect(context.WithoutCancel(ctx), directory, filename, path, uploader.ID, uploader.Username)
+}
+
+// recordScan は保存したファイルに inspect の結果を記録します（スキャン無効時は何もしない）。
+func recordScan(ctx context.Context, sm *scanner.Manager, directory, filename string, outcome scanner.Outcome) {
+	if sm != nil {
+		sm.Record(context.WithoutCancel(ctx), directory, filename, outcome)
+	}
+}
+
+// errQuarantined は検査で隔離したため保存しなかったことを、確定処理の呼び出し元へ伝えます。
+var errQuarantined = errors.New("ファイルを隔離しました")
+
+// quarantineError は隔離したファイルについて利用者へ返すメッセージとステータス（422 または 503）を返します。
+func quarantineError(outcome scanner.Outcome) (string, int) {
+	if outcome.Status == scanner.StatusInfected {
+		return fmt.Sprintf("マルウェアが検出されたためファイルを隔離しました（%s）", outcome.Signature), http.StatusUnprocessableEntity
+	}
+	return "ファイルを検査できなかったため隔離しました。時間をおいて再度アップロードしてください", http.StatusServiceUnavailable
+}
@@ -0,0 +1,227 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルはギルドのメンバー・ロールへファイルやフォルダを共有するメンバー共有を扱います。
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fileserver/internal/config"
+	"fileserver/internal/permission"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// MemberShareHandler はメンバー共有の作成・一覧・取り消しと、自分に共有されたものの一覧を処理します。
+type MemberShareHandler struct {
+	config            *config.Config
+	db                *sql.DB
+	permissionChecker *permission.Checker
+	sseHandler        *SSEHandler
+}
+
+// NewMemberShareHandler は新しいメンバー共有ハンドラーを作成します。
+func NewMemberShareHandler(cfg *config.Config, db *sql.DB, pc *permission.Checker) *MemberShareHandler {
+	return &MemberShareHandler{
+		config:            cfg,
+		db:                db,
+		permissionChecker: pc,
+	}
+}
+
+// SetSSEHandler は共有の変更を相手の権限スナップショットへ反映するSSEハンドラーを設定します。
+func (h *MemberShareHandler) SetSSEHandler(sse *SSEHandler) {
+	h.sseHandler = sse
+}
+
+// CreateMemberShare はファイル・フォルダをユーザーまたはロールへ共有します。
+// 共有できるのは所有者（ファイルのアップロード者、またはディレクトリの delete 権限を持つユーザー）だけで、
+// 自分が設定で持つ権限（read / write）までしか共有できません。ファイルの共有は read のみです。
+func (h *MemberShareHandler) CreateMemberShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Directory  string `json:"directory"`
+		Filename   string `json:"filename"` // 空はフォルダ（配下を含む）の共有
+		User       string `json:"user"`     // 共有相手のユーザーID（role と排他）
+		Role       string `json:"role"`     // 共有相手のロールID
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.Directory == "" {
+		http.Error(w, "ディレクトリが指定されていません", http.StatusBadRequest)
+		return
+	}
+	req.Directory, ok = cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+	if strings.Contains(req.Filename, "..") || strings.ContainsAny(req.Filename, "/\\") {
+		http.Error(w, "無効なファイル名です", http.StatusBadRequest)
+		return
+	}
+	if (req.User == "") == (req.Role == "") {
+		http.Error(w, "共有相手として user か role のどちらか一方を指定してください", http.StatusBadRequest)
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = "read"
+	}
+	if req.Permission != "read" && req.Permission != "write" {
+		http.Error(w, "共有できる権限は read と write です", http.StatusBadRequest)
+		return
+	}
+	if req.Filename != "" && req.Permission != "read" {
+		http.Error(w, "ファイルの共有は read のみです", http.StatusBadRequest)
+		return
+	}
+	if req.User == user.ID {
+		http.Error(w, "自分自身には共有できません", http.StatusBadRequest)
+		return
+	}
+
+	target := filepath.Join(h.config.Storage.UploadPath, req.Directory, req.Filename)
+	// #nosec G703 - directory/filename は上で ".." と区切り文字を除去済み
+	info, err := os.Stat(target)
+	if err != nil || info.IsDir() != (req.Filename == "") {
+		http.Error(w, "共有するファイル・フォルダが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	canShare, err := h.permissionChecker.CanShare(user.ID, req.Directory, req.Filename, req.Permission)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !canShare {
+		http.Error(w, "このファイル・フォルダを共有する権限がありません", http.StatusForbidden)
+		return
+	}
+
+	s := permission.MemberShare{
+		Directory:     req.Directory,
+		Filename:      req.Filename,
+		GranteeType:   permission.GranteeRole,
+		Grantee:       req.Role,
+		Permission:    req.Permission,
+		CreatedBy:     user.ID,
+		CreatedByName: user.Username,
+	}
+	if req.User != "" {
+		s.GranteeType, s.Grantee = permission.GranteeUser, req.User
+		err := h.db.QueryRowContext(r.Context(), "SELECT username FROM users WHERE id = ?", req.User).Scan(&s.GranteeName)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "共有相手のユーザーが見つかりません", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "ユーザー取得エラー", "error", err)
+			http.Error(w, "共有の作成に失敗しました", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	created, err := h.permissionChecker.CreateMemberShare(r.Context(), s)
+	if errors.Is(err, permission.ErrShareExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "メンバー共有作成エラー", "error", err)
+		http.Error(w, "共有の作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	h.refreshGrantee(created)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"share":   created,
+	})
+}
+
+// ListMemberShares は自分が作成したメンバー共有を新しい順に返します。
+func (h *MemberShareHandler) ListMemberShares(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	shares, err := h.permissionChecker.MemberSharesBy(r.Context(), user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "メンバー共有一覧取得エラー", "error", err)
+		http.Error(w, "共有の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"shares":  shares,
+	})
+}
+
+// SharedWithMe は自分（または保有ロール）へ共有され、現在も有効なファイル・フォルダを新しい順に返します。
+func (h *MemberShareHandler) SharedWithMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	shares, err := h.permissionChecker.SharedWith(r.Context(), user.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有されたファイル一覧取得エラー", "error", err)
+		http.Error(w, "共有の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"shares":  shares,
+	})
+}
+
+// RevokeMemberShare は自分が作成したメンバー共有を取り消します。他人の共有は存在しない場合と同じ404です。
+func (h *MemberShareHandler) RevokeMemberShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	revoked, err := h.permissionChecker.RevokeMemberShare(r.Context(), id, user.ID)
+	if errors.Is(err, permission.ErrShareNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "メンバー共有取り消しエラー", "error", err)
+		http.Error(w, "共有の取り消しに失敗しました", http.StatusInternalServerError)
+		return
+	}
+	h.refreshGrantee(revoked)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"id":      id,
+	})
+}
+
+// refreshGrantee は共有相手の接続中のSSEについて権限スナップショットを取り直します。
+// ロール宛ての共有は保有者を特定できないため、全接続を取り直します。
+func (h *MemberShareHandler) refreshGrantee(s *permission.MemberShare) {
+	if h.sseHandler == nil {
+		return
+	}
+	if s.GranteeType == permission.GranteeUser {
+		h.sseHandler.RefreshUserFilter(s.Grantee)
+		return
+	}
+	h.sseHandler.RefreshAllFilters()
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/share"
+	"fileserver/internal/signedurl"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newMemberShareTestRouter は alice（u1）だけが読み書き・削除できる team に proj/plan.txt と memo.txt を置き、
+// メンバー共有のAPIとダウンロード、共有リンク・署名付きURLを登録したルーターを作ります。bob（u2）は設定の grants を持ちません。
+func newMemberShareTestRouter(t *testing.T) (*config.Config, *permission.Checker, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			UploadPath: filepath.Join(dir, "uploads"),
+			Directories: []config.DirectoryConfig{{
+				Path:   "team",
+				Grants: []config.GrantConfig{{User: "u1", Permissions: []string{"read", "write", "delete"}}},
+			}},
+		},
+		SignedURL: config.SignedURLConfig{Enabled: true, DefaultExpiry: 15 * time.Minute, MaxExpiry: time.Hour},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`INSERT INTO users (id, provider, subject, username) VALUES
+		('u1', 'discord', 'u1', 'alice'), ('u2', 'discord', 'u2', 'bob')`); err != nil {
+		t.Fatal(err)
+	}
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	team := filepath.Join(cfg.Storage.UploadPath, "team")
+	if err := os.MkdirAll(filepath.Join(team, "proj"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"proj/plan.txt", "memo.txt"} {
+		if err := os.WriteFile(filepath.Join(team, name), []byte("hello"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	provider := &memberProvider{members: map[string]bool{"u1": true, "u2": true}}
+	pc := permission.NewChecker(cfg, provider, sm, db)
+	h := NewMemberShareHandler(cfg, db, pc)
+	files := NewFileHandler(cfg, sm, nil, pc)
+	shares := NewShareHandler(cfg, db, share.New(db), sm, pc, provider, template.Must(template.New("share").Parse(`{{range .Files}}{{.URL}}{{end}}`)))
+	signer, err := signedurl.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := NewSignedURLHandler(cfg, db, signer, sm, pc, provider)
+
+	r := chi.NewRouter()
+	r.Post("/api/shares", shares.CreateShare)
+	r.Route("/s/{token}", func(r chi.Router) {
+		r.Use(shares.Resolve)
+		r.Get("/", shares.SharePage)
+		r.Get("/{filename}", shares.Download)
+	})
+	r.Post("/api/files/sign", signed.Sign)
+	r.With(signed.Resolve).Get("/files/signed/{directory}/{filename}", files.Download)
+	r.Post("/api/member-shares", h.CreateMemberShare)
+	r.Delete("/api/member-shares/{id}", h.RevokeMemberShare)
+	r.Get("/api/shared-with-me", h.SharedWithMe)
+	r.Get("/files/download/{directory}/{filename}", files.Download)
+	return cfg, pc, r
+}
+
+func doAs(router http.Handler, userID, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: userID}))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// フォルダの共有は配下を含めて相手に読ませ、GetAccessibleDirectories と共有されたものの一覧に現れること。
+// 共有された人は又貸しできず、共有者が権限を失うか取り消すと相手も読めなくなること。
+func TestMemberShareFolder(t *testing.T) {
+	cfg, pc, router := newMemberShareTestRouter(t)
+
+	rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team/proj","user":"u2"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("共有: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Share permission.MemberShare `json:"share"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team/proj","user":"u2"}`); rec.Code != http.StatusConflict {
+		t.Errorf("同じ共有: status = %d, want 409", rec.Code)
+	}
+
+	for _, c := range []struct {
+		dir, perm string
+		want      bool
+	}{
+		{"team/proj", "read", true},
+		{"team/proj/sub", "read", true},
+		{"team/proj", "write", false},
+		{"team", "read", false},
+	} {
+		if got, err := pc.CheckPermission("u2", c.dir, c.perm); err != nil || got != c.want {
+			t.Errorf("CheckPermission(u2, %q, %q) = %v, %v, want %v", c.dir, c.perm, got, err, c.want)
+		}
+	}
+	dirs, err := pc.GetAccessibleDirectories("u2")
+	if err != nil || len(dirs) != 1 || dirs[0].Path != "team/proj" || dirs[0].Type != "shared" {
+		t.Errorf("GetAccessibleDirectories(u2) = %+v, %v", dirs, err)
+	}
+	if rec := doAs(router, "u2", http.MethodGet, "/api/shared-with-me", ""); !strings.Contains(rec.Body.String(), `"directory":"team/proj"`) {
+		t.Errorf("共有されたものの一覧 = %s", rec.Body.String())
+	}
+	if rec := doAs(router, "u2", http.MethodPost, "/api/member-shares", `{"directory":"team/proj","role":"r1"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("又貸し: status = %d, want 403", rec.Code)
+	}
+
+	grants := cfg.Storage.Directories[0].Grants
+	cfg.Storage.Directories[0].Grants = nil
+	if got, _ := pc.CheckPermission("u2", "team/proj", "read"); got {
+		t.Error("共有者が権限を失った後も読める")
+	}
+	cfg.Storage.Directories[0].Grants = grants
+
+	if rec := doAs(router, "u2", http.MethodDelete, "/api/member-shares/"+created.Share.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("他人の共有の取り消し: status = %d, want 404", rec.Code)
+	}
+	if rec := doAs(router, "u1", http.MethodDelete, "/api/member-shares/"+created.Share.ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("取り消し: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := pc.CheckPermission("u2", "team/proj", "read"); got {
+		t.Error("取り消し後も読める")
+	}
+}
+
+// ファイルの共有はそのファイルだけをダウンロードさせ、read 以外の権限は拒否すること。
+func TestMemberShareFile(t *testing.T) {
+	_, _, router := newMemberShareTestRouter(t)
+
+	if rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team","filename":"memo.txt","user":"u2","permission":"write"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("ファイルへの write の共有: status = %d, want 400", rec.Code)
+	}
+	if rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team","filename":"memo.txt","user":"u2"}`); rec.Code != http.StatusOK {
+		t.Fatalf("共有: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doAs(router, "u2", http.MethodGet, "/files/download/team/memo.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("共有されたファイル: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if rec := doAs(router, "u2", http.MethodGet, "/files/download/team/other.txt", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("共有されていないファイル: status = %d, want 403", rec.Code)
+	}
+}
+
+// メンバー共有だけで読めるファイル・フォルダでも、ダウンロードと同じく共有リンク・署名付きURLを作って使えること。
+// 共有が取り消されると、作ったリンク・URLも使えなくなること。
+func TestLinksThroughMemberShare(t *testing.T) {
+	_, _, router := newMemberShareTestRouter(t)
+	rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team","filename":"memo.txt","user":"u2"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ファイルの共有: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Share permission.MemberShare `json:"share"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doAs(router, "u1", http.MethodPost, "/api/member-shares", `{"directory":"team/proj","user":"u2"}`); rec.Code != http.StatusOK {
+		t.Fatalf("フォルダの共有: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	var links []string
+	for _, body := range []string{`{"directory":"team","filename":"memo.txt"}`, `{"directory":"team/proj"}`, `{"directory":"team/proj","filename":"plan.txt"}`} {
+		rec := doAs(router, "u2", http.MethodPost, "/api/shares", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("共有リンク %s: status = %d, body = %s", body, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Share struct {
+				Token string `json:"token"`
+			} `json:"share"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, "/s/"+resp.Share.Token+"/")
+	}
+	for _, target := range []string{links[0] + "memo.txt", links[1] + "plan.txt", links[2] + "plan.txt"} {
+		if rec := doAs(router, "", http.MethodGet, target, ""); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+			t.Errorf("%s: status = %d, body = %s", target, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := doAs(router, "u2", http.MethodPost, "/api/shares", `{"directory":"team"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("共有されていないフォルダの共有リンク: status = %d, want 403", rec.Code)
+	}
+
+	rec = doAs(router, "u2", http.MethodPost, "/api/files/sign", `{"directory":"team","filename":"memo.txt"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("署名付きURL: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &signed); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doAs(router, "", http.MethodGet, signed.URL, ""); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("署名付きURLのダウンロード: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doAs(router, "u1", http.MethodDelete, "/api/member-shares/"+created.Share.ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("取り消し: status = %d", rec.Code)
+	}
+	if rec := doAs(router, "", http.MethodGet, links[0]+"memo.txt", ""); rec.Code != http.StatusGone {
+		t.Errorf("取り消し後の共有リンク: status = %d, want 410", rec.Code)
+	}
+	if rec := doAs(router, "", http.MethodGet, signed.URL, ""); rec.Code != http.StatusGone {
+		t.Errorf("取り消し後の署名付きURL: status = %d, want 410", rec.Code)
+	}
+}
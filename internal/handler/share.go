@@ -0,0 +1,510 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルはログインできない人へファイル・フォルダを渡す共有リンクを扱います。
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/authprovider"
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/share"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/time/rate"
+)
+
+// 共有リンクのパスワードの試行回数の制限です。総当たりを防ぐため、失敗した試行だけを数えます。
+const (
+	sharePasswordBurst    = 5
+	sharePasswordInterval = time.Minute
+)
+
+// shareContextKey は Resolve が解決した共有リンクをコンテキストに格納するキーです。
+type shareContextKey struct{}
+
+// ShareHandler は共有リンクの作成・一覧・取り消しと、/s/{token} での配信を処理します。
+type ShareHandler struct {
+	config            *config.Config
+	db                *sql.DB
+	store             *share.Store
+	storageManager    *storage.Manager
+	permissionChecker *permission.Checker
+	provider          authprovider.Provider
+	sseHandler        *SSEHandler
+	pageTmpl          *template.Template
+
+	mu       sync.Mutex
+	failures map[string]*rate.Limiter // トークンごとのパスワードの失敗（失敗したリンクだけ。回復しきったものは捨てる）
+}
+
+// NewShareHandler は新しい共有リンクハンドラーを作成します。
+// pageTmpl は起動時に一度だけパースした共有ページのテンプレートです。
+func NewShareHandler(cfg *config.Config, db *sql.DB, store *share.Store, sm *storage.Manager, pc *permission.Checker,
+	provider authprovider.Provider, pageTmpl *template.Template) *ShareHandler {
+	return &ShareHandler{
+		config:            cfg,
+		db:                db,
+		store:             store,
+		storageManager:    sm,
+		permissionChecker: pc,
+		provider:          provider,
+		pageTmpl:          pageTmpl,
+		failures:          make(map[string]*rate.Limiter),
+	}
+}
+
+// SetSSEHandler は共有リンクからのダウンロードを通知するSSEハンドラーを設定します。
+func (h *ShareHandler) SetSSEHandler(sse *SSEHandler) {
+	h.sseHandler = sse
+}
+
+// shareLinkResponse はAPIレスポンス用の共有リンクです。
+type shareLinkResponse struct {
+	*share.Link
+	URL string `json:"url"`
+}
+
+func newShareLinkResponse(link *share.Link) shareLinkResponse {
+	return shareLinkResponse{Link: link, URL: "/s/" + link.Token}
+}
+
+func newShareLinkResponses(links []*share.Link) []shareLinkResponse {
+	resp := make([]shareLinkResponse, 0, len(links))
+	for _, link := range links {
+		resp = append(resp, newShareLinkResponse(link))
+	}
+	return resp
+}
+
+// CreateShare は共有リンクを作成します。共有するファイル・フォルダの読み取り権限が必要です。
+// expires_in を省略した場合は share.max_expiry の期間、max_expiry を超える期間は400です。
+func (h *ShareHandler) CreateShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Directory    string `json:"directory"`
+		Filename     string `json:"filename"`   // 空はフォルダの共有
+		ExpiresIn    string `json:"expires_in"` // "24h" 等。空は max_expiry
+		Password     string `json:"password"`
+		MaxDownloads int    `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.Directory == "" {
+		http.Error(w, "ディレクトリが指定されていません", http.StatusBadRequest)
+		return
+	}
+	req.Directory, ok = cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+	if strings.Contains(req.Filename, "..") || strings.ContainsAny(req.Filename, "/\\") {
+		http.Error(w, "無効なファイル名です", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "max_downloads に負の値は指定できません", http.StatusBadRequest)
+		return
+	}
+
+	ttl := h.config.Share.MaxExpiry
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in が不正です（例: 24h）", http.StatusBadRequest)
+			return
+		}
+		if h.config.Share.MaxExpiry > 0 && d > h.config.Share.MaxExpiry {
+			http.Error(w, "expires_in が有効期間の上限（"+h.config.Share.MaxExpiry.String()+"）を超えています", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	// ダウンロードと同じく、メンバー共有されたファイル・フォルダも共有できる。
+	hasPermission, err := h.permissionChecker.CheckFilePermission(user.ID, req.Directory, req.Filename, "read")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !hasPermission {
+		http.Error(w, "読み取り権限がありません", http.StatusForbidden)
+		return
+	}
+
+	target := filepath.Join(h.config.Storage.UploadPath, req.Directory, req.Filename)
+	// #nosec G703 - directory/filename は上で ".." と区切り文字を除去済み
+	info, err := os.Stat(target)
+	if err != nil || info.IsDir() != (req.Filename == "") {
+		http.Error(w, "共有するファイル・フォルダが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	link, err := h.store.Create(r.Context(), share.CreateParams{
+		Directory:    req.Directory,
+		Filename:     req.Filename,
+		CreatedBy:    user.ID,
+		Password:     req.Password,
+		TTL:          ttl,
+		MaxDownloads: req.MaxDownloads,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有リンク作成エラー", "error", err)
+		http.Error(w, "共有リンクの作成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	link.CreatedByName = user.Username
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"share":   newShareLinkResponse(link),
+	})
+}
+
+// ListShares は自分が作成した共有リンクを新しい順に返します。
+func (h *ShareHandler) ListShares(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	h.writeShares(w, r, user.ID)
+}
+
+// AdminListShares は全員の共有リンクを新しい順に返します（管理者用）。
+func (h *ShareHandler) AdminListShares(w http.ResponseWriter, r *http.Request) {
+	h.writeShares(w, r, "")
+}
+
+func (h *ShareHandler) writeShares(w http.ResponseWriter, r *http.Request, createdBy string) {
+	links, err := h.store.List(r.Context(), createdBy)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有リンク一覧取得エラー", "error", err)
+		http.Error(w, "共有リンクの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"shares":  newShareLinkResponses(links),
+	})
+}
+
+// RevokeShare は自分が作成した共有リンクを取り消します。
+func (h *ShareHandler) RevokeShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	token := chi.URLParam(r, "token")
+	link, err := h.store.Get(r.Context(), token)
+	// 他人のリンクは存在を明かさないよう、存在しない場合と同じ404にする。
+	if errors.Is(err, share.ErrNotFound) || (err == nil && link.CreatedBy != user.ID) {
+		http.Error(w, "共有リンクが見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有リンク取得エラー", "error", err)
+		http.Error(w, "共有リンクの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	h.revoke(w, r, token, user)
+}
+
+// AdminRevokeShare は任意の共有リンクを取り消します（管理者用）。
+func (h *ShareHandler) AdminRevokeShare(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	h.revoke(w, r, chi.URLParam(r, "token"), user)
+}
+
+func (h *ShareHandler) revoke(w http.ResponseWriter, r *http.Request, token string, user *models.User) {
+	if err := h.store.Revoke(r.Context(), token, user.ID); err != nil {
+		switch {
+		case errors.Is(err, share.ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, share.ErrRevoked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			slog.ErrorContext(r.Context(), "共有リンク取り消しエラー", "error", err)
+			http.Error(w, "共有リンクの取り消しに失敗しました", http.StatusInternalServerError)
+		}
+		return
+	}
+	h.forgetFailures(token)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"token":   token,
+	})
+}
+
+// Resolve は /s/{token} の共有リンクを検証するミドルウェアです（認証不要のルートに付けます）。
+// 存在しないリンクは404、期限切れ・取り消し済み・回数の上限に達したリンクと、作成者が在籍や読み取り権限を
+// 失ったリンクは410を返します。パスワード付きのリンクは Basic 認証（ユーザー名は任意）でパスワードを受け取ります。
+// 通ったリクエストには作成者をユーザーとして格納し、転送量・帯域の上限を作成者の分として適用させます。
+func (h *ShareHandler) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+		link, err := h.store.Get(r.Context(), token)
+		if errors.Is(err, share.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "共有リンク取得エラー", "error", err)
+			http.Error(w, "共有リンクの取得に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if err := link.Usable(time.Now()); err != nil {
+			h.forgetFailures(token)
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+
+		if link.HasPassword && !h.checkPassword(w, r, link) {
+			return
+		}
+
+		creator, ok := linkCreator(w, r, h.db, h.provider, h.permissionChecker, link.CreatedBy, link.Directory, link.Filename, "read")
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), models.UserContextKey, creator)
+		ctx = context.WithValue(ctx, shareContextKey{}, link)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkPassword は Basic 認証のパスワードを照合します。一致しない場合は401（試行が多すぎる場合は429）を書き込みます。
+func (h *ShareHandler) checkPassword(w http.ResponseWriter, r *http.Request, link *share.Link) bool {
+	h.mu.Lock()
+	limiter := h.failures[link.Token]
+	h.mu.Unlock()
+
+	if limiter != nil && limiter.Tokens() < 1 {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "パスワードの試行回数が多すぎます。しばらく待ってから再試行してください", http.StatusTooManyRequests)
+		return false
+	}
+
+	_, password, ok := r.BasicAuth()
+	if ok && link.CheckPassword(password) {
+		return true
+	}
+	if ok {
+		h.recordFailure(link.Token)
+		slog.WarnContext(r.Context(), "共有リンクのパスワードが一致しません", "ip", r.RemoteAddr, "directory", link.Directory)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="share", charset="UTF-8"`)
+	http.Error(w, "パスワードが必要です", http.StatusUnauthorized)
+	return false
+}
+
+// recordFailure はリンク token のパスワードの失敗を1回数えます。
+// 記録は存在するリンクへの失敗でだけ作り、新しく作る際に試行の制限が回復しきった（作り直しと変わらない）記録を捨てます。
+func (h *ShareHandler) recordFailure(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	limiter, ok := h.failures[token]
+	if !ok {
+		for t, l := range h.failures {
+			if l.Tokens() >= sharePasswordBurst {
+				delete(h.failures, t)
+			}
+		}
+		limiter = rate.NewLimiter(rate.Every(sharePasswordInterval/sharePasswordBurst), sharePasswordBurst)
+		h.failures[token] = limiter
+	}
+	limiter.Allow()
+}
+
+// forgetFailures は取り消した・使えなくなったリンクのパスワードの失敗の記録を捨てます。
+func (h *ShareHandler) forgetFailures(token string) {
+	h.mu.Lock()
+	delete(h.failures, token)
+	h.mu.Unlock()
+}
+
+// linkCreator はリンクの作成者 userID を読み込み、まだ在籍していて directory（filename が空でなければそのファイル）の
+// perm 権限を持っているかを確認します。権限はダウンロードと同じく CheckFilePermission（メンバー共有を含む）で判定します。
+// 共有リンク・アップロードリンク・署名付きURLで使い、確認できない場合は410（確認に失敗した場合は500）を書き込みます。
+func linkCreator(w http.ResponseWriter, r *http.Request, db *sql.DB, provider authprovider.Provider, pc *permission.Checker,
+	userID, directory, filename, perm string) (*models.User, bool) {
+	var user models.User
+	err := db.QueryRowContext(r.Context(), `
+		SELECT id, provider, subject, username, COALESCE(avatar, ''), created_at, last_login
+		FROM users
+		WHERE id = ?
+	`, userID).Scan(&user.ID, &user.Provider, &user.Subject, &user.Username, &user.Avatar, &user.CreatedAt, &user.LastLogin)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "リンクは無効になりました", http.StatusGone)
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "リンク作成者の取得エラー", "error", err, "user_id", userID)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	isMember, err := provider.VerifyMembership(r.Context(), user.Subject)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "在籍確認エラー", "error", err, "user_id", user.ID)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	hasPermission := false
+	if isMember {
+		hasPermission, err = pc.CheckFilePermission(user.ID, directory, filename, perm)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+			http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	if !hasPermission {
+		slog.InfoContext(r.Context(), "作成者が在籍または権限を失ったためリンクを拒否しました", "user_id", user.ID, "directory", directory, "permission", perm)
+		http.Error(w, "リンクは無効になりました", http.StatusGone)
+		return nil, false
+	}
+	return &user, true
+}
+
+// sharePageFile は共有ページに並べるファイルです。
+type sharePageFile struct {
+	Name string
+	URL  string
+	Size int64
+}
+
+// SharePage は共有リンクのページを表示します。ファイルのリンクは1件、フォルダのリンクは直下のファイルを並べます。
+func (h *ShareHandler) SharePage(w http.ResponseWriter, r *http.Request) {
+	link := r.Context().Value(shareContextKey{}).(*share.Link)
+
+	files, err := h.sharedFiles(link)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有ファイル一覧取得エラー", "error", err)
+		http.Error(w, "ファイル一覧の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	items := make([]sharePageFile, 0, len(files))
+	for _, f := range files {
+		items = append(items, sharePageFile{
+			Name: f.OriginalName,
+			URL:  "/s/" + link.Token + "/" + url.PathEscape(f.Filename),
+			Size: f.Size,
+		})
+	}
+
+	data := map[string]interface{}{
+		"ServiceName": h.config.Server.ServiceName,
+		"Link":        link,
+		"Files":       items,
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := h.pageTmpl.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "テンプレートのレンダリングに失敗しました", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Download は共有リンクのファイルを返します。Range リクエストにも対応します。
+// 先頭以外から始まる Range を数えないと回数の上限を回避できてしまうため、途中からの再開も1回として数えます。
+func (h *ShareHandler) Download(w http.ResponseWriter, r *http.Request) {
+	link := r.Context().Value(shareContextKey{}).(*share.Link)
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	filename, err := url.PathUnescape(chi.URLParam(r, "filename"))
+	if err != nil {
+		http.Error(w, "無効なファイル名です", http.StatusBadRequest)
+		return
+	}
+	files, err := h.sharedFiles(link)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "共有ファイル一覧取得エラー", "error", err)
+		http.Error(w, "ファイル一覧の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	var file *models.FileInfo
+	for i := range files {
+		if files[i].Filename == filename {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		http.Error(w, "ファイルが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	admit := func(w http.ResponseWriter, _, length int64) bool {
+		// 転送量の上限は作成者の分として、実際に送る部分の大きさで判定する。
+		if !allowance.FromContext(r.Context()).Allow(w, length) {
+			return false
+		}
+		if err := h.store.CountDownload(r.Context(), link.Token); err != nil {
+			if errors.Is(err, share.ErrLimitReached) {
+				http.Error(w, err.Error(), http.StatusGone)
+				return false
+			}
+			slog.ErrorContext(r.Context(), "共有リンクのダウンロード記録エラー", "error", err)
+			http.Error(w, "ダウンロード回数の記録に失敗しました", http.StatusInternalServerError)
+			return false
+		}
+		return true
+	}
+	filePath := filepath.Join(h.config.Storage.UploadPath, link.Directory, file.Filename)
+	if !serveFile(w, r, filePath, file.OriginalName, admit) {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "共有リンクからのダウンロード", "user_id", user.ID, "filename", file.Filename,
+		"directory", link.Directory, "ip", r.RemoteAddr)
+
+	if h.sseHandler != nil {
+		h.sseHandler.BroadcastFileDownload(&models.User{ID: user.ID, Username: user.Username + "（共有リンク）"}, link.Directory, file.Filename)
+	}
+}
+
+// sharedFiles はリンクで配信できるファイルを返します。フォルダのリンクでもサブディレクトリは含めません。
+func (h *ShareHandler) sharedFiles(link *share.Link) ([]models.FileInfo, error) {
+	entries, err := h.storageManager.ListFiles(link.Directory)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]models.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDirectory || (!link.IsFolder() && e.Filename != link.Filename) {
+			continue
+		}
+		files = append(files, e)
+	}
+	return files, nil
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/share"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/time/rate"
+)
+
+// memberProvider は members に含まれるユーザーだけを在籍とみなすテスト用のプロバイダーです。
+type memberProvider struct {
+	authprovider.Provider
+	members map[string]bool
+}
+
+func (p *memberProvider) VerifyMembership(_ context.Context, subject string) (bool, error) {
+	return p.members[subject], nil
+}
+
+func (p *memberProvider) GetUserRoles(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+// newShareTestRouter は全員が読める public に a.txt を置き、/s/{token} を配信するルーターを作ります。
+func newShareTestRouter(t *testing.T) (*ShareHandler, *memberProvider, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath: filepath.Join(dir, "uploads"),
+		Directories: []config.DirectoryConfig{{
+			Path:   "public",
+			Grants: []config.GrantConfig{{Role: "*", Permissions: []string{"read"}}},
+		}},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', 'u1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadPath, "public", "a.txt"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &memberProvider{members: map[string]bool{"u1": true}}
+	tmpl := template.Must(template.New("share").Parse(`{{range .Files}}{{.URL}}{{end}}`))
+	h := NewShareHandler(cfg, db, share.New(db), sm, permission.NewChecker(cfg, provider, sm, db), provider, tmpl)
+
+	r := chi.NewRouter()
+	r.Route("/s/{token}", func(r chi.Router) {
+		r.Use(h.Resolve)
+		r.Get("/", h.SharePage)
+		r.Get("/{filename}", h.Download)
+	})
+	return h, provider, r
+}
+
+// createTestShare は alice として共有リンクを作成し、そのトークンを返します。
+func createTestShare(t *testing.T, h *ShareHandler, body string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/shares", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	rec := httptest.NewRecorder()
+	h.CreateShare(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("作成: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Share struct {
+			Token string `json:"token"`
+			URL   string `json:"url"`
+		} `json:"share"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Share.URL != "/s/"+resp.Share.Token {
+		t.Errorf("url = %q", resp.Share.URL)
+	}
+	return resp.Share.Token
+}
+
+func getShare(router http.Handler, path, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if password != "" {
+		req.SetBasicAuth("", password)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// フォルダのリンクはページにファイルを並べ、途中からの再開（Range）も1回として数えること。
+// 回数の上限に達したリンクは410を返すこと。
+func TestShareDownloadLimit(t *testing.T) {
+	h, _, router := newShareTestRouter(t)
+	token := createTestShare(t, h, `{"directory":"public","max_downloads":2}`)
+
+	rec := getShare(router, "/s/"+token, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/s/"+token+"/a.txt") {
+		t.Fatalf("ページ: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := getShare(router, "/s/"+token+"/a.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("ダウンロード: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/s/"+token+"/a.txt", nil)
+	req.Header.Set("Range", "bytes=2-")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "llo" {
+		t.Errorf("再開: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := getShare(router, "/s/"+token+"/a.txt", ""); rec.Code != http.StatusGone {
+		t.Errorf("上限後: status = %d, want 410", rec.Code)
+	}
+	if rec := getShare(router, "/s/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("存在しないリンク: status = %d, want 404", rec.Code)
+	}
+}
+
+// パスワード付きのリンクは Basic 認証でパスワードを求め、作成者が在籍を失ったリンクは410を返すこと。
+func TestSharePasswordAndCreatorMembership(t *testing.T) {
+	h, provider, router := newShareTestRouter(t)
+	token := createTestShare(t, h, `{"directory":"public","filename":"a.txt","password":"secret","expires_in":"1h"}`)
+
+	rec := getShare(router, "/s/"+token+"/a.txt", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("パスワードなし: status = %d", rec.Code)
+	}
+	if rec := getShare(router, "/s/"+token+"/a.txt", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("誤ったパスワード: status = %d, want 401", rec.Code)
+	}
+	if rec := getShare(router, "/s/"+token+"/a.txt", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("正しいパスワード: status = %d, want 200", rec.Code)
+	}
+
+	provider.members["u1"] = false
+	if rec := getShare(router, "/s/"+token+"/a.txt", "secret"); rec.Code != http.StatusGone {
+		t.Errorf("作成者の退出後: status = %d, want 410", rec.Code)
+	}
+}
+
+// パスワードの失敗は存在するリンクへの失敗だけを記録し、5回で429にすること。
+// 回復しきった記録と取り消したリンクの記録は残さないこと。
+func TestSharePasswordFailuresArePruned(t *testing.T) {
+	h, _, router := newShareTestRouter(t)
+	token := createTestShare(t, h, `{"directory":"public","filename":"a.txt","password":"secret"}`)
+	other := createTestShare(t, h, `{"directory":"public","password":"other"}`)
+
+	for range sharePasswordBurst {
+		if rec := getShare(router, "/s/"+token+"/a.txt", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("誤ったパスワード: status = %d, want 401", rec.Code)
+		}
+	}
+	if rec := getShare(router, "/s/"+token+"/a.txt", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("失敗が続いた後: status = %d, want 429", rec.Code)
+	}
+	getShare(router, "/s/"+other, "other")
+	getShare(router, "/s/unknown", "wrong")
+	if len(h.failures) != 1 {
+		t.Errorf("記録 = %d 件, want 失敗したリンクの1件", len(h.failures))
+	}
+
+	h.failures["stale"] = rate.NewLimiter(rate.Every(sharePasswordInterval/sharePasswordBurst), sharePasswordBurst)
+	getShare(router, "/s/"+other, "wrong")
+	if _, ok := h.failures["stale"]; ok || len(h.failures) != 2 {
+		t.Errorf("回復しきった記録が残っている: %v", h.failures)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/shares/"+token, nil)
+	h.revoke(httptest.NewRecorder(), req, token, &models.User{ID: "u1"})
+	if _, ok := h.failures[token]; ok {
+		t.Error("取り消したリンクの記録が残っている")
+	}
+}
+
+// 期間の上限を超える expires_in と、存在しないファイルの共有は拒否すること。
+func TestCreateShareValidation(t *testing.T) {
+	h, _, _ := newShareTestRouter(t)
+	h.config.Share.MaxExpiry = 24 * time.Hour
+
+	for body, want := range map[string]int{
+		`{"directory":"public","expires_in":"48h"}`:       http.StatusBadRequest,
+		`{"directory":"public","filename":"missing.txt"}`: http.StatusNotFound,
+		`{"directory":"public","filename":"../a.txt"}`:    http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/shares", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+		rec := httptest.NewRecorder()
+		h.CreateShare(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, want)
+		}
+	}
+}
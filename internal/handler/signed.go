@@ -0,0 +1,203 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルはCookieなしでダウンロードできる短命の署名付きURLを扱います。
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/config"
+	"fileserver/internal/logging"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/signedurl"
+	"fileserver/internal/storage"
+)
+
+// SignedURLHandler は署名付きURLの発行と、/files/signed/... での署名の検証を処理します。
+// 検証を通ったリクエストは発行者をユーザーとして格納し、通常のダウンロードと同じハンドラーで配信します。
+type SignedURLHandler struct {
+	config            *config.Config
+	db                *sql.DB
+	signer            *signedurl.Signer
+	storageManager    *storage.Manager
+	permissionChecker *permission.Checker
+	provider          authprovider.Provider
+}
+
+// NewSignedURLHandler は新しい署名付きURLハンドラーを作成します。
+func NewSignedURLHandler(cfg *config.Config, db *sql.DB, signer *signedurl.Signer, sm *storage.Manager, pc *permission.Checker,
+	provider authprovider.Provider) *SignedURLHandler {
+	return &SignedURLHandler{
+		config:            cfg,
+		db:                db,
+		signer:            signer,
+		storageManager:    sm,
+		permissionChecker: pc,
+		provider:          provider,
+	}
+}
+
+// Sign は署名付きのダウンロードURLを発行します。ファイルの読み取り権限が必要です。
+// expires_in を省略した場合は signed_url.default_expiry の期間、signed_url.max_expiry を超える期間は400です。
+// bind_ip を指定すると、発行を依頼したIPアドレスからのダウンロードだけを許します。
+func (h *SignedURLHandler) Sign(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Directory string `json:"directory"`
+		Filename  string `json:"filename"`
+		ExpiresIn string `json:"expires_in"` // "10m" 等。空は default_expiry
+		BindIP    bool   `json:"bind_ip"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "リクエストのパースに失敗しました", http.StatusBadRequest)
+		return
+	}
+	if req.Directory == "" || req.Filename == "" {
+		http.Error(w, "ディレクトリとファイル名を指定してください", http.StatusBadRequest)
+		return
+	}
+	req.Directory, ok = cleanDir(w, req.Directory)
+	if !ok {
+		return
+	}
+	if strings.Contains(req.Filename, "..") || strings.ContainsAny(req.Filename, "/\\") {
+		http.Error(w, "無効なファイル名です", http.StatusBadRequest)
+		return
+	}
+
+	ttl := h.config.SignedURL.DefaultExpiry
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in が不正です（例: 10m）", http.StatusBadRequest)
+			return
+		}
+		if d > h.config.SignedURL.MaxExpiry {
+			http.Error(w, "expires_in が有効期間の上限（"+h.config.SignedURL.MaxExpiry.String()+"）を超えています", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	// ダウンロードと同じく、メンバー共有されたファイルも発行できる。
+	hasPermission, err := h.permissionChecker.CheckFilePermission(user.ID, req.Directory, req.Filename, "read")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "権限チェックエラー", "error", err)
+		http.Error(w, "権限の確認に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	if !hasPermission {
+		http.Error(w, "読み取り権限がありません", http.StatusForbidden)
+		return
+	}
+
+	// #nosec G703 - directory/filename は上で ".." と区切り文字を除去済み
+	info, err := os.Stat(filepath.Join(h.config.Storage.UploadPath, req.Directory, req.Filename))
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "ファイルが見つかりません", http.StatusNotFound)
+		return
+	}
+	hash, err := h.storageManager.FileHash(req.Directory, req.Filename)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファイルのハッシュの取得エラー", "error", err)
+		http.Error(w, "署名付きURLの発行に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	claims := signedurl.Claims{
+		Expires:   time.Now().Add(ttl).Truncate(time.Second),
+		Directory: req.Directory,
+		Filename:  req.Filename,
+		UserID:    user.ID,
+		Hash:      hash,
+	}
+	if req.BindIP {
+		claims.IP = clientIP(r)
+	}
+	logging.Audit(r.Context(), "signed_url_issued", "user_id", user.ID, "directory", req.Directory, "filename", req.Filename,
+		"expires_at", claims.Expires, "ip", claims.IP)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"url":        "/files/signed/" + url.PathEscape(req.Directory) + "/" + url.PathEscape(req.Filename) + "?" + h.signer.Sign(claims).Encode(),
+		"expires_at": claims.Expires,
+	})
+}
+
+// Resolve は AuthMiddleware の代わりに署名を検証するミドルウェアです。
+// 署名が正しくない・IPアドレスが異なる場合は403、期限切れ・ファイルが置き換えられた場合は410を返します。
+// 発行者が在籍または読み取り権限を失っていれば410とし、検証を通れば発行者をユーザーとしてコンテキストに格納します。
+func (h *SignedURLHandler) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		directory, filename, ok := decodePathParams(w, r)
+		if !ok {
+			return
+		}
+
+		claims, err := h.signer.Verify(directory, filename, r.URL.Query())
+		if errors.Is(err, signedurl.ErrExpired) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if claims.IP != "" && claims.IP != clientIP(r) {
+			slog.InfoContext(r.Context(), "署名付きURLを発行先と異なるIPアドレスから拒否しました", "user_id", claims.UserID, "ip", clientIP(r))
+			http.Error(w, "このURLは別のIPアドレス向けに発行されています", http.StatusForbidden)
+			return
+		}
+
+		// #nosec G703 - directory/filename は署名で発行時のものと確かめ、decodePathParams で ".." も除去済み
+		if info, err := os.Stat(filepath.Join(h.config.Storage.UploadPath, directory, filename)); err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "ファイルが見つかりません", http.StatusNotFound)
+			return
+		}
+		// 発行時に記録したハッシュとだけ照合し、リクエストのたびにファイルを読み直さない。
+		meta, err := h.storageManager.Metadata(directory, filename)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "メタデータの取得エラー", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if meta.Hash == "" || meta.Hash != claims.Hash {
+			http.Error(w, "ファイルが変更されたためURLは無効になりました", http.StatusGone)
+			return
+		}
+
+		issuer, ok := linkCreator(w, r, h.db, h.provider, h.permissionChecker, claims.UserID, directory, filename, "read")
+		if !ok {
+			return
+		}
+
+		// URLはログ・リファラー経由で漏れやすいため、共有キャッシュに残さず他サイトへも渡さない。
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), models.UserContextKey, issuer)))
+	})
+}
+
+// clientIP はリクエスト元のIPアドレスを返します（RealIP ミドルウェアの適用後の RemoteAddr から、ポートを除いたもの）。
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
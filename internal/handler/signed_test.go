@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/signedurl"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newSignedTestRouter は全員が読める public に a.txt を置き、/files/signed/... を Cookie なしで配信するルーターを作ります。
+func newSignedTestRouter(t *testing.T) (*SignedURLHandler, *storage.Manager, *memberProvider, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			UploadPath: filepath.Join(dir, "uploads"),
+			Directories: []config.DirectoryConfig{{
+				Path:   "public",
+				Grants: []config.GrantConfig{{Role: "*", Permissions: []string{"read"}}},
+			}},
+		},
+		SignedURL: config.SignedURLConfig{Enabled: true, DefaultExpiry: 15 * time.Minute, MaxExpiry: time.Hour},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', 'u1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadPath, "public", "a.txt"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := signedurl.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &memberProvider{members: map[string]bool{"u1": true}}
+	pc := permission.NewChecker(cfg, provider, sm, db)
+	h := NewSignedURLHandler(cfg, db, signer, sm, pc, provider)
+	files := NewFileHandler(cfg, sm, nil, pc)
+
+	r := chi.NewRouter()
+	r.With(h.Resolve).Get("/files/signed/{directory}/{filename}", files.Download)
+	return h, sm, provider, r
+}
+
+// signTestURL は alice として remoteAddr から署名付きURLを発行し、そのURLを返します。
+func signTestURL(t *testing.T, h *SignedURLHandler, body, remoteAddr string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/files/sign", strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	rec := httptest.NewRecorder()
+	h.Sign(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("発行: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.URL
+}
+
+func getSigned(router http.Handler, target, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// 署名付きURLはCookieなしでダウンロードでき、書き換えたURLは403、
+// ファイルが置き換えられた・発行者が在籍を失ったURLは410を返すこと。
+// ハッシュは発行時に記録し、ダウンロードのたびには計算し直さないこと。
+func TestSignedURLDownload(t *testing.T) {
+	h, sm, provider, router := newSignedTestRouter(t)
+	target := signTestURL(t, h, `{"directory":"public","filename":"a.txt"}`, "192.0.2.1:1234")
+	if meta, err := sm.Metadata("public", "a.txt"); err != nil || meta.Hash == "" {
+		t.Fatalf("発行時にハッシュが記録されていない: %+v, %v", meta, err)
+	}
+
+	if rec := getSigned(router, target, "198.51.100.1:1234"); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("ダウンロード: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if rec := getSigned(router, strings.Replace(target, "uid=u1", "uid=u2", 1), "192.0.2.1:1234"); rec.Code != http.StatusForbidden {
+		t.Errorf("書き換えたURL: status = %d, want 403", rec.Code)
+	}
+	if rec := getSigned(router, "/files/signed/public/a.txt", "192.0.2.1:1234"); rec.Code != http.StatusForbidden {
+		t.Errorf("署名なし: status = %d, want 403", rec.Code)
+	}
+
+	provider.members["u1"] = false
+	if rec := getSigned(router, target, "192.0.2.1:1234"); rec.Code != http.StatusGone {
+		t.Errorf("発行者の退出後: status = %d, want 410", rec.Code)
+	}
+	provider.members["u1"] = true
+
+	path := filepath.Join(h.config.Storage.UploadPath, "public", "a.txt")
+	if err := os.WriteFile(path, []byte("hellO"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := getSigned(router, target, "192.0.2.1:1234"); rec.Code != http.StatusOK || rec.Body.String() != "hellO" {
+		t.Errorf("記録を更新する前: status = %d, body = %s（記録済みのハッシュと照合するため 200）", rec.Code, rec.Body.String())
+	}
+	if err := sm.SaveFileMetadata("public", "a.txt", "", models.SystemUsername); err != nil {
+		t.Fatal(err)
+	}
+	if rec := getSigned(router, target, "192.0.2.1:1234"); rec.Code != http.StatusGone {
+		t.Errorf("置き換え後: status = %d, want 410", rec.Code)
+	}
+}
+
+// bind_ip を指定したURLは発行を依頼したIPアドレスからだけ使え、期間の上限を超える expires_in は拒否すること。
+func TestSignedURLBindIP(t *testing.T) {
+	h, _, _, router := newSignedTestRouter(t)
+	target := signTestURL(t, h, `{"directory":"public","filename":"a.txt","expires_in":"5m","bind_ip":true}`, "192.0.2.1:1234")
+
+	if rec := getSigned(router, target, "192.0.2.1:5678"); rec.Code != http.StatusOK {
+		t.Errorf("同じIPアドレス: status = %d, want 200", rec.Code)
+	}
+	if rec := getSigned(router, target, "198.51.100.1:1234"); rec.Code != http.StatusForbidden {
+		t.Errorf("別のIPアドレス: status = %d, want 403", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/files/sign", strings.NewReader(`{"directory":"public","filename":"a.txt","expires_in":"2h"}`))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	rec := httptest.NewRecorder()
+	h.Sign(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("上限を超える期間: status = %d, want 400", rec.Code)
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"fileserver/internal/fetcher"
 	"fileserver/internal/models"
 	"fileserver/internal/permission"
+	"fileserver/internal/storage"
 )
 
 // sseFilterRefreshInterval は各接続の読み取り可能ディレクトリ集合を
@@ -20,10 +22,12 @@ const sseFilterRefreshInterval = 5 * time.Minute
 // SSEEvent はイベントの種類を表します。
 // Directory が非空のイベントは、そのディレクトリへの read 権限を持つ
 // クライアントにのみ配信します（空の場合は全ログインユーザーへ配信）。
+// UserID が非空のイベントは、そのユーザーの接続にのみ配信します。
 type SSEEvent struct {
 	Data      interface{}
 	Type      string
 	Directory string
+	UserID    string
 }
 
 // sseClient は接続中のSSEクライアント1件を表します。
@@ -164,6 +168,48 @@ func (h *SSEHandler) BroadcastFileUpload(user *models.User, directory, filename
 	})
 }
 
+// BroadcastBatchUpload は一括アップロードで保存したファイルを1件のイベントにまとめてブロードキャストします。
+// directory はリクエストで指定された保存先で、files の保存先はその配下のサブディレクトリを含みます。
+func (h *SSEHandler) BroadcastBatchUpload(user *models.User, directory string, files []*batchFileResult) {
+	var total int64
+	items := make([]map[string]interface{}, 0, len(files))
+	for _, f := range files {
+		total += f.Size
+		items = append(items, map[string]interface{}{
+			"directory": f.Directory,
+			"filename":  f.Filename,
+			"size":      f.Size,
+		})
+	}
+	h.broadcast(SSEEvent{
+		Type:      "batch_upload",
+		Directory: directory,
+		Data: map[string]interface{}{
+			"username":  user.Username,
+			"user_id":   user.ID,
+			"directory": directory,
+			"count":     len(files),
+			"size":      total,
+			"files":     items,
+			"timestamp": time.Now().Format(time.RFC3339),
+		},
+	})
+}
+
+// BroadcastUploadProgress はチャンク・tus のアップロードの開始・進捗・終了を、
+// アップロード先ディレクトリへの閲覧権限を持つクライアントへブロードキャストします。
+func (h *SSEHandler) BroadcastUploadProgress(event storage.UploadEvent, username string) {
+	h.broadcast(SSEEvent{
+		Type:      "upload_progress",
+		Directory: event.Directory,
+		Data: struct {
+			storage.UploadEvent
+			Username  string `json:"username"`
+			Timestamp string `json:"timestamp"`
+		}{event, username, time.Now().Format(time.RFC3339)},
+	})
+}
+
 // BroadcastFileDownload はファイルダウンロードイベントをブロードキャストします。
 func (h *SSEHandler) BroadcastFileDownload(user *models.User, directory, filename string) {
 	h.broadcast(SSEEvent{
@@ -194,6 +240,16 @@ func (h *SSEHandler) BroadcastFileDelete(user *models.User, directory, filename
 	})
 }
 
+// BroadcastFetchProgress はURLからの取り込みの進捗を、取り込みを開始したユーザーにのみ送ります。
+func (h *SSEHandler) BroadcastFetchProgress(job fetcher.Job) {
+	h.broadcast(SSEEvent{
+		Type:      "fetch_progress",
+		Directory: job.Directory,
+		UserID:    job.UserID,
+		Data:      job,
+	})
+}
+
 // BroadcastUserLogin はユーザーログインイベントをブロードキャストします。
 func (h *SSEHandler) BroadcastUserLogin(user *models.User) {
 	h.broadcast(SSEEvent{
@@ -231,6 +287,9 @@ func (h *SSEHandler) broadcast(event SSEEvent) {
 // ディレクトリ付きイベントは、接続時に解決済みの読み取り可能集合に含まれる場合のみ
 // 配信します（スナップショット未解決なら情報漏えいを避けフェイルクローズ）。
 func (h *SSEHandler) canReceive(client *sseClient, event SSEEvent) bool {
+	if event.UserID != "" && event.UserID != client.userID {
+		return false
+	}
 	if event.Directory == "" {
 		return true
 	}
@@ -261,6 +320,29 @@ func (h *SSEHandler) RefreshUserFilter(userID string) {
 	}
 }
 
+// RefreshAllFilters は全接続について権限スナップショットを取り直し、通知イベントを送ります。
+// ロール宛てのメンバー共有のように、影響を受けるユーザーを特定しにくい変更の後に呼ばれます。
+func (h *SSEHandler) RefreshAllFilters() {
+	for _, userID := range h.ConnectedUserIDs() {
+		h.RefreshUserFilter(userID)
+	}
+}
+
+// ConnectedUserIDs は接続中のユーザーのIDを重複なく返します。
+func (h *SSEHandler) ConnectedUserIDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for c := range h.clients {
+		if !seen[c.userID] {
+			seen[c.userID] = true
+			ids = append(ids, c.userID)
+		}
+	}
+	return ids
+}
+
 // refreshFilter はクライアントの読み取り可能ディレクトリのスナップショットを取り直します。
 // 解決に失敗した場合は既存スナップショットを維持し、無ければ空（全拒否）を設定します。
 func (h *SSEHandler) refreshFilter(client *sseClient) {
@@ -0,0 +1,288 @@
+// Package handler はファイルサーバーのHTTPリクエストハンドラーを提供します。
+// このファイルは tus 1.0（https://tus.io/protocols/resumable-upload）のサーバー実装を含みます。
+// セッションはチャンクAPIと同じ storage.UploadManager で管理し、権限・同時アップロード数の制限も共通です。
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 -- tus の checksum 拡張で必須のアルゴリズム（改ざん検知ではなく転送誤りの検出に使う）
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileserver/internal/models"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	// tusChecksumAlgorithms は Upload-Checksum で受け付けるアルゴリズムです（sha1 は仕様上必須）。
+	tusChecksumAlgorithms = "sha1,sha256"
+	tusContentType        = "application/offset+octet-stream"
+)
+
+// tusResumable は Tus-Resumable ヘッダーを応答に付け、リクエストのバージョンを検証します。
+// 対応していないバージョンの場合は412を書き込み、false を返します。
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "対応していない tus のバージョンです", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// TusOptions はサーバーが対応する tus のバージョン・拡張・上限を返します。
+func (h *ChunkHandler) TusOptions(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.config.Storage.MaxChunkFileSize, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate はアップロードを作成します（creation 拡張）。
+// アップロード先とファイル名は Upload-Metadata の directory と filename（無ければ name）で受け取ります。
+func (h *ChunkHandler) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length には対応していません", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length が不正です", http.StatusBadRequest)
+		return
+	}
+	if length > h.config.Storage.MaxChunkFileSize {
+		http.Error(w, storage.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Upload-Metadata が不正です", http.StatusBadRequest)
+		return
+	}
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+	if filename == "" || meta["directory"] == "" {
+		http.Error(w, "Upload-Metadata に directory と filename が必要です", http.StatusBadRequest)
+		return
+	}
+
+	directory, policy, ok := h.prepareUpload(w, r, user, filename, meta["directory"], length, meta["on_conflict"])
+	if !ok {
+		return
+	}
+
+	session, err := h.uploadManager.CreateStreamSession(user.ID, filename, directory, length, policy)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "tusアップロード作成エラー", "error", err)
+		writeChunkError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "tusアップロード作成", "upload_id", session.UploadID, "user_id", user.ID, "filename", filename, "directory", directory, "size", length)
+
+	// 0バイトのファイルは PATCH が来ないため、作成と同時に確定させる。
+	if length == 0 {
+		if _, _, ok := h.completeUpload(w, r, user, session.UploadID); !ok {
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/files/tus/"+session.UploadID)
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead は受信済みのオフセットを返します（中断したアップロードの再開位置の確認）。
+func (h *ChunkHandler) TusHead(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	session, ok := h.tusSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadedSize, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.TotalSize, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch は Upload-Offset の位置からボディを書き込みます。
+// Upload-Checksum があればボディ全体を検証し、一致しなければ何も受け入れずに460を返します（checksum 拡張）。
+// 最後まで受信したら、チャンクAPIの完了と同じ検査・登録・スキャンを行ってからファイルを確定します。
+func (h *ChunkHandler) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type は "+tusContentType+" である必要があります", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset が不正です", http.StatusBadRequest)
+		return
+	}
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return
+	}
+	session, ok := h.tusSession(w, r)
+	if !ok {
+		return
+	}
+
+	var body io.Reader = r.Body
+	var verify func() error
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		hasher, want, err := parseUploadChecksum(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = io.TeeReader(r.Body, hasher)
+		verify = func() error {
+			if !bytes.Equal(hasher.Sum(nil), want) {
+				return storage.ErrChecksumMismatch
+			}
+			return nil
+		}
+	}
+
+	newOffset, err := h.uploadManager.WriteStream(session.UploadID, user.ID, offset, body, verify)
+	if err != nil {
+		slog.WarnContext(r.Context(), "tus書き込みエラー", "upload_id", session.UploadID, "offset", offset, "received", newOffset-offset, "error", err)
+		switch {
+		case errors.Is(err, storage.ErrInvalidChunk):
+			http.Error(w, "Upload-Length を超えるデータは受け付けられません", http.StatusRequestEntityTooLarge)
+		default:
+			writeChunkError(w, err)
+		}
+		return
+	}
+
+	if newOffset == session.TotalSize {
+		savedFile, _, ok := h.completeUpload(w, r, user, session.UploadID)
+		if !ok {
+			return
+		}
+		slog.InfoContext(r.Context(), "tusアップロード完了", "upload_id", session.UploadID, "final_path", savedFile.Path)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete はアップロードを中止し、受信済みのデータを削除します（termination 拡張）。
+func (h *ChunkHandler) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	session, ok := h.tusSession(w, r)
+	if !ok {
+		return
+	}
+	if err := h.uploadManager.CancelUpload(session.UploadID, session.UserID); err != nil {
+		writeChunkError(w, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "tusアップロード中止", "upload_id", session.UploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusSession はURLの {upload_id} から本人の tus セッションを引きます。
+// 期限切れは410（expiration 拡張）、他人・チャンクAPIのセッションは404として扱い、ok=falseを返します。
+func (h *ChunkHandler) tusSession(w http.ResponseWriter, r *http.Request) (*models.UploadSession, bool) {
+	user, ok := userFromContext(w, r)
+	if !ok {
+		return nil, false
+	}
+	uploadID := chi.URLParam(r, "upload_id")
+	if !validUploadID(w, uploadID) {
+		return nil, false
+	}
+	session, err := h.uploadManager.GetUploadSession(uploadID)
+	if err != nil || session.Protocol != models.UploadProtocolTus {
+		http.Error(w, storage.ErrSessionNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if session.UserID != user.ID {
+		http.Error(w, storage.ErrPermissionDenied.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		http.Error(w, "アップロードの有効期限が切れています", http.StatusGone)
+		return nil, false
+	}
+	return session, true
+}
+
+// parseTusMetadata は Upload-Metadata（"key base64値" のカンマ区切り。値は省略可）を解析します。
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("キーが空です")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%s の値がbase64ではありません: %w", key, err)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// parseUploadChecksum は Upload-Checksum（"アルゴリズム base64ダイジェスト"）を解析し、
+// ボディを通すハッシュと期待値を返します。
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	algo, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, fmt.Errorf("Upload-Checksum が不正です")
+	}
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Upload-Checksum のダイジェストが不正です")
+	}
+	switch algo {
+	case "sha1":
+		return sha1.New(), want, nil // #nosec G401 -- 転送誤りの検出用（上の import を参照）
+	case "sha256":
+		return sha256.New(), want, nil
+	default:
+		return nil, nil, fmt.Errorf("対応していないチェックサムのアルゴリズムです: %s（対応: %s）", algo, tusChecksumAlgorithms)
+	}
+}
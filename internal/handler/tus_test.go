@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+	"fileserver/internal/permission"
+	"fileserver/internal/scanner"
+	"fileserver/internal/storage"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// eicarScanner は内容に "EICAR" を含むファイルを検出するスキャナーです。
+type eicarScanner struct{}
+
+func (eicarScanner) Scan(_ context.Context, path string) (scanner.Verdict, error) {
+	b, err := os.ReadFile(path) // #nosec G304 -- テスト用の一時ディレクトリ内のパス
+	if err != nil {
+		return scanner.Verdict{}, err
+	}
+	if strings.Contains(string(b), "EICAR") {
+		return scanner.Verdict{Infected: true, Signature: "Test.Sig"}, nil
+	}
+	return scanner.Verdict{}, nil
+}
+
+// newTusTestRouter は alice が書き込める inbox を用意し、/files/tus で tus を受け付けるルーターを作ります。
+// 完了したアップロードは eicarScanner で検査します。
+func newTusTestRouter(t *testing.T) (*config.Config, *storage.UploadManager, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			UploadPath:           filepath.Join(dir, "uploads"),
+			MaxFileSize:          1 << 20,
+			MaxChunkFileSize:     1 << 20,
+			MaxConcurrentUploads: 10,
+			UploadSessionTTL:     time.Hour,
+			Directories: []config.DirectoryConfig{{
+				Path:   "inbox",
+				Grants: []config.GrantConfig{{User: "u1", Permissions: []string{"read", "write", "delete"}}},
+			}},
+		},
+		Scan: config.ScanConfig{Timeout: 10 * time.Second},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', 'u1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	um := storage.NewUploadManager(cfg, db)
+	um.SetStorageManager(sm)
+	pc := permission.NewChecker(cfg, &memberProvider{members: map[string]bool{"u1": true}}, sm, db)
+	h := NewChunkHandler(cfg, sm, um, pc)
+	h.SetScanManager(scanner.NewManager(cfg, db, sm, eicarScanner{}))
+
+	r := chi.NewRouter()
+	r.Post("/files/tus", h.TusCreate)
+	r.Head("/files/tus/{upload_id}", h.TusHead)
+	r.Patch("/files/tus/{upload_id}", h.TusPatch)
+	r.Delete("/files/tus/{upload_id}", h.TusDelete)
+	return cfg, um, r
+}
+
+// tusDo は alice として tus のリクエストを送ります。headers は "名前", "値" の順に並べます。
+func tusDo(router http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Username: "alice"}))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", tusContentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// tusCreate は inbox への size バイトのアップロードを作成し、そのURLを返します。
+func tusCreate(t *testing.T, router http.Handler, filename string, size int, metadata ...string) string {
+	t.Helper()
+	enc := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	meta := "filename " + enc(filename) + ",directory " + enc("inbox")
+	for i := 0; i+1 < len(metadata); i += 2 {
+		meta += "," + metadata[i] + " " + enc(metadata[i+1])
+	}
+	rec := tusDo(router, http.MethodPost, "/files/tus", "", "Upload-Length", strconv.Itoa(size), "Upload-Metadata", meta)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("作成: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	return rec.Header().Get("Location")
+}
+
+// inboxFiles は inbox にあるファイル名（作業ファイルを含む）を返します。
+func inboxFiles(t *testing.T, cfg *config.Config) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(cfg.Storage.UploadPath, "inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	enc := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	meta, err := parseTusMetadata("filename " + enc("報告書.pdf") + ",directory " + enc("user/alice") + ",is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["filename"] != "報告書.pdf" || meta["directory"] != "user/alice" {
+		t.Errorf("meta = %v", meta)
+	}
+	if v, ok := meta["is_confidential"]; !ok || v != "" {
+		t.Errorf("値の無いキーが空文字で入っていない: %v", meta)
+	}
+
+	if _, err := parseTusMetadata("filename not-base64!"); err == nil {
+		t.Error("base64でない値でエラーにならない")
+	}
+	if meta, err := parseTusMetadata(""); err != nil || len(meta) != 0 {
+		t.Errorf("空のヘッダー: meta = %v, err = %v", meta, err)
+	}
+}
+
+func TestParseUploadChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	h, want, err := parseUploadChecksum("sha256 " + base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("hello"))
+	if string(h.Sum(nil)) != string(want) {
+		t.Error("sha256 のダイジェストが一致しない")
+	}
+
+	if _, _, err := parseUploadChecksum("sha1 " + base64.StdEncoding.EncodeToString(make([]byte, 20))); err != nil {
+		t.Errorf("sha1 が受け付けられない: %v", err)
+	}
+	for _, bad := range []string{"md5 AAAA", "sha256", "sha256 %%%"} {
+		if _, _, err := parseUploadChecksum(bad); err == nil {
+			t.Errorf("parseUploadChecksum(%q) でエラーにならない", bad)
+		}
+	}
+}
+
+// オフセットの食い違いは409、Upload-Checksum の不一致は460で拒否し、どちらも受信済みの位置を進めないこと。
+// 途中から再開して最後まで送れること。
+func TestTusPatchOffsetAndChecksum(t *testing.T) {
+	_, _, router := newTusTestRouter(t)
+	location := tusCreate(t, router, "a.txt", 10)
+
+	if rec := tusDo(router, http.MethodPatch, location, "56789", "Upload-Offset", "5"); rec.Code != http.StatusConflict {
+		t.Errorf("オフセットの食い違い: status = %d, want 409", rec.Code)
+	}
+	wrong := sha256.Sum256([]byte("other"))
+	if rec := tusDo(router, http.MethodPatch, location, "01234", "Upload-Offset", "0",
+		"Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(wrong[:])); rec.Code != statusChecksumMismatch {
+		t.Errorf("チェックサムの不一致: status = %d, want %d", rec.Code, statusChecksumMismatch)
+	}
+	if rec := tusDo(router, http.MethodHead, location, ""); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("拒否後の HEAD: status = %d, Upload-Offset = %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	sum := sha256.Sum256([]byte("01234"))
+	rec := tusDo(router, http.MethodPatch, location, "01234", "Upload-Offset", "0",
+		"Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("前半: status = %d, Upload-Offset = %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := tusDo(router, http.MethodPatch, location, "56789", "Upload-Offset", "5"); rec.Code != http.StatusNoContent {
+		t.Errorf("後半: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+}
+
+// 中止すると受信済みの作業ファイルが消え、以降のリクエストは404になること。期限切れのアップロードは410になること。
+func TestTusTerminateAndExpire(t *testing.T) {
+	cfg, um, router := newTusTestRouter(t)
+	location := tusCreate(t, router, "a.txt", 10)
+	if rec := tusDo(router, http.MethodPatch, location, "01234", "Upload-Offset", "0"); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: status = %d", rec.Code)
+	}
+	if files := inboxFiles(t, cfg); len(files) != 1 || !strings.HasSuffix(files[0], ".temp") {
+		t.Fatalf("受信中の inbox = %v", files)
+	}
+
+	if rec := tusDo(router, http.MethodDelete, location, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("中止: status = %d", rec.Code)
+	}
+	if files := inboxFiles(t, cfg); len(files) != 0 {
+		t.Errorf("中止後の inbox = %v", files)
+	}
+	if rec := tusDo(router, http.MethodHead, location, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("中止後の HEAD: status = %d, want 404", rec.Code)
+	}
+
+	location = tusCreate(t, router, "b.txt", 10)
+	if _, err := um.SetUploadExpiry(context.Background(), strings.TrimPrefix(location, "/files/tus/"), time.Millisecond, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, method := range []string{http.MethodHead, http.MethodPatch} {
+		if rec := tusDo(router, method, location, "01234", "Upload-Offset", "0"); rec.Code != http.StatusGone {
+			t.Errorf("期限切れの %s: status = %d, want 410", method, rec.Code)
+		}
+	}
+}
+
+// 最後まで受信したアップロードは同名のファイルの扱い（on_conflict）とスキャンを経て確定すること。
+// 検出したファイルは置き換え対象の既存ファイルを消さずに隔離されること。
+func TestTusCompleteConflictAndScan(t *testing.T) {
+	cfg, _, router := newTusTestRouter(t)
+	upload := func(content string, metadata ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		location := tusCreate(t, router, "a.txt", len(content), metadata...)
+		return tusDo(router, http.MethodPatch, location, content, "Upload-Offset", "0")
+	}
+
+	for _, content := range []string{"first", "second"} {
+		if rec := upload(content); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: status = %d, body = %s", content, rec.Code, rec.Body.String())
+		}
+	}
+	files := inboxFiles(t, cfg)
+	if len(files) != 2 {
+		t.Fatalf("inbox = %v", files)
+	}
+	renamed := 0
+	for _, name := range files {
+		if strings.HasSuffix(name, "_a (2).txt") {
+			renamed++
+		}
+	}
+	if renamed != 1 {
+		t.Errorf("2つ目が別名で保存されていない: %v", files)
+	}
+
+	// reject は受信を始める前に断る。
+	rec := tusDo(router, http.MethodPost, "/files/tus", "", "Upload-Length", "1", "Upload-Metadata",
+		"filename "+base64.StdEncoding.EncodeToString([]byte("a.txt"))+",directory "+base64.StdEncoding.EncodeToString([]byte("inbox"))+
+			",on_conflict "+base64.StdEncoding.EncodeToString([]byte("reject")))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reject: status = %d, want 409", rec.Code)
+	}
+	if rec := upload("EICAR", "on_conflict", "replace"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("検出: status = %d, want 422", rec.Code)
+	}
+	if got := inboxFiles(t, cfg); len(got) != 2 {
+		t.Errorf("拒否・隔離後の inbox = %v, want 既存の2件のまま", got)
+	}
+	if entries, err := os.ReadDir(cfg.QuarantinePath()); err != nil || len(entries) != 1 {
+		t.Errorf("隔離領域 = %d 件, %v", len(entries), err)
+	}
+}
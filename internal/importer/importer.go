@@ -0,0 +1,275 @@
+// Package importer は既存のディレクトリツリーを設定済みディレクトリへ一括で取り込みます。
+// 旧ファイル共有からの移行用で、`fileserver import` サブコマンドから使います。
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+	"fileserver/internal/storage"
+)
+
+// importNamespace は保存名のUUIDを決定的に生成するための名前空間です。
+// 同じ取り込み元ファイルは再実行しても同じ保存名になるため、中断後の再開で
+// 「コピー済みだがメタデータ未登録」のファイルを重複させずに登録し直せます。
+var importNamespace = uuid.MustParse("6f1d2c3e-8a4b-4e5f-9c7d-0b1a2e3f4d5c")
+
+// ErrUnknownUploader は指定されたアップロード者が users に存在しない場合のエラーです。
+var ErrUnknownUploader = errors.New("指定されたアップロード者が見つかりません")
+
+// Options は取り込みの指定です。
+type Options struct {
+	Source       string // 取り込み元のローカルディレクトリ
+	Directory    string // 取り込み先（アップロードディレクトリからの相対パス）
+	UploaderID   string // 空の場合は uploader_id をNULLで記録する
+	UploaderName string
+	DryRun       bool // true の場合はコピー・登録せず件数のみ数える
+}
+
+// Result は取り込みの結果です。
+type Result struct {
+	Imported int   `json:"imported"`
+	Skipped  int   `json:"skipped"` // 同じ内容が取り込み先に登録済み（再実行時の取り込み済みを含む）
+	Failed   int   `json:"failed"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Importer はローカルのツリーを取り込みます。
+type Importer struct {
+	config  *config.Config
+	db      *sql.DB
+	storage *storage.Manager
+}
+
+// New は Importer を作成します。
+func New(cfg *config.Config, db *sql.DB, sm *storage.Manager) *Importer {
+	return &Importer{config: cfg, db: db, storage: sm}
+}
+
+// ResolveUploader はユーザーIDまたはユーザー名からアップロード者を解決します。
+// 空文字の場合は実在ユーザーに紐付けず "system" として記録します。
+func (im *Importer) ResolveUploader(ctx context.Context, name string) (id, username string, err error) {
+	if name == "" || name == models.SystemUsername {
+		return "", models.SystemUsername, nil
+	}
+	err = im.db.QueryRowContext(ctx,
+		"SELECT id, username FROM users WHERE id = ? OR username = ? ORDER BY id = ? DESC LIMIT 1",
+		name, name, name).Scan(&id, &username)
+	if err == sql.ErrNoRows {
+		return "", "", fmt.Errorf("%w: %s", ErrUnknownUploader, name)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("ユーザーの取得に失敗しました: %w", err)
+	}
+	return id, username, nil
+}
+
+// Run は opts.Source 配下のファイルを opts.Directory へ取り込みます。
+// サブディレクトリ構成・元のファイル名・更新日時を保ち、取り込み先に同じ内容
+// （SHA-256が一致）のファイルが登録済みならスキップします。個々のファイルの失敗は
+// Result.Failed に数えて続行し、ctx のキャンセルでは中断します（再実行で続きから再開できる）。
+func (im *Importer) Run(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+
+	directory, err := im.validateDirectory(opts.Directory)
+	if err != nil {
+		return result, err
+	}
+	info, err := os.Stat(opts.Source)
+	if err != nil {
+		return result, fmt.Errorf("取り込み元を開けません: %w", err)
+	}
+	if !info.IsDir() {
+		return result, fmt.Errorf("取り込み元はディレクトリである必要があります: %s", opts.Source)
+	}
+
+	err = filepath.WalkDir(opts.Source, func(p string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			slog.Warn("取り込み元の読み取りに失敗しました", "path", p, "error", err)
+			result.Failed++
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			// シンボリックリンク等は取り込み元の外を指し得るため辿らない。
+			return nil
+		}
+		if storage.IsWorkFile(d.Name()) {
+			// 作業ファイルと同じ拡張子は一覧に表示されないため取り込まない。
+			slog.Warn("作業ファイルと同じ拡張子のためスキップしました", "path", p)
+			result.Failed++
+			return nil
+		}
+
+		rel, err := filepath.Rel(opts.Source, p)
+		if err != nil {
+			return err
+		}
+		destDir := directory
+		if relDir := filepath.ToSlash(filepath.Dir(rel)); relDir != "." {
+			destDir = path.Join(directory, sanitizeRelDir(relDir))
+		}
+
+		imported, size, err := im.importFile(p, filepath.ToSlash(rel), destDir, opts)
+		switch {
+		case err != nil:
+			slog.Warn("ファイルの取り込みに失敗しました", "path", p, "error", err)
+			result.Failed++
+		case imported:
+			result.Imported++
+			result.Bytes += size
+		default:
+			result.Skipped++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// importFile は1ファイルを取り込みます。登録済みの内容ならスキップして false を返します。
+func (im *Importer) importFile(src, rel, destDir string, opts Options) (bool, int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, 0, err
+	}
+	hash, err := hashFile(src)
+	if err != nil {
+		return false, 0, err
+	}
+	if existing, err := im.storage.FindByHash(destDir, hash); err != nil {
+		return false, 0, err
+	} else if existing != "" {
+		slog.Debug("取り込み済みのためスキップしました", "path", src, "existing", existing)
+		return false, 0, nil
+	}
+	if opts.DryRun {
+		return true, info.Size(), nil
+	}
+
+	fileID := uuid.NewSHA1(importNamespace, []byte(rel+"\x00"+hash)).String()
+	storedName := storage.StoredFilename(fileID, filepath.Base(src))
+	destPath := filepath.Join(im.config.Storage.UploadPath, destDir, storedName)
+
+	// 前回の実行がコピー後・登録前に中断していれば、コピーを省いて登録だけ行う。
+	if _, err := os.Stat(destPath); os.IsNotExist(err) {
+		if err := copyFile(src, destPath); err != nil {
+			return false, 0, err
+		}
+	} else if err != nil {
+		return false, 0, err
+	}
+	if err := os.Chtimes(destPath, info.ModTime(), info.ModTime()); err != nil {
+		return false, 0, fmt.Errorf("更新日時の設定に失敗しました: %w", err)
+	}
+
+	if err := im.storage.SaveFileMetadata(destDir, storedName, opts.UploaderID, opts.UploaderName); err != nil {
+		return false, 0, err
+	}
+	slog.Info("ファイルを取り込みました", "path", src, "directory", destDir, "filename", storedName, "size", info.Size())
+	return true, info.Size(), nil
+}
+
+// validateDirectory は取り込み先が設定済みディレクトリ（またはその配下）かを検証し、正規化して返します。
+func (im *Importer) validateDirectory(directory string) (string, error) {
+	directory = strings.Trim(path.Clean("/"+filepath.ToSlash(directory)), "/")
+	if directory == "" {
+		return "", fmt.Errorf("取り込み先のディレクトリを指定してください")
+	}
+	top, rest, _ := strings.Cut(directory, "/")
+	dirCfg := im.config.GetDirectoryConfig(top)
+	if dirCfg == nil {
+		return "", fmt.Errorf("設定されていないディレクトリです: %s", top)
+	}
+	// 個人フォルダの直下はファイルを置く場所ではないため、"user/<名前>" を要求する。
+	if dirCfg.Type == "user_private" && rest == "" {
+		return "", fmt.Errorf("%s は個人用のため %s/<ユーザー名> の形で指定してください", top, top)
+	}
+	return directory, nil
+}
+
+// sanitizeRelDir はサブディレクトリの各要素を無害化します。
+func sanitizeRelDir(relDir string) string {
+	parts := strings.Split(relDir, "/")
+	for i, p := range parts {
+		parts[i] = models.SanitizeDirName(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// hashFile はファイルのSHA-256を16進文字列で返します（storage の記録形式と同じ）。
+func hashFile(p string) (string, error) {
+	// #nosec G304 - 管理者がコマンドラインで指定した取り込み元のファイル
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("ハッシュ計算に失敗しました: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile は src を dst へコピーします。途中で失敗・中断しても不完全なファイルが
+// 一覧に出ないよう、作業ファイル（.temp）へ書き切ってからリネームします。
+func copyFile(src, dst string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return fmt.Errorf("ディレクトリの作成に失敗しました: %w", err)
+	}
+
+	// #nosec G304 - 管理者がコマンドラインで指定した取り込み元のファイル
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	tmp := dst + ".temp"
+	// #nosec G304 - 取り込み先はアップロードディレクトリ配下で組み立てたパス
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("ファイル作成エラー: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return fmt.Errorf("ファイルのコピーに失敗しました: %w", err)
+	}
+	if err = out.Sync(); err != nil {
+		return fmt.Errorf("ファイルの同期に失敗しました: %w", err)
+	}
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("ファイルのクローズに失敗しました: %w", err)
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("ファイルの移動に失敗しました: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/storage"
+)
+
+func newTestImporter(t *testing.T) (*Importer, *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath: filepath.Join(dir, "uploads"),
+		Directories: []config.DirectoryConfig{
+			{Path: "user", Type: "user_private"},
+			{Path: "archive"},
+		},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(cfg, db, storage.NewManager(cfg, db)), cfg
+}
+
+func writeSource(t *testing.T, root, rel, content string, mtime time.Time) {
+	t.Helper()
+	p := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 構成・元の名前・更新日時を保って取り込み、再実行では何も取り込まないこと。
+func TestRunImportsTreeAndResumes(t *testing.T) {
+	im, cfg := newTestImporter(t)
+	ctx := context.Background()
+	src := t.TempDir()
+	mtime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	writeSource(t, src, "a.txt", "aaa", mtime)
+	writeSource(t, src, "2019/report_final.pdf", "pdf", mtime)
+	writeSource(t, src, "2019/copy-of-a.txt", "aaa", mtime) // 別ディレクトリなら同じ内容でも取り込む
+
+	opts := Options{Source: src, Directory: "archive", UploaderName: "system"}
+	r, err := im.Run(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Imported != 3 || r.Skipped != 0 || r.Failed != 0 {
+		t.Fatalf("result = %+v, want 3 imported", r)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(cfg.Storage.UploadPath, "archive", "2019"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), "_report_final.pdf") {
+			found = true
+			info, err := e.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(mtime) {
+				t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+			}
+		}
+		if storage.IsWorkFile(e.Name()) {
+			t.Errorf("作業ファイルが残っている: %s", e.Name())
+		}
+	}
+	if !found {
+		t.Errorf("UUID接頭辞付きの保存名が見つからない: %v", entries)
+	}
+
+	r, err = im.Run(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Imported != 0 || r.Skipped != 3 {
+		t.Errorf("再実行 result = %+v, want 0 imported / 3 skipped", r)
+	}
+}
+
+// 同じディレクトリ内で内容が重複するファイルは1つだけ取り込むこと。
+func TestRunSkipsDuplicatesByHash(t *testing.T) {
+	im, _ := newTestImporter(t)
+	src := t.TempDir()
+	writeSource(t, src, "one.txt", "same", time.Now())
+	writeSource(t, src, "two.txt", "same", time.Now())
+
+	r, err := im.Run(context.Background(), Options{Source: src, Directory: "archive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Imported != 1 || r.Skipped != 1 {
+		t.Errorf("result = %+v, want 1 imported / 1 skipped", r)
+	}
+}
+
+// コピー後・登録前に中断した場合、再実行でコピーを重複させず登録だけ行うこと。
+func TestRunResumesCopiedButUnregistered(t *testing.T) {
+	im, cfg := newTestImporter(t)
+	src := t.TempDir()
+	writeSource(t, src, "big.bin", "payload", time.Now())
+
+	opts := Options{Source: src, Directory: "archive"}
+	hash, err := hashFile(filepath.Join(src, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 前回の実行で決定的な保存名のままコピーだけ済んだ状態を作る。
+	first, err := im.Run(context.Background(), opts)
+	if err != nil || first.Imported != 1 {
+		t.Fatalf("first = %+v, err = %v", first, err)
+	}
+	if _, err := im.db.Exec("DELETE FROM file_metadata"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := im.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Imported != 1 {
+		t.Errorf("result = %+v, want 1 imported", r)
+	}
+	entries, err := os.ReadDir(filepath.Join(cfg.Storage.UploadPath, "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("ファイルが重複してコピーされた: %v", entries)
+	}
+	if name, _ := im.storage.FindByHash("archive", hash); name != entries[0].Name() {
+		t.Errorf("登録名 = %q, want %q", name, entries[0].Name())
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	im, cfg := newTestImporter(t)
+	src := t.TempDir()
+	writeSource(t, src, "a.txt", "abc", time.Now())
+
+	r, err := im.Run(context.Background(), Options{Source: src, Directory: "archive", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Imported != 1 || r.Bytes != 3 {
+		t.Errorf("result = %+v, want 1 imported / 3 bytes", r)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Storage.UploadPath, "archive")); !os.IsNotExist(err) {
+		t.Error("dry-run でファイルが書き込まれた")
+	}
+}
+
+func TestValidateDirectory(t *testing.T) {
+	im, _ := newTestImporter(t)
+	cases := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"archive", "archive", true},
+		{"/archive/old/", "archive/old", true},
+		{"archive/../../etc", "", false},
+		{"unknown", "", false},
+		{"user", "", false},
+		{"user/alice", "user/alice", true},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		got, err := im.validateDirectory(c.in)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("validateDirectory(%q) = (%q, %v), want (%q, ok=%v)", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestResolveUploader(t *testing.T) {
+	im, _ := newTestImporter(t)
+	ctx := context.Background()
+	if _, err := im.db.Exec(
+		"INSERT INTO users (id, provider, subject, username) VALUES ('42', 'discord', '42', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"42", "alice"} {
+		id, username, err := im.ResolveUploader(ctx, name)
+		if err != nil || id != "42" || username != "alice" {
+			t.Errorf("ResolveUploader(%q) = (%q, %q, %v)", name, id, username, err)
+		}
+	}
+	if id, username, err := im.ResolveUploader(ctx, ""); err != nil || id != "" || username != "system" {
+		t.Errorf("ResolveUploader(\"\") = (%q, %q, %v), want system", id, username, err)
+	}
+	if _, _, err := im.ResolveUploader(ctx, "nobody"); !errors.Is(err, ErrUnknownUploader) {
+		t.Errorf("未知のユーザーで err = %v", err)
+	}
+}
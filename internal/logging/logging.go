@@ -24,6 +24,12 @@ func ParseLevel(s string) slog.Level {
 	}
 }
 
+// Audit は監査対象の操作（保持期間による拒否・リーガルホールドの設定等）を記録します。
+// 監査用の永続テーブルは持たず、"audit" 属性（操作名）付きの構造化ログとしてログ収集基盤で抽出します。
+func Audit(ctx context.Context, action string, args ...any) {
+	slog.InfoContext(ctx, "監査ログ", append([]any{"audit", action}, args...)...)
+}
+
 // ContextHandler はリクエストコンテキストの request_id を全ログ行へ自動付与する
 // slog.Handler ラッパーです。ハンドラ内で *Context 版のログ関数
 // （InfoContext 等）に r.Context() を渡すと、アクセスログと同じ request_id で
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/authprovider"
+	"fileserver/internal/models"
+)
+
+// errAllowanceExceeded は Content-Length の無いアップロードが転送量の残りを超えた場合に本文の読み取りを止めるエラーです。
+var errAllowanceExceeded = errors.New("転送量の上限を超えました")
+
+// Allowance はユーザーごとの1日・1か月あたりの転送量の上限を適用し、実際に転送したバイト数を数えるミドルウェアです。
+// Bandwidth と同じく AuthMiddleware の後に、ファイルの転送を行うルートにだけ付けます（GET はダウンロード、それ以外はアップロード）。
+// 使い切っている場合と、アップロードの Content-Length が残りを超える場合は 429 と Retry-After を返します。
+// ダウンロードの大きさはハンドラーが allowance.FromContext の Quota で判定します。
+func Allowance(provider authprovider.Provider, tracker *allowance.Tracker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(models.UserContextKey).(*models.User)
+			if !ok || !tracker.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			roles, err := provider.GetUserRoles(r.Context(), user.Subject)
+			if err != nil {
+				// ロールが分からない場合は既定の上限で判定する。
+				slog.WarnContext(r.Context(), "転送量の上限: ロール情報取得エラー", "error", err, "user_id", user.ID)
+			}
+
+			direction := allowance.Upload
+			if r.Method == http.MethodGet {
+				direction = allowance.Download
+			}
+			quota, err := tracker.Check(r.Context(), user.ID, roles, direction)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "転送量の取得エラー", "error", err, "user_id", user.ID)
+				http.Error(w, "転送量の確認に失敗しました", http.StatusInternalServerError)
+				return
+			}
+			if quota != nil {
+				if quota.Remaining == 0 {
+					quota.Reject(w)
+					return
+				}
+				if direction == allowance.Upload && r.ContentLength > 0 && !quota.Allow(w, r.ContentLength) {
+					return
+				}
+				r = r.WithContext(allowance.NewContext(r.Context(), quota))
+			}
+
+			var transferred int64
+			defer func() {
+				// 途中で切断されたリクエストも送受信した分は数えるため、キャンセルされない context で記録する。
+				if err := tracker.Record(context.WithoutCancel(r.Context()), user.ID, direction, transferred); err != nil {
+					slog.ErrorContext(r.Context(), "転送量の記録エラー", "error", err, "user_id", user.ID)
+				}
+			}()
+
+			if direction == allowance.Upload {
+				if r.Body != nil && r.Body != http.NoBody {
+					limit := int64(-1)
+					if quota != nil {
+						limit = quota.Remaining
+					}
+					r.Body = &countingBody{ReadCloser: r.Body, n: &transferred, limit: limit}
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&countingWriter{ResponseWriter: w, n: &transferred}, r)
+		})
+	}
+}
+
+// countingBody は読み取ったリクエストボディのバイト数を数えます。
+// limit（-1 は無制限）を超えた時点で errAllowanceExceeded を返して読み取りを止めます。
+type countingBody struct {
+	io.ReadCloser
+	n     *int64
+	limit int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	if b.limit < 0 {
+		n, err := b.ReadCloser.Read(p)
+		*b.n += int64(n)
+		return n, err
+	}
+	if *b.n > b.limit {
+		return 0, errAllowanceExceeded
+	}
+	// 残りより1バイトだけ多く読み、上限ちょうどで終わる本文と上限を超える本文を見分ける。
+	p = p[:min(int64(len(p)), b.limit-*b.n+1)]
+	n, err := b.ReadCloser.Read(p)
+	*b.n += int64(n)
+	if *b.n > b.limit {
+		return n, errAllowanceExceeded
+	}
+	return n, err
+}
+
+// countingWriter は書き込んだレスポンスボディのバイト数を数えます。
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	*cw.n += int64(n)
+	return n, err
+}
+
+// Unwrap は http.ResponseController が元の ResponseWriter の機能を使えるようにします。
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
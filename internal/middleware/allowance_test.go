@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/allowance"
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/models"
+)
+
+func newTestAllowance(t *testing.T, limits config.AllowanceLimits) (*sql.DB, *config.Config, *allowance.Tracker) {
+	t.Helper()
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cfg := &config.Config{Allowance: config.AllowanceConfig{AllowanceLimits: limits}}
+	return db, cfg, allowance.NewTracker(cfg, db)
+}
+
+// doAllowance は u1 として req を Allowance ミドルウェアに通し、next を呼びます。
+func doAllowance(tracker *allowance.Tracker, req *http.Request, next http.HandlerFunc) *httptest.ResponseRecorder {
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, &models.User{ID: "u1", Subject: "s1"}))
+	rec := httptest.NewRecorder()
+	Allowance(&rolesProvider{}, tracker)(next).ServeHTTP(rec, req)
+	return rec
+}
+
+// drain は本文を読み捨てて 200 を返すハンドラーです。
+func drain(w http.ResponseWriter, r *http.Request) {
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	}
+}
+
+// 残りを超える Content-Length と、使い切った後のリクエストは、ハンドラーを呼ばずに 429 と Retry-After で拒否されること。
+func TestAllowanceRejects(t *testing.T) {
+	_, _, tracker := newTestAllowance(t, config.AllowanceLimits{UploadDaily: 100})
+	called := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		drain(w, r)
+	}
+
+	if rec := doAllowance(tracker, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 101))), next); rec.Code != http.StatusTooManyRequests || called {
+		t.Fatalf("残りを超える Content-Length: status = %d, called = %v", rec.Code, called)
+	}
+	if rec := doAllowance(tracker, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 100))), next); rec.Code != http.StatusOK || !called {
+		t.Fatalf("残りちょうど: status = %d, called = %v", rec.Code, called)
+	}
+
+	called = false
+	rec := doAllowance(tracker, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("x")), next)
+	if rec.Code != http.StatusTooManyRequests || called {
+		t.Fatalf("使い切った後: status = %d, called = %v", rec.Code, called)
+	}
+	// 日次の上限は翌日0時に戻る。
+	retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retry < 1 || retry > 24*60*60 {
+		t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+
+	// ダウンロードには上限が無いため通る。
+	if rec := doAllowance(tracker, httptest.NewRequest(http.MethodGet, "/files/a.txt", nil), next); rec.Code != http.StatusOK {
+		t.Errorf("上限の無い向き: status = %d", rec.Code)
+	}
+}
+
+// Content-Length の無いアップロードは残りを超えた時点で読み取りが止まり、数えるのは読み取った分だけであること。
+func TestAllowanceStopsBodyAtLimit(t *testing.T) {
+	_, _, tracker := newTestAllowance(t, config.AllowanceLimits{UploadDaily: 100})
+	ctx := context.Background()
+
+	var read int64
+	var readErr error
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 1000)))
+	req.ContentLength = -1
+	doAllowance(tracker, req, func(w http.ResponseWriter, r *http.Request) {
+		read, readErr = io.Copy(io.Discard, r.Body)
+	})
+	if !errors.Is(readErr, errAllowanceExceeded) || read > 101 {
+		t.Fatalf("読み取り = %d バイト, %v, want 101 バイト以下で errAllowanceExceeded", read, readErr)
+	}
+
+	st, err := tracker.Status(ctx, "u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Upload.Daily.Used != read || st.Upload.Daily.Remaining != 0 {
+		t.Errorf("転送量 = %+v, want 読み取った %d バイト", st.Upload.Daily, read)
+	}
+
+	// 上限ちょうどで終わる本文はエラーにならない。
+	body := &countingBody{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 100))), n: new(int64), limit: 100}
+	if n, err := io.Copy(io.Discard, body); err != nil || n != 100 {
+		t.Errorf("上限ちょうどの本文 = %d, %v", n, err)
+	}
+}
+
+// Range のダウンロードは実際に送ったバイト数だけを数えること。
+func TestAllowanceCountsRangeResponse(t *testing.T) {
+	_, _, tracker := newTestAllowance(t, config.AllowanceLimits{DownloadDaily: 10000})
+	content := bytes.Repeat([]byte("d"), 5000)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if q := allowance.FromContext(r.Context()); q == nil || q.Remaining != 10000 {
+			t.Errorf("ハンドラーへ渡された Quota = %+v", q)
+		}
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(content))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/a.bin", nil)
+	req.Header.Set("Range", "bytes=100-399")
+	if rec := doAllowance(tracker, req, serve); rec.Code != http.StatusPartialContent || rec.Body.Len() != 300 {
+		t.Fatalf("Range: status = %d, %d バイト", rec.Code, rec.Body.Len())
+	}
+	st, err := tracker.Status(context.Background(), "u1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Download.Daily.Used != 300 {
+		t.Errorf("Range の転送量 = %d, want 300", st.Download.Daily.Used)
+	}
+}
+
+// 転送量は transfer_usage の日次・月次の両方に残り、再起動（Tracker の作り直し）後の判定にも使われること。
+func TestAllowancePersistsUsage(t *testing.T) {
+	db, cfg, tracker := newTestAllowance(t, config.AllowanceLimits{UploadDaily: 1000, UploadMonthly: 1500})
+	ctx := context.Background()
+
+	if rec := doAllowance(tracker, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 600))), drain); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT period, bytes FROM transfer_usage WHERE user_id = 'u1' AND direction = 'upload' ORDER BY period")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	for rows.Next() {
+		var period string
+		var n int64
+		if err := rows.Scan(&period, &n); err != nil {
+			t.Fatal(err)
+		}
+		got[period] = n
+	}
+	rows.Close()
+	now := time.Now()
+	if len(got) != 2 || got[now.Format("2006-01-02")] != 600 || got[now.Format("2006-01")] != 600 {
+		t.Fatalf("transfer_usage = %v", got)
+	}
+
+	restarted := allowance.NewTracker(cfg, db)
+	q, err := restarted.Check(ctx, "u1", nil, allowance.Upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Remaining != 400 || q.Period != "1日" {
+		t.Errorf("再起動後の Check = %+v", q)
+	}
+	if rec := doAllowance(restarted, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 500))), drain); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("再起動後に残りを超える: status = %d, want 429", rec.Code)
+	}
+}
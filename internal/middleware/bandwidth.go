@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/bandwidth"
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+)
+
+// Bandwidth はリクエストボディ（アップロード）とレスポンス（ダウンロード）の転送を帯域の上限に合わせて待たせ、
+// ユーザーごとの転送速度を数えるミドルウェアです。AuthMiddleware の後に、ファイルの転送を行うルートにだけ付けます。
+// 上限が設定されていない場合もロールは引かずに速度だけを数えます。
+func Bandwidth(cfg *config.Config, provider authprovider.Provider, limiter *bandwidth.Manager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(models.UserContextKey).(*models.User)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var roles []string
+			if cfg.Bandwidth.Enabled() {
+				var err error
+				roles, err = provider.GetUserRoles(r.Context(), user.Subject)
+				if err != nil {
+					// ロールが分からない場合は1人あたりの既定の上限で続ける（転送自体は止めない）。
+					slog.WarnContext(r.Context(), "帯域制限: ロール情報取得エラー", "error", err, "user_id", user.ID)
+				}
+			}
+
+			transfer := limiter.Begin(user, roles)
+			defer transfer.End()
+
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{transfer.Reader(r.Context(), r.Body), r.Body}
+			}
+			next.ServeHTTP(&throttledWriter{ResponseWriter: w, w: transfer.Writer(r.Context(), w)}, r)
+		})
+	}
+}
+
+// throttledWriter はレスポンスボディの書き込みだけを帯域制限付きの Writer に通します。
+type throttledWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	return tw.w.Write(b)
+}
+
+// Unwrap は http.ResponseController が元の ResponseWriter の機能を使えるようにします。
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
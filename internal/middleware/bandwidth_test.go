@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/bandwidth"
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+)
+
+// rolesProvider は subject ごとに決めたロールを返します。
+type rolesProvider struct {
+	authprovider.Provider
+	roles map[string][]string
+}
+
+func (p *rolesProvider) GetUserRoles(_ context.Context, subject string) ([]string, error) {
+	return p.roles[subject], nil
+}
+
+// doTransfer は user として body をアップロードし、ハンドラーが download バイトを返すリクエストを mw に通します。
+// ハンドラーが読み取った本文・受け取ったレスポンスとかかった時間を返します。
+func doTransfer(t *testing.T, mw func(http.Handler) http.Handler, user *models.User, body []byte, download int) (received, response []byte, elapsed time.Duration) {
+	t.Helper()
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if received, err = io.ReadAll(r.Body); err != nil {
+			t.Errorf("本文の読み取り: %v", err)
+		}
+		w.Write(bytes.Repeat([]byte("d"), download)) //nolint:errcheck // テスト用のレスポンス
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), models.UserContextKey, user))
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+	return received, rec.Body.Bytes(), time.Since(start)
+}
+
+// 上限を超えるアップロードとダウンロードは、バケットの容量（1秒分）を超えた分だけ待たされること。
+// 本文とレスポンスは欠けずに届くこと。
+func TestBandwidthThrottles(t *testing.T) {
+	const limit = 128 * 1024
+	cfg := &config.Config{Bandwidth: config.BandwidthConfig{PerUser: limit}}
+	mw := Bandwidth(cfg, &rolesProvider{}, bandwidth.New(cfg))
+
+	// 容量を使い切った後の limit/4 バイトは 250ms かかる（アップロードとダウンロードは同じバケットを使う）。
+	body := bytes.Repeat([]byte("u"), limit)
+	received, response, elapsed := doTransfer(t, mw, &models.User{ID: "u1", Subject: "s1"}, body, limit/4)
+	if !bytes.Equal(received, body) || len(response) != limit/4 {
+		t.Fatalf("転送した内容 = %d, %d バイト", len(received), len(response))
+	}
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("上限を超える転送の所要時間 = %v, want >= 250ms", elapsed)
+	}
+}
+
+// 管理者（admin 未設定）とロールで無制限のユーザー、上限の無い設定では、1人あたりの上限を何倍超えても待たずに通ること。
+func TestBandwidthBypass(t *testing.T) {
+	const limit = 64 * 1024
+	body := bytes.Repeat([]byte("u"), 4*limit)
+
+	cfg := &config.Config{
+		Storage: config.StorageConfig{AdminRoleID: "admin"},
+		Bandwidth: config.BandwidthConfig{
+			PerUser: limit,
+			Roles:   []config.RoleBandwidth{{Role: "staff", Limit: 0}},
+		},
+	}
+	provider := &rolesProvider{roles: map[string][]string{"admin": {"admin"}, "staff": {"staff"}}}
+	mw := Bandwidth(cfg, provider, bandwidth.New(cfg))
+	for _, user := range []*models.User{
+		{ID: "a1", Subject: "admin"},
+		{ID: "s1", Subject: "staff"},
+	} {
+		received, response, elapsed := doTransfer(t, mw, user, body, 4*limit)
+		if !bytes.Equal(received, body) || len(response) != 4*limit {
+			t.Fatalf("%s: 転送した内容 = %d, %d バイト", user.Subject, len(received), len(response))
+		}
+		// 制限されていれば7秒かかる。
+		if elapsed > time.Second {
+			t.Errorf("%s: 所要時間 = %v, want 待たずに通る", user.Subject, elapsed)
+		}
+	}
+
+	cfg = &config.Config{}
+	mw = Bandwidth(cfg, &rolesProvider{}, bandwidth.New(cfg))
+	received, response, elapsed := doTransfer(t, mw, &models.User{ID: "u1", Subject: "s1"}, body, 4*limit)
+	if !bytes.Equal(received, body) || len(response) != 4*limit || elapsed > time.Second {
+		t.Errorf("上限なし: %d, %d バイト, 所要時間 = %v", len(received), len(response), elapsed)
+	}
+}
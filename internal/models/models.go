@@ -21,6 +21,11 @@ func SanitizeDirName(name string) string {
 	return name
 }
 
+// SystemUsername はAPIを経由せず置かれたファイル（rsync・NAS共有等）の
+// アップロード者として表示・通知に用いる名前です。実在ユーザーではないため
+// file_metadata.uploader_id はNULLで記録します。
+const SystemUsername = "system"
+
 // User は認証済みユーザーを表します。
 // 認証プロバイダーを1つに限定しているため、ID にはプロバイダー内のsubjectをそのまま用います。
 type User struct {
@@ -65,16 +70,25 @@ type AccessLog struct {
 
 // FileInfo は一覧表示に用いるファイルまたはディレクトリの情報を表します。
 type FileInfo struct {
-	ModifiedAt   time.Time `json:"modified_at"`
-	Filename     string    `json:"filename"`
-	OriginalName string    `json:"original_name"`
-	Uploader     string    `json:"uploader"`
-	Hash         string    `json:"hash"`
-	Path         string    `json:"path"` // ファイル/ディレクトリの相対パス
-	Size         int64     `json:"size"`
-	IsDirectory  bool      `json:"is_directory"`
+	ModifiedAt   time.Time  `json:"modified_at"`
+	Filename     string     `json:"filename"`
+	OriginalName string     `json:"original_name"`
+	Uploader     string     `json:"uploader"`
+	Hash         string     `json:"hash"`
+	RetainUntil  *time.Time `json:"retain_until,omitempty"` // 保持期限（WORMディレクトリのみ）
+	ScanStatus   string     `json:"scan_status,omitempty"`  // clean / error / released（未スキャンは省略）
+	SourceURL    string     `json:"source_url,omitempty"`   // URLから取り込んだファイルの取得元
+	Path         string     `json:"path"`                   // ファイル/ディレクトリの相対パス
+	Size         int64      `json:"size"`
+	IsDirectory  bool       `json:"is_directory"`
+	LegalHold    bool       `json:"legal_hold,omitempty"`
 }
 
+// UploadProtocolTus は tus プロトコル（/files/tus）で作られたアップロードセッションを表します。
+// tus のセッションはチャンク番号ではなくオフセット（UploadedSize）で進捗を管理し、
+// 全体を1チャンク（ChunkSize = TotalSize）として扱います。
+const UploadProtocolTus = "tus"
+
 // UploadSession は進行中のチャンク分割アップロードの状態を表します。
 type UploadSession struct {
 	CreatedAt      time.Time `json:"created_at"`
@@ -84,9 +98,26 @@ type UploadSession struct {
 	UserID         string    `json:"user_id"`
 	Filename       string    `json:"filename"`
 	Directory      string    `json:"directory"`
+	Protocol       string    `json:"protocol,omitempty"`    // 空はチャンクAPI、"tus" は tus
+	FileSHA256     string    `json:"file_sha256,omitempty"` // 初期化時に宣言されたファイル全体のSHA-256（完了時に照合）
+	OnConflict     string    `json:"on_conflict,omitempty"` // 同名ファイルがある場合の扱い（空はディレクトリの既定）
 	UploadedChunks []int     `json:"uploaded_chunks"`
+	BytesPerSecond float64   `json:"-"` // 直近の受信速度（メモリ上でのみ計測し、永続化しない）
 	TotalSize      int64     `json:"total_size"`
 	ChunkSize      int64     `json:"chunk_size"`
 	UploadedSize   int64     `json:"uploaded_size"`
 	TotalChunks    int       `json:"total_chunks"`
 }
+
+// ReceivedBytes は受信済みのバイト数を返します。
+// チャンクAPIでは末尾チャンクが端数のため、チャンク数×サイズを総サイズで頭打ちにします。
+func (s *UploadSession) ReceivedBytes() int64 {
+	if s.Protocol == UploadProtocolTus {
+		return s.UploadedSize
+	}
+	received := int64(len(s.UploadedChunks)) * s.ChunkSize
+	if received > s.TotalSize {
+		received = s.TotalSize
+	}
+	return received
+}
@@ -0,0 +1,276 @@
+package permission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"fileserver/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrShareNotFound はメンバー共有が存在しない（または他人の共有である）場合に返されます。
+	ErrShareNotFound = errors.New("共有が見つかりません")
+	// ErrShareExists は同じ対象・相手・権限の共有が既にある場合に返されます。
+	ErrShareExists = errors.New("同じ共有が既にあります")
+)
+
+// 共有の相手の種類です。
+const (
+	GranteeUser = "user"
+	GranteeRole = "role"
+)
+
+// MemberShare はメンバー共有1件です。設定の grants はトップレベルのディレクトリ単位ですが、
+// メンバー共有は所有者が実行時にファイルやサブフォルダを特定のユーザー・ロールへ共有します。
+// write の共有は read も含み、delete は共有できません。
+type MemberShare struct {
+	CreatedAt     time.Time `json:"created_at"`
+	ID            string    `json:"id"`
+	Directory     string    `json:"directory"`
+	Filename      string    `json:"filename,omitempty"` // 空はフォルダ（配下を含む）の共有
+	GranteeType   string    `json:"grantee_type"`       // GranteeUser / GranteeRole
+	Grantee       string    `json:"grantee"`
+	GranteeName   string    `json:"grantee_name,omitempty"` // ユーザーの場合のユーザー名
+	Permission    string    `json:"permission"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedByName string    `json:"created_by_name,omitempty"`
+}
+
+// covers は共有が directory（filename が空ならディレクトリそのもの）を対象に含むかを返します。
+// フォルダの共有は配下のディレクトリ・ファイルを含み、ファイルの共有はそのファイルだけを含みます。
+func (s *MemberShare) covers(directory, filename string) bool {
+	if s.Filename != "" {
+		return filename != "" && s.Directory == directory && s.Filename == filename
+	}
+	return directory == s.Directory || strings.HasPrefix(directory, s.Directory+"/")
+}
+
+// grants は共有が permission を与えるかを返します（write は read を含む）。
+func (s *MemberShare) grants(permission string) bool {
+	return s.Permission == permission || (s.Permission == "write" && permission == "read")
+}
+
+// memberShareColumns は scanMemberShare が読む列です。
+const memberShareColumns = `s.id, s.directory, s.filename, s.grantee_type, s.grantee,
+	CASE WHEN s.grantee_type = 'user' THEN COALESCE(g.username, '') ELSE '' END,
+	s.permission, s.created_by, COALESCE(c.username, ''), s.created_at`
+
+// memberShareFrom はユーザー名を引くための結合を含む FROM 句です。
+const memberShareFrom = ` FROM member_shares s
+	LEFT JOIN users g ON g.id = s.grantee
+	LEFT JOIN users c ON c.id = s.created_by`
+
+func scanMemberShare(row interface{ Scan(...any) error }) (*MemberShare, error) {
+	var s MemberShare
+	if err := row.Scan(&s.ID, &s.Directory, &s.Filename, &s.GranteeType, &s.Grantee, &s.GranteeName,
+		&s.Permission, &s.CreatedBy, &s.CreatedByName, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CanShare は userID が directory（filename が空ならフォルダ）を permission で共有できるかを返します。
+// 共有できるのは、設定の grants（メンバー共有を除く）でその権限を持ち、かつ所有者であるユーザーです。
+// 所有者は、ファイルのアップロード者か、ディレクトリの delete 権限を持つユーザー（user_private では本人）です。
+func (pc *Checker) CanShare(userID, directory, filename, permission string) (bool, error) {
+	if permission != "read" && permission != "write" {
+		return false, nil
+	}
+	allowed, err := pc.configuredPermission(userID, directory, permission)
+	if err != nil || !allowed {
+		return false, err
+	}
+	if filename != "" {
+		meta, err := pc.storage.Metadata(directory, filename)
+		if err != nil {
+			return false, err
+		}
+		if meta.UploaderID == userID {
+			return true, nil
+		}
+	}
+	return pc.configuredPermission(userID, directory, "delete")
+}
+
+// CreateMemberShare はメンバー共有を作成します。共有できるかは呼び出し側で CanShare により確認しておくこと。
+// 同じ共有が既にある場合は ErrShareExists を返します。
+func (pc *Checker) CreateMemberShare(ctx context.Context, s MemberShare) (*MemberShare, error) {
+	if s.GranteeType != GranteeUser && s.GranteeType != GranteeRole {
+		return nil, fmt.Errorf("共有の相手の種類が不正です: %q", s.GranteeType)
+	}
+	if s.Permission != "read" && s.Permission != "write" {
+		return nil, fmt.Errorf("共有できる権限は read と write です: %q", s.Permission)
+	}
+	if s.Filename != "" && s.Permission != "read" {
+		return nil, fmt.Errorf("ファイルの共有は read のみです")
+	}
+
+	s.ID = uuid.New().String()
+	s.CreatedAt = time.Now().UTC()
+	res, err := pc.db.ExecContext(ctx, `
+		INSERT INTO member_shares (id, directory, filename, grantee_type, grantee, permission, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (directory, filename, grantee_type, grantee, permission) DO NOTHING
+	`, s.ID, s.Directory, s.Filename, s.GranteeType, s.Grantee, s.Permission, s.CreatedBy, s.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("共有の保存に失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrShareExists
+	}
+
+	logging.Audit(ctx, "member_share_created", "id", s.ID, "directory", s.Directory, "filename", s.Filename,
+		"grantee_type", s.GranteeType, "grantee", s.Grantee, "permission", s.Permission, "actor", s.CreatedBy)
+	return &s, nil
+}
+
+// MemberSharesBy は createdBy が作成したメンバー共有を新しい順に返します。
+func (pc *Checker) MemberSharesBy(ctx context.Context, createdBy string) ([]*MemberShare, error) {
+	return pc.queryMemberShares(ctx, " WHERE s.created_by = ? ORDER BY s.created_at DESC", createdBy)
+}
+
+// SharedWith は userID（本人または保有ロール）へ共有され、現在も有効なメンバー共有を新しい順に返します。
+// ロールの取得に失敗した場合は本人宛ての共有だけを返します。
+func (pc *Checker) SharedWith(ctx context.Context, userID string) ([]*MemberShare, error) {
+	candidates, err := pc.sharesFor(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]*MemberShare, 0, len(candidates))
+	for _, s := range candidates {
+		if s.CreatedBy != userID && pc.sharerStillAllowed(s) {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+// RevokeMemberShare は actor が作成したメンバー共有を削除し、削除した共有を返します。
+// 存在しない、または他人の共有の場合は ErrShareNotFound を返します。
+func (pc *Checker) RevokeMemberShare(ctx context.Context, id, actor string) (*MemberShare, error) {
+	shares, err := pc.queryMemberShares(ctx, " WHERE s.id = ? AND s.created_by = ?", id, actor)
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, ErrShareNotFound
+	}
+	if _, err := pc.db.ExecContext(ctx, "DELETE FROM member_shares WHERE id = ?", id); err != nil {
+		return nil, fmt.Errorf("共有の削除に失敗しました: %w", err)
+	}
+	logging.Audit(ctx, "member_share_revoked", "id", id, "directory", shares[0].Directory, "filename", shares[0].Filename, "actor", actor)
+	return shares[0], nil
+}
+
+func (pc *Checker) queryMemberShares(ctx context.Context, where string, args ...any) ([]*MemberShare, error) {
+	rows, err := pc.db.QueryContext(ctx, "SELECT "+memberShareColumns+memberShareFrom+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("共有の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	shares := make([]*MemberShare, 0)
+	for rows.Next() {
+		s, err := scanMemberShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("共有の読み取りに失敗しました: %w", err)
+		}
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// sharesFor は userID 本人と保有ロールへのメンバー共有を新しい順に返します（共有者の権限は確認しません）。
+func (pc *Checker) sharesFor(ctx context.Context, userID string) ([]*MemberShare, error) {
+	where := " WHERE (s.grantee_type = 'user' AND s.grantee = ?)"
+	args := []any{userID}
+	roles, err := pc.provider.GetUserRoles(ctx, userID)
+	if err != nil {
+		slog.Warn("ユーザーロール取得に失敗しました。本人宛ての共有のみで判定します", "user_id", userID, "error", err)
+		roles = nil
+	}
+	if len(roles) > 0 {
+		where += " OR (s.grantee_type = 'role' AND s.grantee IN (?" + strings.Repeat(", ?", len(roles)-1) + "))"
+		for _, role := range roles {
+			args = append(args, role)
+		}
+	}
+	return pc.queryMemberShares(ctx, where+" ORDER BY s.created_at DESC", args...)
+}
+
+// sharerStillAllowed は共有者が今も設定の grants で共有した権限を持つかを返します。
+// 退出したり権限を失ったりした人の共有は、その時点から効力を失います。
+// 判定にメンバー共有を含めないため、共有されたものを又貸しすることはできません。
+func (pc *Checker) sharerStillAllowed(s *MemberShare) bool {
+	return pc.sharerAllows(s, s.Directory, s.Permission)
+}
+
+// sharerAllows は共有者が設定の grants で directory に permission を持つかを返します。
+// フォルダの共有が配下へ及ぶ場合も、subdirectories の規則で共有者が入れないパスには及ばないよう、
+// 実際に求められたパスで確かめるのに使います。
+func (pc *Checker) sharerAllows(s *MemberShare, directory, permission string) bool {
+	allowed, err := pc.configuredPermission(s.CreatedBy, directory, permission)
+	if err != nil {
+		slog.Warn("共有者の権限の確認に失敗しました", "share_id", s.ID, "created_by", s.CreatedBy, "directory", directory, "error", err)
+		return false
+	}
+	return allowed
+}
+
+// sharedPermission は userID がメンバー共有により directory（filename が空ならディレクトリそのもの）で
+// permission を持つかを返します。delete は共有できないため常に false です。
+func (pc *Checker) sharedPermission(userID, directory, filename, permission string) (bool, error) {
+	if permission != "read" && permission != "write" {
+		return false, nil
+	}
+	shares, err := pc.sharesFor(context.Background(), userID)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range shares {
+		if !s.grants(permission) || !s.covers(directory, filename) || !pc.sharerStillAllowed(s) {
+			continue
+		}
+		if directory == s.Directory || pc.sharerAllows(s, directory, permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sharedFolders は userID へ共有され、現在も有効なフォルダとその権限を返します（同じフォルダへの共有はまとめます）。
+func (pc *Checker) sharedFolders(userID string) ([]AccessibleDirectory, error) {
+	shares, err := pc.sharesFor(context.Background(), userID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		order []string
+		perms = make(map[string]map[string]bool)
+	)
+	for _, s := range shares {
+		if s.Filename != "" || !pc.sharerStillAllowed(s) {
+			continue
+		}
+		if perms[s.Directory] == nil {
+			perms[s.Directory] = make(map[string]bool)
+			order = append(order, s.Directory)
+		}
+		perms[s.Directory]["read"] = true
+		if s.Permission == "write" {
+			perms[s.Directory]["write"] = true
+		}
+	}
+
+	folders := make([]AccessibleDirectory, 0, len(order))
+	for _, dir := range order {
+		folders = append(folders, AccessibleDirectory{Path: dir, Type: "shared", Permissions: permissionList(perms[dir])})
+	}
+	return folders, nil
+}
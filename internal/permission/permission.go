@@ -1,6 +1,6 @@
 // Package permission はファイル操作のためのユーザー権限チェック機能を提供します。
-// 認証プロバイダーのロール、および設定のディレクトリ付与（grants）と統合して、
-// 異なるディレクトリへのユーザーアクセスを決定します。
+// 認証プロバイダーのロール、設定のディレクトリ付与（grants）、および所有者が実行時に作成する
+// メンバー共有（member_shares）と統合して、異なるディレクトリへのユーザーアクセスを決定します。
 package permission
 
 import (
@@ -8,6 +8,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"path"
+	"slices"
 	"strings"
 
 	"fileserver/internal/authprovider"
@@ -47,39 +49,71 @@ func NewChecker(cfg *config.Config, provider authprovider.Provider, sm *storage.
 // userID: ユーザーID（＝プロバイダー内のsubject。ロール取得とユーザー指定grantの照合に使用）
 // directory: ディレクトリパス（例: "user", "user/alice", "public", "admin"）
 // permission: 権限タイプ（"read", "write", "delete"）
+// 設定の grants で許可されない場合も、フォルダのメンバー共有で許可されていれば true を返します。
+// grants で明示的に拒否（deny）された操作は、メンバー共有でも許可しません。
 func (pc *Checker) CheckPermission(userID, directory, permission string) (bool, error) {
+	return pc.CheckFilePermission(userID, directory, "", permission)
+}
+
+// CheckFilePermission はユーザーがディレクトリ内のファイルに対して指定された権限を持っているかを検証します。
+// CheckPermission に加え、そのファイルだけのメンバー共有も考慮します。
+func (pc *Checker) CheckFilePermission(userID, directory, filename, permission string) (bool, error) {
+	allowed, denied, err := pc.configuredAccess(userID, directory, permission)
+	if err != nil || allowed || denied {
+		return allowed, err
+	}
+	return pc.sharedPermission(userID, directory, filename, permission)
+}
+
+// configuredPermission は設定の grants（user_private・管理者ロールを含む）だけで権限を判定します。
+// サブディレクトリでは、subdirectories のうち最も具体的な規則の付与に従います。
+func (pc *Checker) configuredPermission(userID, directory, permission string) (bool, error) {
+	allowed, _, err := pc.configuredAccess(userID, directory, permission)
+	return allowed, err
+}
+
+// configuredAccess は configuredPermission の判定に加え、操作が grants で明示的に拒否されているか
+// （メンバー共有でも許可してはならないか）を返します。管理者ロールは拒否の対象になりません。
+func (pc *Checker) configuredAccess(userID, directory, permission string) (allowed, denied bool, err error) {
 	pathParts := strings.Split(directory, "/")
 	rootDir := pathParts[0]
+	subpath := strings.Join(pathParts[1:], "/")
 
 	dirConfig := pc.config.GetDirectoryConfig(rootDir)
 	if dirConfig == nil {
-		return false, fmt.Errorf("ディレクトリ '%s' の設定が見つかりません", rootDir)
+		return false, false, fmt.Errorf("ディレクトリ '%s' の設定が見つかりません", rootDir)
 	}
 
 	// user_private は本人と管理者のみアクセスできるため個別に判定する
 	if dirConfig.Type == "user_private" {
-		return pc.checkUserPrivatePermission(userID, permission, pathParts)
+		allowed, err := pc.checkUserPrivatePermission(userID, permission, pathParts)
+		return allowed, false, err
 	}
 
 	// ロールに依存しない付与（"*" / ユーザー指定）を先に評価する。
 	// これによりロール取得の失敗に影響されず公開・個人指定を許可できる。
-	if dirConfig.StaticPermissions(userID)[permission] {
-		return true, nil
+	// StaticPermissions はロールへの拒否がある操作を含まないため、ここで許可しても拒否を追い越さない。
+	if dirConfig.StaticPermissions(subpath, userID)[permission] {
+		return true, false, nil
 	}
 
 	userRoles, err := pc.provider.GetUserRoles(context.Background(), userID)
 	if err != nil {
 		slog.Error("ユーザーロール取得エラー", "user_id", userID, "error", err)
-		return false, fmt.Errorf("ユーザーロールの取得に失敗しました: %w", err)
+		return false, false, fmt.Errorf("ユーザーロールの取得に失敗しました: %w", err)
 	}
 
 	// 管理者ロールは全ディレクトリ・全操作を許可する。
 	if pc.config.HasAdminRole(userRoles) {
 		slog.Debug("管理者権限によるアクセス許可", "user_id", userID, "directory", directory)
-		return true, nil
+		return true, false, nil
 	}
 
-	return dirConfig.RolePermissions(toSet(userRoles))[permission], nil
+	roleSet := toSet(userRoles)
+	if dirConfig.DeniedPermissions(subpath, userID, roleSet)[permission] {
+		return false, true, nil
+	}
+	return dirConfig.EffectivePermissions(subpath, userID, roleSet)[permission], false, nil
 }
 
 // checkUserPrivatePermission はuser_privateディレクトリへの権限を判定します。
@@ -159,21 +193,46 @@ func (pc *Checker) getUserDirectoryName(userID string) (string, error) {
 
 // GetAccessibleDirectories はユーザーがアクセスできるディレクトリと実効権限のリストを返します。
 // ロールをディレクトリの付与（grants）と照合し、user_privateなどの特殊なケースを処理します。
+// subdirectories で親より広く許可された配下のパス（親を読めないもの）と、メンバー共有されたフォルダ
+// （Type "shared"。読み取れるパスの配下にあるものは除く）も加えます。
 // ロール取得に失敗した場合でも、ロールに依存しない付与（公開・個人指定）と
 // user_privateディレクトリは引き続き列挙します。
 func (pc *Checker) GetAccessibleDirectories(userID string) ([]AccessibleDirectory, error) {
+	accessible, _, _ := pc.resolveAccess(userID)
+	return accessible, nil
+}
+
+// resolveAccess はユーザーの一覧用のディレクトリと、ReadFilter 用のパスごとの読み取り可否を求めます。
+// 読み取り可否には、トップレベルのディレクトリと subdirectories の規則のあるパスを、
+// 読めないものも含めて記録します（CanRead が最も具体的なパスで判定するため）。
+func (pc *Checker) resolveAccess(userID string) ([]AccessibleDirectory, map[string]bool, bool) {
 	accessible := []AccessibleDirectory{}
+	readable := make(map[string]bool)
 
 	// ユーザーのロールを取得（失敗しても致命的にはせず、ロール非依存の付与は返す）
-	userRoles, err := pc.provider.GetUserRoles(context.Background(), userID)
-	if err != nil {
-		slog.Warn("ユーザーロール取得に失敗しました。ロール非依存の付与のみで一覧します", "user_id", userID, "error", err)
+	userRoles, roleErr := pc.provider.GetUserRoles(context.Background(), userID)
+	if roleErr != nil {
+		slog.Warn("ユーザーロール取得に失敗しました。ロール非依存の付与のみで一覧します", "user_id", userID, "error", roleErr)
 		userRoles = nil
 	}
 	roleSet := toSet(userRoles)
 	isAdmin := pc.config.HasAdminRole(userRoles)
 
-	for _, dirConfig := range pc.config.Storage.Directories {
+	// 実効権限を算出（管理者は全操作）。ロールが分からない場合はロールへの拒否を取りこぼさないよう、
+	// ロールに関係なく確定する StaticPermissions だけを使う。
+	effective := func(dirConfig *config.DirectoryConfig, subpath string) map[string]bool {
+		if isAdmin {
+			return map[string]bool{"read": true, "write": true, "delete": true}
+		}
+		if roleErr != nil {
+			return dirConfig.StaticPermissions(subpath, userID)
+		}
+		return dirConfig.EffectivePermissions(subpath, userID, roleSet)
+	}
+
+	dirs := pc.config.Directories()
+	for i := range dirs {
+		dirConfig := &dirs[i]
 		// user_private タイプの場合は、ユーザー個別ディレクトリパスに変換
 		if dirConfig.Type == "user_private" {
 			userDirName, err := pc.getUserDirectoryName(userID)
@@ -186,20 +245,18 @@ func (pc *Checker) GetAccessibleDirectories(userID string) ([]AccessibleDirector
 			if !pc.storage.UserDirectoryExists(userDirName) {
 				continue
 			}
+			userDir := fmt.Sprintf("user/%s", userDirName)
 			accessible = append(accessible, AccessibleDirectory{
-				Path:        fmt.Sprintf("user/%s", userDirName),
+				Path:        userDir,
 				Type:        dirConfig.Type,
 				Permissions: []string{"read", "write", "delete"},
 			})
+			readable[userDir] = true
 			continue
 		}
 
-		// 実効権限を算出（管理者は全操作）
-		perms := map[string]bool{"read": true, "write": true, "delete": true}
-		if !isAdmin {
-			perms = dirConfig.EffectivePermissions(userID, roleSet)
-		}
-
+		perms := effective(dirConfig, "")
+		readable[dirConfig.Path] = perms["read"]
 		if len(perms) > 0 {
 			accessible = append(accessible, AccessibleDirectory{
 				Path:        dirConfig.Path,
@@ -207,20 +264,97 @@ func (pc *Checker) GetAccessibleDirectories(userID string) ([]AccessibleDirector
 				Permissions: permissionList(perms),
 			})
 		}
+
+		for _, sub := range dirConfig.Subdirectories {
+			subPerms := effective(dirConfig, sub.Path)
+			fullPath := dirConfig.Path + "/" + sub.Path
+			readable[fullPath] = subPerms["read"]
+			// 親を読めるなら親から辿れるため、一覧には親を読めない場合だけ加える。
+			parent := ""
+			if j := strings.LastIndex(sub.Path, "/"); j >= 0 {
+				parent = sub.Path[:j]
+			}
+			if len(subPerms) > 0 && !effective(dirConfig, parent)["read"] {
+				accessible = append(accessible, AccessibleDirectory{
+					Path:        fullPath,
+					Type:        dirConfig.Type,
+					Permissions: permissionList(subPerms),
+				})
+			}
+		}
 	}
 
-	return accessible, nil
+	// ロールが分からない場合は、ロールへの拒否を確かめられないため共有されたフォルダを加えない。
+	if roleErr != nil {
+		return accessible, readable, isAdmin
+	}
+	shared, err := pc.sharedFolders(userID)
+	if err != nil {
+		// 共有の取得に失敗しても、設定で許可されたディレクトリは返す。
+		slog.Warn("共有されたフォルダの取得に失敗しました", "user_id", userID, "error", err)
+		return accessible, readable, isAdmin
+	}
+	byConfig := &ReadFilter{dirs: readable, admin: isAdmin}
+	var under []string // 共有されたフォルダ配下の subdirectories の規則
+	for _, folder := range shared {
+		if pc.readDenied(folder.Path, userID, roleSet, isAdmin) {
+			continue
+		}
+		for p := range readable {
+			if strings.HasPrefix(p, folder.Path+"/") && !slices.Contains(under, p) {
+				under = append(under, p)
+			}
+		}
+		if !byConfig.CanRead(folder.Path) {
+			accessible = append(accessible, folder)
+			readable[folder.Path] = true
+		}
+	}
+	// 共有は共有者が入れる範囲にだけ及ぶため、配下の規則は共有を含めた判定（CheckPermission）で決め直す。
+	// 親から順に決め、親を読めないパスだけを一覧に加える。
+	slices.Sort(under)
+	for _, p := range under {
+		perms := make(map[string]bool)
+		for _, permission := range []string{"read", "write"} {
+			allowed, err := pc.CheckPermission(userID, p, permission)
+			if err != nil {
+				slog.Warn("共有されたフォルダ配下の権限の確認に失敗しました", "user_id", userID, "directory", p, "error", err)
+			}
+			if allowed {
+				perms[permission] = true
+			}
+		}
+		parentReadable := byConfig.CanRead(path.Dir(p))
+		readable[p] = perms["read"]
+		listed := slices.ContainsFunc(accessible, func(d AccessibleDirectory) bool { return d.Path == p })
+		if perms["read"] && !parentReadable && !listed {
+			accessible = append(accessible, AccessibleDirectory{Path: p, Type: "shared", Permissions: permissionList(perms)})
+		}
+	}
+
+	return accessible, readable, isAdmin
+}
+
+// readDenied は directory の読み取りが grants で明示的に拒否されているかを返します（管理者は拒否されません）。
+func (pc *Checker) readDenied(directory, userID string, roleSet map[string]bool, isAdmin bool) bool {
+	if isAdmin {
+		return false
+	}
+	rootDir, subpath, _ := strings.Cut(directory, "/")
+	dirConfig := pc.config.GetDirectoryConfig(rootDir)
+	return dirConfig != nil && dirConfig.DeniedPermissions(subpath, userID, roleSet)["read"]
 }
 
 // ReadFilter はあるユーザーの「読み取り可能なディレクトリ」を静的スナップショットとして保持します。
 // SSE配信のホットパスでロールをその都度問い合わせず、メモリ上の集合判定だけで
 // イベントの可視性を決めるために使います。
 type ReadFilter struct {
-	dirs  map[string]bool
+	dirs  map[string]bool // パス → 読み取り可否（読めないパスも subdirectories の規則として記録する）
 	admin bool
 }
 
 // CanRead はディレクトリ（またはその配下）を読み取れるかを返します。
+// 記録したパスのうち directory そのものか最も近い親の可否に従い、該当が無ければ拒否します。
 // admin は全ディレクトリを読めるため常に真を返します。
 func (f *ReadFilter) CanRead(directory string) bool {
 	if f == nil {
@@ -229,43 +363,26 @@ func (f *ReadFilter) CanRead(directory string) bool {
 	if f.admin {
 		return true
 	}
-	for allowed := range f.dirs {
-		if directory == allowed || strings.HasPrefix(directory, allowed+"/") {
-			return true
+	for p := directory; ; {
+		if allowed, ok := f.dirs[p]; ok {
+			return allowed
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
 		}
+		p = p[:i]
 	}
-	return false
 }
 
 // ReadFilterFor はユーザーの読み取り可能ディレクトリのスナップショットを構築します。
 // ロール取得は（キャッシュ経由で）ここで一度だけ行い、以降のイベント判定を
 // I/Oなしにします。SSE接続時と定期リフレッシュ時に呼び出す想定です。
+// 管理者は他ユーザーのuser_privateも読めるが、それらは列挙に含まれないためフラグで全許可します。
+// ロール取得に失敗した場合は安全側（非管理者）に倒れます。
 func (pc *Checker) ReadFilterFor(userID string) (*ReadFilter, error) {
-	dirs, err := pc.GetAccessibleDirectories(userID)
-	if err != nil {
-		return nil, err
-	}
-
-	set := make(map[string]bool, len(dirs))
-	for _, d := range dirs {
-		for _, p := range d.Permissions {
-			if p == "read" {
-				set[d.Path] = true
-				break
-			}
-		}
-	}
-
-	// 管理者は他ユーザーのuser_privateも読めるが、それらは列挙に含まれないため
-	// フラグで全許可する（GetAccessibleDirectoriesは本人のuser_dirのみ返す）。
-	admin, err := pc.isAdmin(userID)
-	if err != nil {
-		// ロール取得はGetAccessibleDirectoriesと同一キャッシュを引くため通常は失敗しない。
-		// 失敗時は安全側（非管理者）に倒す。
-		admin = false
-	}
-
-	return &ReadFilter{dirs: set, admin: admin}, nil
+	_, readable, admin := pc.resolveAccess(userID)
+	return &ReadFilter{dirs: readable, admin: admin}, nil
 }
 
 // toSet は文字列スライスを集合に変換します。
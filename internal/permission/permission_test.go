@@ -1,6 +1,26 @@
 package permission
 
-import "testing"
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"fileserver/internal/authprovider"
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/storage"
+)
+
+// rolesProvider は roles に書いたロールを返すテスト用のプロバイダーです。
+type rolesProvider struct {
+	authprovider.Provider
+	roles map[string][]string
+}
+
+func (p *rolesProvider) GetUserRoles(_ context.Context, userID string) ([]string, error) {
+	return p.roles[userID], nil
+}
 
 func TestReadFilterCanRead(t *testing.T) {
 	f := &ReadFilter{dirs: map[string]bool{"public": true, "user/alice": true}}
@@ -40,3 +60,163 @@ func TestReadFilterNilFailsClosed(t *testing.T) {
 		t.Error("未解決(nil)のフィルタは全拒否であるべき")
 	}
 }
+
+func TestReadFilterMostSpecificPathWins(t *testing.T) {
+	f := &ReadFilter{dirs: map[string]bool{"projects": true, "projects/secret": false, "projects/secret/open": true}}
+
+	cases := []struct {
+		dir  string
+		want bool
+	}{
+		{"projects", true},
+		{"projects/other", true},
+		{"projects/secret", false},
+		{"projects/secret/x", false},
+		{"projects/secret/open", true},
+		{"projects/secret/open/y", true},
+		{"projects/secretx", true},
+	}
+	for _, c := range cases {
+		if got := f.CanRead(c.dir); got != c.want {
+			t.Errorf("CanRead(%q) = %v, want %v", c.dir, got, c.want)
+		}
+	}
+}
+
+// サブディレクトリの規則は CheckPermission・GetAccessibleDirectories・ReadFilter で同じ結果になること。
+func TestSubdirectoryRulesAreConsistent(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath: filepath.Join(dir, "uploads"),
+		Directories: []config.DirectoryConfig{{
+			Path:   "projects",
+			Grants: []config.GrantConfig{{Role: "member", Permissions: []string{"read", "write"}}},
+			Subdirectories: []config.SubdirectoryConfig{
+				{Path: "secret", Grants: []config.GrantConfig{{Role: "staff", Permissions: []string{"read"}}}},
+				{Path: "secret/lounge", Grants: []config.GrantConfig{{Role: "member", Permissions: []string{"read"}}}},
+			},
+		}},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	pc := NewChecker(cfg, &rolesProvider{roles: map[string][]string{"m": {"member"}, "s": {"staff"}}}, sm, db)
+	// フォルダの共有は、共有者が subdirectories の規則で入れない配下には及ばない。
+	if _, err := pc.CreateMemberShare(context.Background(), MemberShare{
+		Directory: "projects", GranteeType: GranteeUser, Grantee: "x", Permission: "read", CreatedBy: "m",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user, dir, perm string
+		want            bool
+	}{
+		{"m", "projects/a", "write", true},
+		{"m", "projects/secret", "read", false},
+		{"m", "projects/secret/lounge/x", "read", true},
+		{"m", "projects/secret/lounge", "write", false},
+		{"s", "projects", "read", false},
+		{"s", "projects/secret/b", "read", true},
+		{"x", "projects/a", "read", true},
+		{"x", "projects/secret", "read", false},
+		{"x", "projects/secret/lounge/x", "read", true},
+	} {
+		got, err := pc.CheckPermission(c.user, c.dir, c.perm)
+		if err != nil || got != c.want {
+			t.Errorf("CheckPermission(%s, %q, %s) = %v, %v, want %v", c.user, c.dir, c.perm, got, err, c.want)
+		}
+		if c.perm != "read" {
+			continue
+		}
+		if got, err := pc.CheckFilePermission(c.user, c.dir, "f.txt", c.perm); err != nil || got != c.want {
+			t.Errorf("CheckFilePermission(%s, %q, f.txt, %s) = %v, %v, want %v", c.user, c.dir, c.perm, got, err, c.want)
+		}
+		f, err := pc.ReadFilterFor(c.user)
+		if err != nil || f.CanRead(c.dir) != c.want {
+			t.Errorf("ReadFilterFor(%s).CanRead(%q) = %v, %v, want %v", c.user, c.dir, f.CanRead(c.dir), err, c.want)
+		}
+	}
+
+	// 親を読めない配下のパスだけが一覧に加わる。
+	for user, want := range map[string][]string{
+		"m": {"projects", "projects/secret/lounge"},
+		"s": {"projects/secret"},
+		"x": {"projects", "projects/secret/lounge"},
+	} {
+		dirs, err := pc.GetAccessibleDirectories(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range dirs {
+			got = append(got, d.Path)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("GetAccessibleDirectories(%s) = %v, want %v", user, got, want)
+		}
+	}
+}
+
+// ロールへの拒否は "*" の許可（ロール取得前の判定）とメンバー共有のどちらにも追い越されず、
+// 一覧・ReadFilter にも同じく効くこと。管理者ロールは拒否の対象にならないこと。
+func TestDenyOverridesStaticAllowAndShares(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath:  filepath.Join(dir, "uploads"),
+		AdminRoleID: "admin",
+		Directories: []config.DirectoryConfig{{
+			Path: "team",
+			Grants: []config.GrantConfig{
+				{Role: "*", Permissions: []string{"read"}},
+				{User: "owner", Permissions: []string{"read", "write", "delete"}},
+				{Role: "muted", Deny: true, Permissions: []string{"read"}},
+			},
+		}},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sm := storage.NewManager(cfg, db)
+	if err := sm.InitializeDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	pc := NewChecker(cfg, &rolesProvider{roles: map[string][]string{"m": {"muted"}, "a": {"admin", "muted"}}}, sm, db)
+
+	if _, err := pc.CreateMemberShare(context.Background(), MemberShare{
+		Directory: "team", GranteeType: GranteeUser, Grantee: "m", Permission: "read", CreatedBy: "owner",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user string
+		want bool
+	}{
+		{"p", true},
+		{"m", false},
+		{"a", true},
+	} {
+		if got, err := pc.CheckPermission(c.user, "team/sub", "read"); err != nil || got != c.want {
+			t.Errorf("CheckPermission(%s, team/sub, read) = %v, %v, want %v", c.user, got, err, c.want)
+		}
+		f, err := pc.ReadFilterFor(c.user)
+		if err != nil || f.CanRead("team") != c.want {
+			t.Errorf("ReadFilterFor(%s).CanRead(team) = %v, %v, want %v", c.user, f.CanRead("team"), err, c.want)
+		}
+	}
+	if got, err := pc.CheckFilePermission("m", "team", "a.txt", "read"); err != nil || got {
+		t.Errorf("CheckFilePermission(m) = %v, %v, want false", got, err)
+	}
+	if dirs, err := pc.GetAccessibleDirectories("m"); err != nil || len(dirs) != 0 {
+		t.Errorf("GetAccessibleDirectories(m) = %+v, %v, want 空", dirs, err)
+	}
+}
@@ -0,0 +1,117 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize は INSTREAM で1回に送るデータの大きさです（clamd の StreamMaxLength とは別）。
+const clamdChunkSize = 64 * 1024
+
+// Clamd は ClamAV デーモンへ INSTREAM コマンドでファイルを送ってスキャンします。
+// ファイルはソケット経由で送るため、clamd からアップロードディレクトリが見えている必要はありません。
+type Clamd struct {
+	network string
+	address string
+}
+
+// NewClamd は clamd の接続先（"tcp://host:port"・"unix:///path"・"host:port"）から Clamd を作成します。
+func NewClamd(address string) (*Clamd, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return &Clamd{network: "unix", address: strings.TrimPrefix(address, "unix://")}, nil
+	case strings.HasPrefix(address, "tcp://"):
+		return &Clamd{network: "tcp", address: strings.TrimPrefix(address, "tcp://")}, nil
+	case strings.Contains(address, "://"):
+		return nil, fmt.Errorf("clamd の接続先の形式が不正です: %s", address)
+	case address == "":
+		return nil, errors.New("clamd の接続先が指定されていません")
+	default:
+		return &Clamd{network: "tcp", address: address}, nil
+	}
+}
+
+// Scan は path の内容を clamd へ送り、結果を返します。
+func (c *Clamd) Scan(ctx context.Context, path string) (Verdict, error) {
+	f, err := os.Open(path) // #nosec G304 -- アップロードディレクトリ配下の保存済みファイル
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer func() { _ = f.Close() }() //nolint:errcheck // 読み取り専用
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("clamd に接続できません: %w", err)
+	}
+	defer func() { _ = conn.Close() }() //nolint:errcheck // 結果は読み終えている
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline) //nolint:errcheck // 失敗してもタイムアウトが効かないだけ
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now()) //nolint:errcheck // 読み書き中の処理を止めるだけ
+	})
+	defer stop()
+
+	sendErr := sendStream(conn, f)
+	// サイズ上限超過などで clamd が途中で応答して切断した場合も、理由は応答に書かれている。
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if sendErr != nil {
+			return Verdict{}, fmt.Errorf("clamd への送信に失敗しました: %w", sendErr)
+		}
+		return Verdict{}, fmt.Errorf("clamd の応答を読めません: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// sendStream は INSTREAM コマンドと、4バイト（ビッグエンディアン）の長さ付きチャンク列を送ります。
+// 長さ0のチャンクが終端です。
+func sendStream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n)) // #nosec G115 -- n はバッファサイズ以下
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply は "stream: OK" / "stream: <検出名> FOUND" / "... ERROR" 形式の応答を解釈します。
+func parseClamdReply(reply string) (Verdict, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	_, result, ok := strings.Cut(reply, ": ")
+	if !ok {
+		result = reply
+	}
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return Verdict{}, fmt.Errorf("clamd がエラーを返しました: %s", reply)
+	}
+}
@@ -0,0 +1,79 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Exec は外部コマンドでファイルをスキャンします（clamscan・社内スキャナーのラッパー等）。
+// 終了コード 0 は問題なし、1 は検出、それ以外はスキャン失敗として扱います（clamscan と同じ規約）。
+type Exec struct {
+	command []string
+}
+
+// NewExec はコマンドと引数から Exec を作成します。"{file}" はスキャン対象のパスに置き換わり、
+// 含まれない場合はパスを末尾に追加します。
+func NewExec(command []string) *Exec {
+	return &Exec{command: command}
+}
+
+// Scan はコマンドを実行し、終了コードから結果を判定します。
+func (e *Exec) Scan(ctx context.Context, path string) (Verdict, error) {
+	if len(e.command) == 0 {
+		return Verdict{}, errors.New("スキャンコマンドが指定されていません")
+	}
+	args := make([]string, 0, len(e.command))
+	replaced := false
+	for _, a := range e.command[1:] {
+		if strings.Contains(a, "{file}") {
+			a = strings.ReplaceAll(a, "{file}", path)
+			replaced = true
+		}
+		args = append(args, a)
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+
+	cmd := exec.CommandContext(ctx, e.command[0], args...) // #nosec G204 -- コマンドは管理者が設定ファイルで指定する
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return Verdict{}, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+		return Verdict{Infected: true, Signature: signatureFromOutput(out)}, nil
+	}
+	if ctx.Err() != nil {
+		return Verdict{}, fmt.Errorf("スキャンがタイムアウトしました: %w", ctx.Err())
+	}
+	return Verdict{}, fmt.Errorf("スキャンコマンドが失敗しました: %w: %s", err, strings.TrimSpace(string(out)))
+}
+
+// signatureFromOutput は "<パス>: <検出名> FOUND" 形式の行から検出名を取り出します。
+// 見つからない場合は出力の先頭行を返します。
+func signatureFromOutput(out []byte) string {
+	var first string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if first == "" {
+			first = line
+		}
+		if strings.HasSuffix(line, " FOUND") {
+			if idx := strings.LastIndex(line, ": "); idx >= 0 {
+				line = line[idx+2:]
+			}
+			return strings.TrimSuffix(line, " FOUND")
+		}
+	}
+	return first
+}
@@ -0,0 +1,335 @@
+// Package scanner はアップロードされたファイルのマルウェアスキャンと隔離を提供します。
+// スキャナーは ClamAV デーモン（clamd）または外部コマンドから選べ、検出したファイルは
+// アップロードディレクトリの外（隔離領域）へ移して管理者だけが確認・解除できるようにします。
+package scanner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"fileserver/internal/config"
+	"fileserver/internal/storage"
+)
+
+// file_metadata.scan_status / quarantine.scan_status に記録する値です。
+const (
+	StatusClean    = "clean"    // 検出なし
+	StatusInfected = "infected" // 検出あり（隔離済み）
+	StatusError    = "error"    // スキャン自体に失敗
+	StatusReleased = "released" // 管理者が隔離を解除した（誤検知）
+)
+
+var (
+	// ErrNotFound は指定された隔離エントリが無い場合のエラーです。
+	ErrNotFound = errors.New("隔離されたファイルが見つかりません")
+	// ErrExists は隔離解除の戻し先に同名のファイルが既にある場合のエラーです。
+	ErrExists = errors.New("戻し先に同名のファイルが既に存在します")
+)
+
+// Verdict はスキャン結果です。
+type Verdict struct {
+	Infected  bool
+	Signature string // 検出名（Infected の場合のみ）
+}
+
+// Scanner はファイル1つをスキャンします。検出の有無は Verdict で、スキャンできなかった場合は error で返します。
+type Scanner interface {
+	Scan(ctx context.Context, path string) (Verdict, error)
+}
+
+// New は設定からスキャナーを作成します。スキャンが無効な場合は nil を返します。
+func New(cfg config.ScanConfig) (Scanner, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "clamd":
+		return NewClamd(cfg.ClamdAddress)
+	case "exec":
+		return NewExec(cfg.Command), nil
+	default:
+		return nil, fmt.Errorf("未対応のスキャン方式です: %s", cfg.Type)
+	}
+}
+
+// Outcome はアップロード直後の検査結果です。
+type Outcome struct {
+	Status      string
+	Signature   string
+	Quarantined bool
+}
+
+// Entry は隔離されたファイル1件です（管理者API用）。
+type Entry struct {
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	Directory     string    `json:"directory"`
+	Filename      string    `json:"filename"`
+	Hash          string    `json:"hash"`
+	UploaderID    string    `json:"uploader_id"`
+	UploaderName  string    `json:"uploader_name"`
+	ScanStatus    string    `json:"scan_status"`
+	Signature     string    `json:"signature"`
+	storedName    string
+	ID            int64 `json:"id"`
+	Size          int64 `json:"size"`
+}
+
+// Manager はスキャンの実行と隔離領域の管理を行います。
+// スキャンが無効（scanner が nil）でも、既存の隔離エントリの確認・解除のために作成します。
+type Manager struct {
+	config  *config.Config
+	db      *sql.DB
+	storage *storage.Manager
+	scanner Scanner
+}
+
+// NewManager は Manager を作成します。sc が nil の場合はスキャンしません。
+func NewManager(cfg *config.Config, db *sql.DB, sm *storage.Manager, sc Scanner) *Manager {
+	return &Manager{config: cfg, db: db, storage: sm, scanner: sc}
+}
+
+// Enabled はスキャンが有効かを返します。
+func (m *Manager) Enabled() bool {
+	return m.scanner != nil
+}
+
+// Check は保存済みのファイルをスキャンし、結果を file_metadata に記録します。
+// 検出した場合（fail_closed ならスキャン失敗時も）はファイルを隔離します。
+// アップロードは保存前に Inspect で検査するため、これは監視で登録した外部のファイルに使います。
+func (m *Manager) Check(ctx context.Context, directory, filename string) Outcome {
+	if m.scanner == nil {
+		return Outcome{}
+	}
+
+	outcome, block := m.scan(ctx, filepath.Join(m.config.Storage.UploadPath, directory, filename), directory, filename)
+	if block {
+		if err := m.quarantine(ctx, directory, filename, outcome.Status, outcome.Signature); err != nil {
+			// 隔離できなかったファイルは公開したままになるため、結果だけは必ず残す。
+			slog.ErrorContext(ctx, "ファイルの隔離に失敗しました", "directory", directory, "filename", filename, "error", err)
+		} else {
+			outcome.Quarantined = true
+			slog.WarnContext(ctx, "ファイルを隔離しました", "directory", directory, "filename", filename,
+				"scan_status", outcome.Status, "signature", outcome.Signature)
+			return outcome
+		}
+	}
+	m.Record(ctx, directory, filename, outcome)
+	return outcome
+}
+
+// Inspect は保存名へ移す前の作業ファイル path（directory へ filename として保存する予定のもの）をスキャンします。
+// 検出した場合（fail_closed ならスキャン失敗時も）は作業ファイルを隔離し、uploaderID・uploaderName とともに記録します。
+// 隔離できなかった場合は作業ファイルを削除してエラーを返します。
+// それ以外の場合、呼び出し側は保存とメタデータの登録の後に Record で結果を記録します。
+func (m *Manager) Inspect(ctx context.Context, directory, filename, path, uploaderID, uploaderName string) (Outcome, error) {
+	if m.scanner == nil {
+		return Outcome{}, nil
+	}
+
+	outcome, block := m.scan(ctx, path, directory, filename)
+	if !block {
+		return outcome, nil
+	}
+	if err := m.quarantineReceived(ctx, directory, filename, path, uploaderID, uploaderName, outcome); err != nil {
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			slog.ErrorContext(ctx, "隔離できなかった作業ファイルの削除に失敗しました", "path", path, "error", removeErr)
+		}
+		return outcome, fmt.Errorf("ファイルの隔離に失敗しました: %w", err)
+	}
+	outcome.Quarantined = true
+	slog.WarnContext(ctx, "ファイルを隔離しました", "directory", directory, "filename", filename,
+		"scan_status", outcome.Status, "signature", outcome.Signature)
+	return outcome, nil
+}
+
+// Record は保存したファイルにスキャン結果を記録します。スキャンしていない（Status が空の）場合は何もしません。
+func (m *Manager) Record(ctx context.Context, directory, filename string, outcome Outcome) {
+	if outcome.Status == "" {
+		return
+	}
+	if err := m.storage.SetScanStatus(directory, filename, outcome.Status, outcome.Signature); err != nil {
+		slog.WarnContext(ctx, "スキャン結果の保存に失敗しました", "error", err)
+	}
+}
+
+// scan は path をスキャンし、結果と隔離すべきか（検出、または fail_closed でのスキャン失敗）を返します。
+func (m *Manager) scan(ctx context.Context, path, directory, filename string) (Outcome, bool) {
+	scanCtx, cancel := context.WithTimeout(ctx, m.config.Scan.Timeout)
+	verdict, err := m.scanner.Scan(scanCtx, path)
+	cancel()
+
+	switch {
+	case err != nil:
+		slog.ErrorContext(ctx, "ファイルのスキャンに失敗しました", "directory", directory, "filename", filename, "error", err)
+		return Outcome{Status: StatusError}, m.config.Scan.FailClosed
+	case verdict.Infected:
+		return Outcome{Status: StatusInfected, Signature: verdict.Signature}, true
+	default:
+		return Outcome{Status: StatusClean}, false
+	}
+}
+
+// quarantine はファイルを隔離領域へ移し、元に戻せるよう情報を記録します。
+func (m *Manager) quarantine(ctx context.Context, directory, filename, status, signature string) error {
+	meta, err := m.storage.Metadata(directory, filename)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filepath.Join(m.config.Storage.UploadPath, directory, filename))
+	if err != nil {
+		return err
+	}
+
+	id, storedName, err := m.insertEntry(ctx, directory, filename, info.Size(), meta.Hash, meta.UploaderID, meta.UploaderName, status, signature)
+	if err != nil {
+		return err
+	}
+	if err := m.storage.MoveOut(ctx, directory, filename, filepath.Join(m.config.QuarantinePath(), storedName)); err != nil {
+		m.deleteEntry(ctx, id)
+		return fmt.Errorf("隔離領域への移動に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// quarantineReceived は保存前の作業ファイル path を隔離領域へ移します。
+// 解除時は directory に filename の保存名（"UUID_元のファイル名"）で戻せるよう、保存名を決めて記録します。
+func (m *Manager) quarantineReceived(ctx context.Context, directory, filename, path, uploaderID, uploaderName string, outcome Outcome) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	hash, err := storage.HashFile(path)
+	if err != nil {
+		// ハッシュは解除後の重複判定に使うだけのため、無くても隔離は続ける。
+		slog.WarnContext(ctx, "隔離するファイルのハッシュ計算に失敗しました", "error", err)
+	}
+
+	stored := storage.StoredFilename(uuid.New().String(), filename)
+	id, storedName, err := m.insertEntry(ctx, directory, stored, info.Size(), hash, uploaderID, uploaderName, outcome.Status, outcome.Signature)
+	if err != nil {
+		return err
+	}
+	if err := storage.MoveFile(path, filepath.Join(m.config.QuarantinePath(), storedName)); err != nil {
+		m.deleteEntry(ctx, id)
+		return fmt.Errorf("隔離領域への移動に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// insertEntry は隔離の情報を記録し、そのIDと隔離領域での名前を返します。
+// 隔離領域では元の名前を使わない（実行可能な拡張子のまま置かない・衝突を避ける）。
+func (m *Manager) insertEntry(ctx context.Context, directory, filename string, size int64, hash, uploaderID, uploaderName, status, signature string) (int64, string, error) {
+	storedName := uuid.New().String()
+	res, err := m.db.ExecContext(ctx, `
+		INSERT INTO quarantine (directory, filename, stored_name, size, hash, uploader_id, uploader_name, scan_status, signature)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, NULLIF(?, ''))`,
+		directory, filename, storedName, size, hash, uploaderID, uploaderName, status, signature)
+	if err != nil {
+		return 0, "", fmt.Errorf("隔離情報の保存に失敗しました: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", fmt.Errorf("隔離情報の保存に失敗しました: %w", err)
+	}
+	return id, storedName, nil
+}
+
+// deleteEntry は移動できなかった隔離の情報を取り消します。
+func (m *Manager) deleteEntry(ctx context.Context, id int64) {
+	_, _ = m.db.ExecContext(ctx, "DELETE FROM quarantine WHERE id = ?", id) //nolint:errcheck // 隔離失敗の後始末
+}
+
+// List は隔離されたファイルを新しい順に返します。
+func (m *Manager) List(ctx context.Context) ([]Entry, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT id, directory, filename, stored_name, size, COALESCE(hash, ''), COALESCE(uploader_id, ''),
+			COALESCE(uploader_name, ''), scan_status, COALESCE(signature, ''), quarantined_at
+		FROM quarantine ORDER BY quarantined_at DESC, id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("隔離一覧の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Release は隔離を解除して元の場所へ戻します（誤検知の救済）。
+// 戻したファイルは scan_status=released として一覧に表示されます。
+func (m *Manager) Release(ctx context.Context, id int64) (Entry, error) {
+	e, err := m.get(ctx, id)
+	if err != nil {
+		return e, err
+	}
+	dest := filepath.Join(m.config.Storage.UploadPath, e.Directory, e.Filename)
+	if _, err := os.Stat(dest); err == nil {
+		return e, ErrExists
+	}
+
+	if err := storage.MoveFile(filepath.Join(m.config.QuarantinePath(), e.storedName), dest); err != nil {
+		return e, fmt.Errorf("隔離領域からの移動に失敗しました: %w", err)
+	}
+	if err := m.storage.SaveFileMetadata(e.Directory, e.Filename, e.UploaderID, e.UploaderName); err != nil {
+		slog.WarnContext(ctx, "メタデータの保存に失敗しました", "error", err)
+	}
+	if err := m.storage.SetScanStatus(e.Directory, e.Filename, StatusReleased, e.Signature); err != nil {
+		slog.WarnContext(ctx, "スキャン結果の保存に失敗しました", "error", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM quarantine WHERE id = ?", id); err != nil {
+		return e, fmt.Errorf("隔離情報の削除に失敗しました: %w", err)
+	}
+	return e, nil
+}
+
+// Delete は隔離されたファイルを完全に削除します。
+func (m *Manager) Delete(ctx context.Context, id int64) (Entry, error) {
+	e, err := m.get(ctx, id)
+	if err != nil {
+		return e, err
+	}
+	if err := os.Remove(filepath.Join(m.config.QuarantinePath(), e.storedName)); err != nil && !os.IsNotExist(err) {
+		return e, fmt.Errorf("隔離ファイルの削除に失敗しました: %w", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM quarantine WHERE id = ?", id); err != nil {
+		return e, fmt.Errorf("隔離情報の削除に失敗しました: %w", err)
+	}
+	return e, nil
+}
+
+func (m *Manager) get(ctx context.Context, id int64) (Entry, error) {
+	row := m.db.QueryRowContext(ctx, `
+		SELECT id, directory, filename, stored_name, size, COALESCE(hash, ''), COALESCE(uploader_id, ''),
+			COALESCE(uploader_name, ''), scan_status, COALESCE(signature, ''), quarantined_at
+		FROM quarantine WHERE id = ?`, id)
+	e, err := scanEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, ErrNotFound
+	}
+	return e, err
+}
+
+// rowScanner は *sql.Row と *sql.Rows の共通部分です。
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanEntry(row rowScanner) (Entry, error) {
+	var e Entry
+	err := row.Scan(&e.ID, &e.Directory, &e.Filename, &e.storedName, &e.Size, &e.Hash, &e.UploaderID,
+		&e.UploaderName, &e.ScanStatus, &e.Signature, &e.QuarantinedAt)
+	return e, err
+}
@@ -0,0 +1,339 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/storage"
+)
+
+// stubClamd は INSTREAM を受け取り、内容に "EICAR" を含めば検出として応答する clamd の代わりです。
+func stubClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn)
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func serveClamd(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		_, _ = io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+		_, _ = io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+		return
+	}
+	_, _ = io.WriteString(conn, "stream: OK\x00")
+}
+
+func writeTemp(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClamdScan(t *testing.T) {
+	c, err := NewClamd(stubClamd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	v, err := c.Scan(ctx, writeTemp(t, "hello"))
+	if err != nil || v.Infected {
+		t.Errorf("clean: verdict = %+v, err = %v", v, err)
+	}
+	// チャンク境界をまたぐ大きさでも内容が欠けずに届くこと。
+	big := string(bytes.Repeat([]byte("x"), clamdChunkSize+10)) + "EICAR"
+	v, err = c.Scan(ctx, writeTemp(t, big))
+	if err != nil || !v.Infected || v.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected: verdict = %+v, err = %v", v, err)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c, err := NewClamd(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Scan(context.Background(), writeTemp(t, "x")); err == nil {
+		t.Error("接続できない clamd でエラーにならない")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	cases := []struct {
+		reply    string
+		infected bool
+		sig      string
+		err      bool
+	}{
+		{"stream: OK\x00", false, "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND\x00", true, "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR\x00", false, "", true},
+	}
+	for _, c := range cases {
+		v, err := parseClamdReply(c.reply)
+		if v.Infected != c.infected || v.Signature != c.sig || (err != nil) != c.err {
+			t.Errorf("parseClamdReply(%q) = (%+v, %v)", c.reply, v, err)
+		}
+	}
+}
+
+func TestExecScan(t *testing.T) {
+	e := NewExec([]string{"sh", "-c", `if grep -q EICAR "$1"; then echo "$1: Test.Sig FOUND"; exit 1; fi`, "sh", "{file}"})
+	ctx := context.Background()
+
+	if v, err := e.Scan(ctx, writeTemp(t, "ok")); err != nil || v.Infected {
+		t.Errorf("clean: verdict = %+v, err = %v", v, err)
+	}
+	if v, err := e.Scan(ctx, writeTemp(t, "EICAR")); err != nil || !v.Infected || v.Signature != "Test.Sig" {
+		t.Errorf("infected: verdict = %+v, err = %v", v, err)
+	}
+	if _, err := NewExec([]string{"sh", "-c", "exit 2"}).Scan(ctx, writeTemp(t, "x")); err == nil {
+		t.Error("終了コード2でエラーにならない")
+	}
+}
+
+func newTestManager(t *testing.T, sc Scanner, failClosed bool) (*Manager, *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{UploadPath: filepath.Join(dir, "uploads")},
+		Scan:    config.ScanConfig{Timeout: 10 * time.Second, FailClosed: failClosed},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewManager(cfg, db, storage.NewManager(cfg, db), sc), cfg
+}
+
+func putFile(t *testing.T, m *Manager, directory, filename, content string) {
+	t.Helper()
+	p := filepath.Join(m.config.Storage.UploadPath, directory, filename)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.storage.SaveFileMetadata(directory, filename, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 検出したファイルは一覧から消えて隔離領域へ移り、解除すると元の場所に戻ること。
+func TestManagerQuarantineAndRelease(t *testing.T) {
+	c, err := NewClamd(stubClamd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, cfg := newTestManager(t, c, false)
+	ctx := context.Background()
+
+	putFile(t, m, "public", "clean.txt", "hello")
+	if o := m.Check(ctx, "public", "clean.txt"); o.Status != StatusClean || o.Quarantined {
+		t.Errorf("clean outcome = %+v", o)
+	}
+
+	putFile(t, m, "public", "bad.exe", "EICAR")
+	o := m.Check(ctx, "public", "bad.exe")
+	if o.Status != StatusInfected || !o.Quarantined || o.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("infected outcome = %+v", o)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Storage.UploadPath, "public", "bad.exe")); !os.IsNotExist(err) {
+		t.Error("検出したファイルがアップロードディレクトリに残っている")
+	}
+
+	files, err := m.storage.ListFiles("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].ScanStatus != StatusClean {
+		t.Errorf("一覧 = %+v, want clean.txt のみ", files)
+	}
+
+	entries, err := m.List(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("隔離一覧 = %+v, err = %v", entries, err)
+	}
+	e := entries[0]
+	if e.Filename != "bad.exe" || e.UploaderName != "alice" || e.Size != 5 {
+		t.Errorf("隔離エントリ = %+v", e)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.QuarantinePath(), e.storedName)); err != nil {
+		t.Errorf("隔離領域にファイルが無い: %v", err)
+	}
+
+	if _, err := m.Release(ctx, e.ID); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := m.storage.Metadata("public", "bad.exe")
+	if err != nil || meta.ScanStatus != StatusReleased || meta.UploaderName != "alice" {
+		t.Errorf("解除後のメタデータ = %+v, err = %v", meta, err)
+	}
+	if _, err := m.Release(ctx, e.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("解除済みの再解除で err = %v, want ErrNotFound", err)
+	}
+}
+
+// 保存名へ移す前の作業ファイルは、検出すると一度も一覧に出ずに隔離され、解除すると保存名で置かれること。
+func TestManagerInspect(t *testing.T) {
+	c, err := NewClamd(stubClamd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, cfg := newTestManager(t, c, false)
+	ctx := context.Background()
+	if err := os.MkdirAll(filepath.Join(cfg.Storage.UploadPath, "public"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	clean, _, err := m.storage.Receive("public", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := m.Inspect(ctx, "public", "clean.txt", clean, "", "alice")
+	if err != nil || o.Status != StatusClean || o.Quarantined {
+		t.Errorf("clean outcome = %+v, err = %v", o, err)
+	}
+	if _, err := os.Stat(clean); err != nil {
+		t.Errorf("検査を通った作業ファイルが無い: %v", err)
+	}
+	m.storage.RemoveReceived(clean)
+
+	bad, _, err := m.storage.Receive("public", strings.NewReader("EICAR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err = m.Inspect(ctx, "public", "bad.exe", bad, "", "alice")
+	if err != nil || o.Status != StatusInfected || !o.Quarantined {
+		t.Fatalf("infected outcome = %+v, err = %v", o, err)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Error("検出した作業ファイルが残っている")
+	}
+	if files, _ := m.storage.ListFiles("public"); len(files) != 0 {
+		t.Errorf("一覧 = %+v, want 空", files)
+	}
+
+	entries, err := m.List(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("隔離一覧 = %+v, err = %v", entries, err)
+	}
+	if _, err := m.Release(ctx, entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	files, err := m.storage.ListFiles("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].OriginalName != "bad.exe" || files[0].ScanStatus != StatusReleased || files[0].Uploader != "alice" {
+		t.Errorf("解除後の一覧 = %+v", files)
+	}
+}
+
+func TestManagerDelete(t *testing.T) {
+	c, err := NewClamd(stubClamd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, cfg := newTestManager(t, c, false)
+	ctx := context.Background()
+
+	putFile(t, m, "public", "bad.exe", "EICAR")
+	m.Check(ctx, "public", "bad.exe")
+	entries, err := m.List(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("隔離一覧 = %+v, err = %v", entries, err)
+	}
+	if _, err := m.Delete(ctx, entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := os.ReadDir(cfg.QuarantinePath()); len(left) != 0 {
+		t.Errorf("隔離領域にファイルが残っている: %v", left)
+	}
+	if entries, _ := m.List(ctx); len(entries) != 0 {
+		t.Errorf("削除後の隔離一覧 = %+v", entries)
+	}
+}
+
+type failingScanner struct{}
+
+func (failingScanner) Scan(context.Context, string) (Verdict, error) {
+	return Verdict{}, errors.New("clamd停止中")
+}
+
+// スキャン失敗時、fail_closed なら隔離し、そうでなければ公開したまま error を記録すること。
+func TestManagerScanError(t *testing.T) {
+	ctx := context.Background()
+
+	open, _ := newTestManager(t, failingScanner{}, false)
+	putFile(t, open, "public", "a.txt", "x")
+	if o := open.Check(ctx, "public", "a.txt"); o.Status != StatusError || o.Quarantined {
+		t.Errorf("fail-open outcome = %+v", o)
+	}
+	if meta, _ := open.storage.Metadata("public", "a.txt"); meta.ScanStatus != StatusError {
+		t.Errorf("scan_status = %q, want error", meta.ScanStatus)
+	}
+
+	closed, _ := newTestManager(t, failingScanner{}, true)
+	putFile(t, closed, "public", "a.txt", "x")
+	if o := closed.Check(ctx, "public", "a.txt"); o.Status != StatusError || !o.Quarantined {
+		t.Errorf("fail-closed outcome = %+v", o)
+	}
+}
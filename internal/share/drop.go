@@ -0,0 +1,265 @@
+package share
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"fileserver/internal/logging"
+)
+
+// ErrQuotaExceeded はアップロードリンクのファイル数・容量の上限を超える場合に返されます。
+var ErrQuotaExceeded = errors.New("アップロードリンクのファイル数・容量の上限を超えています")
+
+// retainReservation は upload_id に結び付いていない予約を残しておく期間です。
+// 通常のアップロードは1リクエストで確定・解放するため、これを過ぎた予約は中断されたものとして Prune で消します。
+const retainReservation = 24 * time.Hour
+
+// Drop はアップロードリンク1件です。訪問者は Directory へアップロードだけでき、一覧・ダウンロードはできません。
+type Drop struct {
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	Token         string     `json:"token"`
+	Directory     string     `json:"directory"`
+	Label         string     `json:"label,omitempty"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedByName string     `json:"created_by_name,omitempty"`
+	RevokedBy     string     `json:"revoked_by,omitempty"`
+	MaxBytes      int64      `json:"max_bytes,omitempty"` // 0 は無制限
+	UsedBytes     int64      `json:"used_bytes"`
+	MaxFiles      int        `json:"max_files,omitempty"` // 0 は無制限
+	UsedFiles     int        `json:"used_files"`
+}
+
+// Usable は now の時点でリンクを使えるかを判定し、使えない理由をエラーで返します。
+// 受信中の予約は含めないため、上限の最終的な判定は Reserve で行います。
+func (d *Drop) Usable(now time.Time) error {
+	switch {
+	case d.RevokedAt != nil:
+		return ErrRevoked
+	case d.ExpiresAt != nil && !now.Before(*d.ExpiresAt):
+		return ErrExpired
+	case d.MaxFiles > 0 && d.UsedFiles >= d.MaxFiles, d.MaxBytes > 0 && d.UsedBytes >= d.MaxBytes:
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// DropParams はアップロードリンクを作成する際の指定です。
+type DropParams struct {
+	Directory string
+	Label     string // 訪問者に見せる説明（任意）
+	CreatedBy string
+	TTL       time.Duration // 0 は無期限
+	MaxBytes  int64         // 0 は無制限
+	MaxFiles  int           // 0 は無制限
+}
+
+// CreateDrop はアップロードリンクを作成し、作成したリンクを返します。
+func (s *Store) CreateDrop(ctx context.Context, p DropParams) (*Drop, error) {
+	if p.MaxBytes < 0 || p.MaxFiles < 0 || p.TTL < 0 {
+		return nil, fmt.Errorf("有効期間・容量・ファイル数に負の値は指定できません")
+	}
+	drop := &Drop{
+		Token:     rand.Text(),
+		Directory: p.Directory,
+		Label:     p.Label,
+		CreatedBy: p.CreatedBy,
+		CreatedAt: s.now(),
+		MaxBytes:  p.MaxBytes,
+		MaxFiles:  p.MaxFiles,
+	}
+	if p.TTL > 0 {
+		expiresAt := drop.CreatedAt.Add(p.TTL)
+		drop.ExpiresAt = &expiresAt
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO drop_links (token, directory, label, created_by, max_bytes, max_files, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, drop.Token, drop.Directory, drop.Label, drop.CreatedBy, drop.MaxBytes, drop.MaxFiles,
+		drop.CreatedAt, drop.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("アップロードリンクの保存に失敗しました: %w", err)
+	}
+	logging.Audit(ctx, "drop_link_created", "token_prefix", tokenPrefix(drop.Token), "directory", drop.Directory,
+		"expires_at", drop.ExpiresAt, "max_bytes", drop.MaxBytes, "max_files", drop.MaxFiles, "actor", drop.CreatedBy)
+	return drop, nil
+}
+
+// dropColumns は scanDrop が読む列です。
+const dropColumns = `d.token, d.directory, d.label, d.created_by, COALESCE(u.username, ''), d.max_bytes, d.used_bytes,
+	d.max_files, d.used_files, d.created_at, d.expires_at, d.revoked_at, COALESCE(d.revoked_by, '')`
+
+// scanDrop は dropColumns の1行を Drop に読み込みます。
+func scanDrop(row interface{ Scan(...any) error }) (*Drop, error) {
+	var (
+		d                    Drop
+		expiresAt, revokedAt sql.NullTime
+	)
+	if err := row.Scan(&d.Token, &d.Directory, &d.Label, &d.CreatedBy, &d.CreatedByName, &d.MaxBytes, &d.UsedBytes,
+		&d.MaxFiles, &d.UsedFiles, &d.CreatedAt, &expiresAt, &revokedAt, &d.RevokedBy); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		d.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		d.RevokedAt = &revokedAt.Time
+	}
+	return &d, nil
+}
+
+// GetDrop はトークンでアップロードリンクを取得します。存在しない場合は ErrNotFound を返します。
+// 期限切れ・取り消し済みのリンクもそのまま返すため、使う前に Usable で判定します。
+func (s *Store) GetDrop(ctx context.Context, token string) (*Drop, error) {
+	drop, err := scanDrop(s.db.QueryRowContext(ctx,
+		"SELECT "+dropColumns+" FROM drop_links d LEFT JOIN users u ON u.id = d.created_by WHERE d.token = ?", token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("アップロードリンクの取得に失敗しました: %w", err)
+	}
+	return drop, nil
+}
+
+// ListDrops はアップロードリンクを新しい順に返します。createdBy が空なら全員のリンクを返します（管理者用）。
+func (s *Store) ListDrops(ctx context.Context, createdBy string) ([]*Drop, error) {
+	query := "SELECT " + dropColumns + " FROM drop_links d LEFT JOIN users u ON u.id = d.created_by"
+	var args []any
+	if createdBy != "" {
+		query += " WHERE d.created_by = ?"
+		args = append(args, createdBy)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY d.created_at DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("アップロードリンクの取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	drops := make([]*Drop, 0)
+	for rows.Next() {
+		drop, err := scanDrop(rows)
+		if err != nil {
+			return nil, fmt.Errorf("アップロードリンクの読み取りに失敗しました: %w", err)
+		}
+		drops = append(drops, drop)
+	}
+	return drops, rows.Err()
+}
+
+// RevokeDrop はアップロードリンクを取り消します。受信中のアップロードも以後は確定できません。
+// 存在しない場合は ErrNotFound、取り消し済みなら ErrRevoked を返します。
+func (s *Store) RevokeDrop(ctx context.Context, token, actor string) error {
+	return s.revoke(ctx, "drop_links", "drop_link_revoked", token, actor, func() error {
+		_, err := s.GetDrop(ctx, token)
+		return err
+	})
+}
+
+// Reserve は size バイトのファイル1件分をリンクの上限から予約し、予約IDを返します。
+// 確定済みの分と受信中の予約の合計が上限を超える場合は ErrQuotaExceeded を返します。
+// 判定と予約を1つの INSERT で行うため、同時のアップロードでも上限を超えません。
+func (s *Store) Reserve(ctx context.Context, token string, size int64) (string, error) {
+	id := rand.Text()
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO drop_reservations (id, token, size, created_at)
+		SELECT ?, d.token, ?, ? FROM drop_links d
+		WHERE d.token = ?
+			AND (d.max_files = 0 OR d.used_files + (SELECT COUNT(*) FROM drop_reservations r WHERE r.token = d.token) < d.max_files)
+			AND (d.max_bytes = 0 OR d.used_bytes + (SELECT COALESCE(SUM(r.size), 0) FROM drop_reservations r WHERE r.token = d.token) + ? <= d.max_bytes)
+	`, id, size, s.now(), token, size)
+	if err != nil {
+		return "", fmt.Errorf("アップロードの予約に失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("アップロードの予約に失敗しました: %w", err)
+	} else if n == 0 {
+		return "", ErrQuotaExceeded
+	}
+	return id, nil
+}
+
+// Bind は予約をチャンクアップロードのセッションに結び付けます。以後 Reservation で引けるようになり、
+// セッションが期限切れで消えた予約は Prune で解放されます。
+func (s *Store) Bind(ctx context.Context, reservationID, uploadID string) error {
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE drop_reservations SET upload_id = ? WHERE id = ?", uploadID, reservationID); err != nil {
+		return fmt.Errorf("アップロードの予約の更新に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// Reservation は token のリンクで uploadID に結び付けた予約のIDを返します。
+// 他のリンクや、リンクを使わずに始めたアップロードの場合は ErrNotFound を返します。
+func (s *Store) Reservation(ctx context.Context, token, uploadID string) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id FROM drop_reservations WHERE token = ? AND upload_id = ?", token, uploadID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("アップロードの予約の取得に失敗しました: %w", err)
+	}
+	return id, nil
+}
+
+// Commit は予約を確定し、size バイト・1ファイルをリンクの使用量に加えます。
+// 予約が Prune で先に消えていても、保存済みのファイルの分は使用量に加えます。
+func (s *Store) Commit(ctx context.Context, token, reservationID string, size int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("アップロードの確定に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() //nolint:errcheck // Commit 後の Rollback は常に ErrTxDone
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM drop_reservations WHERE id = ?", reservationID); err != nil {
+		return fmt.Errorf("アップロードの確定に失敗しました: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE drop_links SET used_bytes = used_bytes + ?, used_files = used_files + 1 WHERE token = ?", size, token); err != nil {
+		return fmt.Errorf("アップロードの確定に失敗しました: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("アップロードの確定に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// Release は確定しなかったアップロードの予約を解放します。
+func (s *Store) Release(ctx context.Context, reservationID string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM drop_reservations WHERE id = ?", reservationID); err != nil {
+		return fmt.Errorf("アップロードの予約の解放に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// PruneDrops は期限切れ・取り消しから retainFinished を過ぎたアップロードリンクと、
+// セッションが消えた（期限切れ・管理者による中止）予約を削除し、削除したリンクの件数を返します。
+func (s *Store) PruneDrops(ctx context.Context) (int64, error) {
+	now := s.now()
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM drop_reservations
+		WHERE (upload_id != '' AND upload_id NOT IN (SELECT upload_id FROM upload_sessions))
+			OR (upload_id = '' AND created_at < ?)
+	`, now.Add(-retainReservation)); err != nil {
+		return 0, fmt.Errorf("古いアップロードの予約の削除に失敗しました: %w", err)
+	}
+
+	cutoff := now.Add(-retainFinished)
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM drop_links WHERE expires_at < ? OR revoked_at < ?", cutoff, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("古いアップロードリンクの削除に失敗しました: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM drop_reservations WHERE token NOT IN (SELECT token FROM drop_links)"); err != nil {
+		return 0, fmt.Errorf("古いアップロードの予約の削除に失敗しました: %w", err)
+	}
+	return res.RowsAffected()
+}
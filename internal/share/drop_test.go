@@ -0,0 +1,128 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 同時に予約されても、受信中の予約と確定済みの分の合計が容量の上限を超えないこと。
+// 解放した予約の分は再び予約でき、確定した分は使用量に残ること。
+func TestReserveLimit(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	drop, err := s.CreateDrop(ctx, DropParams{Directory: "inbox", CreatedBy: "alice", MaxBytes: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		reservations []string
+	)
+	for range 10 {
+		wg.Go(func() {
+			id, err := s.Reserve(ctx, drop.Token, 100)
+			if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+				t.Error(err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				reservations = append(reservations, id)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if len(reservations) != 3 {
+		t.Fatalf("予約できた件数 = %d, want 3", len(reservations))
+	}
+
+	if err := s.Commit(ctx, drop.Token, reservations[0], 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(ctx, reservations[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(ctx, drop.Token, 100); err != nil {
+		t.Errorf("解放した分の予約 = %v", err)
+	}
+	if _, err := s.Reserve(ctx, drop.Token, 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("上限を超える予約 = %v, want ErrQuotaExceeded", err)
+	}
+
+	got, err := s.GetDrop(ctx, drop.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UsedBytes != 100 || got.UsedFiles != 1 {
+		t.Errorf("使用量 = %d バイト・%d 件, want 100・1", got.UsedBytes, got.UsedFiles)
+	}
+}
+
+// セッションに結び付いた予約はそのリンクからだけ引け、セッションが消えた予約と
+// 結び付かないまま残った予約は PruneDrops で解放されること。
+func TestReservationBindAndPrune(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	drop, err := s.CreateDrop(ctx, DropParams{Directory: "inbox", CreatedBy: "alice", MaxFiles: 2, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := s.Reserve(ctx, drop.Token, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bind(ctx, bound, "upload-1"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.Reservation(ctx, drop.Token, "upload-1"); err != nil || id != bound {
+		t.Errorf("予約の取得 = %q, %v", id, err)
+	}
+	if _, err := s.Reservation(ctx, "other", "upload-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("他のリンクからの取得 = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Reserve(ctx, drop.Token, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(ctx, drop.Token, 10); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("上限を超える予約 = %v, want ErrQuotaExceeded", err)
+	}
+
+	// upload-1 のセッションは存在しないため、結び付いた予約はすぐに解放される。
+	if _, err := s.PruneDrops(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reservation(ctx, drop.Token, "upload-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("セッションが消えた予約 = %v, want ErrNotFound", err)
+	}
+	now = now.Add(retainReservation + time.Minute)
+	if _, err := s.PruneDrops(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(ctx, drop.Token, 10); err != nil {
+		t.Errorf("予約がすべて解放された後の予約 = %v", err)
+	}
+
+	if err := s.RevokeDrop(ctx, drop.Token, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetDrop(ctx, drop.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Usable(now); !errors.Is(err, ErrRevoked) {
+		t.Errorf("取り消し後 = %v, want ErrRevoked", err)
+	}
+	now = now.Add(retainFinished)
+	if n, err := s.PruneDrops(ctx); err != nil || n != 1 {
+		t.Errorf("保持期間後の PruneDrops = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,313 @@
+// Package share はログインできない人へファイル・フォルダを渡す共有リンクと、
+// ログインできない人からファイルを受け取るアップロードリンクを提供します。
+// リンクは推測できないランダムなトークンで表し、share_links・drop_links テーブルに保存します。
+package share
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileserver/internal/logging"
+)
+
+var (
+	// ErrNotFound はリンクが存在しない場合に返されます。
+	ErrNotFound = errors.New("リンクが見つかりません")
+	// ErrExpired はリンクの有効期限が切れている場合に返されます。
+	ErrExpired = errors.New("リンクの有効期限が切れています")
+	// ErrRevoked はリンクが取り消されている場合に返されます。
+	ErrRevoked = errors.New("リンクは取り消されています")
+	// ErrLimitReached はダウンロード回数の上限に達している場合に返されます。
+	ErrLimitReached = errors.New("共有リンクのダウンロード回数の上限に達しています")
+)
+
+// パスワードは PBKDF2-HMAC-SHA256 で保存します（反復回数は OWASP の推奨値）。
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+// retainFinished は期限切れ・取り消し済みのリンクを一覧に残しておく期間です。これを過ぎると Prune で削除します。
+const retainFinished = 30 * 24 * time.Hour
+
+// Link は共有リンク1件です。
+type Link struct {
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	Token         string     `json:"token"`
+	Directory     string     `json:"directory"`
+	Filename      string     `json:"filename,omitempty"` // 空はフォルダの共有
+	CreatedBy     string     `json:"created_by"`
+	CreatedByName string     `json:"created_by_name,omitempty"`
+	RevokedBy     string     `json:"revoked_by,omitempty"`
+	passwordHash  string
+	MaxDownloads  int  `json:"max_downloads,omitempty"` // 0 は無制限
+	Downloads     int  `json:"downloads"`
+	HasPassword   bool `json:"has_password"`
+}
+
+// IsFolder はフォルダ（Directory 直下のファイル）を共有するリンクかを返します。
+func (l *Link) IsFolder() bool {
+	return l.Filename == ""
+}
+
+// Usable は now の時点でリンクを使えるかを判定し、使えない理由をエラーで返します。
+func (l *Link) Usable(now time.Time) error {
+	switch {
+	case l.RevokedAt != nil:
+		return ErrRevoked
+	case l.ExpiresAt != nil && !now.Before(*l.ExpiresAt):
+		return ErrExpired
+	case l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads:
+		return ErrLimitReached
+	}
+	return nil
+}
+
+// CheckPassword は password がリンクのパスワードと一致するかを返します。パスワードの無いリンクは常に true です。
+func (l *Link) CheckPassword(password string) bool {
+	if !l.HasPassword {
+		return true
+	}
+	return verifyPassword(l.passwordHash, password)
+}
+
+// CreateParams は共有リンクを作成する際の指定です。
+type CreateParams struct {
+	Directory    string
+	Filename     string // 空はフォルダの共有
+	CreatedBy    string
+	Password     string        // 空はパスワードなし
+	TTL          time.Duration // 0 は無期限
+	MaxDownloads int           // 0 は無制限
+}
+
+// Store は share_links テーブルを使う共有リンクのストアです。
+type Store struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+// New は Store を作成します。
+func New(db *sql.DB) *Store {
+	return &Store{db: db, now: time.Now}
+}
+
+// Create は共有リンクを作成し、作成したリンクを返します。
+func (s *Store) Create(ctx context.Context, p CreateParams) (*Link, error) {
+	if p.MaxDownloads < 0 || p.TTL < 0 {
+		return nil, fmt.Errorf("有効期間・ダウンロード回数に負の値は指定できません")
+	}
+	link := &Link{
+		Token:        rand.Text(),
+		Directory:    p.Directory,
+		Filename:     p.Filename,
+		CreatedBy:    p.CreatedBy,
+		CreatedAt:    s.now(),
+		MaxDownloads: p.MaxDownloads,
+		HasPassword:  p.Password != "",
+	}
+	if p.TTL > 0 {
+		expiresAt := link.CreatedAt.Add(p.TTL)
+		link.ExpiresAt = &expiresAt
+	}
+	if link.HasPassword {
+		hash, err := hashPassword(p.Password)
+		if err != nil {
+			return nil, err
+		}
+		link.passwordHash = hash
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO share_links (token, directory, filename, created_by, password_hash, max_downloads, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, link.Token, link.Directory, link.Filename, link.CreatedBy, link.passwordHash, link.MaxDownloads,
+		link.CreatedAt, link.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("共有リンクの保存に失敗しました: %w", err)
+	}
+	logging.Audit(ctx, "share_link_created", "token_prefix", tokenPrefix(link.Token), "directory", link.Directory,
+		"filename", link.Filename, "expires_at", link.ExpiresAt, "max_downloads", link.MaxDownloads,
+		"password", link.HasPassword, "actor", link.CreatedBy)
+	return link, nil
+}
+
+// linkColumns は scanLink が読む列です。
+const linkColumns = `s.token, s.directory, s.filename, s.created_by, COALESCE(u.username, ''), s.password_hash,
+	s.max_downloads, s.download_count, s.created_at, s.expires_at, s.revoked_at, COALESCE(s.revoked_by, '')`
+
+// scanLink は linkColumns の1行を Link に読み込みます。
+func scanLink(row interface{ Scan(...any) error }) (*Link, error) {
+	var (
+		l                    Link
+		expiresAt, revokedAt sql.NullTime
+	)
+	if err := row.Scan(&l.Token, &l.Directory, &l.Filename, &l.CreatedBy, &l.CreatedByName, &l.passwordHash,
+		&l.MaxDownloads, &l.Downloads, &l.CreatedAt, &expiresAt, &revokedAt, &l.RevokedBy); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		l.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		l.RevokedAt = &revokedAt.Time
+	}
+	l.HasPassword = l.passwordHash != ""
+	return &l, nil
+}
+
+// Get はトークンで共有リンクを取得します。存在しない場合は ErrNotFound を返します。
+// 期限切れ・取り消し済みのリンクもそのまま返すため、使う前に Usable で判定します。
+func (s *Store) Get(ctx context.Context, token string) (*Link, error) {
+	link, err := scanLink(s.db.QueryRowContext(ctx,
+		"SELECT "+linkColumns+" FROM share_links s LEFT JOIN users u ON u.id = s.created_by WHERE s.token = ?", token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("共有リンクの取得に失敗しました: %w", err)
+	}
+	return link, nil
+}
+
+// List は共有リンクを新しい順に返します。createdBy が空なら全員のリンクを返します（管理者用）。
+func (s *Store) List(ctx context.Context, createdBy string) ([]*Link, error) {
+	query := "SELECT " + linkColumns + " FROM share_links s LEFT JOIN users u ON u.id = s.created_by"
+	var args []any
+	if createdBy != "" {
+		query += " WHERE s.created_by = ?"
+		args = append(args, createdBy)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY s.created_at DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("共有リンクの取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	links := make([]*Link, 0)
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("共有リンクの読み取りに失敗しました: %w", err)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Revoke は共有リンクを取り消します。actor は取り消したユーザーで、監査ログに残します。
+// 存在しない場合は ErrNotFound、取り消し済みなら ErrRevoked を返します。
+func (s *Store) Revoke(ctx context.Context, token, actor string) error {
+	return s.revoke(ctx, "share_links", "share_link_revoked", token, actor, func() error {
+		_, err := s.Get(ctx, token)
+		return err
+	})
+}
+
+// revoke は table のリンクを取り消します。取り消せなかった場合は exists で存在を確かめ、
+// 存在しなければそのエラー（ErrNotFound）を、存在すれば ErrRevoked を返します。
+func (s *Store) revoke(ctx context.Context, table, event, token, actor string, exists func() error) error {
+	// #nosec G202 - table は呼び出し元の固定値
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE "+table+" SET revoked_at = ?, revoked_by = ? WHERE token = ? AND revoked_at IS NULL",
+		s.now(), actor, token)
+	if err != nil {
+		return fmt.Errorf("リンクの取り消しに失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err := exists(); err != nil {
+			return err
+		}
+		return ErrRevoked
+	}
+	logging.Audit(ctx, event, "token_prefix", tokenPrefix(token), "actor", actor)
+	return nil
+}
+
+// CountDownload はダウンロードを1回数えます。上限に達している場合は数えずに ErrLimitReached を返します。
+// 判定と加算を1つの UPDATE で行うため、同時のダウンロードでも上限を超えません。
+func (s *Store) CountDownload(ctx context.Context, token string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE share_links SET download_count = download_count + 1
+		WHERE token = ? AND (max_downloads = 0 OR download_count < max_downloads)
+	`, token)
+	if err != nil {
+		return fmt.Errorf("ダウンロード回数の記録に失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("ダウンロード回数の記録に失敗しました: %w", err)
+	} else if n == 0 {
+		return ErrLimitReached
+	}
+	return nil
+}
+
+// Prune は期限切れ・取り消しから retainFinished を過ぎたリンクを削除し、削除した件数を返します。
+func (s *Store) Prune(ctx context.Context) (int64, error) {
+	cutoff := s.now().Add(-retainFinished)
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM share_links WHERE expires_at < ? OR revoked_at < ?", cutoff, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("古い共有リンクの削除に失敗しました: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// tokenPrefix はトークンの先頭だけをログ用に取り出します（全体を残すとログからリンクを使えてしまう）。
+func tokenPrefix(token string) string {
+	const n = 6
+	if len(token) <= n {
+		return "..."
+	}
+	return token[:n] + "..."
+}
+
+// hashPassword は password を "pbkdf2-sha256$反復回数$ソルト$ハッシュ" の形式でハッシュ化します。
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("ソルトの生成に失敗しました: %w", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeySize)
+	if err != nil {
+		return "", fmt.Errorf("パスワードのハッシュ化に失敗しました: %w", err)
+	}
+	enc := base64.RawStdEncoding
+	return strings.Join([]string{passwordScheme, strconv.Itoa(passwordIterations), enc.EncodeToString(salt), enc.EncodeToString(key)}, "$"), nil
+}
+
+// verifyPassword は password が hashPassword の結果 encoded と一致するかを返します。
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,147 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"fileserver/internal/database"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db)
+}
+
+// パスワード・有効期限・取り消しが保存した状態のまま取得でき、Usable で判定できること。
+func TestCreateGetUsable(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	created, err := s.Create(ctx, CreateParams{Directory: "public", Filename: "a.txt", CreatedBy: "alice", Password: "secret", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := s.Get(ctx, created.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.IsFolder() || !link.HasPassword || link.ExpiresAt == nil || !link.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("取得したリンク = %+v", link)
+	}
+	if !link.CheckPassword("secret") || link.CheckPassword("wrong") {
+		t.Error("パスワードの照合が正しくない")
+	}
+	if err := link.Usable(now); err != nil {
+		t.Errorf("有効期間内 = %v", err)
+	}
+	if err := link.Usable(now.Add(time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Errorf("期限切れ = %v, want ErrExpired", err)
+	}
+
+	if err := s.Revoke(ctx, created.Token, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke(ctx, created.Token, "admin"); !errors.Is(err, ErrRevoked) {
+		t.Errorf("二度目の取り消し = %v, want ErrRevoked", err)
+	}
+	if err := s.Revoke(ctx, "unknown", "admin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("存在しないリンクの取り消し = %v, want ErrNotFound", err)
+	}
+	link, err = s.Get(ctx, created.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Usable(now); !errors.Is(err, ErrRevoked) || link.RevokedBy != "admin" {
+		t.Errorf("取り消し後 = %v, revoked_by = %q", err, link.RevokedBy)
+	}
+}
+
+// 同時にダウンロードされても上限を超えて数えないこと。
+func TestCountDownloadLimit(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	link, err := s.Create(ctx, CreateParams{Directory: "public", CreatedBy: "alice", MaxDownloads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		counted int
+	)
+	for range 10 {
+		wg.Go(func() {
+			err := s.CountDownload(ctx, link.Token)
+			if err != nil && !errors.Is(err, ErrLimitReached) {
+				t.Error(err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				counted++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if counted != 3 {
+		t.Errorf("数えた回数 = %d, want 3", counted)
+	}
+	got, err := s.Get(ctx, link.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Usable(time.Now()); !errors.Is(err, ErrLimitReached) {
+		t.Errorf("上限に達した後 = %v, want ErrLimitReached", err)
+	}
+}
+
+// 作成者を指定した一覧は自分のリンクだけを返し、Prune は保持期間を過ぎたリンクだけを消すこと。
+func TestListAndPrune(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	old, err := s.Create(ctx, CreateParams{Directory: "public", CreatedBy: "alice", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, CreateParams{Directory: "public", CreatedBy: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, CreateParams{Directory: "public", CreatedBy: "bob", TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if links, err := s.List(ctx, "alice"); err != nil || len(links) != 2 {
+		t.Fatalf("alice の一覧 = %d件, %v", len(links), err)
+	}
+	if links, err := s.List(ctx, ""); err != nil || len(links) != 3 {
+		t.Fatalf("全員の一覧 = %d件, %v", len(links), err)
+	}
+
+	now = now.Add(retainFinished)
+	if n, err := s.Prune(ctx); err != nil || n != 0 {
+		t.Fatalf("保持期間内の Prune = %d, %v", n, err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, err := s.Prune(ctx); err != nil || n != 2 {
+		t.Fatalf("保持期間後の Prune = %d, %v", n, err)
+	}
+	if _, err := s.Get(ctx, old.Token); !errors.Is(err, ErrNotFound) {
+		t.Errorf("削除したリンク = %v, want ErrNotFound", err)
+	}
+}
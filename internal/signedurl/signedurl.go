@@ -0,0 +1,113 @@
+// Package signedurl はCookieなしでダウンロードできる短命の署名付きURLを提供します。
+// URLは対象のファイル・発行者・有効期限・（任意で）IPアドレス・ファイルのハッシュを
+// サーバーの鍵で HMAC-SHA256 署名したクエリで表し、URLごとの記録はデータベースに残しません。
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrInvalid は署名が欠けている・一致しない場合に返されます。
+	ErrInvalid = errors.New("URLの署名が正しくありません")
+	// ErrExpired はURLの有効期限が切れている場合に返されます。
+	ErrExpired = errors.New("URLの有効期限が切れています")
+)
+
+// version は署名する内容の形式です。形式を変えたときに古いURLを確実に無効にするため署名に含めます。
+const version = "v1"
+
+// keySize は鍵を生成する場合の長さです。
+const keySize = 32
+
+// Claims は署名付きURLが許可する内容です。
+type Claims struct {
+	Expires   time.Time
+	Directory string
+	Filename  string
+	UserID    string // 発行者。ダウンロードはこのユーザーとして扱う
+	IP        string // 空はIPアドレスを限定しない
+	Hash      string // 発行時のファイルのSHA-256。ファイルが置き換えられたURLを無効にする
+}
+
+// Signer は署名付きURLのクエリを作成・検証します。
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// New は secret を鍵とする Signer を作成します。
+// secret が空の場合はランダムな鍵を生成するため、プロセスを再起動すると発行済みのURLは無効になります。
+func New(secret string) (*Signer, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("署名の鍵の生成に失敗しました: %w", err)
+		}
+	}
+	return &Signer{key: key, now: time.Now}, nil
+}
+
+// Sign は c を署名したクエリ（exp・uid・ip・sha・sig）を返します。
+func (s *Signer) Sign(c Claims) url.Values {
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(c.Expires.Unix(), 10))
+	q.Set("uid", c.UserID)
+	if c.IP != "" {
+		q.Set("ip", c.IP)
+	}
+	q.Set("sha", c.Hash)
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(s.mac(c)))
+	return q
+}
+
+// Verify はパスの directory・filename とクエリ q の署名を検証し、署名された内容を返します。
+// IPアドレスとファイルのハッシュの照合は、リクエストとファイルを知る呼び出し側で行います。
+func (s *Signer) Verify(directory, filename string, q url.Values) (Claims, error) {
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return Claims{}, ErrInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil {
+		return Claims{}, ErrInvalid
+	}
+	c := Claims{
+		Expires:   time.Unix(exp, 0),
+		Directory: directory,
+		Filename:  filename,
+		UserID:    q.Get("uid"),
+		IP:        q.Get("ip"),
+		Hash:      q.Get("sha"),
+	}
+	if c.UserID == "" || !hmac.Equal(sig, s.mac(c)) {
+		return Claims{}, ErrInvalid
+	}
+	if !s.now().Before(c.Expires) {
+		return Claims{}, ErrExpired
+	}
+	return c, nil
+}
+
+// mac は c の HMAC-SHA256 を返します。各項目は長さを前置して連結し、区切り文字を含む値で境界をずらせないようにします。
+func (s *Signer) mac(c Claims) []byte {
+	m := hmac.New(sha256.New, s.key)
+	for _, field := range []string{version, c.Directory, c.Filename, strconv.FormatInt(c.Expires.Unix(), 10), c.UserID, c.IP, c.Hash} {
+		writeField(m, field)
+	}
+	return m.Sum(nil)
+}
+
+func writeField(m hash.Hash, field string) {
+	fmt.Fprintf(m, "%d:%s", len(field), field) //nolint:errcheck // hash.Hash への書き込みは失敗しない
+}
@@ -0,0 +1,64 @@
+package signedurl
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 署名したクエリは同じファイルに対してだけ通り、どの項目を書き換えても、
+// 別の鍵で検証しても、期限を過ぎても拒否されること。
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s, err := New("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	claims := Claims{
+		Expires:   now.Add(15 * time.Minute),
+		Directory: "media",
+		Filename:  "movie.mp4",
+		UserID:    "u1",
+		IP:        "192.0.2.1",
+		Hash:      "abc",
+	}
+	q := s.Sign(claims)
+	got, err := s.Verify("media", "movie.mp4", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != "u1" || got.IP != "192.0.2.1" || got.Hash != "abc" || !got.Expires.Equal(claims.Expires) {
+		t.Errorf("Verify = %+v", got)
+	}
+
+	if _, err := s.Verify("media", "other.mp4", q); !errors.Is(err, ErrInvalid) {
+		t.Errorf("別のファイル = %v, want ErrInvalid", err)
+	}
+	for _, key := range []string{"exp", "uid", "ip", "sha"} {
+		tampered := s.Sign(claims)
+		tampered.Set(key, "1")
+		if _, err := s.Verify("media", "movie.mp4", tampered); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s の書き換え = %v, want ErrInvalid", key, err)
+		}
+	}
+	unbound := s.Sign(claims)
+	unbound.Del("ip")
+	if _, err := s.Verify("media", "movie.mp4", unbound); !errors.Is(err, ErrInvalid) {
+		t.Errorf("ip の削除 = %v, want ErrInvalid", err)
+	}
+
+	other, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Verify("media", "movie.mp4", q); !errors.Is(err, ErrInvalid) {
+		t.Errorf("別の鍵 = %v, want ErrInvalid", err)
+	}
+
+	now = claims.Expires
+	if _, err := s.Verify("media", "movie.mp4", q); !errors.Is(err, ErrExpired) {
+		t.Errorf("期限切れ = %v, want ErrExpired", err)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"fileserver/internal/config"
+)
+
+// ErrNameConflict は on_conflict が reject で、同じ名前のファイルが既にある場合のエラーです。
+var ErrNameConflict = errors.New("同じ名前のファイルが既に存在します")
+
+// FindByName は directory にある、元のファイル名が filename のファイルの保存名を返します。
+// 作業ファイル（.temp / .meta）は含みません。
+func (m *Manager) FindByName(directory, filename string) ([]string, error) {
+	names, err := m.storedNames(directory)
+	if err != nil {
+		return nil, err
+	}
+	return names[sanitizeFilename(filename)], nil
+}
+
+// storedNames は directory のファイルを元のファイル名ごとの保存名にまとめて返します。
+// まだ作られていないディレクトリ（初回アップロード前の配下パス等）は空として扱います。
+func (m *Manager) storedNames(directory string) (map[string][]string, error) {
+	entries, err := os.ReadDir(filepath.Join(m.config.Storage.UploadPath, directory))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ディレクトリ読み込みエラー: %w", err)
+	}
+	names := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.IsDir() || IsWorkFile(entry.Name()) {
+			continue
+		}
+		original := extractOriginalFilename(entry.Name())
+		names[original] = append(names[original], entry.Name())
+	}
+	return names, nil
+}
+
+// CheckConflict はアップロードを受け付ける前に、policy で保存できるかを判定します。
+// reject で同名ファイルがあれば ErrNameConflict、replace で置き換え対象が保持期間中・リーガルホールド中なら
+// ErrRetained / ErrLegalHold を返します。受信中に状況が変わり得るため、保存時（Place）にも同じ判定を行います。
+// existing は同じ名前の既存ファイルの保存名です。
+func (m *Manager) CheckConflict(ctx context.Context, directory, filename, policy string) (existing []string, err error) {
+	existing, err = m.FindByName(directory, filename)
+	if err != nil {
+		return nil, err
+	}
+	return existing, m.checkPolicy(ctx, directory, existing, policy)
+}
+
+// checkPolicy は同名の既存ファイル existing に対して policy で保存できるかを判定します。
+func (m *Manager) checkPolicy(ctx context.Context, directory string, existing []string, policy string) error {
+	switch {
+	case len(existing) == 0:
+		return nil
+	case policy == config.ConflictReject:
+		return ErrNameConflict
+	case policy == config.ConflictReplace:
+		for _, name := range existing {
+			if err := m.CheckModifiable(ctx, directory, name, "replace"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Place は受信済みのファイル src を directory へ filename として保存します（保存名は "UUID_元のファイル名"）。
+// 同じ名前のファイルがある場合は policy に従い、rename なら「名前 (2).拡張子」のように空いている番号を付け、
+// replace なら置き換え対象を SavedFile.Replaces に入れて返します（削除は呼び出し側が検査を終えてから RemoveReplaced で行う）。
+// 同時に同じ名前で保存されても番号が重ならないよう、判定から移動までを直列化します。
+func (m *Manager) Place(ctx context.Context, src, directory, filename, policy string) (*SavedFile, error) {
+	m.placeMu.Lock()
+	defer m.placeMu.Unlock()
+
+	names, err := m.storedNames(directory)
+	if err != nil {
+		return nil, err
+	}
+	name := sanitizeFilename(filename)
+	existing := names[name]
+	if err := m.checkPolicy(ctx, directory, existing, policy); err != nil {
+		return nil, err
+	}
+
+	var replaces []string
+	switch {
+	case len(existing) == 0:
+	case policy == config.ConflictReplace:
+		replaces = existing
+	default:
+		name = nextFreeName(names, name)
+	}
+
+	stored := StoredFilename(uuid.New().String(), name)
+	dest := filepath.Join(m.config.Storage.UploadPath, directory, stored)
+	if err := os.Rename(src, dest); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &SavedFile{
+		Filename: stored,
+		Path:     filepath.Join(directory, stored),
+		Size:     info.Size(),
+		Replaces: replaces,
+	}, nil
+}
+
+// nextFreeName は「名前 (2).拡張子」から順に、names でまだ使われていない名前を返します。
+func nextFreeName(names map[string][]string, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		// ".env" のような拡張子だけの名前は全体を名前として扱う。
+		base, ext = name, ""
+	}
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if len(names[candidate]) == 0 {
+			return candidate
+		}
+	}
+}
+
+// RemoveReplaced は Place が返した置き換え対象を削除します。
+// 新しいファイルは保存済みのため、削除の失敗はログに残すだけにします。
+func (m *Manager) RemoveReplaced(ctx context.Context, saved *SavedFile) {
+	directory := filepath.Dir(saved.Path)
+	for _, name := range saved.Replaces {
+		if err := m.DeleteFile(ctx, directory, name); err != nil {
+			slog.ErrorContext(ctx, "置き換えたファイルの削除に失敗しました", "directory", directory, "filename", name, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "同名のファイルを置き換えました", "directory", directory, "filename", name, "replaced_by", saved.Filename)
+	}
+}
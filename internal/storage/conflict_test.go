@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+)
+
+func originalNames(t *testing.T, m *Manager, directory string) []string {
+	t.Helper()
+	files, err := m.ListFiles(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.OriginalName)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// rename は空いている番号を付けて両方残し、reject は 409 用のエラーを返すこと。
+func TestSaveFileRenameAndReject(t *testing.T) {
+	m := newRetentionManager(t, 0)
+	ctx := context.Background()
+	putRecord(t, m, "records", "report.pdf")
+
+	for range 2 {
+		if _, err := m.SaveFile(ctx, strings.NewReader("v2"), "report.pdf", "records", config.ConflictRename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.SaveFile(ctx, strings.NewReader("env"), ".env", "records", config.ConflictRename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.SaveFile(ctx, strings.NewReader("env"), ".env", "records", config.ConflictRename); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".env", ".env (2)", "report (2).pdf", "report (3).pdf", "report.pdf"}
+	if got := originalNames(t, m, "records"); !slices.Equal(got, want) {
+		t.Errorf("名前 = %v, want %v", got, want)
+	}
+
+	if _, err := m.SaveFile(ctx, strings.NewReader("v3"), "report.pdf", "records", config.ConflictReject); !errors.Is(err, ErrNameConflict) {
+		t.Errorf("reject で err = %v, want ErrNameConflict", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(m.config.Storage.UploadPath, "records"))
+	if len(entries) != len(want) {
+		t.Errorf("拒否した作業ファイルが残っている: %d 件", len(entries))
+	}
+}
+
+// replace は保存後に RemoveReplaced で既存ファイルを消し、保持期間中のファイルは置き換えないこと。
+func TestSaveFileReplace(t *testing.T) {
+	m := newRetentionManager(t, 0)
+	ctx := context.Background()
+	putRecord(t, m, "records", "report.pdf")
+
+	saved, err := m.SaveFile(ctx, strings.NewReader("v2"), "report.pdf", "records", config.ConflictReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(saved.Replaces, []string{"report.pdf"}) {
+		t.Fatalf("Replaces = %v", saved.Replaces)
+	}
+	m.RemoveReplaced(ctx, saved)
+	if got := originalNames(t, m, "records"); !slices.Equal(got, []string{"report.pdf"}) {
+		t.Fatalf("置き換え後の名前 = %v", got)
+	}
+	data, _ := os.ReadFile(filepath.Join(m.config.Storage.UploadPath, saved.Path))
+	if string(data) != "v2" {
+		t.Errorf("置き換え後の内容 = %q", data)
+	}
+
+	m.config.Storage.Directories[0].Retention = 24 * time.Hour
+	if err := m.SaveFileMetadata("records", saved.Filename, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CheckConflict(ctx, "records", "report.pdf", config.ConflictReplace); !errors.Is(err, ErrRetained) {
+		t.Errorf("保持期間中の置き換えで err = %v, want ErrRetained", err)
+	}
+}
+
+// 同名ファイルで拒否した完了はセッションを残し、既存ファイルを退ければ完了し直せること。
+func TestCompleteUploadConflict(t *testing.T) {
+	um := newTestUploadManager(t)
+	sm := NewManager(um.config, um.db)
+	um.SetStorageManager(sm)
+	if err := os.MkdirAll(filepath.Join(um.config.Storage.UploadPath, "public"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := sm.SaveFile(context.Background(), strings.NewReader("old"), "a.txt", "public", config.ConflictRename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 3, 3, 1, "", config.ConflictReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.SaveChunk(s.UploadID, "alice", 0, strings.NewReader("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.CompleteUpload(s.UploadID, "alice", nil); !errors.Is(err, ErrNameConflict) {
+		t.Fatalf("CompleteUpload err = %v, want ErrNameConflict", err)
+	}
+
+	if err := sm.DeleteFile(context.Background(), "public", first.Filename); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := um.CompleteUpload(s.UploadID, "alice", nil)
+	if err != nil {
+		t.Fatalf("既存ファイルを消した後の完了で err = %v", err)
+	}
+	if !strings.HasSuffix(saved.Filename, "_a.txt") || saved.Size != 3 {
+		t.Errorf("保存結果 = %+v", saved)
+	}
+}
@@ -0,0 +1,46 @@
+// Package storage はファイルストレージ管理機能を提供します。
+// このファイルは一括アップロードで使うサブディレクトリの作成・取り消しを含みます。
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// MakeDirectories は directory（アップロード先からの相対パス）を親も含めて作成し、
+// 新たに作成したディレクトリを浅い順に返します（取り消す場合は RemoveDirectories に渡す）。
+// 途中で失敗した場合も、それまでに作成したディレクトリを返します。
+func (m *Manager) MakeDirectories(directory string) ([]string, error) {
+	var missing []string
+	for d := filepath.Clean(directory); d != "." && d != string(filepath.Separator); d = filepath.Dir(d) {
+		_, err := os.Stat(filepath.Join(m.config.Storage.UploadPath, d))
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("ディレクトリの確認に失敗しました: %w", err)
+		}
+		missing = append(missing, d)
+	}
+	slices.Reverse(missing)
+
+	for i, d := range missing {
+		if err := os.Mkdir(filepath.Join(m.config.Storage.UploadPath, d), 0750); err != nil && !os.IsExist(err) {
+			return missing[:i], fmt.Errorf("ディレクトリの作成に失敗しました: %w", err)
+		}
+	}
+	return missing, nil
+}
+
+// RemoveDirectories は MakeDirectories で作成したディレクトリを深い順に削除します。
+// 空でないディレクトリ（同時に別のアップロードが置いたファイルがある等）は残します。
+func (m *Manager) RemoveDirectories(dirs []string) {
+	for _, d := range slices.Backward(dirs) {
+		if err := os.Remove(filepath.Join(m.config.Storage.UploadPath, d)); err != nil && !os.IsNotExist(err) {
+			slog.Debug("作成したディレクトリを残しました", "directory", d, "error", err)
+		}
+	}
+}
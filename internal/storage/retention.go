@@ -0,0 +1,177 @@
+// Package storage はファイルストレージ管理機能を提供します。
+// このファイルは保持期間（WORM）とリーガルホールドによる削除・変更の禁止を扱います。
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"fileserver/internal/logging"
+)
+
+var (
+	// ErrRetained は保持期間中のファイルを削除・変更しようとした場合に返されます
+	ErrRetained = errors.New("保持期間中のため削除・変更できません")
+	// ErrLegalHold はリーガルホールド中のファイルを削除・変更しようとした場合に返されます
+	ErrLegalHold = errors.New("リーガルホールド中のため削除・変更できません")
+	// ErrNotIndexed は file_metadata に登録されていないファイルを指定した場合に返されます
+	ErrNotIndexed = errors.New("ファイルが見つかりません")
+)
+
+// Lock はファイルの保持期限とリーガルホールドの状態です。
+type Lock struct {
+	RetainUntil time.Time // ゼロ値は保持期限なし
+	HeldAt      time.Time
+	HoldReason  string
+	HeldBy      string
+	LegalHold   bool
+}
+
+// Check は now の時点で削除・変更できるかを判定します。リーガルホールドが保持期限より優先されます。
+func (l Lock) Check(now time.Time) error {
+	if l.LegalHold {
+		return fmt.Errorf("%w（理由: %s）", ErrLegalHold, l.HoldReason)
+	}
+	if now.Before(l.RetainUntil) {
+		return fmt.Errorf("%w（%s まで）", ErrRetained, l.RetainUntil.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// HeldFile はリーガルホールド中のファイル1件です（管理者API用）。
+type HeldFile struct {
+	HeldAt      time.Time  `json:"held_at"`
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+	Directory   string     `json:"directory"`
+	Filename    string     `json:"filename"`
+	Reason      string     `json:"reason"`
+	HeldBy      string     `json:"held_by"`
+}
+
+// retentionFor は directory（配下パスも可）のトップレベル設定の保持期間を返します。
+func (m *Manager) retentionFor(directory string) time.Duration {
+	root, _, _ := strings.Cut(directory, "/")
+	if d := m.config.GetDirectoryConfig(root); d != nil {
+		return d.Retention
+	}
+	return 0
+}
+
+// FileLock はファイルの保持期限とリーガルホールドの状態を返します。
+// 保持期限が記録されていないファイル（保持期間の設定前に登録されたもの）は、登録日時に現在の保持期間を足して求めます。
+// file_metadata に登録されていないファイル（アップロード途中の作業ファイル等）は保持の対象外です。
+func (m *Manager) FileLock(directory, filename string) (Lock, error) {
+	var lock Lock
+	retention := m.retentionFor(directory)
+
+	var (
+		retainUntil, heldAt, createdAt sql.NullTime
+		reason, heldBy                 sql.NullString
+		registered                     bool
+	)
+	if m.db != nil {
+		err := m.db.QueryRowContext(context.Background(), `
+			SELECT retain_until, legal_hold, legal_hold_reason, legal_hold_by, legal_hold_at, created_at
+			FROM file_metadata WHERE directory = ? AND filename = ?`, directory, filename).Scan(
+			&retainUntil, &lock.LegalHold, &reason, &heldBy, &heldAt, &createdAt)
+		switch {
+		case err == nil:
+			registered = true
+		case !errors.Is(err, sql.ErrNoRows):
+			return lock, fmt.Errorf("保持情報の取得に失敗しました: %w", err)
+		}
+	}
+	lock.HoldReason, lock.HeldBy, lock.HeldAt = reason.String, heldBy.String, heldAt.Time
+
+	switch {
+	case retainUntil.Valid:
+		lock.RetainUntil = retainUntil.Time
+	case registered && createdAt.Valid && retention > 0:
+		lock.RetainUntil = createdAt.Time.Add(retention)
+	}
+	return lock, nil
+}
+
+// CheckModifiable はファイルを削除・移動・上書きしてよいかを判定し、禁止されていれば理由を監査ログに残します。
+// action は監査ログに記録する操作名（"delete" 等）です。
+func (m *Manager) CheckModifiable(ctx context.Context, directory, filename, action string) error {
+	lock, err := m.FileLock(directory, filename)
+	if err != nil {
+		return err
+	}
+	if err := lock.Check(time.Now()); err != nil {
+		logging.Audit(ctx, "modification_denied", "action", action, "directory", directory, "filename", filename, "reason", err.Error())
+		return err
+	}
+	return nil
+}
+
+// SetLegalHold はファイルのリーガルホールドを設定・解除し、理由と実行者を監査ログに残します。
+// 保持期限とは独立しており、解除するまで期限を過ぎても削除・変更できません。
+func (m *Manager) SetLegalHold(ctx context.Context, directory, filename string, hold bool, reason, actor string) error {
+	if m.db == nil {
+		return fmt.Errorf("データベース接続が設定されていません")
+	}
+	var (
+		res sql.Result
+		err error
+	)
+	if hold {
+		res, err = m.db.ExecContext(ctx, `
+			UPDATE file_metadata SET legal_hold = 1, legal_hold_reason = ?, legal_hold_by = ?, legal_hold_at = CURRENT_TIMESTAMP
+			WHERE directory = ? AND filename = ?`, reason, actor, directory, filename)
+	} else {
+		res, err = m.db.ExecContext(ctx, `
+			UPDATE file_metadata SET legal_hold = 0, legal_hold_reason = NULL, legal_hold_by = NULL, legal_hold_at = NULL
+			WHERE directory = ? AND filename = ?`, directory, filename)
+	}
+	if err != nil {
+		return fmt.Errorf("リーガルホールドの保存に失敗しました: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotIndexed
+	}
+
+	action := "legal_hold_released"
+	if hold {
+		action = "legal_hold_set"
+	}
+	logging.Audit(ctx, action, "directory", directory, "filename", filename, "reason", reason, "actor", actor)
+	return nil
+}
+
+// LegalHolds はリーガルホールド中のファイルを設定日時の新しい順に返します。
+func (m *Manager) LegalHolds(ctx context.Context) ([]HeldFile, error) {
+	if m.db == nil {
+		return nil, fmt.Errorf("データベース接続が設定されていません")
+	}
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT directory, filename, COALESCE(legal_hold_reason, ''), COALESCE(legal_hold_by, ''), legal_hold_at, retain_until
+		FROM file_metadata WHERE legal_hold = 1 ORDER BY legal_hold_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("リーガルホールド一覧の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	held := make([]HeldFile, 0)
+	for rows.Next() {
+		var (
+			f           HeldFile
+			heldAt      sql.NullTime
+			retainUntil sql.NullTime
+		)
+		if err := rows.Scan(&f.Directory, &f.Filename, &f.Reason, &f.HeldBy, &heldAt, &retainUntil); err != nil {
+			return nil, fmt.Errorf("リーガルホールド一覧の読み取りに失敗しました: %w", err)
+		}
+		f.HeldAt = heldAt.Time
+		if retainUntil.Valid {
+			f.RetainUntil = &retainUntil.Time
+		}
+		held = append(held, f)
+	}
+	return held, rows.Err()
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+)
+
+func newRetentionManager(t *testing.T, retention time.Duration) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			UploadPath:  filepath.Join(dir, "uploads"),
+			Directories: []config.DirectoryConfig{{Path: "records", Retention: retention}},
+		},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewManager(cfg, db)
+}
+
+func putRecord(t *testing.T, m *Manager, directory, filename string) {
+	t.Helper()
+	p := filepath.Join(m.config.Storage.UploadPath, directory, filename)
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveFileMetadata(directory, filename, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 保持期間中は削除できず、再登録しても保持期限が変わらないこと。
+func TestDeleteFileRetained(t *testing.T) {
+	m := newRetentionManager(t, 24*time.Hour)
+	ctx := context.Background()
+	putRecord(t, m, "records", "a.pdf")
+
+	if err := m.DeleteFile(ctx, "records", "a.pdf"); !errors.Is(err, ErrRetained) {
+		t.Fatalf("保持期間中の削除で err = %v, want ErrRetained", err)
+	}
+	before, err := m.Metadata("records", "a.pdf")
+	if err != nil || before.RetainUntil == nil {
+		t.Fatalf("保持期限が記録されていない: %+v, err = %v", before, err)
+	}
+
+	if err := m.SaveFileMetadata("records", "a.pdf", "", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := m.Metadata("records", "a.pdf")
+	if after.RetainUntil == nil || !after.RetainUntil.Equal(*before.RetainUntil) {
+		t.Errorf("再登録で保持期限が変わった: %v → %v", before.RetainUntil, after.RetainUntil)
+	}
+
+	// 保持期限を過ぎれば削除できる。
+	if _, err := m.db.Exec("UPDATE file_metadata SET retain_until = ?", time.Now().Add(-time.Minute).UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteFile(ctx, "records", "a.pdf"); err != nil {
+		t.Errorf("保持期限後の削除で err = %v", err)
+	}
+}
+
+// 保持期間の設定前に登録されたファイルは、登録日時から保持期間を数えること。
+func TestFileLockWithoutRecordedRetention(t *testing.T) {
+	m := newRetentionManager(t, 0)
+	putRecord(t, m, "records", "old.pdf")
+	if err := m.DeleteFile(context.Background(), "records", "old.pdf"); err != nil {
+		t.Fatalf("保持期間なしで削除できない: %v", err)
+	}
+
+	putRecord(t, m, "records", "old.pdf")
+	m.config.Storage.Directories[0].Retention = time.Hour
+	lock, err := m.FileLock("records", "old.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.RetainUntil.IsZero() || lock.Check(time.Now()) == nil {
+		t.Errorf("既存ファイルが保持されない: %+v", lock)
+	}
+	if lock, _ := m.FileLock("records", "work.meta"); lock.Check(time.Now()) != nil {
+		t.Errorf("未登録ファイルが保持対象になっている: %+v", lock)
+	}
+}
+
+// リーガルホールドは保持期間の有無にかかわらず解除まで削除を拒否すること。
+func TestLegalHold(t *testing.T) {
+	m := newRetentionManager(t, 0)
+	ctx := context.Background()
+	putRecord(t, m, "records", "evidence.pdf")
+
+	if err := m.SetLegalHold(ctx, "records", "missing.pdf", true, "訴訟対応", "admin"); !errors.Is(err, ErrNotIndexed) {
+		t.Errorf("未登録ファイルへの設定で err = %v, want ErrNotIndexed", err)
+	}
+	if err := m.SetLegalHold(ctx, "records", "evidence.pdf", true, "訴訟対応", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteFile(ctx, "records", "evidence.pdf"); !errors.Is(err, ErrLegalHold) {
+		t.Fatalf("ホールド中の削除で err = %v, want ErrLegalHold", err)
+	}
+
+	held, err := m.LegalHolds(ctx)
+	if err != nil || len(held) != 1 || held[0].Reason != "訴訟対応" || held[0].HeldBy != "admin" {
+		t.Fatalf("ホールド一覧 = %+v, err = %v", held, err)
+	}
+	files, err := m.ListFiles("records")
+	if err != nil || len(files) != 1 || !files[0].LegalHold {
+		t.Errorf("一覧にホールドが反映されていない: %+v, err = %v", files, err)
+	}
+
+	if err := m.SetLegalHold(ctx, "records", "evidence.pdf", false, "和解成立", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteFile(ctx, "records", "evidence.pdf"); err != nil {
+		t.Errorf("ホールド解除後の削除で err = %v", err)
+	}
+}
+
+// 隔離のための移動は保持期間中でも行えること（実体は隔離領域に残る）。
+func TestMoveOutOverridesRetention(t *testing.T) {
+	m := newRetentionManager(t, 24*time.Hour)
+	putRecord(t, m, "records", "bad.exe")
+
+	dest := filepath.Join(t.TempDir(), "q", "bad")
+	if err := m.MoveOut(context.Background(), "records", "bad.exe", dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); err != nil {
+		t.Errorf("移動先にファイルが無い: %v", err)
+	}
+}
+
+// 作業ファイルと同じ拡張子で登録されたファイルは、期限切れの孤立ファイルに見えても掃除で消さないこと。
+func TestCleanupSkipsRetainedFiles(t *testing.T) {
+	m := newRetentionManager(t, 24*time.Hour)
+	m.config.Storage.UploadSessionTTL = time.Hour
+	um := &UploadManager{config: m.config, sessions: map[string]*activeUpload{}, userUploads: map[string]int{}}
+	um.SetStorageManager(m)
+
+	dir := filepath.Join(m.config.Storage.UploadPath, "records")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"kept.meta", "orphan.meta"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SaveFileMetadata("records", "kept.meta", "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	um.cleanupOrphanedFiles()
+
+	if _, err := os.Stat(filepath.Join(dir, "kept.meta")); err != nil {
+		t.Errorf("保持期間中のファイルが掃除で消えた: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orphan.meta")); !os.IsNotExist(err) {
+		t.Errorf("孤立した作業ファイルが残っている: %v", err)
+	}
+}
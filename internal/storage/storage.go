@@ -7,14 +7,19 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"fileserver/internal/config"
+	"fileserver/internal/logging"
 	"fileserver/internal/models"
 
 	"github.com/google/uuid"
@@ -22,14 +27,25 @@ import (
 
 // Manager はディレクトリ作成とファイル管理を含むファイルストレージ操作を処理します。
 type Manager struct {
-	config *config.Config
-	db     *sql.DB
+	config  *config.Config
+	db      *sql.DB
+	usage   UsageRecorder
+	placeMu sync.Mutex // Place の同名判定から保存までを直列化する
+}
+
+// UsageRecorder はファイルの追加・削除をストレージ使用量の集計へ反映する受け口です。
+// 集計の失敗でファイル操作を失敗させないよう、エラーは返さず実装側でログに残します。
+type UsageRecorder interface {
+	RecordAdd(directory, filename, uploaderID string, size int64)
+	RecordRemove(directory, filename, uploaderID string, size int64)
 }
 
 // SavedFile は正常に保存されたファイルとそのメタデータを表します。
 type SavedFile struct {
 	Filename string
 	Path     string
+	// Replaces は on_conflict が replace の場合に置き換える既存ファイルの保存名です（RemoveReplaced で削除する）。
+	Replaces []string
 	Size     int64
 }
 
@@ -41,6 +57,11 @@ func NewManager(cfg *config.Config, db *sql.DB) *Manager {
 	}
 }
 
+// SetUsageRecorder は使用量集計の受け口を設定します（未設定なら集計しません）。
+func (m *Manager) SetUsageRecorder(r UsageRecorder) {
+	m.usage = r
+}
+
 // InitializeDirectories は設定ファイルで定義されたすべてのディレクトリを作成します。
 // ルートアップロードディレクトリと、安全な権限を持つすべての設定されたサブディレクトリを作成します。
 func (m *Manager) InitializeDirectories() error {
@@ -48,18 +69,33 @@ func (m *Manager) InitializeDirectories() error {
 		return fmt.Errorf("アップロードディレクトリの作成に失敗しました: %w", err)
 	}
 
-	for _, dir := range m.config.Storage.Directories {
-		// user_privateは親のみ作る。ユーザー個別ディレクトリは初回アクセス時に作成する。
-		dirPath := filepath.Join(m.config.Storage.UploadPath, dir.Path)
-		if err := os.MkdirAll(dirPath, 0750); err != nil {
-			return fmt.Errorf("ディレクトリ '%s' の作成に失敗しました: %w", dir.Path, err)
+	for _, dir := range m.config.Directories() {
+		if err := m.InitializeDirectory(dir); err != nil {
+			return err
 		}
-		slog.Info("ディレクトリを作成しました", "path", dirPath)
 	}
 
 	return nil
 }
 
+// InitializeDirectory は設定のディレクトリ1件と、権限の規則を付けた配下のパスを作成します。
+// 起動時のほか、管理者APIでディレクトリを追加・変更したときに呼ばれます。
+func (m *Manager) InitializeDirectory(dir config.DirectoryConfig) error {
+	// user_privateは親のみ作る。ユーザー個別ディレクトリは初回アクセス時に作成する。
+	dirPath := filepath.Join(m.config.Storage.UploadPath, dir.Path)
+	if err := os.MkdirAll(dirPath, 0750); err != nil {
+		return fmt.Errorf("ディレクトリ '%s' の作成に失敗しました: %w", dir.Path, err)
+	}
+	slog.Info("ディレクトリを作成しました", "path", dirPath)
+	// 権限の規則を付けた配下のパスも、一覧から辿れるよう作っておく。
+	for _, sub := range dir.Subdirectories {
+		if err := os.MkdirAll(filepath.Join(dirPath, filepath.FromSlash(sub.Path)), 0750); err != nil {
+			return fmt.Errorf("ディレクトリ '%s/%s' の作成に失敗しました: %w", dir.Path, sub.Path, err)
+		}
+	}
+	return nil
+}
+
 // EnsureUserDirectory はユーザー専用ディレクトリが存在しない場合に作成します。
 // これは、ユーザーが個人ディレクトリに初めてアップロードする際にオンデマンドで呼び出されます。
 // directoryName はユーザーのディレクトリ名（例: "username"）である必要があります。
@@ -81,39 +117,47 @@ func (m *Manager) UserDirectoryExists(directoryName string) bool {
 	return err == nil && info.IsDir()
 }
 
-// SaveFile はファイルを一意のUUIDベースのファイル名で指定されたディレクトリに保存します。
-// 生成されたファイル名、パス、サイズを含む保存されたファイルのメタデータを返します。
-func (m *Manager) SaveFile(file io.Reader, filename, directory string) (*SavedFile, error) {
-	// 元ファイル名の衝突を避けるためUUIDを前置する。表示名はextractOriginalFilenameで復元する。
-	fileID := uuid.New().String()
-	savedFilename := fmt.Sprintf("%s_%s", fileID, sanitizeFilename(filename))
-
-	destPath := filepath.Join(m.config.Storage.UploadPath, directory, savedFilename)
+// SaveFile はアップロードされたファイルを受信し、Place で directory へ保存します。
+// 同じ名前のファイルがある場合の扱いは policy（config.ConflictRename 等）に従います。
+func (m *Manager) SaveFile(ctx context.Context, file io.Reader, filename, directory, policy string) (*SavedFile, error) {
+	tempPath, _, err := m.Receive(directory, file)
+	if err != nil {
+		return nil, err
+	}
 
-	// #nosec G304 - destPath is constructed from sanitized inputs
-	destFile, err := os.Create(destPath)
+	saved, err := m.Place(ctx, tempPath, directory, filename, policy)
 	if err != nil {
-		return nil, fmt.Errorf("ファイル作成エラー: %w", err)
+		m.RemoveReceived(tempPath)
+		return nil, err
 	}
-	defer func() {
-		if closeErr := destFile.Close(); closeErr != nil {
-			slog.Error("ファイルのクローズに失敗しました", "error", closeErr)
-		}
-	}()
+	return saved, nil
+}
 
-	written, err := io.Copy(destFile, file)
+// Receive は file を directory の作業ファイルへ書き込み、そのパスと大きさを返します。
+// 受信中のファイルが一覧に出ないよう作業ファイルとして書き込み、保存名へは Place で移します。
+// 書き込みに失敗した場合は作業ファイルを残しません。
+func (m *Manager) Receive(directory string, file io.Reader) (string, int64, error) {
+	tempPath := filepath.Join(m.config.Storage.UploadPath, directory, uuid.New().String()+"_upload.temp")
+
+	// #nosec G304 - tempPath is constructed from sanitized inputs
+	destFile, err := os.Create(tempPath)
 	if err != nil {
-		if removeErr := os.Remove(destPath); removeErr != nil {
-			slog.Error("一時ファイルの削除に失敗しました", "error", removeErr)
-		}
-		return nil, fmt.Errorf("ファイル書き込みエラー: %w", err)
+		return "", 0, fmt.Errorf("ファイル作成エラー: %w", err)
+	}
+
+	n, copyErr := io.Copy(destFile, file)
+	if err := errors.Join(copyErr, destFile.Close()); err != nil {
+		m.RemoveReceived(tempPath)
+		return "", 0, fmt.Errorf("ファイル書き込みエラー: %w", err)
 	}
+	return tempPath, n, nil
+}
 
-	return &SavedFile{
-		Filename: savedFilename,
-		Path:     filepath.Join(directory, savedFilename),
-		Size:     written,
-	}, nil
+// RemoveReceived は Receive で書き込んだ作業ファイルを削除します。
+func (m *Manager) RemoveReceived(tempPath string) {
+	if err := os.Remove(tempPath); err != nil {
+		slog.Error("一時ファイルの削除に失敗しました", "error", err)
+	}
 }
 
 // ListFiles は指定されたディレクトリ内のすべてのファイルとサブディレクトリのリストを返します。
@@ -151,13 +195,13 @@ func (m *Manager) ListFiles(directory string) ([]models.FileInfo, error) {
 		}
 
 		// アップロード途中の作業ファイルは一覧に見せない。
-		if strings.HasSuffix(entry.Name(), ".temp") || strings.HasSuffix(entry.Name(), ".meta") {
+		if IsWorkFile(entry.Name()) {
 			continue
 		}
 
 		originalName := extractOriginalFilename(entry.Name())
 
-		uploader, hash, err := m.GetFileMetadata(directory, entry.Name())
+		meta, err := m.Metadata(directory, entry.Name())
 		if err != nil {
 			slog.Warn("メタデータの取得に失敗しました", "filename", entry.Name(), "error", err)
 		}
@@ -172,8 +216,12 @@ func (m *Manager) ListFiles(directory string) ([]models.FileInfo, error) {
 			OriginalName: originalName,
 			Size:         info.Size(),
 			ModifiedAt:   info.ModTime(),
-			Uploader:     uploader,
-			Hash:         hash,
+			Uploader:     meta.UploaderName,
+			Hash:         meta.Hash,
+			ScanStatus:   meta.ScanStatus,
+			SourceURL:    meta.SourceURL,
+			RetainUntil:  meta.RetainUntil,
+			LegalHold:    meta.LegalHold,
 			IsDirectory:  false,
 			Path:         filePath,
 		})
@@ -183,9 +231,100 @@ func (m *Manager) ListFiles(directory string) ([]models.FileInfo, error) {
 }
 
 // DeleteFile は指定されたディレクトリからファイルを削除します。
-func (m *Manager) DeleteFile(directory, filename string) error {
+// 併せてメタデータ行を取り除き、使用量の集計から差し引きます。
+// 保持期間中・リーガルホールド中のファイルは削除せず ErrRetained / ErrLegalHold を返します。
+func (m *Manager) DeleteFile(ctx context.Context, directory, filename string) error {
+	if err := m.CheckModifiable(ctx, directory, filename, "delete"); err != nil {
+		return err
+	}
+	return m.removeFile(directory, filename, os.Remove)
+}
+
+// MoveOut はファイルをアップロードディレクトリの外（dest）へ移し、一覧・使用量から取り除きます。
+// 隔離のように実体は残しつつ公開をやめる場合に使います。
+// 実体を失わないため保持期間・リーガルホールド中でも移動し、その旨を監査ログに残します。
+func (m *Manager) MoveOut(ctx context.Context, directory, filename, dest string) error {
+	lock, err := m.FileLock(directory, filename)
+	if err != nil {
+		return err
+	}
+	if lockErr := lock.Check(time.Now()); lockErr != nil {
+		logging.Audit(ctx, "retention_override", "action", "move_out", "directory", directory, "filename", filename,
+			"dest", dest, "reason", lockErr.Error())
+	}
+	return m.removeFile(directory, filename, func(src string) error {
+		return MoveFile(src, dest)
+	})
+}
+
+// MoveFile は src を dst へ移動します。別ファイルシステム間（EXDEV）ではコピーしてから元を削除します。
+func MoveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return fmt.Errorf("移動先ディレクトリの作成に失敗しました: %w", err)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// #nosec G304 - 呼び出し側で組み立てたアップロード/隔離ディレクトリ配下のパス
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }() //nolint:errcheck // 読み取り専用のため close 失敗は結果に影響しない
+
+	// #nosec G304 - 呼び出し側で組み立てたアップロード/隔離ディレクトリ配下のパス
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeFile はファイルを remove で取り除き、メタデータ行と使用量を更新します。
+func (m *Manager) removeFile(directory, filename string, remove func(path string) error) error {
 	filePath := filepath.Join(m.config.Storage.UploadPath, directory, filename)
-	return os.Remove(filePath)
+
+	// 削除後はサイズもアップロード者も引けないため、先に控えておく。
+	info, statErr := os.Stat(filePath)
+	uploaderID := m.uploaderID(directory, filename)
+
+	if err := remove(filePath); err != nil {
+		return err
+	}
+
+	if m.db != nil {
+		if _, err := m.db.ExecContext(context.Background(),
+			"DELETE FROM file_metadata WHERE directory = ? AND filename = ?", directory, filename); err != nil {
+			slog.Warn("メタデータの削除に失敗しました", "directory", directory, "filename", filename, "error", err)
+		}
+		// 同名のファイルを後から置いた人へ共有が引き継がれないよう、ファイル単位のメンバー共有も消す。
+		if _, err := m.db.ExecContext(context.Background(),
+			"DELETE FROM member_shares WHERE directory = ? AND filename = ?", directory, filename); err != nil {
+			slog.Warn("メンバー共有の削除に失敗しました", "directory", directory, "filename", filename, "error", err)
+		}
+	}
+	if m.usage != nil && statErr == nil {
+		m.usage.RecordRemove(directory, filename, uploaderID, info.Size())
+	}
+	return nil
+}
+
+// IsWorkFile はアップロード途中の作業ファイル（.temp / .meta）かを返します。
+// 一覧・使用量集計のいずれでも実ファイルとして数えないために使います。
+func IsWorkFile(name string) bool {
+	return strings.HasSuffix(name, ".temp") || strings.HasSuffix(name, ".meta")
 }
 
 // sanitizeFilename はパストラバーサルを防ぐためファイル名から危険な要素を除去します。
@@ -202,11 +341,20 @@ func sanitizeFilename(filename string) string {
 	return replacer.Replace(filename)
 }
 
+// StoredFilename は保存用のファイル名 "UUID_元のファイル名" を組み立てます。
+// 元のファイル名はパストラバーサル対策のため無害化されます。
+func StoredFilename(fileID, filename string) string {
+	return fmt.Sprintf("%s_%s", fileID, sanitizeFilename(filename))
+}
+
 // extractOriginalFilename は "UUID_元のファイル名" 形式から元のファイル名を取り出します。
+// 接頭辞がUUIDでない名前（API外で置かれた "my_file.txt" 等）はそのまま返します。
 func extractOriginalFilename(filename string) string {
 	parts := strings.SplitN(filename, "_", 2)
 	if len(parts) == 2 {
-		return parts[1]
+		if _, err := uuid.Parse(parts[0]); err == nil {
+			return parts[1]
+		}
 	}
 	return filename
 }
@@ -224,50 +372,233 @@ func (m *Manager) SaveFileMetadata(directory, filename, uploaderID, uploaderName
 		hash = ""
 	}
 
+	ctx := context.Background()
+
+	// 同名の行が既にある場合（再登録）は使用量を二重に数えない。
+	var exists bool
+	if err := m.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM file_metadata WHERE directory = ? AND filename = ?)",
+		directory, filename).Scan(&exists); err != nil {
+		return fmt.Errorf("メタデータの確認に失敗しました: %w", err)
+	}
+
+	// 保持期限は登録時に確定させる。再登録では既存の期限を延ばしも縮めもしない。
 	query := `
-		INSERT INTO file_metadata (directory, filename, uploader_id, uploader_name, hash)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO file_metadata (directory, filename, uploader_id, uploader_name, hash, retain_until)
+		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(directory, filename) DO UPDATE SET
 			uploader_id = excluded.uploader_id,
 			uploader_name = excluded.uploader_name,
 			hash = excluded.hash,
+			retain_until = COALESCE(file_metadata.retain_until, excluded.retain_until),
 			created_at = CURRENT_TIMESTAMP
 	`
 
-	ctx := context.Background()
-	_, err = m.db.ExecContext(ctx, query, directory, filename, uploaderID, uploaderName, hash)
+	// uploader_id は users への外部キーのため、アップロード者の無いファイル
+	// （API外で置かれたもの）は空文字ではなくNULLで記録する。
+	var uploader sql.NullString
+	if uploaderID != "" {
+		uploader = sql.NullString{String: uploaderID, Valid: true}
+	}
+
+	var retainUntil sql.NullTime
+	if retention := m.retentionFor(directory); retention > 0 {
+		retainUntil = sql.NullTime{Time: time.Now().Add(retention).UTC(), Valid: true}
+	}
+
+	_, err = m.db.ExecContext(ctx, query, directory, filename, uploader, uploaderName, hash, retainUntil)
 	if err != nil {
 		return fmt.Errorf("メタデータの保存に失敗しました: %w", err)
 	}
 
+	if m.usage != nil && !exists {
+		if info, statErr := os.Stat(filepath.Join(m.config.Storage.UploadPath, directory, filename)); statErr == nil {
+			m.usage.RecordAdd(directory, filename, uploaderID, info.Size())
+		}
+	}
+
 	return nil
 }
 
-// GetFileMetadata はファイルのメタデータをデータベースから取得します。
+// IndexedFilenames は file_metadata に記録済みのファイル名の集合を返します。
+// API外で置かれた未登録ファイルの検出に使います。
+func (m *Manager) IndexedFilenames(directory string) (map[string]bool, error) {
+	if m.db == nil {
+		return nil, fmt.Errorf("データベース接続が設定されていません")
+	}
+	rows, err := m.db.QueryContext(context.Background(),
+		"SELECT filename FROM file_metadata WHERE directory = ?", directory)
+	if err != nil {
+		return nil, fmt.Errorf("メタデータの取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("メタデータの読み取りに失敗しました: %w", err)
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+// FindByHash は directory 内で同じハッシュを持つ登録済みファイルの名前を返します（無ければ空文字）。
+func (m *Manager) FindByHash(directory, hash string) (string, error) {
+	if m.db == nil {
+		return "", fmt.Errorf("データベース接続が設定されていません")
+	}
+	var filename string
+	err := m.db.QueryRowContext(context.Background(),
+		"SELECT filename FROM file_metadata WHERE directory = ? AND hash = ? LIMIT 1",
+		directory, hash).Scan(&filename)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("メタデータの取得に失敗しました: %w", err)
+	}
+	return filename, nil
+}
+
+// uploaderID はファイルのアップロード者IDを返します（記録が無ければ空文字）。
+func (m *Manager) uploaderID(directory, filename string) string {
+	if m.db == nil {
+		return ""
+	}
+	var id sql.NullString
+	if err := m.db.QueryRowContext(context.Background(),
+		"SELECT uploader_id FROM file_metadata WHERE directory = ? AND filename = ?",
+		directory, filename).Scan(&id); err != nil {
+		return ""
+	}
+	return id.String
+}
+
+// FileMetadata は file_metadata の1行です（記録の無い項目は空文字）。
+type FileMetadata struct {
+	RetainUntil   *time.Time // 保持期限（記録が無ければ nil）
+	UploaderID    string
+	UploaderName  string
+	Hash          string
+	ScanStatus    string
+	ScanSignature string
+	SourceURL     string // URLから取り込んだファイルの取得元
+	LegalHold     bool
+}
+
+// Metadata はファイルのメタデータを返します。記録が無い場合は空の FileMetadata を返します。
+func (m *Manager) Metadata(directory, filename string) (FileMetadata, error) {
+	var meta FileMetadata
+	if m.db == nil {
+		return meta, nil
+	}
+
+	query := `SELECT COALESCE(uploader_id, ''), COALESCE(uploader_name, ''), COALESCE(hash, ''),
+		COALESCE(scan_status, ''), COALESCE(scan_signature, ''), COALESCE(source_url, ''), retain_until, legal_hold
+		FROM file_metadata WHERE directory = ? AND filename = ?`
+	var retainUntil sql.NullTime
+	err := m.db.QueryRowContext(context.Background(), query, directory, filename).Scan(
+		&meta.UploaderID, &meta.UploaderName, &meta.Hash, &meta.ScanStatus, &meta.ScanSignature, &meta.SourceURL, &retainUntil, &meta.LegalHold)
+	if err == sql.ErrNoRows {
+		return meta, nil // データが存在しない場合はエラーではなく空を返す
+	}
+	if err != nil {
+		return meta, fmt.Errorf("メタデータの取得に失敗しました: %w", err)
+	}
+	if retainUntil.Valid {
+		meta.RetainUntil = &retainUntil.Time
+	}
+	return meta, nil
+}
+
+// GetFileMetadata はファイルのアップロード者名とハッシュをデータベースから取得します。
 func (m *Manager) GetFileMetadata(directory, filename string) (uploader string, hash string, err error) {
+	meta, err := m.Metadata(directory, filename)
+	return meta.UploaderName, meta.Hash, err
+}
+
+// FileHash はファイルの記録済みのSHA-256を返します。ハッシュが未記録の行は計算して記録し、
+// 未登録のファイル（監視でまだ登録されていない外部のファイル）は監視と同じくアップロード者なしで登録します。
+// 次回からは記録済みの値を返すため、同じファイルを何度も計算し直しません。
+func (m *Manager) FileHash(directory, filename string) (string, error) {
+	meta, err := m.Metadata(directory, filename)
+	if err != nil || meta.Hash != "" {
+		return meta.Hash, err
+	}
 	if m.db == nil {
-		return "", "", nil
+		return "", fmt.Errorf("データベース接続が設定されていません")
 	}
 
-	query := `SELECT uploader_name, hash FROM file_metadata WHERE directory = ? AND filename = ?`
 	ctx := context.Background()
-	err = m.db.QueryRowContext(ctx, query, directory, filename).Scan(&uploader, &hash)
-	if err == sql.ErrNoRows {
-		return "", "", nil // データが存在しない場合はエラーではなく空文字列を返す
+	var exists bool
+	if err := m.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM file_metadata WHERE directory = ? AND filename = ?)",
+		directory, filename).Scan(&exists); err != nil {
+		return "", fmt.Errorf("メタデータの確認に失敗しました: %w", err)
+	}
+	if !exists {
+		if err := m.SaveFileMetadata(directory, filename, "", models.SystemUsername); err != nil {
+			return "", err
+		}
+		meta, err := m.Metadata(directory, filename)
+		if err == nil && meta.Hash == "" {
+			err = fmt.Errorf("ファイルハッシュを計算できませんでした: %s/%s", directory, filename)
+		}
+		return meta.Hash, err
+	}
+
+	hash, err := m.calculateFileHash(directory, filename)
+	if err != nil {
+		return "", err
 	}
+	if _, err := m.db.ExecContext(ctx,
+		"UPDATE file_metadata SET hash = ? WHERE directory = ? AND filename = ?",
+		hash, directory, filename); err != nil {
+		return "", fmt.Errorf("ファイルハッシュの保存に失敗しました: %w", err)
+	}
+	return hash, nil
+}
+
+// SetScanStatus はファイルのスキャン結果を記録します。
+func (m *Manager) SetScanStatus(directory, filename, status, signature string) error {
+	if m.db == nil {
+		return fmt.Errorf("データベース接続が設定されていません")
+	}
+	_, err := m.db.ExecContext(context.Background(), `
+		UPDATE file_metadata SET scan_status = ?, scan_signature = NULLIF(?, ''), scanned_at = CURRENT_TIMESTAMP
+		WHERE directory = ? AND filename = ?`,
+		status, signature, directory, filename)
 	if err != nil {
-		return "", "", fmt.Errorf("メタデータの取得に失敗しました: %w", err)
+		return fmt.Errorf("スキャン結果の保存に失敗しました: %w", err)
 	}
+	return nil
+}
 
-	return uploader, hash, nil
+// SetSourceURL はURLから取り込んだファイルの取得元を記録します。
+func (m *Manager) SetSourceURL(directory, filename, sourceURL string) error {
+	if m.db == nil {
+		return fmt.Errorf("データベース接続が設定されていません")
+	}
+	_, err := m.db.ExecContext(context.Background(),
+		"UPDATE file_metadata SET source_url = ? WHERE directory = ? AND filename = ?",
+		sourceURL, directory, filename)
+	if err != nil {
+		return fmt.Errorf("取得元URLの保存に失敗しました: %w", err)
+	}
+	return nil
 }
 
 // calculateFileHash はファイルのSHA256ハッシュ値を計算します。
 func (m *Manager) calculateFileHash(directory, filename string) (string, error) {
-	filePath := filepath.Join(m.config.Storage.UploadPath, directory, filename)
+	return HashFile(filepath.Join(m.config.Storage.UploadPath, directory, filename))
+}
 
-	// #nosec G304 - filePath is constructed from controlled inputs
-	file, err := os.Open(filePath)
+// HashFile はファイルのSHA-256を16進文字列で返します。
+func HashFile(path string) (string, error) {
+	// #nosec G304 - path はアップロードディレクトリ配下で組み立てたパス
+	file, err := os.Open(path)
 	if err != nil {
 		return "", fmt.Errorf("ファイルのオープンに失敗しました: %w", err)
 	}
@@ -0,0 +1,155 @@
+// Package storage はファイルストレージ管理機能を提供します。
+// このファイルは管理者によるアップロードセッションの操作（中止・期限の変更・一括削除）と受信速度の計測を含みます。
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"fileserver/internal/logging"
+	"fileserver/internal/models"
+)
+
+// rateWindow は受信速度を求める計測区間の長さです。
+// これより長く受信が途絶えたセッションは速度0（停止中）として扱います。
+const rateWindow = 5 * time.Second
+
+// transferRate は直近の受信速度（バイト/秒）を求めるための計測値です。
+// 同じセッションの複数チャンクが並行に届く場合も、区間内の合計で速度を出します。
+type transferRate struct {
+	start time.Time // 計測区間の開始
+	last  time.Time // 最後に受信を終えた時刻
+	bytes int64     // 計測区間内に受信したバイト数
+	prev  float64   // 直前の計測区間の速度
+}
+
+// add は began から now までに n バイトを受信したことを記録します。
+func (t *transferRate) add(n int64, began, now time.Time) {
+	if t.start.IsZero() || now.Sub(t.last) > rateWindow {
+		// 初回か、しばらく途絶えていた場合は受信を始めた時点から計り直す。
+		t.start, t.bytes, t.prev = began, 0, 0
+	}
+	t.bytes += n
+	t.last = now
+	if elapsed := now.Sub(t.start); elapsed >= rateWindow {
+		t.prev = float64(t.bytes) / elapsed.Seconds()
+		t.start, t.bytes = now, 0
+	}
+}
+
+// current は now 時点の受信速度を返します。rateWindow より長く受信が無ければ0です。
+func (t *transferRate) current(now time.Time) float64 {
+	if t.last.IsZero() || now.Sub(t.last) > rateWindow {
+		return 0
+	}
+	if t.prev > 0 {
+		return t.prev
+	}
+	if elapsed := t.last.Sub(t.start); elapsed > 0 {
+		return float64(t.bytes) / elapsed.Seconds()
+	}
+	return 0
+}
+
+// AbortUpload は所有者に関わらずアップロードセッションを中止し、受信済みのデータを削除します（管理者用）。
+// actor は操作した管理者で、監査ログに残します。中止したセッションの複製を返します。
+func (um *UploadManager) AbortUpload(ctx context.Context, uploadID, actor string) (*models.UploadSession, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	u, ok := um.sessions[uploadID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	session := u.snapshot()
+	um.notifyCancelled(u, CancelByAdmin)
+	um.removeSession(uploadID, u.session)
+
+	logging.Audit(ctx, "upload_aborted", "upload_id", uploadID, "user_id", session.UserID,
+		"directory", session.Directory, "filename", session.Filename, "actor", actor)
+	return session, nil
+}
+
+// SetUploadExpiry はアップロードセッションの有効期限を now+ttl に変更します（管理者用）。延長・短縮のどちらにも使えます。
+// actor は操作した管理者で、変更前後の期限とともに監査ログに残します。変更後のセッションの複製を返します。
+func (um *UploadManager) SetUploadExpiry(ctx context.Context, uploadID string, ttl time.Duration, actor string) (*models.UploadSession, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("有効期間は正の値で指定してください")
+	}
+	u, release, err := um.acquire(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	previous := u.session.ExpiresAt
+	expiresAt := time.Now().Add(ttl)
+	if _, err := um.db.ExecContext(ctx,
+		"UPDATE upload_sessions SET expires_at = ? WHERE upload_id = ?", expiresAt, uploadID); err != nil {
+		return nil, fmt.Errorf("アップロードセッションの更新に失敗しました: %w", err)
+	}
+	u.session.ExpiresAt = expiresAt
+
+	logging.Audit(ctx, "upload_expiry_changed", "upload_id", uploadID, "user_id", u.session.UserID,
+		"previous", previous, "expires_at", expiresAt, "actor", actor)
+	return u.snapshot(), nil
+}
+
+// PurgeUserUploads は userID のセッションのうち、期限切れか idle 以上進捗の無いものをまとめて中止します（管理者用）。
+// 書き込み中・検証中のセッションは進行中として残します。中止したセッションのIDを返します。
+func (um *UploadManager) PurgeUserUploads(ctx context.Context, userID string, idle time.Duration, actor string) []string {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	now := time.Now()
+	purged := make([]string, 0)
+	// 走査中にmapを変更しないよう、対象を集めてから削除する。
+	for uploadID, u := range um.sessions {
+		s := u.session
+		if s.UserID != userID || u.busy() {
+			continue
+		}
+		if now.After(s.ExpiresAt) || now.Sub(s.UpdatedAt) >= idle {
+			purged = append(purged, uploadID)
+		}
+	}
+	for _, uploadID := range purged {
+		um.notifyCancelled(um.sessions[uploadID], CancelPurged)
+		um.removeSession(uploadID, um.sessions[uploadID].session)
+	}
+
+	logging.Audit(ctx, "upload_sessions_purged", "user_id", userID, "idle", idle.String(),
+		"upload_ids", purged, "actor", actor)
+	return purged
+}
+
+// Usernames は userIDs のユーザー名を引きます（管理者の一覧表示用）。登録の無いIDは含みません。
+func (um *UploadManager) Usernames(ctx context.Context, userIDs []string) (map[string]string, error) {
+	names := make(map[string]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return names, nil
+	}
+
+	args := make([]any, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+	// #nosec G202 - プレースホルダの個数だけを組み立てており、値は引数で渡す
+	rows, err := um.db.QueryContext(ctx,
+		"SELECT id, username FROM users WHERE id IN (?"+strings.Repeat(", ?", len(userIDs)-1)+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("ユーザー名の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, fmt.Errorf("ユーザー名の読み取りに失敗しました: %w", err)
+		}
+		names[id] = username
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// 管理者は所有者に関わらずセッションを中止でき、同時アップロード枠も返ること。
+func TestAbortUpload(t *testing.T) {
+	um := newTestUploadManager(t)
+	ctx := context.Background()
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 3, 3, 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.CancelUpload(s.UploadID, "bob"); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("他人の CancelUpload で err = %v", err)
+	}
+
+	aborted, err := um.AbortUpload(ctx, s.UploadID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aborted.UserID != "alice" {
+		t.Errorf("中止したセッション = %+v", aborted)
+	}
+	if _, err := os.Stat(um.getTempFilePath(s.UploadID, s.Filename, s.Directory)); !os.IsNotExist(err) {
+		t.Errorf("一時ファイルが残っている: %v", err)
+	}
+	if _, err := um.AbortUpload(ctx, s.UploadID, "admin"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("2回目の中止で err = %v", err)
+	}
+	if _, err := um.CreateUploadSession("alice", "b.txt", "public", 3, 3, 1, "", ""); err != nil {
+		t.Errorf("中止後に枠が空いていない: %v", err)
+	}
+}
+
+// 期限の変更はメモリと upload_sessions の両方に反映され、再起動後も保たれること。
+func TestSetUploadExpiry(t *testing.T) {
+	um := newTestUploadManager(t)
+	ctx := context.Background()
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 3, 3, 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := um.SetUploadExpiry(ctx, s.UploadID, 48*time.Hour, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(updated.ExpiresAt); d < 47*time.Hour {
+		t.Errorf("延長後の残り = %v", d)
+	}
+
+	restored := &UploadManager{config: um.config, db: um.db, sessions: map[string]*activeUpload{}, userUploads: map[string]int{}}
+	if err := restored.Restore(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := restored.GetUploadSession(s.UploadID)
+	if err != nil || !got.ExpiresAt.Equal(updated.ExpiresAt) {
+		t.Errorf("復元後の期限 = %v, err = %v, want %v", got, err, updated.ExpiresAt)
+	}
+}
+
+// 一括削除は対象ユーザーの停滞したセッションだけを中止すること。
+func TestPurgeUserUploads(t *testing.T) {
+	um := newTestUploadManager(t)
+	um.config.Storage.MaxConcurrentUploads = 3
+	ctx := context.Background()
+
+	var ids []string
+	for _, user := range []string{"alice", "alice", "bob"} {
+		s, err := um.CreateUploadSession(user, "a.txt", "public", 3, 3, 1, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, s.UploadID)
+	}
+	um.sessions[ids[0]].session.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	um.sessions[ids[2]].session.UpdatedAt = time.Now().Add(-2 * time.Hour)
+
+	purged := um.PurgeUserUploads(ctx, "alice", time.Hour, "admin")
+	if !slices.Equal(purged, ids[:1]) {
+		t.Errorf("purged = %v, want %v", purged, ids[:1])
+	}
+	if _, err := um.GetUploadSession(ids[1]); err != nil {
+		t.Errorf("進行中のセッションが消えた: %v", err)
+	}
+	if _, err := um.GetUploadSession(ids[2]); err != nil {
+		t.Errorf("他のユーザーのセッションが消えた: %v", err)
+	}
+}
+
+// 受信速度は受信した量と時間から求め、途絶えたら0になること。
+func TestTransferRate(t *testing.T) {
+	var r transferRate
+	start := time.Now()
+	r.add(1000, start, start.Add(time.Second))
+	if got := r.current(start.Add(time.Second)); got != 1000 {
+		t.Errorf("1秒で1000バイトの速度 = %v", got)
+	}
+	r.add(9000, start.Add(time.Second), start.Add(5*time.Second))
+	if got := r.current(start.Add(5 * time.Second)); got != 2000 {
+		t.Errorf("区間を締めた後の速度 = %v", got)
+	}
+	if got := r.current(start.Add(time.Minute)); got != 0 {
+		t.Errorf("途絶えた後の速度 = %v", got)
+	}
+}
+
+// 一覧に出すユーザー名を users から引けること。
+func TestUsernames(t *testing.T) {
+	um := newTestUploadManager(t)
+	if _, err := um.db.Exec(
+		"INSERT INTO users (id, provider, subject, username) VALUES ('u1', 'discord', '1', 'alice')"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := um.Usernames(context.Background(), []string{"u1", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names["u1"] != "alice" {
+		t.Errorf("names = %v", names)
+	}
+}
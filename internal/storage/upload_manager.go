@@ -3,14 +3,21 @@
 package storage
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fileserver/internal/config"
@@ -32,21 +39,78 @@ var (
 	ErrInvalidChunk = errors.New("チャンクの指定が不正です")
 	// ErrSizeMismatch は完了時の実サイズが宣言サイズと一致しない場合に返されます
 	ErrSizeMismatch = errors.New("アップロードされたファイルサイズが宣言と一致しません")
+	// ErrTooLarge はファイルサイズがチャンクアップロードの上限を超える場合に返されます
+	ErrTooLarge = errors.New("ファイルサイズが上限を超えています")
+	// ErrOffsetMismatch は書き込み位置が受信済みのバイト数と一致しない場合に返されます（tus）
+	ErrOffsetMismatch = errors.New("書き込み位置が受信済みのサイズと一致しません")
+	// ErrUploadBusy は同じアップロードへ別のリクエストが書き込み中の場合に返されます
+	ErrUploadBusy = errors.New("このアップロードには別のリクエストが書き込み中です")
+	// ErrChecksumMismatch はチャンクまたはファイル全体のチェックサムが宣言と一致しない場合に返されます
+	ErrChecksumMismatch = errors.New("チェックサムが一致しません")
+	// ErrChunkRead はリクエストボディの読み取りに失敗した（途中で切断された・大きすぎる）場合に返されます
+	ErrChunkRead = errors.New("チャンクデータが大きすぎるか読み取りに失敗しました")
 )
 
 // UploadManager は同時アップロード制限とクリーンアップを備えたチャンク分割ファイルアップロードセッションを管理します。
+//
+// セッションは upload_sessions テーブルを正とし、メモリ上の sessions は起動時に Restore で全件を載せた写しです。
+// mu は sessions と userUploads を守ります。セッションの内容を変える処理は mu の読み取りロックの下で
+// セッションごとのロック（activeUpload.mu）を取るため、別々のセッションへの書き込みは互いを待たず、
+// セッションの破棄（mu の書き込みロック）とは排他になります。チャンクのデータはどちらのロックも持たずに書き込みます。
 type UploadManager struct {
 	config      *config.Config
-	sessions    map[string]*models.UploadSession
-	userUploads map[string]int // ユーザーごとの同時アップロード数
+	db          *sql.DB
+	storage     *Manager // 保持期間の確認用（未設定なら確認しない）
+	sessions    map[string]*activeUpload
+	userUploads map[string]int   // ユーザーごとの同時アップロード数
+	progress    chan UploadEvent // 開始・進捗・中止の通知の配送待ち（SetProgressNotifier で設定）
 	mu          sync.RWMutex
 }
 
+// activeUpload はメモリ上のアップロードセッションと、セッション単位の状態です。
+// フィールドは UploadManager.mu の読み取りロックと mu の両方、または UploadManager.mu の書き込みロックを持って扱います。
+type activeUpload struct {
+	session   *models.UploadSession // UploadedChunks は使わず chunks で管理する
+	chunks    chunkBitmap           // 受信済みのチャンク
+	writing   map[int]bool          // データを書き込み中のチャンク番号（tus は 0）
+	rate      transferRate          // 直近の受信速度（管理者の一覧表示用）
+	reported  atomic.Int32          // 通知済みの進捗の段階（%）
+	mu        sync.Mutex
+	verifying bool // 完了処理で結合したファイルを検証中
+}
+
+func newActiveUpload(session *models.UploadSession) *activeUpload {
+	return &activeUpload{session: session, chunks: newChunkBitmap(session.TotalChunks), writing: make(map[int]bool)}
+}
+
+// busy はデータの書き込みか完了時の検証が進行中かを返します。
+func (u *activeUpload) busy() bool {
+	return u.verifying || len(u.writing) > 0
+}
+
+// receivedBytes は受信済みのバイト数を返します（models.UploadSession.ReceivedBytes と同じ数え方）。
+func (u *activeUpload) receivedBytes() int64 {
+	if u.session.Protocol == models.UploadProtocolTus {
+		return u.session.UploadedSize
+	}
+	return min(int64(u.chunks.count())*u.session.ChunkSize, u.session.TotalSize)
+}
+
+// snapshot は呼び出し側がロックの外で読めるようにセッションの複製を返します。
+func (u *activeUpload) snapshot() *models.UploadSession {
+	s := *u.session
+	s.UploadedChunks = u.chunks.list()
+	s.BytesPerSecond = u.rate.current(time.Now())
+	return &s
+}
+
 // NewUploadManager は新しいアップロードマネージャーを作成し、クリーンアップルーチンを開始します。
-func NewUploadManager(cfg *config.Config) *UploadManager {
+// 既存のセッションは Restore で読み込みます。
+func NewUploadManager(cfg *config.Config, db *sql.DB) *UploadManager {
 	um := &UploadManager{
 		config:      cfg,
-		sessions:    make(map[string]*models.UploadSession),
+		db:          db,
+		sessions:    make(map[string]*activeUpload),
 		userUploads: make(map[string]int),
 	}
 
@@ -56,9 +120,16 @@ func NewUploadManager(cfg *config.Config) *UploadManager {
 	return um
 }
 
+// SetStorageManager は孤立ファイルの掃除で保持期間・リーガルホールドを確認するためのストレージマネージャーを設定します。
+func (um *UploadManager) SetStorageManager(m *Manager) {
+	um.storage = m
+}
+
 // CreateUploadSession はファイルのための新しいチャンク分割アップロードセッションを作成します。
 // ファイルサイズの検証、同時アップロード制限のチェック、一時ファイルの作成を行います。
-func (um *UploadManager) CreateUploadSession(userID, filename, directory string, totalSize, chunkSize int64, totalChunks int) (*models.UploadSession, error) {
+// fileSHA256 はクライアントが宣言したファイル全体のSHA-256（16進）で、空でなければ完了時に照合します。
+// onConflict は完了時に同じ名前のファイルがある場合の扱いで、空ならディレクトリの既定に従います。
+func (um *UploadManager) CreateUploadSession(userID, filename, directory string, totalSize, chunkSize int64, totalChunks int, fileSHA256, onConflict string) (*models.UploadSession, error) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
@@ -80,28 +151,55 @@ func (um *UploadManager) CreateUploadSession(userID, filename, directory string,
 		return nil, fmt.Errorf("チャンク数が上限を超えています")
 	}
 
-	uploadID := uuid.New().String()
-	now := time.Now()
+	return um.startSession(&models.UploadSession{
+		UserID:      userID,
+		Filename:    filename,
+		Directory:   directory,
+		TotalSize:   totalSize,
+		ChunkSize:   chunkSize,
+		TotalChunks: totalChunks,
+		FileSHA256:  strings.ToLower(fileSHA256),
+		OnConflict:  onConflict,
+	})
+}
 
-	session := &models.UploadSession{
-		UploadID:       uploadID,
-		UserID:         userID,
-		Filename:       filename,
-		Directory:      directory,
-		TotalSize:      totalSize,
-		ChunkSize:      chunkSize,
-		TotalChunks:    totalChunks,
-		UploadedChunks: make([]int, 0),
-		CreatedAt:      now,
-		UpdatedAt:      now,
-		ExpiresAt:      now.Add(um.config.Storage.UploadSessionTTL),
-	}
-
-	um.sessions[uploadID] = session
-	um.userUploads[userID]++
+// CreateStreamSession はオフセット順に書き込む tus 用のアップロードセッションを作成します。
+// 全体を1チャンクとして扱い、受信済みの位置は UploadedSize で管理します。
+// 0バイトのファイルは作成時点で受信済み（CompleteUpload 可能）になります。
+func (um *UploadManager) CreateStreamSession(userID, filename, directory string, totalSize int64, onConflict string) (*models.UploadSession, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.userUploads[userID] >= um.config.Storage.MaxConcurrentUploads {
+		return nil, ErrMaxConcurrentUploads
+	}
+	if totalSize < 0 || totalSize > um.config.Storage.MaxChunkFileSize {
+		return nil, ErrTooLarge
+	}
+
+	return um.startSession(&models.UploadSession{
+		UserID:      userID,
+		Filename:    filename,
+		Directory:   directory,
+		Protocol:    models.UploadProtocolTus,
+		TotalSize:   totalSize,
+		ChunkSize:   totalSize,
+		TotalChunks: 1,
+		OnConflict:  onConflict,
+	})
+}
+
+// startSession は session にIDと期限を割り当て、一時ファイルを作って upload_sessions に登録します。
+// 呼び出し側は um.mu の書き込みロックを保持している必要があります。
+func (um *UploadManager) startSession(session *models.UploadSession) (*models.UploadSession, error) {
+	now := time.Now()
+	session.UploadID = uuid.New().String()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	session.ExpiresAt = now.Add(um.config.Storage.UploadSessionTTL)
 
 	// 総サイズ分を確保した空ファイルを先に作り、各チャンクをoffsetへ書き込む。
-	tempPath := um.getTempFilePath(uploadID, filename, directory)
+	tempPath := um.getTempFilePath(session.UploadID, session.Filename, session.Directory)
 	if err := os.MkdirAll(filepath.Dir(tempPath), 0750); err != nil {
 		return nil, err
 	}
@@ -115,150 +213,353 @@ func (um *UploadManager) CreateUploadSession(userID, filename, directory string,
 		slog.Error("一時ファイルのクローズに失敗しました", "error", err)
 	}
 
-	// .metaが無いと再起動後にセッションを復元できないため、tempとセットで作る。
-	if err := um.saveMetaFile(session); err != nil {
+	u := newActiveUpload(session)
+	if session.TotalSize == 0 {
+		// 0バイトのファイル（tus）は作成時点で受信済み。
+		u.chunks.set(0)
+	}
+	// 登録が無いと再起動後にセッションを復元できないため、tempとセットで作る。
+	if err := um.insertSession(context.Background(), session, u.chunks); err != nil {
 		if removeErr := os.Remove(tempPath); removeErr != nil {
 			slog.Error("一時ファイルの削除に失敗しました", "error", removeErr)
 		}
 		return nil, err
 	}
 
-	return session, nil
+	um.sessions[session.UploadID] = u
+	um.userUploads[session.UserID]++
+	um.notify(NewUploadEvent(session, UploadStarted, u.receivedBytes()))
+	return u.snapshot(), nil
 }
 
-// GetUploadSession はメモリまたはディスクからIDでアップロードセッションを取得します。
+// GetUploadSession はIDでアップロードセッションを取得します。
+// 返す値は複製のため、以降のアップロードの進行は反映されません。
 func (um *UploadManager) GetUploadSession(uploadID string) (*models.UploadSession, error) {
+	u, release, err := um.acquire(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return u.snapshot(), nil
+}
+
+// acquire は um.mu の読み取りロックとセッションのロックを取った状態でセッションを返します。
+// release で両方を解放します。保持している間に um.mu の書き込みロックを取ってはいけません。
+func (um *UploadManager) acquire(uploadID string) (*activeUpload, func(), error) {
 	um.mu.RLock()
-	defer um.mu.RUnlock()
+	u, ok := um.sessions[uploadID]
+	if !ok {
+		um.mu.RUnlock()
+		return nil, nil, ErrSessionNotFound
+	}
+	u.mu.Lock()
+	return u, func() {
+		u.mu.Unlock()
+		um.mu.RUnlock()
+	}, nil
+}
 
-	return um.findSession(uploadID)
+// reacquire はロックを外して書き込んだ後、u が破棄されていなければ acquire と同じロックを取り直します。
+// キャンセル・期限切れで破棄されていた場合は ok が false です（書いた内容ごと無効）。
+func (um *UploadManager) reacquire(uploadID string, u *activeUpload) (release func(), ok bool) {
+	um.mu.RLock()
+	if um.sessions[uploadID] != u {
+		um.mu.RUnlock()
+		return nil, false
+	}
+	u.mu.Lock()
+	return func() {
+		u.mu.Unlock()
+		um.mu.RUnlock()
+	}, true
 }
 
-// SaveChunk はデータのチャンクを一時ファイルの適切なオフセットに保存します。
+// SaveChunk は body のチャンクを一時ファイルの適切なオフセットへ直接書き込みます。
 // アップロード済みチャンクを追跡し、セッションメタデータを更新します。
 // userID はセッション所有者との照合に使用します（他ユーザーからの書き込みを拒否）。
-func (um *UploadManager) SaveChunk(uploadID, userID string, chunkNumber int, data []byte) error {
-	um.mu.Lock()
-	defer um.mu.Unlock()
-
-	session, err := um.findSession(uploadID)
+// checksum はクライアントが送ったチャンクのSHA-256で、空でなければ書き込みながら計算した値と照合し、
+// 一致しなければチャンクを受信済みにせず ErrChecksumMismatch を返します（クライアントは同じチャンクを送り直せます）。
+// 書き込み中はロックを持たないため、別のセッションや同じセッションの別のチャンクと並行に書き込めます。
+func (um *UploadManager) SaveChunk(uploadID, userID string, chunkNumber int, body io.Reader, checksum []byte) error {
+	u, release, err := um.acquire(uploadID)
 	if err != nil {
-		return ErrSessionNotFound
+		return err
 	}
-	um.sessions[uploadID] = session
+	session := u.session
 
-	if session.UserID != userID {
-		return ErrPermissionDenied
+	// chunkNumberはクライアント任意入力。範囲外や総サイズを超える位置を弾かないと、
+	// 巨大offsetへの書き込みでスパースファイルを生成できてしまう。
+	offset := int64(chunkNumber) * session.ChunkSize
+	limit := min(session.ChunkSize, session.TotalSize-offset)
+	switch {
+	case session.UserID != userID:
+		err = ErrPermissionDenied
+	case session.Protocol == models.UploadProtocolTus:
+		// tus のセッションはオフセットで進捗を持つため、チャンク番号での書き込みと混ぜない。
+		err = ErrInvalidChunk
+	case chunkNumber < 0 || chunkNumber >= session.TotalChunks || limit < 0:
+		err = ErrInvalidChunk
+	case u.verifying || u.writing[chunkNumber]:
+		err = ErrUploadBusy
 	}
+	// 冪等: 再送されたチャンクは成功として無視する。
+	if err != nil || u.chunks.has(chunkNumber) {
+		release()
+		return err
+	}
+	u.writing[chunkNumber] = true
+	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
+	release()
 
-	// chunkNumber/dataはクライアント任意入力。範囲外・過大サイズ・総サイズ超過を
-	// 弾かないと、巨大offsetへの書き込みでスパースファイルを生成できてしまう。
-	if chunkNumber < 0 || chunkNumber >= session.TotalChunks {
-		return ErrInvalidChunk
+	var digest hash.Hash
+	if len(checksum) > 0 {
+		digest = sha256.New()
 	}
-	if int64(len(data)) > session.ChunkSize {
-		return ErrInvalidChunk
+	began := time.Now()
+	writeErr := writeChunk(tempPath, offset, limit, body, digest)
+	if writeErr == nil && digest != nil && !bytes.Equal(digest.Sum(nil), checksum) {
+		writeErr = ErrChecksumMismatch
 	}
-	offset := int64(chunkNumber) * session.ChunkSize
-	if offset+int64(len(data)) > session.TotalSize {
-		return ErrInvalidChunk
+
+	release, ok := um.reacquire(uploadID, u)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	defer release()
+	delete(u.writing, chunkNumber)
+	if writeErr != nil {
+		return writeErr
 	}
 
-	// 冪等: 再送されたチャンクは成功として無視する。
-	for _, uploaded := range session.UploadedChunks {
-		if uploaded == chunkNumber {
-			return nil
+	u.chunks.set(chunkNumber)
+	session.UpdatedAt = time.Now()
+	u.rate.add(limit, began, session.UpdatedAt)
+	um.reportProgress(u, u.receivedBytes())
+
+	return um.saveProgress(u)
+}
+
+// writeChunk は body から最大 limit バイトを path の offset へ書き込みます。
+// digest が nil でなければ書き込んだデータを digest にも通します（チェックサム検証用）。
+// limit を超えるデータが続く場合は ErrInvalidChunk、body の読み取りに失敗した場合は ErrChunkRead を返します。
+func writeChunk(path string, offset, limit int64, body io.Reader, digest hash.Hash) error {
+	var src io.Reader = io.LimitReader(body, limit)
+	if digest != nil {
+		src = io.TeeReader(src, digest)
+	}
+	tracked := &bodyReader{r: src}
+	if _, err := writeAt(path, offset, tracked); err != nil {
+		if tracked.err != nil {
+			return fmt.Errorf("%w: %w", ErrChunkRead, tracked.err)
 		}
+		return err
+	}
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		return ErrInvalidChunk
 	}
+	return nil
+}
 
-	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
-	// #nosec G304 - tempPath is constructed from sanitized inputs
-	file, err := os.OpenFile(tempPath, os.O_WRONLY, 0600)
+// bodyReader は書き込み側のエラーと区別できるよう、読み取り側のエラーを記録します。
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// WriteStream は tus のセッションへ offset から body を書き込み、書き込み後のオフセットを返します。
+// offset は受信済みのサイズと一致している必要があり、総サイズを超える body は拒否します。
+// body を読み切る前に途切れた場合も、受信できた分まではオフセットを進めます（再開できるように）。
+// verify が nil でなければ読み切った後に呼び、エラーならオフセットを進めずにそのエラーを返します（チェックサム検証用）。
+// 書き込み中はロックを持たず、同じアップロードへの並行書き込みは ErrUploadBusy で拒否します。
+func (um *UploadManager) WriteStream(uploadID, userID string, offset int64, body io.Reader, verify func() error) (int64, error) {
+	u, release, err := um.acquire(uploadID)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	session := u.session
+	switch {
+	case session.UserID != userID:
+		err = ErrPermissionDenied
+	case session.Protocol != models.UploadProtocolTus:
+		err = ErrInvalidChunk
+	case offset != session.UploadedSize:
+		err = ErrOffsetMismatch
+	case u.busy():
+		err = ErrUploadBusy
+	}
+	if err != nil {
+		release()
+		return session.UploadedSize, err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			slog.Error("ファイルのクローズに失敗しました", "error", err)
+	u.writing[0] = true
+	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
+	remaining := session.TotalSize - offset
+	release()
+
+	began := time.Now()
+	written, writeErr := writeAt(tempPath, offset, &progressReader{r: io.LimitReader(body, remaining), um: um, u: u, offset: offset})
+	if writeErr == nil {
+		// 総サイズ分を受け取った後にまだ続きがあれば、宣言より大きいファイルとして拒否する。
+		if n, _ := body.Read(make([]byte, 1)); n > 0 {
+			writeErr, written = ErrInvalidChunk, -1
+		} else if verify != nil {
+			if err := verify(); err != nil {
+				writeErr, written = err, -1
+			}
 		}
-	}()
+	} else if verify != nil {
+		// 検証できない途中までのデータは受け入れない。
+		written = -1
+	}
 
-	if _, err := file.Seek(offset, 0); err != nil {
-		return err
+	release, ok := um.reacquire(uploadID, u)
+	if !ok {
+		return offset, ErrSessionNotFound
 	}
-	if _, err := file.Write(data); err != nil {
-		return err
+	defer release()
+	delete(u.writing, 0)
+	if written < 0 {
+		// 受け入れなかった分まで進捗を通知しているため、段階を戻す。
+		u.resetProgress(offset)
+		return offset, writeErr
 	}
 
-	session.UploadedChunks = append(session.UploadedChunks, chunkNumber)
+	session.UploadedSize = offset + written
 	session.UpdatedAt = time.Now()
+	u.rate.add(written, began, session.UpdatedAt)
+	if session.UploadedSize == session.TotalSize {
+		u.chunks.set(0)
+	}
+	if err := um.saveProgress(u); err != nil {
+		return session.UploadedSize, err
+	}
+	return session.UploadedSize, writeErr
+}
 
-	return um.saveMetaFile(session)
+// writeAt は path の offset 以降へ r の内容を書き込み、書き込んだバイト数を返します。
+func writeAt(path string, offset int64, r io.Reader) (int64, error) {
+	// #nosec G304 - path is constructed from sanitized inputs
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(file, offset), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
 }
 
 // GetUploadedChunks は正常にアップロードされたチャンク番号のリストを返します。
 func (um *UploadManager) GetUploadedChunks(uploadID string) ([]int, error) {
-	um.mu.RLock()
-	defer um.mu.RUnlock()
-
-	session, err := um.findSession(uploadID)
+	u, release, err := um.acquire(uploadID)
 	if err != nil {
-		return nil, ErrSessionNotFound
+		return nil, err
 	}
+	defer release()
 
-	return session.UploadedChunks, nil
+	return u.chunks.list(), nil
 }
 
 // CompleteUpload は一時ファイルをリネームしてメタデータをクリーンアップすることでアップロードを完了します。
 // 完了前にすべてのチャンクがアップロード済みであることを検証します。
 // userID はセッション所有者との照合に使用します。
-func (um *UploadManager) CompleteUpload(uploadID, userID string) (*SavedFile, error) {
+// 大きなファイルの検証で他のセッションを止めないよう、検証中はロックを外し、同じセッションへの書き込みは ErrUploadBusy で拒否します。
+// inspect が指定されていれば、検証を通った一時ファイルを保存名へ移す前に呼びます。
+// inspect がエラーを返した場合はセッションを破棄し、そのエラーを返します。
+func (um *UploadManager) CompleteUpload(uploadID, userID string, inspect func(session *models.UploadSession, tempPath string) error) (*SavedFile, error) {
+	u, release, err := um.acquire(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	session := u.session
+	switch {
+	case session.UserID != userID:
+		err = ErrPermissionDenied
+	case u.chunks.count() != session.TotalChunks:
+		err = ErrIncompleteUpload
+	case u.busy():
+		err = ErrUploadBusy
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	u.verifying = true
+	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
+	release()
+
+	verifyErr := verifyTempFile(session, tempPath)
+	var inspectErr error
+	if verifyErr == nil && inspect != nil {
+		inspectErr = inspect(session, tempPath)
+	}
+
 	um.mu.Lock()
 	defer um.mu.Unlock()
-
-	session, err := um.findSession(uploadID)
-	if err != nil {
+	if um.sessions[uploadID] != u {
 		return nil, ErrSessionNotFound
 	}
-
-	if session.UserID != userID {
-		return nil, ErrPermissionDenied
+	u.verifying = false
+	if errors.Is(verifyErr, ErrChecksumMismatch) {
+		// どのチャンクが壊れたか特定できないため、受信済みチャンクを破棄して送り直してもらう。
+		u.chunks.clear()
+		u.resetProgress(0)
+		session.UpdatedAt = time.Now()
+		if err := um.saveProgress(u); err != nil {
+			slog.Error("アップロードセッションの更新に失敗しました", "error", err)
+		}
+	}
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	if inspectErr != nil {
+		um.removeSession(uploadID, session)
+		return nil, inspectErr
 	}
 
-	if len(session.UploadedChunks) != session.TotalChunks {
-		return nil, ErrIncompleteUpload
+	saved, err := um.place(tempPath, session)
+	if err != nil {
+		// 同名ファイルによる拒否では受信済みのデータを残し、既存ファイルを退けてから完了し直せるようにする。
+		return nil, err
 	}
 
-	// チャンク数が揃っていても、各チャンクが規定サイズとは限らない。
-	// 実サイズと宣言サイズの一致で完全性を担保する。
-	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
-	if info, statErr := os.Stat(tempPath); statErr != nil {
-		return nil, statErr
-	} else if info.Size() != session.TotalSize {
-		return nil, ErrSizeMismatch
+	um.deleteSessionRow(uploadID)
+	delete(um.sessions, uploadID)
+	um.releaseUploadSlot(session.UserID)
+
+	return saved, nil
+}
+
+// place は結合済みの一時ファイルを保存名へ移します。
+// ストレージマネージャーが設定されていれば同名ファイルの扱い（on_conflict）を適用します。
+func (um *UploadManager) place(tempPath string, session *models.UploadSession) (*SavedFile, error) {
+	if um.storage != nil {
+		policy := session.OnConflict
+		if policy == "" {
+			policy = um.config.ConflictPolicy(session.Directory)
+		}
+		return um.storage.Place(context.Background(), tempPath, session.Directory, session.Filename, policy)
 	}
 
-	fileID := uuid.New().String()
-	finalFilename := fmt.Sprintf("%s_%s", fileID, sanitizeFilename(session.Filename))
+	finalFilename := StoredFilename(uuid.New().String(), session.Filename)
 	finalPath := filepath.Join(um.config.Storage.UploadPath, session.Directory, finalFilename)
-
 	if err := os.Rename(tempPath, finalPath); err != nil {
 		return nil, err
 	}
-
 	fileInfo, err := os.Stat(finalPath)
 	if err != nil {
 		return nil, err
 	}
-
-	metaPath := um.getMetaFilePath(uploadID, session.Filename, session.Directory)
-	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
-		slog.Error("メタファイルの削除に失敗しました", "error", err)
-	}
-
-	delete(um.sessions, uploadID)
-	um.releaseUploadSlot(session.UserID)
-
 	return &SavedFile{
 		Filename: finalFilename,
 		Path:     filepath.Join(session.Directory, finalFilename),
@@ -266,22 +567,49 @@ func (um *UploadManager) CompleteUpload(uploadID, userID string) (*SavedFile, er
 	}, nil
 }
 
+// verifyTempFile は結合したファイルのサイズと、宣言されていればファイル全体のSHA-256を照合します。
+// チャンク数が揃っていても各チャンクが規定サイズとは限らないため、実サイズと宣言サイズの一致で完全性を担保します。
+func verifyTempFile(session *models.UploadSession, tempPath string) error {
+	info, err := os.Stat(tempPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != session.TotalSize {
+		return ErrSizeMismatch
+	}
+	if session.FileSHA256 == "" {
+		return nil
+	}
+
+	sum, err := HashFile(tempPath)
+	if err != nil {
+		return err
+	}
+	if sum != session.FileSHA256 {
+		slog.Warn("ファイル全体のチェックサムが一致しないため受信済みチャンクを破棄します",
+			"upload_id", session.UploadID, "declared", session.FileSHA256, "actual", sum)
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
 // CancelUpload はアップロードセッションをキャンセルし、関連するすべてのファイルを削除します。
 // userID はセッション所有者との照合に使用します。
 func (um *UploadManager) CancelUpload(uploadID, userID string) error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	session, err := um.findSession(uploadID)
-	if err != nil {
+	u, ok := um.sessions[uploadID]
+	if !ok {
 		return ErrSessionNotFound
 	}
 
-	if session.UserID != userID {
+	if u.session.UserID != userID {
 		return ErrPermissionDenied
 	}
 
-	um.removeSession(uploadID, session)
+	um.notifyCancelled(u, CancelByOwner)
+	um.removeSession(uploadID, u.session)
 	return nil
 }
 
@@ -310,60 +638,52 @@ func (um *UploadManager) cleanup() {
 	expiredSessions := make([]string, 0)
 
 	// 走査中にmapを変更しないよう、対象を集めてから削除する。
-	for uploadID, session := range um.sessions {
-		if now.After(session.ExpiresAt) {
+	for uploadID, u := range um.sessions {
+		if now.After(u.session.ExpiresAt) {
 			expiredSessions = append(expiredSessions, uploadID)
 		}
 	}
 
 	for _, uploadID := range expiredSessions {
-		um.removeSession(uploadID, um.sessions[uploadID])
+		um.notifyCancelled(um.sessions[uploadID], CancelExpired)
+		um.removeSession(uploadID, um.sessions[uploadID].session)
 		slog.Info("期限切れセッションを削除しました", "upload_id", uploadID)
 	}
 
 	um.cleanupOrphanedFiles()
 }
 
-// cleanupOrphanedFiles は各ディレクトリを走査し、期限切れの.meta/.tempファイルを削除します。
-// メモリにセッションが残っていない再起動後のケースを想定した後始末です。
+// cleanupOrphanedFiles は各ディレクトリを走査し、セッションの無い作業ファイル（.temp と、移行できなかった古い .meta）のうち
+// 最終更新からセッションの有効期限を過ぎたものを削除します。セッションの登録前に停止した場合などの後始末です。
+// 呼び出し側は um.mu の書き込みロックを保持している必要があります。
 func (um *UploadManager) cleanupOrphanedFiles() {
-	for _, dir := range um.config.Storage.Directories {
+	cutoff := time.Now().Add(-um.config.Storage.UploadSessionTTL)
+	for _, dir := range um.config.Directories() {
 		dirPath := filepath.Join(um.config.Storage.UploadPath, dir.Path)
 
-		if err := filepath.Walk(dirPath, func(path string, info fs.FileInfo, err error) error {
-			if err != nil || info.IsDir() {
+		if err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !IsWorkFile(d.Name()) {
 				return nil
 			}
-
-			if filepath.Ext(path) == ".meta" {
-				// #nosec G304,G122 - path はアプリ所有のアップロードディレクトリのみを走査する filepath.Walk 由来
-				data, err := os.ReadFile(path)
-				if err != nil {
-					return nil
-				}
-
-				var session models.UploadSession
-				if err := json.Unmarshal(data, &session); err != nil {
-					return nil
-				}
-
-				if time.Now().After(session.ExpiresAt) {
-					// #nosec G122 - path はアプリ所有のアップロードディレクトリ内
-					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-						slog.Error("孤立ファイルの削除に失敗しました", "error", err)
-					}
-
-					// .metaと対になる.tempも消す（"..._X.meta" → "..._X.temp"）
-					tempPath := path[:len(path)-5] + ".temp"
-					// #nosec G122 - tempPath はアプリ所有のアップロードディレクトリ内
-					if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
-						slog.Error("孤立ファイルの削除に失敗しました", "error", err)
-					}
-
-					slog.Info("孤立ファイルを削除しました", "path", path)
-				}
+			if uploadID, _, ok := strings.Cut(d.Name(), "_"); ok && um.sessions[uploadID] != nil {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				return nil
+			}
+			// 作業ファイルと同じ拡張子で登録されたファイル（"x.temp" のアップロード等）は、
+			// 保持期間・リーガルホールド中なら掃除でも消さない。
+			if um.retained(path) {
+				return nil
 			}
 
+			// #nosec G122 - path はアプリ所有のアップロードディレクトリ内
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Error("孤立ファイルの削除に失敗しました", "error", err)
+				return nil
+			}
+			slog.Info("孤立ファイルを削除しました", "path", path)
 			return nil
 		}); err != nil {
 			slog.Error("孤立ファイルのクリーンアップに失敗しました", "directory", dirPath, "error", err)
@@ -371,54 +691,19 @@ func (um *UploadManager) cleanupOrphanedFiles() {
 	}
 }
 
-// saveMetaFile はセッションの状態を.metaファイルにJSONで永続化します。
-func (um *UploadManager) saveMetaFile(session *models.UploadSession) error {
-	metaPath := um.getMetaFilePath(session.UploadID, session.Filename, session.Directory)
-
-	data, err := json.MarshalIndent(session, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(metaPath, data, 0600)
-}
-
-// loadSessionFromMeta は全ディレクトリを検索し、.metaファイルからセッションを復元します。
-// 見つからない場合は ErrSessionNotFound を返します。
-func (um *UploadManager) loadSessionFromMeta(uploadID string) (*models.UploadSession, error) {
-	for _, dir := range um.config.Storage.Directories {
-		metaPath := filepath.Join(um.config.Storage.UploadPath, dir.Path, uploadID+"_*.meta")
-		matches, err := filepath.Glob(metaPath)
-		if err != nil || len(matches) == 0 {
-			continue
-		}
-
-		data, err := os.ReadFile(matches[0])
-		if err != nil {
-			continue
-		}
-
-		var session models.UploadSession
-		if err := json.Unmarshal(data, &session); err != nil {
-			continue
-		}
-
-		return &session, nil
+// retained は path のファイルが保持期間・リーガルホールドにより削除できないかを返します（理由は監査ログに残ります）。
+func (um *UploadManager) retained(path string) bool {
+	if um.storage == nil {
+		return false
 	}
-
-	return nil, ErrSessionNotFound
-}
-
-// findSession はメモリから、無ければ.metaファイルからセッションを取得します。
-// 呼び出し側は um.mu を保持している必要があります（本関数はロックを取得しません）。
-func (um *UploadManager) findSession(uploadID string) (*models.UploadSession, error) {
-	if session, ok := um.sessions[uploadID]; ok {
-		return session, nil
+	rel, err := filepath.Rel(um.config.Storage.UploadPath, filepath.Dir(path))
+	if err != nil {
+		return false
 	}
-	return um.loadSessionFromMeta(uploadID)
+	return um.storage.CheckModifiable(context.Background(), filepath.ToSlash(rel), filepath.Base(path), "cleanup") != nil
 }
 
-// removeSession は一時ファイルとメタファイルを削除し、セッション管理情報を破棄します。
+// removeSession は一時ファイルと upload_sessions の行を削除し、セッション管理情報を破棄します。
 // 呼び出し側は um.mu の書き込みロックを保持している必要があります。
 func (um *UploadManager) removeSession(uploadID string, session *models.UploadSession) {
 	tempPath := um.getTempFilePath(uploadID, session.Filename, session.Directory)
@@ -426,18 +711,34 @@ func (um *UploadManager) removeSession(uploadID string, session *models.UploadSe
 		slog.Error("一時ファイルの削除に失敗しました", "error", err)
 	}
 
-	metaPath := um.getMetaFilePath(uploadID, session.Filename, session.Directory)
-	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
-		slog.Error("メタファイルの削除に失敗しました", "error", err)
-	}
-
+	um.deleteSessionRow(uploadID)
 	delete(um.sessions, uploadID)
 	um.releaseUploadSlot(session.UserID)
 }
 
+// ReserveSlot はセッションを持たないアップロード（URLからの取り込み等）のために、ユーザーの同時アップロード枠を1つ確保します。
+// 上限に達している場合は ErrMaxConcurrentUploads を返します。確保した枠は ReleaseSlot で返します。
+func (um *UploadManager) ReserveSlot(userID string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.userUploads[userID] >= um.config.Storage.MaxConcurrentUploads {
+		return ErrMaxConcurrentUploads
+	}
+	um.userUploads[userID]++
+	return nil
+}
+
+// ReleaseSlot は ReserveSlot で確保した同時アップロード枠を返します。
+func (um *UploadManager) ReleaseSlot(userID string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.releaseUploadSlot(userID)
+}
+
 // releaseUploadSlot はユーザーの同時アップロード数を1減らします。
-// .metaから復元したセッション（再起動でカウンタ未加算）を破棄しても
-// カウンタが負値にならないよう下限を0で保護し、0になった要素は取り除きます。
+// 下限を0で保護し、0になった要素は取り除きます。
 func (um *UploadManager) releaseUploadSlot(userID string) {
 	if um.userUploads[userID] <= 1 {
 		delete(um.userUploads, userID)
@@ -446,30 +747,22 @@ func (um *UploadManager) releaseUploadSlot(userID string) {
 	um.userUploads[userID]--
 }
 
-// sessionFilePath はセッションに紐づくファイル（.temp/.meta）のパスを組み立てます。
-func (um *UploadManager) sessionFilePath(uploadID, filename, directory, ext string) string {
-	name := fmt.Sprintf("%s_%s%s", uploadID, sanitizeFilename(filename), ext)
-	return filepath.Join(um.config.Storage.UploadPath, directory, name)
-}
-
 // getTempFilePath .tempファイルパス取得
 func (um *UploadManager) getTempFilePath(uploadID, filename, directory string) string {
-	return um.sessionFilePath(uploadID, filename, directory, ".temp")
-}
-
-// getMetaFilePath .metaファイルパス取得
-func (um *UploadManager) getMetaFilePath(uploadID, filename, directory string) string {
-	return um.sessionFilePath(uploadID, filename, directory, ".meta")
+	name := fmt.Sprintf("%s_%s.temp", uploadID, sanitizeFilename(filename))
+	return filepath.Join(um.config.Storage.UploadPath, directory, name)
 }
 
-// GetAllUploadSessions は現在進行中のすべてのアップロードセッション情報を取得します（管理者用）。
+// GetAllUploadSessions は現在進行中のすべてのアップロードセッション情報の複製を取得します（管理者用）。
 func (um *UploadManager) GetAllUploadSessions() []*models.UploadSession {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
 	sessions := make([]*models.UploadSession, 0, len(um.sessions))
-	for _, session := range um.sessions {
-		sessions = append(sessions, session)
+	for _, u := range um.sessions {
+		u.mu.Lock()
+		sessions = append(sessions, u.snapshot())
+		u.mu.Unlock()
 	}
 
 	return sessions
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+)
+
+func newTestUploadManager(t testing.TB) *UploadManager {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			UploadPath:           filepath.Join(dir, "uploads"),
+			Directories:          []config.DirectoryConfig{{Path: "public"}},
+			MaxChunkFileSize:     1 << 20,
+			MaxConcurrentUploads: 1,
+			UploadSessionTTL:     time.Hour,
+		},
+	}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &UploadManager{
+		config:      cfg,
+		db:          db,
+		sessions:    make(map[string]*activeUpload),
+		userUploads: make(map[string]int),
+	}
+}
+
+// 途中で切れた書き込みは受信できた分だけ進み、続きから再開して完了できること。
+func TestWriteStreamResume(t *testing.T) {
+	um := newTestUploadManager(t)
+	s, err := um.CreateStreamSession("alice", "a.txt", "public", 11, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.CreateStreamSession("alice", "b.txt", "public", 1, ""); !errors.Is(err, ErrMaxConcurrentUploads) {
+		t.Errorf("同時アップロード上限で err = %v", err)
+	}
+
+	broken := io.MultiReader(strings.NewReader("hello"), errReader{})
+	off, err := um.WriteStream(s.UploadID, "alice", 0, broken, nil)
+	if err == nil || off != 5 {
+		t.Fatalf("途切れた書き込み: offset = %d, err = %v", off, err)
+	}
+	if _, err := um.WriteStream(s.UploadID, "alice", 0, strings.NewReader(" world"), nil); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("古いオフセットで err = %v, want ErrOffsetMismatch", err)
+	}
+	if _, err := um.WriteStream(s.UploadID, "bob", 5, strings.NewReader(" world"), nil); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("他人の書き込みで err = %v", err)
+	}
+
+	// 検証に失敗した書き込みはオフセットを進めない。
+	mismatch := errors.New("mismatch")
+	if off, err := um.WriteStream(s.UploadID, "alice", 5, strings.NewReader(" WORLD"), func() error { return mismatch }); !errors.Is(err, mismatch) || off != 5 {
+		t.Errorf("検証失敗: offset = %d, err = %v", off, err)
+	}
+	if _, err := um.WriteStream(s.UploadID, "alice", 5, strings.NewReader(" world!"), nil); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("総サイズを超える書き込みで err = %v", err)
+	}
+	if off, err := um.WriteStream(s.UploadID, "alice", 5, strings.NewReader(" world"), nil); err != nil || off != 11 {
+		t.Fatalf("再開: offset = %d, err = %v", off, err)
+	}
+
+	saved, err := um.CompleteUpload(s.UploadID, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(um.config.Storage.UploadPath, saved.Path))
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("完了後の内容 = %q, err = %v", data, err)
+	}
+	if um.userUploads["alice"] != 0 {
+		t.Errorf("完了後も同時アップロード数が残っている: %d", um.userUploads["alice"])
+	}
+}
+
+func TestWriteStreamRejectsChunkSession(t *testing.T) {
+	um := newTestUploadManager(t)
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 10, 5, 2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.WriteStream(s.UploadID, "alice", 0, strings.NewReader("x"), nil); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("チャンクAPIのセッションへの書き込みで err = %v", err)
+	}
+}
+
+// チャンクのチェックサムが違えば書き込まずに拒否し、同じチャンクを送り直せること。
+func TestSaveChunkChecksum(t *testing.T) {
+	um := newTestUploadManager(t)
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 10, 5, 2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := sha256.Sum256([]byte("hello"))
+	if err := um.SaveChunk(s.UploadID, "alice", 0, strings.NewReader("hellO"), good[:]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("壊れたチャンクで err = %v, want ErrChecksumMismatch", err)
+	}
+	if chunks, _ := um.GetUploadedChunks(s.UploadID); len(chunks) != 0 {
+		t.Errorf("拒否したチャンクが受信済みになっている: %v", chunks)
+	}
+	if err := um.SaveChunk(s.UploadID, "alice", 0, strings.NewReader("hello"), good[:]); err != nil {
+		t.Fatalf("送り直しで err = %v", err)
+	}
+}
+
+// 宣言したファイル全体のハッシュと一致しなければ完了せず、受信済みチャンクを破棄すること。
+func TestCompleteUploadFileChecksum(t *testing.T) {
+	um := newTestUploadManager(t)
+	um.config.Storage.MaxConcurrentUploads = 2
+	sum := sha256.Sum256([]byte("helloworld"))
+	declared := hex.EncodeToString(sum[:])
+
+	bad, err := um.CreateUploadSession("alice", "bad.txt", "public", 10, 5, 2, declared, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = um.SaveChunk(bad.UploadID, "alice", 0, strings.NewReader("hello"), nil)
+	_ = um.SaveChunk(bad.UploadID, "alice", 1, strings.NewReader("WORLD"), nil)
+	if _, err := um.CompleteUpload(bad.UploadID, "alice", nil); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ハッシュ不一致で err = %v, want ErrChecksumMismatch", err)
+	}
+	if chunks, _ := um.GetUploadedChunks(bad.UploadID); len(chunks) != 0 {
+		t.Errorf("不一致の後も受信済みチャンクが残っている: %v", chunks)
+	}
+
+	ok, err := um.CreateUploadSession("alice", "ok.txt", "public", 10, 5, 2, strings.ToUpper(declared), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = um.SaveChunk(ok.UploadID, "alice", 0, strings.NewReader("hello"), nil)
+	_ = um.SaveChunk(ok.UploadID, "alice", 1, strings.NewReader("world"), nil)
+	if _, err := um.CompleteUpload(ok.UploadID, "alice", nil); err != nil {
+		t.Errorf("一致するハッシュで err = %v", err)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("接続が切れました") }
+
+// 同じセッションの別々のチャンクを並行に書き込んでも正しく結合され、
+// チャンクサイズを超えるボディや途中で切れたボディは受信済みにならないこと。
+func TestSaveChunkConcurrent(t *testing.T) {
+	um := newTestUploadManager(t)
+	const chunks = 16
+	want := strings.Repeat("0123456789abcdef", chunks)
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", int64(len(want)), 16, chunks, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := um.SaveChunk(s.UploadID, "alice", 0, strings.NewReader(want[:17]), nil); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("チャンクサイズを超えるボディで err = %v, want ErrInvalidChunk", err)
+	}
+	broken := io.MultiReader(strings.NewReader("0123"), errReader{})
+	if err := um.SaveChunk(s.UploadID, "alice", 0, broken, nil); !errors.Is(err, ErrChunkRead) {
+		t.Errorf("途中で切れたボディで err = %v, want ErrChunkRead", err)
+	}
+	if chunks, _ := um.GetUploadedChunks(s.UploadID); len(chunks) != 0 {
+		t.Errorf("拒否したチャンクが受信済みになっている: %v", chunks)
+	}
+
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Go(func() {
+			if err := um.SaveChunk(s.UploadID, "alice", i, strings.NewReader(want[i*16:(i+1)*16]), nil); err != nil {
+				t.Errorf("チャンク %d: %v", i, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	saved, err := um.CompleteUpload(s.UploadID, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(um.config.Storage.UploadPath, saved.Path))
+	if err != nil || string(data) != want {
+		t.Errorf("完了後の内容 = %q, err = %v", data, err)
+	}
+}
+
+// 多数のアップロードが同時にチャンクを送ったときのスループットを測ります。
+func BenchmarkSaveChunkParallel(b *testing.B) {
+	const (
+		uploaders = 32
+		chunkSize = 1 << 20
+		chunks    = 64
+	)
+	um := newTestUploadManager(b)
+	um.config.Storage.MaxChunkFileSize = chunkSize * chunks
+	um.config.Storage.MaxConcurrentUploads = uploaders
+	data := make([]byte, chunkSize)
+
+	ids := make([]string, uploaders)
+	for i := range ids {
+		s, err := um.CreateUploadSession(fmt.Sprintf("user%d", i), "bench.bin", "public", chunkSize*chunks, chunkSize, chunks, "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = s.UploadID
+	}
+
+	var next atomic.Int64
+	b.SetBytes(chunkSize)
+	b.SetParallelism(uploaders)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := int(next.Add(1) - 1)
+			id, chunk := ids[n%uploaders], (n/uploaders)%chunks
+			if err := um.SaveChunk(id, fmt.Sprintf("user%d", n%uploaders), chunk, bytes.NewReader(data), nil); err != nil {
+				b.Error(err)
+				return
+			}
+			// 同じチャンクを次に送ったときも書き込まれるよう、受信済みから外す。
+			u, release, _ := um.acquire(id)
+			u.chunks[chunk/8] &^= 1 << (chunk % 8)
+			release()
+		}
+	})
+}
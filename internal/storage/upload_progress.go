@@ -0,0 +1,140 @@
+// Package storage はファイルストレージ管理機能を提供します。
+// このファイルはアップロードセッションの開始・進捗・中止の通知を含みます。
+package storage
+
+import (
+	"io"
+	"log/slog"
+
+	"fileserver/internal/models"
+)
+
+// アップロードの進捗通知の状態です。
+const (
+	UploadStarted   = "started"
+	UploadProgress  = "progress"
+	UploadCompleted = "completed"
+	UploadFailed    = "failed"
+	UploadCancelled = "cancelled"
+)
+
+// アップロードを中止した理由です（UploadCancelled の Reason）。
+const (
+	CancelByOwner = "cancelled" // 所有者が中止した
+	CancelByAdmin = "aborted"   // 管理者が中止した
+	CancelExpired = "expired"   // 有効期限が切れた
+	CancelPurged  = "purged"    // 管理者が停滞したセッションを一括削除した
+)
+
+// progressStep は受信の進捗を通知する間隔（%）です。
+const progressStep = 5
+
+// progressQueueSize は通知の送り先へ渡す前に溜めておける件数です。
+// 送り先が詰まっていても受信やロックを止めないよう、溢れた通知は捨てます。
+const progressQueueSize = 256
+
+// UploadEvent はアップロードセッションの開始・進捗・終了の通知です。
+type UploadEvent struct {
+	UploadID     string `json:"upload_id"`
+	UserID       string `json:"user_id"`
+	Directory    string `json:"directory"`
+	Filename     string `json:"filename"`
+	State        string `json:"state"`
+	Reason       string `json:"reason,omitempty"` // 中止した理由（cancelled のみ）
+	TotalSize    int64  `json:"total_size"`
+	ReceivedSize int64  `json:"received_size"`
+	Percent      int    `json:"percent"`
+}
+
+// NewUploadEvent は session の received バイトまで受信した時点の通知を作ります。
+func NewUploadEvent(session *models.UploadSession, state string, received int64) UploadEvent {
+	return UploadEvent{
+		UploadID:     session.UploadID,
+		UserID:       session.UserID,
+		Directory:    session.Directory,
+		Filename:     session.Filename,
+		State:        state,
+		TotalSize:    session.TotalSize,
+		ReceivedSize: received,
+		Percent:      percentOf(received, session.TotalSize),
+	}
+}
+
+// percentOf は received が total の何%かを切り捨てで返します（0バイトのファイルは100%）。
+func percentOf(received, total int64) int {
+	if total <= 0 {
+		return 100
+	}
+	return int(received * 100 / total)
+}
+
+// SetProgressNotifier はアップロードの開始・進捗（progressStep %ごと）・中止を受け取る関数を設定し、配送を開始します。
+// notify は受信やロックとは別のゴルーチンから、発生順に呼ばれます。完了（completed / failed）は
+// 種類の判定・スキャンを行う呼び出し側が通知します。
+func (um *UploadManager) SetProgressNotifier(notify func(UploadEvent)) {
+	um.progress = make(chan UploadEvent, progressQueueSize)
+	go func() {
+		for event := range um.progress {
+			notify(event)
+		}
+	}()
+}
+
+// notify は通知を配送待ちに積みます。ロックを持ったまま呼べるよう、待たずに戻ります。
+func (um *UploadManager) notify(event UploadEvent) {
+	if um.progress == nil {
+		return
+	}
+	select {
+	case um.progress <- event:
+	default:
+		slog.Warn("アップロードの進捗通知が溢れたため捨てました", "upload_id", event.UploadID, "state", event.State)
+	}
+}
+
+// notifyCancelled はセッションを中止したことを通知します。
+func (um *UploadManager) notifyCancelled(u *activeUpload, reason string) {
+	event := NewUploadEvent(u.session, UploadCancelled, u.receivedBytes())
+	event.Reason = reason
+	um.notify(event)
+}
+
+// reportProgress は received バイトまで受信したことを、前回の通知から progressStep %以上進んだ場合にだけ通知します。
+// 同じセッションの複数チャンクが並行に届いても同じ段階を二度通知しないよう、段階は比較交換で進めます。
+// 参照するセッションの項目は作成後に変わらないため、ロックを持たずに呼べます。
+func (um *UploadManager) reportProgress(u *activeUpload, received int64) {
+	step := int32(percentOf(received, u.session.TotalSize) / progressStep * progressStep)
+	for {
+		last := u.reported.Load()
+		if step <= last {
+			return
+		}
+		if u.reported.CompareAndSwap(last, step) {
+			um.notify(NewUploadEvent(u.session, UploadProgress, received))
+			return
+		}
+	}
+}
+
+// resetProgress は受信済みのデータを破棄した場合に、通知済みの段階を received まで戻します。
+func (u *activeUpload) resetProgress(received int64) {
+	u.reported.Store(int32(percentOf(received, u.session.TotalSize) / progressStep * progressStep))
+}
+
+// progressReader は tus の1回の PATCH の途中でも進捗を通知できるよう、読み取ったバイト数を数えます。
+type progressReader struct {
+	r      io.Reader
+	um     *UploadManager
+	u      *activeUpload
+	offset int64 // 読み始めた位置
+	n      int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if n > 0 {
+		p.um.reportProgress(p.u, p.offset+p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// drainEvents は配送待ちの通知をすべて取り出します。
+func drainEvents(um *UploadManager) []UploadEvent {
+	var events []UploadEvent
+	for {
+		select {
+		case e := <-um.progress:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// 進捗は progressStep %ごとに一度だけ通知され、中止は理由付きで通知されること。
+func TestChunkUploadProgressEvents(t *testing.T) {
+	um := newTestUploadManager(t)
+	um.progress = make(chan UploadEvent, progressQueueSize)
+
+	s, err := um.CreateUploadSession("alice", "video.mkv", "public", 40, 1, 40, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 40 {
+		if err := um.SaveChunk(s.UploadID, "alice", i, strings.NewReader("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 再送されたチャンクでは通知しない。
+	if err := um.SaveChunk(s.UploadID, "alice", 39, strings.NewReader("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.CancelUpload(s.UploadID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := drainEvents(um)
+	if len(events) != 22 {
+		t.Fatalf("通知の件数 = %d, want 22（開始 + 20段階 + 中止）", len(events))
+	}
+	if e := events[0]; e.State != UploadStarted || e.Filename != "video.mkv" || e.Percent != 0 {
+		t.Errorf("開始の通知 = %+v", e)
+	}
+	for i, e := range events[1:21] {
+		if e.State != UploadProgress || e.Percent != (i+1)*progressStep {
+			t.Errorf("進捗の通知[%d] = %+v", i, e)
+		}
+	}
+	if e := events[21]; e.State != UploadCancelled || e.Reason != CancelByOwner || e.ReceivedSize != 40 {
+		t.Errorf("中止の通知 = %+v", e)
+	}
+}
+
+// tus は1回の書き込みの途中でも進捗を通知し、受け入れなかった書き込みの後は段階を戻すこと。
+func TestWriteStreamProgressEvents(t *testing.T) {
+	um := newTestUploadManager(t)
+	um.progress = make(chan UploadEvent, progressQueueSize)
+
+	s, err := um.CreateStreamSession("alice", "a.bin", "public", 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := iotest.OneByteReader(strings.NewReader(strings.Repeat("x", 50)))
+	if _, err := um.WriteStream(s.UploadID, "alice", 0, body, func() error { return errors.New("不一致") }); err == nil {
+		t.Fatal("検証の失敗が返らない")
+	}
+	if n := len(drainEvents(um)); n != 11 {
+		t.Errorf("通知の件数 = %d, want 11（開始 + 10段階）", n)
+	}
+
+	body = iotest.OneByteReader(strings.NewReader(strings.Repeat("x", 50)))
+	if _, err := um.WriteStream(s.UploadID, "alice", 0, body, nil); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(um)
+	if len(events) != 10 || events[0].Percent != 5 || events[9].Percent != 50 {
+		t.Errorf("書き直した後の通知 = %+v", events)
+	}
+}
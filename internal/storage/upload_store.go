@@ -0,0 +1,207 @@
+// Package storage はファイルストレージ管理機能を提供します。
+// このファイルはアップロードセッションの永続化（upload_sessions テーブル）と起動時の復元を扱います。
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fileserver/internal/models"
+)
+
+// chunkBitmap はチャンク番号ごとに1ビットで受信済みかを表します（チャンク i は i/8 バイト目の 1<<(i%8)）。
+type chunkBitmap []byte
+
+func newChunkBitmap(totalChunks int) chunkBitmap {
+	return make(chunkBitmap, (totalChunks+7)/8)
+}
+
+func (b chunkBitmap) has(i int) bool {
+	return i >= 0 && i/8 < len(b) && b[i/8]&(1<<(i%8)) != 0
+}
+
+func (b chunkBitmap) set(i int) {
+	b[i/8] |= 1 << (i % 8)
+}
+
+func (b chunkBitmap) clear() {
+	clear(b)
+}
+
+// count は受信済みのチャンク数を返します。
+func (b chunkBitmap) count() int {
+	n := 0
+	for _, v := range b {
+		n += bits.OnesCount8(v)
+	}
+	return n
+}
+
+// list は受信済みのチャンク番号を昇順で返します（API応答用）。
+func (b chunkBitmap) list() []int {
+	chunks := make([]int, 0, b.count())
+	for i := range len(b) * 8 {
+		if b.has(i) {
+			chunks = append(chunks, i)
+		}
+	}
+	return chunks
+}
+
+// insertSession は新しいセッションを upload_sessions に登録します。
+func (um *UploadManager) insertSession(ctx context.Context, s *models.UploadSession, chunks chunkBitmap) error {
+	_, err := um.db.ExecContext(ctx, `
+		INSERT INTO upload_sessions (upload_id, user_id, filename, directory, protocol, file_sha256, on_conflict,
+			total_size, chunk_size, total_chunks, uploaded_chunks, uploaded_size, created_at, updated_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(upload_id) DO NOTHING`,
+		s.UploadID, s.UserID, s.Filename, s.Directory, s.Protocol, s.FileSHA256, s.OnConflict,
+		s.TotalSize, s.ChunkSize, s.TotalChunks, []byte(chunks), s.UploadedSize, s.CreatedAt, s.UpdatedAt, s.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("アップロードセッションの保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// saveProgress はセッションの受信状況を upload_sessions に反映します。
+// 呼び出し側はセッションのロック（または um.mu の書き込みロック）を保持している必要があります。
+func (um *UploadManager) saveProgress(u *activeUpload) error {
+	_, err := um.db.ExecContext(context.Background(), `
+		UPDATE upload_sessions SET uploaded_chunks = ?, uploaded_size = ?, updated_at = ? WHERE upload_id = ?`,
+		[]byte(u.chunks), u.session.UploadedSize, u.session.UpdatedAt, u.session.UploadID)
+	if err != nil {
+		return fmt.Errorf("アップロードセッションの更新に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// deleteSessionRow は upload_sessions からセッションを削除します。
+func (um *UploadManager) deleteSessionRow(uploadID string) {
+	if _, err := um.db.ExecContext(context.Background(), "DELETE FROM upload_sessions WHERE upload_id = ?", uploadID); err != nil {
+		slog.Error("アップロードセッションの削除に失敗しました", "upload_id", uploadID, "error", err)
+	}
+}
+
+// Restore は起動時に upload_sessions からセッションを復元し、ユーザーごとの同時アップロード数を数え直します。
+// 以前の版が各ディレクトリに残した .meta ファイルは先に取り込んで削除します。
+// 期限切れのセッションと、一時ファイルが失われたセッションは破棄します。
+func (um *UploadManager) Restore(ctx context.Context) error {
+	if err := um.migrateMetaFiles(ctx); err != nil {
+		return err
+	}
+
+	rows, err := um.db.QueryContext(ctx, `
+		SELECT upload_id, user_id, filename, directory, protocol, COALESCE(file_sha256, ''), on_conflict,
+			total_size, chunk_size, total_chunks, uploaded_chunks, uploaded_size, created_at, updated_at, expires_at
+		FROM upload_sessions`)
+	if err != nil {
+		return fmt.Errorf("アップロードセッションの読み込みに失敗しました: %w", err)
+	}
+	var restored []*activeUpload
+	for rows.Next() {
+		var (
+			s      models.UploadSession
+			chunks []byte
+		)
+		if err := rows.Scan(&s.UploadID, &s.UserID, &s.Filename, &s.Directory, &s.Protocol, &s.FileSHA256, &s.OnConflict,
+			&s.TotalSize, &s.ChunkSize, &s.TotalChunks, &chunks, &s.UploadedSize, &s.CreatedAt, &s.UpdatedAt, &s.ExpiresAt); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("アップロードセッションの読み取りに失敗しました: %w", err)
+		}
+		u := newActiveUpload(&s)
+		copy(u.chunks, chunks)
+		restored = append(restored, u)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	now := time.Now()
+	for _, u := range restored {
+		s := u.session
+		um.sessions[s.UploadID] = u
+		um.userUploads[s.UserID]++
+
+		info, statErr := os.Stat(um.getTempFilePath(s.UploadID, s.Filename, s.Directory))
+		switch {
+		case now.After(s.ExpiresAt):
+			um.removeSession(s.UploadID, s)
+			slog.Info("期限切れセッションを削除しました", "upload_id", s.UploadID)
+		case statErr != nil:
+			um.removeSession(s.UploadID, s)
+			slog.Warn("一時ファイルが無いためアップロードセッションを破棄しました", "upload_id", s.UploadID, "error", statErr)
+		case s.Protocol == models.UploadProtocolTus && info.Size() < s.UploadedSize:
+			// 書き込んだはずのデータが残っていない（ディスクへ書き出される前に停止した等）場合は、
+			// 実際に残っている位置から再開させる。
+			s.UploadedSize = info.Size()
+			u.chunks.clear()
+			if err := um.saveProgress(u); err != nil {
+				slog.Error("アップロードセッションの補正に失敗しました", "upload_id", s.UploadID, "error", err)
+			}
+		}
+	}
+	slog.Info("アップロードセッションを復元しました", "count", len(um.sessions))
+	return nil
+}
+
+// migrateMetaFiles は以前の版が保存先ディレクトリに置いていた .meta ファイルを upload_sessions へ取り込み、削除します。
+// 取り込めないファイルは残し、期限が過ぎた時点で孤立ファイルとして掃除されます。
+func (um *UploadManager) migrateMetaFiles(ctx context.Context) error {
+	migrated := 0
+	for _, dir := range um.config.Directories() {
+		dirPath := filepath.Join(um.config.Storage.UploadPath, dir.Path)
+		err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || filepath.Ext(path) != ".meta" {
+				return nil
+			}
+			// #nosec G304,G122 - path はアプリ所有のアップロードディレクトリのみを走査する filepath.WalkDir 由来
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			var s models.UploadSession
+			// 同じ拡張子で登録された普通のファイルを取り込まないよう、セッションのファイル名の形か確かめる。
+			if json.Unmarshal(data, &s) != nil || s.UploadID == "" || !strings.HasPrefix(d.Name(), s.UploadID+"_") {
+				return nil
+			}
+
+			chunks := newChunkBitmap(s.TotalChunks)
+			for _, c := range s.UploadedChunks {
+				if c >= 0 && c < s.TotalChunks {
+					chunks.set(c)
+				}
+			}
+			if err := um.insertSession(ctx, &s, chunks); err != nil {
+				return err
+			}
+			// #nosec G122 - path はアプリ所有のアップロードディレクトリ内
+			if err := os.Remove(path); err != nil {
+				slog.Error(".meta ファイルの削除に失敗しました", "path", path, "error", err)
+			}
+			migrated++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf(".meta ファイルの移行に失敗しました: %w", err)
+		}
+	}
+	if migrated > 0 {
+		slog.Info(".meta ファイルのアップロードセッションを移行しました", "count", migrated)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fileserver/internal/models"
+)
+
+// 再起動後も受信済みチャンクと同時アップロード数が復元され、続きから完了できること。
+// 以前の版の .meta ファイルは取り込まれ、期限切れ・一時ファイルの無いセッションは破棄されること。
+func TestRestoreSessions(t *testing.T) {
+	um := newTestUploadManager(t)
+	um.config.Storage.MaxConcurrentUploads = 2
+	s, err := um.CreateUploadSession("alice", "a.txt", "public", 10, 5, 2, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.SaveChunk(s.UploadID, "alice", 1, strings.NewReader("world"), nil); err != nil {
+		t.Fatal(err)
+	}
+	gone, err := um.CreateUploadSession("bob", "b.txt", "public", 5, 5, 1, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(um.getTempFilePath(gone.UploadID, gone.Filename, gone.Directory)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 以前の版が残した .meta（受信済みチャンクは一覧で持っていた）と、期限切れのもの。
+	dir := filepath.Join(um.config.Storage.UploadPath, "public")
+	writeMeta := func(s models.UploadSession) {
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := filepath.Join(dir, s.UploadID+"_"+s.Filename)
+		if err := os.WriteFile(base+".meta", data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(base+".temp", []byte("hello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeMeta(models.UploadSession{UploadID: "legacy", UserID: "alice", Filename: "c.txt", Directory: "public",
+		TotalSize: 10, ChunkSize: 5, TotalChunks: 2, UploadedChunks: []int{0}, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	writeMeta(models.UploadSession{UploadID: "expired", UserID: "carol", Filename: "d.txt", Directory: "public",
+		TotalSize: 5, ChunkSize: 5, TotalChunks: 1, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(-time.Hour)})
+
+	restarted := &UploadManager{
+		config:      um.config,
+		db:          um.db,
+		sessions:    make(map[string]*activeUpload),
+		userUploads: make(map[string]int),
+	}
+	if err := restarted.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks, err := restarted.GetUploadedChunks(s.UploadID); err != nil || len(chunks) != 1 || chunks[0] != 1 {
+		t.Errorf("復元したチャンク = %v, err = %v", chunks, err)
+	}
+	if chunks, err := restarted.GetUploadedChunks("legacy"); err != nil || len(chunks) != 1 || chunks[0] != 0 {
+		t.Errorf(".meta から移行したチャンク = %v, err = %v", chunks, err)
+	}
+	for _, id := range []string{gone.UploadID, "expired"} {
+		if _, err := restarted.GetUploadSession(id); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s が破棄されていない: err = %v", id, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.meta")); len(matches) != 0 {
+		t.Errorf(".meta が残っている: %v", matches)
+	}
+	if got := len(restarted.GetAllUploadSessions()); got != 2 {
+		t.Errorf("復元したセッション数 = %d, want 2", got)
+	}
+	if _, err := restarted.CreateUploadSession("alice", "e.txt", "public", 5, 5, 1, "", ""); !errors.Is(err, ErrMaxConcurrentUploads) {
+		t.Errorf("復元後の同時アップロード数が数えられていない: err = %v", err)
+	}
+
+	if err := restarted.SaveChunk(s.UploadID, "alice", 0, strings.NewReader("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.CompleteUpload(s.UploadID, "alice", nil); err != nil {
+		t.Errorf("再開したアップロードの完了で err = %v", err)
+	}
+}
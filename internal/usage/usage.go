@@ -0,0 +1,385 @@
+// Package usage はストレージ使用量（バイト数・ファイル数）の集計を提供します。
+// トップレベルディレクトリ・user_private の個人フォルダ・アップロード者の3つの単位で、
+// アップロード/削除のたびに増分で更新し、必要に応じてファイルシステムから全数再集計します。
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/storage"
+)
+
+// 集計の単位（storage_usage.scope の値）。
+const (
+	// ScopeDirectory はトップレベルディレクトリ単位の集計です（key はディレクトリ名）。
+	ScopeDirectory = "directory"
+	// ScopeUserPrivate は user_private 配下の個人フォルダ単位の集計です（key はフォルダ名）。
+	ScopeUserPrivate = "user_private"
+	// ScopeUploader はアップロード者単位の集計です（key はユーザーID。不明は空文字）。
+	ScopeUploader = "uploader"
+)
+
+// Entry は集計1件分の値です。
+type Entry struct {
+	Scope string `json:"scope"`
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"` // アップロード者の表示名（ScopeUploader のみ）
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+// Report は管理者向けの使用量レポートです。
+type Report struct {
+	UpdatedAt   time.Time `json:"updated_at"`
+	Directories []Entry   `json:"directories"`
+	UserPrivate []Entry   `json:"user_private"`
+	Uploaders   []Entry   `json:"uploaders"`
+	TotalBytes  int64     `json:"total_bytes"`
+	TotalFiles  int64     `json:"total_files"`
+	Recounting  bool      `json:"recounting"` // 再集計の実行中か
+}
+
+// HistoryPoint は日次スナップショット1点分の値です。
+type HistoryPoint struct {
+	Date  string `json:"date"` // YYYY-MM-DD
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+}
+
+// Tracker は使用量の増分更新・再集計・スナップショットを担います。
+// storage.UsageRecorder インターフェースを満たします。
+type Tracker struct {
+	config *config.Config
+	db     *sql.DB
+
+	// recountMu は再集計の多重実行を防ぎます。
+	recountMu sync.Mutex
+	// recounting は再集計の実行中に真になります（管理画面の表示用）。
+	recounting atomic.Bool
+
+	// mu は増分更新と再集計結果の差し替えを直列化し、pending を守ります。
+	mu sync.Mutex
+	// pending は再集計の走査中（nil 以外）に届いたファイルごとの最後の増減です（キーは "directory/filename"）。
+	// 走査がそのファイルに届く前か後かで取りこぼし・二重計上が起きないよう、差し替え時にこれで補正します。
+	pending map[string]fileChange
+
+	// visit はテストで走査の途中にファイルを変更するためのフックです（nil なら何もしない）。
+	visit func(rel string)
+}
+
+// fileChange は1ファイル分の集計への寄与です。present が偽なら削除（寄与なし）を表します。
+type fileChange struct {
+	directory  string
+	uploaderID string
+	size       int64
+	present    bool
+}
+
+// NewTracker は Tracker を作成します。
+func NewTracker(cfg *config.Config, db *sql.DB) *Tracker {
+	return &Tracker{config: cfg, db: db}
+}
+
+// RecordAdd はファイル1件の追加を集計へ反映します。
+// 集計の失敗はアップロード自体を失敗させないため、ログのみ残します（再集計で復旧できる）。
+func (t *Tracker) RecordAdd(directory, filename, uploaderID string, size int64) {
+	t.record(directory, filename, fileChange{directory: directory, uploaderID: uploaderID, size: size, present: true})
+}
+
+// RecordRemove はファイル1件の削除を集計へ反映します。
+func (t *Tracker) RecordRemove(directory, filename, uploaderID string, size int64) {
+	t.record(directory, filename, fileChange{directory: directory, uploaderID: uploaderID, size: size})
+}
+
+// record は増減を集計へ加算し、再集計の走査中であれば差し替え時の補正用に控えます。
+func (t *Tracker) record(directory, filename string, c fileChange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.present {
+		t.apply(c.directory, c.uploaderID, c.size, 1)
+	} else {
+		t.apply(c.directory, c.uploaderID, -c.size, -1)
+	}
+	if t.pending != nil {
+		t.pending[filepath.ToSlash(directory)+"/"+filename] = c
+	}
+}
+
+// apply は該当する全スコープへ差分を加算します。呼び出し側で mu を保持します。
+func (t *Tracker) apply(directory, uploaderID string, deltaBytes, deltaFiles int64) {
+	ctx := context.Background()
+	for _, k := range t.keysFor(directory, uploaderID) {
+		_, err := t.db.ExecContext(ctx, `
+			INSERT INTO storage_usage (scope, key, bytes, files, updated_at)
+			VALUES (?, ?, MAX(?, 0), MAX(?, 0), CURRENT_TIMESTAMP)
+			ON CONFLICT(scope, key) DO UPDATE SET
+				bytes = MAX(bytes + ?, 0),
+				files = MAX(files + ?, 0),
+				updated_at = CURRENT_TIMESTAMP
+		`, k.Scope, k.Key, deltaBytes, deltaFiles, deltaBytes, deltaFiles)
+		if err != nil {
+			slog.Warn("使用量の更新に失敗しました", "scope", k.Scope, "key", k.Key, "error", err)
+		}
+	}
+}
+
+// keysFor はディレクトリとアップロード者から、加算対象となる集計キーを求めます。
+func (t *Tracker) keysFor(directory, uploaderID string) []Entry {
+	top, userFolder := SplitDirectory(t.config, directory)
+	keys := []Entry{
+		{Scope: ScopeDirectory, Key: top},
+		{Scope: ScopeUploader, Key: uploaderID},
+	}
+	if userFolder != "" {
+		keys = append(keys, Entry{Scope: ScopeUserPrivate, Key: userFolder})
+	}
+	return keys
+}
+
+// SplitDirectory はディレクトリパスをトップレベル名と、user_private 配下であれば
+// 個人フォルダ名に分解します。user_private 以外では userFolder は空です。
+func SplitDirectory(cfg *config.Config, directory string) (top, userFolder string) {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(directory)), "/")
+	top = parts[0]
+	if len(parts) >= 2 {
+		if dc := cfg.GetDirectoryConfig(top); dc != nil && dc.Type == "user_private" {
+			userFolder = parts[1]
+		}
+	}
+	return top, userFolder
+}
+
+// Report は現在の集計値を返します。アップロード者には users テーブルの表示名を添えます。
+func (t *Tracker) Report(ctx context.Context) (*Report, error) {
+	rows, err := t.db.QueryContext(ctx, `
+		SELECT su.scope, su.key, COALESCE(u.username, ''), su.bytes, su.files, su.updated_at
+		FROM storage_usage su
+		LEFT JOIN users u ON su.scope = 'uploader' AND u.id = su.key
+		ORDER BY su.bytes DESC, su.key
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("使用量の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	report := &Report{
+		Directories: []Entry{},
+		UserPrivate: []Entry{},
+		Uploaders:   []Entry{},
+		Recounting:  t.Recounting(),
+	}
+	for rows.Next() {
+		var e Entry
+		var updatedAt time.Time
+		if err := rows.Scan(&e.Scope, &e.Key, &e.Name, &e.Bytes, &e.Files, &updatedAt); err != nil {
+			return nil, fmt.Errorf("使用量の読み取りに失敗しました: %w", err)
+		}
+		if updatedAt.After(report.UpdatedAt) {
+			report.UpdatedAt = updatedAt
+		}
+		switch e.Scope {
+		case ScopeDirectory:
+			report.Directories = append(report.Directories, e)
+			report.TotalBytes += e.Bytes
+			report.TotalFiles += e.Files
+		case ScopeUserPrivate:
+			report.UserPrivate = append(report.UserPrivate, e)
+		case ScopeUploader:
+			report.Uploaders = append(report.Uploaders, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("使用量の読み取りに失敗しました: %w", err)
+	}
+	return report, nil
+}
+
+// Recount はファイルシステムを走査して集計を作り直します。
+// 増分更新の取りこぼし（API外でのファイル追加・削除、更新失敗）を解消するためのもので、
+// アップロード者は file_metadata から引きます（記録の無いファイルは不明扱い）。
+// 走査はロックを持たずに行い、その間に届いた増減はファイルごとに控えておき、
+// 差し替え時にそのファイルの走査結果を最後の増減で置き換えます。
+func (t *Tracker) Recount(ctx context.Context) error {
+	t.recountMu.Lock()
+	defer t.recountMu.Unlock()
+	t.recounting.Store(true)
+	defer t.recounting.Store(false)
+
+	t.mu.Lock()
+	t.pending = make(map[string]fileChange)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.pending = nil
+		t.mu.Unlock()
+	}()
+
+	uploaders, err := t.loadUploaders(ctx)
+	if err != nil {
+		return err
+	}
+
+	totals := make(map[Entry]*Entry)
+	add := func(c fileChange, sign int64) {
+		for _, k := range t.keysFor(c.directory, c.uploaderID) {
+			e, ok := totals[k]
+			if !ok {
+				e = &Entry{Scope: k.Scope, Key: k.Key}
+				totals[k] = e
+			}
+			e.Bytes += sign * c.size
+			e.Files += sign
+		}
+	}
+	walked := make(map[string]fileChange)
+
+	for _, dir := range t.config.Directories() {
+		root := filepath.Join(t.config.Storage.UploadPath, dir.Path)
+		// 空のディレクトリも0件として一覧に出すため、先に枠を作っておく。
+		totals[Entry{Scope: ScopeDirectory, Key: dir.Path}] = &Entry{Scope: ScopeDirectory, Key: dir.Path}
+
+		walkErr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || storage.IsWorkFile(d.Name()) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(t.config.Storage.UploadPath, filepath.Dir(path))
+			if err != nil {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+			key := rel + "/" + d.Name()
+			c := fileChange{directory: rel, uploaderID: uploaders[key], size: info.Size(), present: true}
+			walked[key] = c
+			add(c, 1)
+			if t.visit != nil {
+				t.visit(key)
+			}
+			return nil
+		})
+		if walkErr != nil {
+			return fmt.Errorf("ディレクトリ '%s' の走査に失敗しました: %w", dir.Path, walkErr)
+		}
+	}
+
+	// ここから差し替えまで増分更新を止め、走査中の増減で補正する。
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.pending {
+		if w, ok := walked[key]; ok {
+			add(w, -1)
+		}
+		if c.present {
+			add(c, 1)
+		}
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }() //nolint:errcheck // Commit後のRollbackは常にErrTxDoneで無害
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM storage_usage"); err != nil {
+		return fmt.Errorf("使用量のクリアに失敗しました: %w", err)
+	}
+	for _, e := range totals {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO storage_usage (scope, key, bytes, files, updated_at)
+			VALUES (?, ?, MAX(?, 0), MAX(?, 0), CURRENT_TIMESTAMP)
+		`, e.Scope, e.Key, e.Bytes, e.Files); err != nil {
+			return fmt.Errorf("使用量の書き込みに失敗しました: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("使用量のコミットに失敗しました: %w", err)
+	}
+	return nil
+}
+
+// Recounting は再集計を実行中かを返します。
+func (t *Tracker) Recounting() bool {
+	return t.recounting.Load()
+}
+
+// loadUploaders は "directory/filename" → uploader_id の対応を読み込みます。
+func (t *Tracker) loadUploaders(ctx context.Context) (map[string]string, error) {
+	rows, err := t.db.QueryContext(ctx,
+		"SELECT directory, filename, COALESCE(uploader_id, '') FROM file_metadata")
+	if err != nil {
+		return nil, fmt.Errorf("メタデータの取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	result := make(map[string]string)
+	for rows.Next() {
+		var dir, name, uploader string
+		if err := rows.Scan(&dir, &name, &uploader); err != nil {
+			return nil, fmt.Errorf("メタデータの読み取りに失敗しました: %w", err)
+		}
+		result[filepath.ToSlash(dir)+"/"+name] = uploader
+	}
+	return result, rows.Err()
+}
+
+// Snapshot は現在の集計値を当日分の履歴として保存します（同日内は上書き）。
+// 増加傾向のグラフ表示に使うため、定期的に呼び出します。
+func (t *Tracker) Snapshot(ctx context.Context) error {
+	date := time.Now().Format(time.DateOnly)
+	_, err := t.db.ExecContext(ctx, `
+		INSERT INTO storage_usage_history (date, scope, key, bytes, files)
+		SELECT ?, scope, key, bytes, files FROM storage_usage WHERE true
+		ON CONFLICT(date, scope, key) DO UPDATE SET
+			bytes = excluded.bytes,
+			files = excluded.files
+	`, date)
+	if err != nil {
+		return fmt.Errorf("使用量スナップショットの保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// History は指定スコープの日次推移を直近 days 日分返します（古い順）。
+func (t *Tracker) History(ctx context.Context, scope string, days int) ([]HistoryPoint, error) {
+	since := time.Now().AddDate(0, 0, -days).Format(time.DateOnly)
+	rows, err := t.db.QueryContext(ctx, `
+		SELECT date, key, bytes, files FROM storage_usage_history
+		WHERE scope = ? AND date > ?
+		ORDER BY date, key
+	`, scope, since)
+	if err != nil {
+		return nil, fmt.Errorf("使用量履歴の取得に失敗しました: %w", err)
+	}
+	defer func() { _ = rows.Close() }() //nolint:errcheck // 読み取り専用クエリのclose失敗は結果に影響しない
+
+	points := make([]HistoryPoint, 0)
+	for rows.Next() {
+		var p HistoryPoint
+		if err := rows.Scan(&p.Date, &p.Key, &p.Bytes, &p.Files); err != nil {
+			return nil, fmt.Errorf("使用量履歴の読み取りに失敗しました: %w", err)
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,203 @@
+package usage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+)
+
+func newTestTracker(t *testing.T) (*Tracker, *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath: filepath.Join(dir, "uploads"),
+		Directories: []config.DirectoryConfig{
+			{Path: "user", Type: "user_private"},
+			{Path: "public"},
+		},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewTracker(cfg, db), cfg
+}
+
+func findEntry(entries []Entry, key string) (Entry, bool) {
+	for _, e := range entries {
+		if e.Key == key {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func TestSplitDirectory(t *testing.T) {
+	cfg := &config.Config{Storage: config.StorageConfig{Directories: []config.DirectoryConfig{
+		{Path: "user", Type: "user_private"},
+		{Path: "public"},
+	}}}
+	cases := []struct {
+		dir, top, folder string
+	}{
+		{"public", "public", ""},
+		{"public/sub/deep", "public", ""},
+		{"user", "user", ""},
+		{"user/alice", "user", "alice"},
+		{"user/alice/photos", "user", "alice"},
+	}
+	for _, c := range cases {
+		top, folder := SplitDirectory(cfg, c.dir)
+		if top != c.top || folder != c.folder {
+			t.Errorf("SplitDirectory(%q) = (%q, %q), want (%q, %q)", c.dir, top, folder, c.top, c.folder)
+		}
+	}
+}
+
+// 追加と削除が全スコープへ増分で反映され、負値にならないこと。
+func TestRecordAddRemove(t *testing.T) {
+	tr, _ := newTestTracker(t)
+	ctx := context.Background()
+
+	tr.RecordAdd("user/alice", "a.txt", "u1", 100)
+	tr.RecordAdd("user/alice/sub", "b.txt", "u1", 50)
+	tr.RecordAdd("public", "c.txt", "u2", 10)
+	tr.RecordRemove("public", "c.txt", "u2", 10)
+	tr.RecordRemove("public", "c.txt", "u2", 10) // 取りこぼしで過剰に引いても0で止まる
+
+	r, err := tr.Report(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := findEntry(r.Directories, "user"); e.Bytes != 150 || e.Files != 2 {
+		t.Errorf("user = %+v, want 150 bytes / 2 files", e)
+	}
+	if e, _ := findEntry(r.UserPrivate, "alice"); e.Bytes != 150 || e.Files != 2 {
+		t.Errorf("alice = %+v, want 150 bytes / 2 files", e)
+	}
+	if e, _ := findEntry(r.Directories, "public"); e.Bytes != 0 || e.Files != 0 {
+		t.Errorf("public = %+v, 負値にならず0であるべき", e)
+	}
+	if e, _ := findEntry(r.Uploaders, "u1"); e.Bytes != 150 {
+		t.Errorf("uploader u1 = %+v, want 150 bytes", e)
+	}
+	if r.TotalBytes != 150 || r.TotalFiles != 2 {
+		t.Errorf("total = %d/%d, want 150/2", r.TotalBytes, r.TotalFiles)
+	}
+}
+
+// 再集計は実ファイルから作り直し、作業ファイル（.temp/.meta）を数えないこと。
+func TestRecount(t *testing.T) {
+	tr, cfg := newTestTracker(t)
+	ctx := context.Background()
+
+	write := func(rel string, size int) {
+		p := filepath.Join(cfg.Storage.UploadPath, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("public/a.txt", 10)
+	write("public/sub/b.txt", 20)
+	write("public/x_upload.temp", 999)
+	write("public/x_upload.meta", 999)
+	write("user/bob/c.txt", 5)
+
+	tr.RecordAdd("public", "ghost.txt", "ghost", 12345) // 実体の無い増分は再集計で消える
+
+	if err := tr.Recount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tr.Report(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := findEntry(r.Directories, "public"); e.Bytes != 30 || e.Files != 2 {
+		t.Errorf("public = %+v, want 30 bytes / 2 files", e)
+	}
+	if e, _ := findEntry(r.UserPrivate, "bob"); e.Bytes != 5 || e.Files != 1 {
+		t.Errorf("bob = %+v, want 5 bytes / 1 file", e)
+	}
+	if _, ok := findEntry(r.Uploaders, "ghost"); ok {
+		t.Error("再集計後に実体の無いアップロード者が残っている")
+	}
+
+	if err := tr.Snapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	points, err := tr.History(ctx, ScopeDirectory, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("スナップショットはディレクトリ2件分あるべき: %+v", points)
+	}
+}
+
+// 走査中に届いた増減は、走査がそのファイルに届く前でも後でも取りこぼさず二重にも数えないこと。
+func TestRecountWithConcurrentChanges(t *testing.T) {
+	tr, cfg := newTestTracker(t)
+	ctx := context.Background()
+
+	write := func(rel string, size int) {
+		p := filepath.Join(cfg.Storage.UploadPath, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("public/a.txt", 10)
+	write("public/m.txt", 20)
+	write("public/sub/.keep", 0)
+
+	tr.visit = func(rel string) {
+		if rel != "public/m.txt" {
+			return
+		}
+		// 走査済みのファイルの削除
+		if err := os.Remove(filepath.Join(cfg.Storage.UploadPath, "public/a.txt")); err != nil {
+			t.Fatal(err)
+		}
+		tr.RecordRemove("public", "a.txt", "", 10)
+		// 一覧を読み終えたディレクトリへの追加（走査には現れない）
+		write("public/b.txt", 5)
+		tr.RecordAdd("public", "b.txt", "u1", 5)
+		// まだ読んでいないディレクトリへの追加（走査にも現れる）
+		write("public/sub/n.txt", 100)
+		tr.RecordAdd("public/sub", "n.txt", "u1", 100)
+	}
+	if err := tr.Recount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tr.visit = nil
+
+	r, err := tr.Report(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := findEntry(r.Directories, "public"); e.Bytes != 125 || e.Files != 4 {
+		t.Errorf("public = %+v, want 125 bytes / 4 files", e)
+	}
+	if e, _ := findEntry(r.Uploaders, "u1"); e.Bytes != 105 || e.Files != 2 {
+		t.Errorf("u1 = %+v, want 105 bytes / 2 files", e)
+	}
+
+	// 再集計の後の増分更新は通常どおり反映される。
+	tr.RecordRemove("public", "m.txt", "", 20)
+	if r, err = tr.Report(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := findEntry(r.Directories, "public"); e.Bytes != 105 || e.Files != 3 {
+		t.Errorf("再集計後の削除: public = %+v, want 105 bytes / 3 files", e)
+	}
+}
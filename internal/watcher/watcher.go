@@ -0,0 +1,247 @@
+// Package watcher はAPIを経由せずアップロード先へ置かれたファイル
+// （rsync・NAS共有からのコピー等）を検出し、file_metadata へ登録します。
+// Linux では inotify で変化を即時に拾い、それ以外の環境や inotify を使えない
+// ファイルシステムでは定期走査（ポーリング）で検出します。
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/models"
+	"fileserver/internal/storage"
+)
+
+const (
+	// settleTime は最終更新からこの時間が経つまでファイルを登録しない猶予です。
+	// コピー途中のファイルを不完全な内容のままハッシュ化・通知しないためのものです。
+	settleTime = 5 * time.Second
+	// debounceTime は inotify のイベントが続く間、走査をまとめて遅らせる時間です。
+	debounceTime = 2 * time.Second
+)
+
+// IndexedFunc は新しいファイルを登録した際に呼ばれるコールバックです。
+// directory はアップロードディレクトリからの相対パスです。
+// announce は起動時の走査では false、以降の走査で見つけたファイルでは true です（通知の要否に使う）。
+type IndexedFunc func(directory, filename string, size int64, announce bool)
+
+// notifier はディレクトリの変化を通知する仕組み（inotify）の抽象です。
+// Events には変化のあったディレクトリの絶対パスが流れます。
+type notifier interface {
+	Events() <-chan string
+	Close() error
+}
+
+// Watcher は watch: true のディレクトリを監視し、未登録ファイルを登録します。
+type Watcher struct {
+	config    *config.Config
+	storage   *storage.Manager
+	onIndexed IndexedFunc
+	roots     []string // 監視対象のディレクトリ（アップロードディレクトリからの相対パス）
+	ready     chan struct{}
+}
+
+// New は Watcher を作成します。onIndexed は起動時の走査を含め、登録のたびに呼ばれます（nil可）。
+func New(cfg *config.Config, sm *storage.Manager, onIndexed IndexedFunc) *Watcher {
+	roots := make([]string, 0)
+	for _, d := range cfg.WatchedDirectories() {
+		roots = append(roots, d.Path)
+	}
+	w := &Watcher{
+		config:    cfg,
+		storage:   sm,
+		onIndexed: onIndexed,
+		roots:     roots,
+		ready:     make(chan struct{}),
+	}
+	if !w.Enabled() {
+		close(w.ready)
+	}
+	return w
+}
+
+// Enabled は監視対象のディレクトリが1つ以上あるかを返します。
+func (w *Watcher) Enabled() bool {
+	return len(w.roots) > 0
+}
+
+// Ready は起動時の走査（既存ファイルの登録）が終わると閉じるチャネルを返します。
+// 監視対象が無い場合は最初から閉じています。
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Run は ctx が終了するまで監視を続けます。
+// 起動直後の走査は既存ファイルの登録のみ行い、通知はしません（起動のたびに
+// 過去のファイルがアップロードとして一斉に通知されるのを避けるため）。
+func (w *Watcher) Run(ctx context.Context) {
+	if !w.Enabled() {
+		return
+	}
+
+	w.scanAll(false)
+	close(w.ready)
+
+	var events <-chan string
+	absRoots := make([]string, 0, len(w.roots))
+	for _, r := range w.roots {
+		absRoots = append(absRoots, filepath.Join(w.config.Storage.UploadPath, r))
+	}
+	if n, err := newNotifier(absRoots); err != nil {
+		slog.Info("inotifyを利用できないため定期走査のみで監視します", "interval", w.config.Storage.WatchPollInterval, "reason", err)
+	} else {
+		defer func() {
+			if err := n.Close(); err != nil {
+				slog.Error("inotifyのクローズに失敗しました", "error", err)
+			}
+		}()
+		events = n.Events()
+		slog.Info("ディレクトリの監視を開始しました（inotify）", "directories", w.roots)
+	}
+
+	poll := time.NewTicker(w.config.Storage.WatchPollInterval)
+	defer poll.Stop()
+
+	// 走査は inotify のイベントが落ち着いてから、変化のあったディレクトリだけ行う。
+	dirty := make(map[string]bool)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-poll.C:
+			if w.scanAll(true) {
+				timer.Reset(settleTime)
+			}
+
+		case dir, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			dirty[dir] = true
+			timer.Reset(debounceTime)
+
+		case <-timer.C:
+			pending := false
+			for dir := range dirty {
+				if w.scanDir(dir, true) {
+					pending = true
+				}
+				delete(dirty, dir)
+			}
+			// 書き込み中で見送ったファイルがあれば、落ち着いた頃に取り直す。
+			if pending {
+				for _, r := range w.roots {
+					dirty[filepath.Join(w.config.Storage.UploadPath, r)] = true
+				}
+				timer.Reset(settleTime)
+			}
+		}
+	}
+}
+
+// scanAll は全監視対象を走査します。書き込み中で見送ったファイルがあれば true を返します。
+func (w *Watcher) scanAll(announce bool) bool {
+	pending := false
+	for _, r := range w.roots {
+		if w.scanDir(filepath.Join(w.config.Storage.UploadPath, r), announce) {
+			pending = true
+		}
+	}
+	return pending
+}
+
+// scanDir は absDir 配下を再帰的に走査し、未登録のファイルを登録します。
+// announce は登録ごとに onIndexed へ渡します。
+// 書き込み中で見送ったファイルがあれば true を返します。
+func (w *Watcher) scanDir(absDir string, announce bool) bool {
+	pending := false
+	indexed := make(map[string]map[string]bool)
+
+	err := filepath.WalkDir(absDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			// rsync等の隠しディレクトリ（作業用）は辿らない。
+			if path != absDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || skipFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.config.Storage.UploadPath, filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		directory := filepath.ToSlash(rel)
+
+		names, ok := indexed[directory]
+		if !ok {
+			names, err = w.storage.IndexedFilenames(directory)
+			if err != nil {
+				return err
+			}
+			indexed[directory] = names
+		}
+		if names[d.Name()] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if time.Since(info.ModTime()) < settleTime {
+			pending = true
+			return nil
+		}
+
+		if err := w.index(directory, d.Name(), info.Size(), announce); err != nil {
+			slog.Warn("外部から置かれたファイルの登録に失敗しました", "directory", directory, "filename", d.Name(), "error", err)
+			return nil
+		}
+		names[d.Name()] = true
+		return nil
+	})
+	if err != nil {
+		slog.Error("監視ディレクトリの走査に失敗しました", "path", absDir, "error", err)
+	}
+	return pending
+}
+
+// index はファイルを登録（ハッシュ計算を含む）し、onIndexed を呼びます。
+func (w *Watcher) index(directory, filename string, size int64, announce bool) error {
+	if err := w.storage.SaveFileMetadata(directory, filename, "", models.SystemUsername); err != nil {
+		return fmt.Errorf("メタデータの保存に失敗しました: %w", err)
+	}
+	slog.Info("外部から置かれたファイルを登録しました", "directory", directory, "filename", filename, "size", size)
+	if w.onIndexed != nil {
+		w.onIndexed(directory, filename, size, announce)
+	}
+	return nil
+}
+
+// skipFile は登録対象外のファイルかを返します。
+// アップロード途中の作業ファイルと、rsync等がコピー中に使う隠しファイルを除外します。
+func skipFile(name string) bool {
+	return storage.IsWorkFile(name) || strings.HasPrefix(name, ".")
+}
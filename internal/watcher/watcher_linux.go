@@ -0,0 +1,150 @@
+//go:build linux
+
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask は書き込み完了・移動・作成のみを拾います。
+// IN_MODIFY はコピー中に大量に発生するため監視しません（完了は IN_CLOSE_WRITE で分かる）。
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+// inotifyNotifier は inotify によるディレクトリ変化の通知です。
+// watch はディレクトリ単位のため、配下のディレクトリにも個別に watch を張ります。
+type inotifyNotifier struct {
+	file   *os.File
+	paths  map[int]string // watch descriptor → 絶対パス（読み取りgoroutineのみが更新）
+	events chan string
+}
+
+// newNotifier は roots 配下を再帰的に監視する inotify を作成します。
+// NFS/SMB 等 inotify がリモートの変更を通知しないファイルシステムでも作成自体は成功するため、
+// Run は常に定期走査を併用します。
+func newNotifier(roots []string) (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotifyの初期化に失敗しました: %w", err)
+	}
+	n := &inotifyNotifier{
+		// 非ブロッキングのfdを渡すとランタイムのポーラーに載り、Close で Read が解除される。
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		paths:  make(map[int]string),
+		events: make(chan string, 64),
+	}
+	for _, root := range roots {
+		if err := os.MkdirAll(root, 0750); err != nil {
+			_ = n.file.Close()
+			return nil, fmt.Errorf("監視ディレクトリの作成に失敗しました: %w", err)
+		}
+		if err := n.addRecursive(fd, root); err != nil {
+			_ = n.file.Close()
+			return nil, err
+		}
+	}
+	go n.readLoop(fd)
+	return n, nil
+}
+
+// Events は変化のあったディレクトリの絶対パスを返すチャネルです。
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+// Close は inotify を閉じ、読み取りgoroutineを終了させます。
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
+
+// addRecursive は dir とその配下の（隠しでない）ディレクトリに watch を張ります。
+func (n *inotifyNotifier) addRecursive(fd int, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(fd, path, watchMask)
+		if err != nil {
+			return fmt.Errorf("inotifyの監視登録に失敗しました (%s): %w", path, err)
+		}
+		n.paths[wd] = path
+		return nil
+	})
+}
+
+// readLoop はイベントを読み取り、変化のあったディレクトリを通知します。
+// 新しく作られた・移動してきたディレクトリには watch を追加し、
+// watch より先に中身が置かれた場合に備えてそのディレクトリ自体も通知します。
+func (n *inotifyNotifier) readLoop(fd int) {
+	defer close(n.events)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= size; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset])) // #nosec G103 -- カーネルが返すinotify_event構造体の読み取り
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(ev.Len)
+			offset = nameEnd
+			if nameEnd > size {
+				break
+			}
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				// 取りこぼしがあったため全監視対象を走査させる。
+				for _, p := range n.paths {
+					n.send(p)
+				}
+				continue
+			}
+
+			dir, ok := n.paths[int(ev.Wd)]
+			if !ok {
+				continue
+			}
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(n.paths, int(ev.Wd))
+				continue
+			}
+			name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+
+			if ev.Mask&unix.IN_ISDIR != 0 && name != "" && !strings.HasPrefix(name, ".") {
+				sub := filepath.Join(dir, name)
+				if err := n.addRecursive(fd, sub); err != nil {
+					slog.Warn("新しいディレクトリの監視登録に失敗しました", "path", sub, "error", err)
+				}
+				n.send(sub)
+				continue
+			}
+			n.send(dir)
+		}
+	}
+}
+
+// send はイベントを通知します。受け手が詰まっている場合は捨てます
+// （次の定期走査で拾えるため、読み取りを止めてカーネル側のキューを溢れさせない方を優先する）。
+func (n *inotifyNotifier) send(dir string) {
+	select {
+	case n.events <- dir:
+	default:
+	}
+}
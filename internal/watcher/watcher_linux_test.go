@@ -0,0 +1,46 @@
+//go:build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 監視開始後に作られたサブディレクトリ内の書き込みも通知されること。
+func TestInotifyNotifierRecursive(t *testing.T) {
+	root := t.TempDir()
+	n, err := newNotifier([]string{root})
+	if err != nil {
+		t.Skipf("inotifyを利用できない環境: %v", err)
+	}
+	defer n.Close()
+
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0750); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, n, sub)
+
+	if err := os.WriteFile(filepath.Join(sub, "a.txt"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, n, sub)
+}
+
+func waitEvent(t *testing.T, n notifier, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case dir := <-n.Events():
+			if dir == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s のイベントが届かない", want)
+		}
+	}
+}
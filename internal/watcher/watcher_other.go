@@ -0,0 +1,10 @@
+//go:build !linux
+
+package watcher
+
+import "errors"
+
+// newNotifier は Linux 以外では利用できないため、常に定期走査へフォールバックさせます。
+func newNotifier(_ []string) (notifier, error) {
+	return nil, errors.New("inotifyはLinuxでのみ利用できます")
+}
@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fileserver/internal/config"
+	"fileserver/internal/database"
+	"fileserver/internal/storage"
+)
+
+func newTestWatcher(t *testing.T, onIndexed IndexedFunc) (*Watcher, *storage.Manager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{
+		UploadPath:        filepath.Join(dir, "uploads"),
+		WatchPollInterval: time.Minute,
+		Directories: []config.DirectoryConfig{
+			{Path: "nas", Watch: true},
+			{Path: "public"},
+		},
+	}}
+	db, err := database.Initialize(filepath.Join(dir, "test.db"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sm := storage.NewManager(cfg, db)
+	return New(cfg, sm, onIndexed), sm, cfg.Storage.UploadPath
+}
+
+// writeFile はファイルを作成し、settled なら書き込み完了済みに見えるよう更新時刻を過去へずらす。
+func writeFile(t *testing.T, path string, settled bool) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if settled {
+		old := time.Now().Add(-time.Minute)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchedDirectoriesOnly(t *testing.T) {
+	w, _, _ := newTestWatcher(t, nil)
+	if len(w.roots) != 1 || w.roots[0] != "nas" {
+		t.Errorf("roots = %v, want [nas]", w.roots)
+	}
+}
+
+// 起動時の走査は通知せずに登録し（コールバックは呼ぶ）、以降の走査では新規ファイルだけを通知すること。
+func TestScanIndexesNewFiles(t *testing.T) {
+	var indexed, announced []string
+	w, sm, root := newTestWatcher(t, func(directory, filename string, _ int64, announce bool) {
+		indexed = append(indexed, directory+"/"+filename)
+		if announce {
+			announced = append(announced, directory+"/"+filename)
+		}
+	})
+
+	writeFile(t, filepath.Join(root, "nas", "old.txt"), true)
+	if w.scanAll(false) {
+		t.Error("書き込み中のファイルは無いはず")
+	}
+	if len(announced) != 0 {
+		t.Errorf("起動時の走査で通知された: %v", announced)
+	}
+	// 起動時に登録したファイルもスキャンできるよう、コールバックは呼ばれる。
+	if len(indexed) != 1 || indexed[0] != "nas/old.txt" {
+		t.Errorf("起動時の走査で登録したファイル = %v, want [nas/old.txt]", indexed)
+	}
+
+	writeFile(t, filepath.Join(root, "nas", "sub", "new.txt"), true)
+	w.scanAll(true)
+	if len(announced) != 1 || announced[0] != "nas/sub/new.txt" {
+		t.Errorf("announced = %v, want [nas/sub/new.txt]", announced)
+	}
+
+	uploader, hash, err := sm.GetFileMetadata("nas/sub", "new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploader != "system" || hash == "" {
+		t.Errorf("uploader=%q hash=%q, uploader=system かつハッシュ計算済みであるべき", uploader, hash)
+	}
+
+	// 2回目以降の走査で登録済みファイルを再通知しない。
+	w.scanAll(true)
+	if len(announced) != 1 {
+		t.Errorf("登録済みファイルが再通知された: %v", announced)
+	}
+}
+
+// 作業ファイル・隠しファイル・書き込み直後のファイルは登録しないこと。
+func TestScanSkipsWorkHiddenAndUnsettled(t *testing.T) {
+	var indexed, announced []string
+	w, _, root := newTestWatcher(t, func(directory, filename string, _ int64, announce bool) {
+		indexed = append(indexed, directory+"/"+filename)
+		if announce {
+			announced = append(announced, directory+"/"+filename)
+		}
+	})
+
+	writeFile(t, filepath.Join(root, "nas", "x_upload.temp"), true)
+	writeFile(t, filepath.Join(root, "nas", ".rsync-tmp"), true)
+	writeFile(t, filepath.Join(root, "nas", ".partial", "a.txt"), true)
+	writeFile(t, filepath.Join(root, "nas", "copying.bin"), false)
+	writeFile(t, filepath.Join(root, "public", "other.txt"), true)
+
+	if !w.scanAll(true) {
+		t.Error("書き込み直後のファイルがあるため再走査が必要なはず")
+	}
+	if len(indexed) != 0 || len(announced) != 0 {
+		t.Errorf("登録対象外のファイルが登録・通知された: %v, %v", indexed, announced)
+	}
+}
@@ -17,15 +17,25 @@ import (
 	// これにより zoneinfo を持たない distroless / DHI static 上でも TZ が解決できる。
 	_ "time/tzdata"
 
+	"fileserver/internal/allowance"
 	"fileserver/internal/authprovider"
+	"fileserver/internal/bandwidth"
 	"fileserver/internal/config"
 	"fileserver/internal/database"
+	"fileserver/internal/dirstore"
+	"fileserver/internal/fetcher"
 	"fileserver/internal/handler"
 	"fileserver/internal/logging"
 	"fileserver/internal/middleware"
+	"fileserver/internal/models"
 	"fileserver/internal/permission"
 	"fileserver/internal/rolestore"
+	"fileserver/internal/scanner"
+	"fileserver/internal/share"
+	"fileserver/internal/signedurl"
 	"fileserver/internal/storage"
+	"fileserver/internal/usage"
+	"fileserver/internal/watcher"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
@@ -104,6 +114,13 @@ func runHealthcheck() int {
 }
 
 func main() {
+	// 管理用サブコマンド（import 等）はサーバーを起動せずに実行して終了する。
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	// コンテナのHEALTHCHECK用モード。サーバーを起動せず疎通確認のみ行う。
 	healthcheck := flag.Bool("healthcheck", false, "ヘルスチェックを実行して終了する（コンテナHEALTHCHECK用）")
 	flag.Parse()
@@ -168,13 +185,42 @@ func main() {
 		}
 	}()
 
+	// ディレクトリと付与はデータベースが正となる（config.yaml からはデータベースに無い path だけを取り込む）。
+	dirStore := dirstore.New(db)
+	dirs, err := dirStore.Load(context.Background(), cfg.Directories())
+	if err != nil {
+		slog.Error("ディレクトリ定義の読み込みに失敗しました", "error", err)
+		os.Exit(1)
+	}
+	cfg.SetDirectories(dirs)
+
 	storageManager := storage.NewManager(cfg, db)
 	if err := storageManager.InitializeDirectories(); err != nil {
 		slog.Error("ストレージディレクトリの初期化に失敗しました", "error", err)
 		os.Exit(1)
 	}
 
-	uploadManager := storage.NewUploadManager(cfg)
+	// 使用量はアップロード/削除で増分更新する（起動時の再集計は監視の開始後に行う）。
+	usageTracker := usage.NewTracker(cfg, db)
+	storageManager.SetUsageRecorder(usageTracker)
+
+	uploadManager := storage.NewUploadManager(cfg, db)
+	uploadManager.SetStorageManager(storageManager)
+	if err := uploadManager.Restore(context.Background()); err != nil {
+		slog.Error("アップロードセッションの復元に失敗しました", "error", err)
+		os.Exit(1)
+	}
+
+	// スキャンが無効でも、過去に隔離したファイルを管理者が確認・解除できるよう Manager は作る。
+	fileScanner, err := scanner.New(cfg.Scan)
+	if err != nil {
+		slog.Error("スキャナーの初期化に失敗しました", "error", err)
+		os.Exit(1)
+	}
+	scanManager := scanner.NewManager(cfg, db, storageManager, fileScanner)
+	if scanManager.Enabled() {
+		slog.Info("アップロードファイルのスキャンが有効です", "type", cfg.Scan.Type, "quarantine_path", cfg.QuarantinePath())
+	}
 
 	// OIDCのロールは再起動後も復元できるようDBへ永続化する（Discordでは未使用）。
 	roleStore := rolestore.New(db)
@@ -213,14 +259,145 @@ func main() {
 	indexTmpl := loadTemplate("web/templates/index.html")
 	indexMobileTmpl := loadTemplate("web/templates/index_mobile.html")
 	adminTmpl := loadTemplate("web/templates/admin.html")
+	shareTmpl := loadTemplate("web/templates/share.html")
+	dropTmpl := loadTemplate("web/templates/drop.html")
 
 	authHandler := handler.NewAuthHandler(cfg, db, authProvider, storageManager)
 	fileHandler := handler.NewFileHandler(cfg, storageManager, uploadManager, permissionChecker)
-	chunkHandler := handler.NewChunkHandler(storageManager, uploadManager, permissionChecker)
-	adminHandler := handler.NewAdminHandler(cfg, uploadManager, adminTmpl)
+	chunkHandler := handler.NewChunkHandler(cfg, storageManager, uploadManager, permissionChecker)
+	adminHandler := handler.NewAdminHandler(cfg, storageManager, uploadManager, usageTracker, scanManager, adminTmpl)
+	shareStore := share.New(db)
+	shareHandler := handler.NewShareHandler(cfg, db, shareStore, storageManager, permissionChecker, authProvider, shareTmpl)
+	dropHandler := handler.NewDropHandler(cfg, db, shareStore, chunkHandler, authProvider, dropTmpl)
+	memberShareHandler := handler.NewMemberShareHandler(cfg, db, permissionChecker)
+	directoryHandler := handler.NewDirectoryHandler(cfg, dirStore, storageManager, permissionChecker)
+
+	// 署名付きURLの鍵。未設定の場合は起動ごとに生成するため、再起動で発行済みのURLが無効になる。
+	if cfg.SignedURL.Enabled && cfg.SignedURL.Secret == "" {
+		slog.Warn("signed_url.secret が未設定のため署名の鍵を生成しました。再起動すると発行済みの署名付きURLは無効になります")
+	}
+	signer, err := signedurl.New(cfg.SignedURL.Secret)
+	if err != nil {
+		slog.Error("署名付きURLの初期化に失敗しました", "error", err)
+		os.Exit(1)
+	}
+	signedURLHandler := handler.NewSignedURLHandler(cfg, db, signer, storageManager, permissionChecker, authProvider)
+
+	// アップロード・ダウンロードの帯域の上限と、ユーザーごとの転送速度の計測（管理者API用）。
+	bandwidthManager := bandwidth.New(cfg)
+	throttle := middleware.Bandwidth(cfg, authProvider, bandwidthManager)
+	adminHandler.SetBandwidthManager(bandwidthManager)
+
+	// ユーザーごとの1日・1か月あたりの転送量の上限（帯域の制限より先に判定する）。
+	allowanceTracker := allowance.NewTracker(cfg, db)
+	transferAllowance := middleware.Allowance(authProvider, allowanceTracker)
+	authHandler.SetAllowanceTracker(allowanceTracker)
+
+	// 前月以前の転送量を定期的に掃除する（起動直後に一度、以後1時間毎）。
+	go func() {
+		prune := func() {
+			if n, err := allowanceTracker.Prune(context.Background()); err != nil {
+				slog.Error("古い転送量の削除に失敗しました", "error", err)
+			} else if n > 0 {
+				slog.Info("古い転送量を削除しました", "count", n)
+			}
+		}
+		prune()
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			prune()
+		}
+	}()
+
+	// 期限切れ・取り消しから30日を過ぎた共有リンク・アップロードリンクと、
+	// セッションが消えたアップロードの予約を定期的に掃除する（起動直後に一度、以後1時間毎）。
+	go func() {
+		prune := func() {
+			if n, err := shareStore.Prune(context.Background()); err != nil {
+				slog.Error("古い共有リンクの削除に失敗しました", "error", err)
+			} else if n > 0 {
+				slog.Info("古い共有リンクを削除しました", "count", n)
+			}
+			if n, err := shareStore.PruneDrops(context.Background()); err != nil {
+				slog.Error("古いアップロードリンクの削除に失敗しました", "error", err)
+			} else if n > 0 {
+				slog.Info("古いアップロードリンクを削除しました", "count", n)
+			}
+		}
+		prune()
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			prune()
+		}
+	}()
 
 	fileHandler.SetSSEHandler(sseHandler)
 	authHandler.SetSSEHandler(sseHandler)
+	chunkHandler.SetSSEHandler(sseHandler)
+	shareHandler.SetSSEHandler(sseHandler)
+	memberShareHandler.SetSSEHandler(sseHandler)
+	directoryHandler.SetSSEHandler(sseHandler)
+
+	// チャンク・tus のアップロードの開始・進捗・中止を、アップロード先を閲覧できる全員へ通知する（完了は chunkHandler が通知する）。
+	uploadManager.SetProgressNotifier(func(event storage.UploadEvent) {
+		names, err := uploadManager.Usernames(context.Background(), []string{event.UserID})
+		if err != nil {
+			slog.Warn("アップロードの進捗通知: ユーザー名の取得に失敗しました", "error", err, "user_id", event.UserID)
+		}
+		sseHandler.BroadcastUploadProgress(event, names[event.UserID])
+	})
+	fileHandler.SetScanManager(scanManager)
+	chunkHandler.SetScanManager(scanManager)
+
+	// URLからの取り込みは進捗を本人へ、完了をアップロードと同じ file_upload イベントで通知する。
+	// 隔離したファイルは通知しない。
+	// 取り込んだ量はアップロードの転送量に数える。
+	urlFetcher := fetcher.New(cfg, storageManager, uploadManager, scanManager, func(job fetcher.Job) {
+		sseHandler.BroadcastFetchProgress(job)
+		if job.Status == fetcher.StatusCompleted {
+			sseHandler.BroadcastFileUpload(&models.User{ID: job.UserID, Username: job.Username}, job.Directory, job.Filename, job.Received)
+		}
+	})
+	urlFetcher.SetAllowanceTracker(allowanceTracker)
+	fileHandler.SetFetcher(urlFetcher)
+
+	// watch: true のディレクトリへAPI外（rsync・NAS共有等）で置かれたファイルを登録し、
+	// アップロードと同じ file_upload イベントを "system" 名義で通知する。
+	// 外から置かれたファイルは登録した時点でスキャンし（それまでは一覧に見える）、隔離したファイルは通知しない。
+	systemUser := &models.User{ID: models.SystemUsername, Username: models.SystemUsername}
+	dirWatcher := watcher.New(cfg, storageManager, func(directory, filename string, size int64, announce bool) {
+		// 起動時の走査で登録したファイル（停止中に置かれたもの）も検査する。
+		if scanManager.Check(context.Background(), directory, filename).Quarantined || !announce {
+			return
+		}
+		sseHandler.BroadcastFileUpload(systemUser, directory, filename, size)
+	})
+	if dirWatcher.Enabled() {
+		go dirWatcher.Run(context.Background())
+	}
+
+	// 起動時に一度全数を再集計して API外での変更や前回までの取りこぼしを解消し、
+	// 以後は1時間毎に日次スナップショットを取る。監視による既存ファイルの登録も使用量へ
+	// 加算されるため、二重計上しないよう登録が終わってから再集計する。
+	go func() {
+		<-dirWatcher.Ready()
+		if err := usageTracker.Recount(context.Background()); err != nil {
+			slog.Error("使用量の再集計に失敗しました", "error", err)
+		}
+		snapshot := func() {
+			if err := usageTracker.Snapshot(context.Background()); err != nil {
+				slog.Error("使用量スナップショットの保存に失敗しました", "error", err)
+			}
+		}
+		snapshot()
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			snapshot()
+		}
+	}()
 
 	r := chi.NewRouter()
 
@@ -277,25 +454,87 @@ func main() {
 	r.Get("/auth/callback", authHandler.Callback)
 	r.Get("/auth/logout", authHandler.Logout)
 
+	// 共有リンク（認証不要）。Resolve が作成者をユーザーとして格納するため、転送量・帯域の上限は作成者の分として適用される。
+	if cfg.Share.Enabled {
+		r.Route("/s/{token}", func(r chi.Router) {
+			r.Use(shareHandler.Resolve)
+			r.Get("/", shareHandler.SharePage)
+			r.With(transferAllowance, throttle).Get("/{filename}", shareHandler.Download)
+		})
+	}
+
+	// アップロードリンク（認証不要）。訪問者にはアップロードだけを許し、一覧・ダウンロードのルートは置かない。
+	// Resolve が作成者をユーザーとして格納するため、アップロードは作成者の名義で記録・通知される。
+	if cfg.Share.DropEnabled {
+		r.Route("/d/{token}", func(r chi.Router) {
+			r.Use(dropHandler.Resolve)
+			r.Get("/", dropHandler.DropPage)
+			r.With(transferAllowance, throttle).Post("/", dropHandler.Upload)
+			if cfg.Storage.ChunkUploadOn() {
+				r.Post("/chunk/init", dropHandler.InitChunkUpload)
+				r.With(transferAllowance, throttle).Post("/chunk/upload/{upload_id}", dropHandler.UploadChunk)
+				r.Post("/chunk/complete/{upload_id}", dropHandler.CompleteChunkUpload)
+				r.Delete("/chunk/cancel/{upload_id}", dropHandler.CancelChunkUpload)
+			}
+		})
+	}
+
+	// 署名付きURL（Cookie不要）。AuthMiddleware の代わりに Resolve が署名を検証し、発行者をユーザーとして格納する。
+	if cfg.SignedURL.Enabled {
+		r.With(signedURLHandler.Resolve, transferAllowance, throttle).Get("/files/signed/{directory}/{filename}", fileHandler.Download)
+	}
+
 	r.Group(func(r chi.Router) {
 		r.Use(middleware.AuthMiddleware(cfg, db, authProvider))
 
 		r.Get("/api/user", authHandler.GetCurrentUser)
 		r.Get("/api/events", sseHandler.HandleSSE)
 
-		r.Post("/files/upload", fileHandler.Upload)
+		r.With(transferAllowance, throttle).Post("/files/upload", fileHandler.Upload)
+		r.With(transferAllowance, throttle).Post("/files/upload/batch", fileHandler.UploadBatch)
+		r.With(transferAllowance).Post("/files/fetch", fileHandler.FetchURL)
+		r.Get("/files/fetch/{job_id}", fileHandler.GetFetchJob)
 		r.Get("/files", fileHandler.ListFiles)
 		r.Get("/files/directories", fileHandler.ListDirectories)
-		r.Get("/files/download/{directory}/{filename}", fileHandler.Download)
+		r.With(transferAllowance, throttle).Get("/files/download/{directory}/{filename}", fileHandler.Download)
 		r.Delete("/files/{directory}/{filename}", fileHandler.DeleteFile)
 
+		// メンバー共有（ギルドのユーザー・ロールへの共有）
+		r.Post("/api/member-shares", memberShareHandler.CreateMemberShare)
+		r.Get("/api/member-shares", memberShareHandler.ListMemberShares)
+		r.Delete("/api/member-shares/{id}", memberShareHandler.RevokeMemberShare)
+		r.Get("/api/shared-with-me", memberShareHandler.SharedWithMe)
+
+		// 共有リンク（設定で有効化されている場合のみ登録）
+		if cfg.Share.Enabled {
+			r.Post("/api/shares", shareHandler.CreateShare)
+			r.Get("/api/shares", shareHandler.ListShares)
+			r.Delete("/api/shares/{token}", shareHandler.RevokeShare)
+		}
+		if cfg.SignedURL.Enabled {
+			r.Post("/api/files/sign", signedURLHandler.Sign)
+		}
+		if cfg.Share.DropEnabled {
+			r.Post("/api/drops", dropHandler.CreateDrop)
+			r.Get("/api/drops", dropHandler.ListDrops)
+			r.Delete("/api/drops/{token}", dropHandler.RevokeDrop)
+		}
+
 		// チャンクアップロード（設定で有効化されている場合のみ登録）
 		if cfg.Storage.ChunkUploadOn() {
 			r.Post("/files/chunk/init", chunkHandler.InitChunkUpload)
-			r.Post("/files/chunk/upload/{upload_id}", chunkHandler.UploadChunk)
+			r.With(transferAllowance, throttle).Post("/files/chunk/upload/{upload_id}", chunkHandler.UploadChunk)
 			r.Get("/files/chunk/status/{upload_id}", chunkHandler.GetChunkStatus)
 			r.Post("/files/chunk/complete/{upload_id}", chunkHandler.CompleteChunkUpload)
 			r.Delete("/files/chunk/cancel/{upload_id}", chunkHandler.CancelChunkUpload)
+
+			// tus 1.0（Uppy・tus-js-client 等の標準クライアント向け）。セッションはチャンクAPIと共通。
+			r.Options("/files/tus", chunkHandler.TusOptions)
+			r.Options("/files/tus/{upload_id}", chunkHandler.TusOptions)
+			r.Post("/files/tus", chunkHandler.TusCreate)
+			r.Head("/files/tus/{upload_id}", chunkHandler.TusHead)
+			r.With(transferAllowance, throttle).Patch("/files/tus/{upload_id}", chunkHandler.TusPatch)
+			r.Delete("/files/tus/{upload_id}", chunkHandler.TusDelete)
 		} else {
 			slog.Info("チャンクアップロードは無効化されています（storage.chunk_upload_enabled=false）")
 		}
@@ -305,7 +544,26 @@ func main() {
 
 			r.Get("/admin", adminHandler.AdminPage)
 			r.Get("/api/admin/uploads", adminHandler.GetUploadSessions)
+			r.Delete("/api/admin/uploads/{upload_id}", adminHandler.AbortUploadSession)
+			r.Put("/api/admin/uploads/{upload_id}/expiry", adminHandler.SetUploadSessionExpiry)
+			r.Post("/api/admin/uploads/purge", adminHandler.PurgeUploadSessions)
 			r.Get("/api/admin/stats", adminHandler.GetUploadStats)
+			r.Get("/api/admin/bandwidth", adminHandler.GetBandwidth)
+			r.Get("/api/admin/usage", adminHandler.GetUsage)
+			r.Get("/api/admin/usage/history", adminHandler.GetUsageHistory)
+			r.Post("/api/admin/usage/recount", adminHandler.RecountUsage)
+			r.Get("/api/admin/quarantine", adminHandler.GetQuarantine)
+			r.Post("/api/admin/quarantine/{id}/release", adminHandler.ReleaseQuarantine)
+			r.Delete("/api/admin/quarantine/{id}", adminHandler.DeleteQuarantine)
+			r.Get("/api/admin/legal-hold", adminHandler.GetLegalHolds)
+			r.Put("/api/admin/legal-hold", adminHandler.SetLegalHold)
+			r.Get("/api/admin/shares", shareHandler.AdminListShares)
+			r.Delete("/api/admin/shares/{token}", shareHandler.AdminRevokeShare)
+			r.Get("/api/admin/drops", dropHandler.AdminListDrops)
+			r.Delete("/api/admin/drops/{token}", dropHandler.AdminRevokeDrop)
+			r.Get("/api/admin/directories", directoryHandler.ListDirectories)
+			r.Put("/api/admin/directories/{directory}", directoryHandler.PutDirectory)
+			r.Delete("/api/admin/directories/{directory}", directoryHandler.DeleteDirectory)
 		})
 	})
 
@@ -19,7 +19,8 @@ const state = {
     sortBy: 'name-asc',
     searchQuery: '',
     eventListenersInitialized: false,
-    selectedFiles: new Set() // 一括操作用の選択されたファイル
+    selectedFiles: new Set(), // 一括操作用の選択されたファイル
+    remoteUploads: {} // 他のメンバーが進行中のアップロード（upload_id → upload_progress イベント）
 };
 
 // ページ読み込み時
@@ -40,8 +41,12 @@ async function checkAuth() {
         if (response.ok) {
             state.user = await response.json();
             console.log('認証成功:', state.user);
+            document.getElementById('context-share-link')?.classList.toggle('hidden', !state.user.share_enabled);
+            document.getElementById('create-drop-link')?.classList.toggle('hidden', !state.user.drop_enabled);
+            document.getElementById('context-signed-url')?.classList.toggle('hidden', !state.user.signed_url_enabled);
             showAppSection();
             await loadDirectories();
+            loadSharedWithMe();
             connectSSE();
         } else {
             console.log('認証失敗: ログインが必要です');
@@ -266,6 +271,7 @@ async function selectDirectory(path) {
     }
     renderDirectories();
     updateBreadcrumb();
+    renderRemoteUploads();
     await loadFiles(path);
 
     // モバイル版: ディレクトリ選択後にメニューを自動で閉じる。
@@ -877,10 +883,19 @@ async function uploadFileInChunks(file, uploadId) {
             let retries = 3;
             let uploaded = false;
 
+            // 転送中の破損をサーバー側で検出できるよう、チャンクのSHA-256を添える（460で再送）
+            const headers = {};
+            if (window.crypto && crypto.subtle) {
+                const digest = await crypto.subtle.digest('SHA-256', await chunk.arrayBuffer());
+                headers['X-Chunk-SHA256'] = Array.from(new Uint8Array(digest))
+                    .map(b => b.toString(16).padStart(2, '0')).join('');
+            }
+
             while (retries > 0 && !uploaded) {
                 try {
                     const uploadResponse = await fetch(`/files/chunk/upload/${upload_id}?chunk_index=${i}`, {
                         method: 'POST',
+                        headers,
                         body: chunk,
                         credentials: 'include'
                     });
@@ -977,6 +992,178 @@ async function deleteFile(filename) {
     }
 }
 
+// 共有リンク作成（ログインできない人へ渡すURLを作り、クリップボードへコピーする）
+window.createShareLink = async function(filename) {
+    const expiresIn = prompt('有効期間（例: 24h、7d は 168h。空欄はサーバーの既定）', '24h');
+    if (expiresIn === null) return;
+    const password = prompt('パスワード（空欄はパスワードなし）', '');
+    if (password === null) return;
+    const maxDownloads = prompt('ダウンロード回数の上限（0 は無制限）', '0');
+    if (maxDownloads === null) return;
+
+    try {
+        const response = await fetch('/api/shares', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                directory: state.selectedDirectory,
+                filename,
+                expires_in: expiresIn.trim(),
+                password,
+                max_downloads: parseInt(maxDownloads, 10) || 0
+            })
+        });
+
+        if (response.ok) {
+            const data = await response.json();
+            await navigator.clipboard.writeText(window.location.origin + data.share.url);
+            if (window.toast) toast.success('共有リンクをコピーしました');
+        } else {
+            const error = await response.text();
+            if (window.toast) toast.error(`共有リンクの作成に失敗しました: ${error}`);
+        }
+    } catch (error) {
+        console.error('共有リンク作成エラー:', error);
+        if (window.toast) toast.error('共有リンクの作成に失敗しました');
+    }
+};
+
+// メンバー共有（ファイル・フォルダをギルドのユーザーまたはロールへ共有する）
+window.shareWithMember = async function(file) {
+    const grantee = prompt('共有相手（ユーザーIDか、role: に続けてロールID）', '');
+    if (!grantee || !grantee.trim()) return;
+    let permission = 'read';
+    if (file.is_directory && confirm('書き込み（アップロード）も許可しますか？')) {
+        permission = 'write';
+    }
+
+    const target = grantee.trim();
+    const body = file.is_directory
+        ? { directory: `${state.selectedDirectory}/${file.filename}`, permission }
+        : { directory: state.selectedDirectory, filename: file.filename, permission };
+    if (target.startsWith('role:')) {
+        body.role = target.slice('role:'.length);
+    } else {
+        body.user = target;
+    }
+
+    try {
+        const response = await fetch('/api/member-shares', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+
+        if (response.ok) {
+            if (window.toast) toast.success('共有しました');
+        } else {
+            const error = await response.text();
+            if (window.toast) toast.error(`共有に失敗しました: ${error}`);
+        }
+    } catch (error) {
+        console.error('メンバー共有エラー:', error);
+        if (window.toast) toast.error('共有に失敗しました');
+    }
+};
+
+// 自分に共有されたファイルをサイドバーに表示する（フォルダの共有はフォルダ一覧に出る）
+async function loadSharedWithMe() {
+    const container = document.getElementById('shared-with-me');
+    if (!container) return;
+
+    try {
+        const response = await fetch('/api/shared-with-me', { credentials: 'include' });
+        if (!response.ok) return;
+        const data = await response.json();
+        const files = (data.shares || []).filter(s => s.filename);
+        container.classList.toggle('hidden', files.length === 0);
+        container.querySelector('ul').innerHTML = files.map(s => {
+            const href = `/files/download/${encodeURIComponent(s.directory)}/${encodeURIComponent(s.filename)}`;
+            return `
+            <li>
+                <a href="${href}" class="block px-3 py-1.5 rounded-lg text-sm truncate text-gray-700 dark:text-gray-300 hover:bg-gray-100 dark:hover:bg-gray-700"
+                   title="${escapeHtml(s.directory)}（${escapeHtml(s.created_by_name || s.created_by)} から）">${escapeHtml(s.filename)}</a>
+            </li>`;
+        }).join('');
+    } catch (error) {
+        console.error('共有されたファイルの読み込みエラー:', error);
+    }
+}
+
+// 署名付きURL作成（Cookieなしで使える短命のダウンロードURLを作り、クリップボードへコピーする）
+window.createSignedURL = async function(filename) {
+    const expiresIn = prompt('有効期間（例: 10m、1h。空欄はサーバーの既定）', '');
+    if (expiresIn === null) return;
+    const bindIP = confirm('このIPアドレスからのダウンロードだけに限定しますか？');
+
+    try {
+        const response = await fetch('/api/files/sign', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                directory: state.selectedDirectory,
+                filename,
+                expires_in: expiresIn.trim(),
+                bind_ip: bindIP
+            })
+        });
+
+        if (response.ok) {
+            const data = await response.json();
+            await navigator.clipboard.writeText(window.location.origin + data.url);
+            if (window.toast) toast.success('署名付きURLをコピーしました');
+        } else {
+            const error = await response.text();
+            if (window.toast) toast.error(`署名付きURLの作成に失敗しました: ${error}`);
+        }
+    } catch (error) {
+        console.error('署名付きURL作成エラー:', error);
+        if (window.toast) toast.error('署名付きURLの作成に失敗しました');
+    }
+};
+
+// 選択中のディレクトリへのアップロードリンクを作成し、URLをクリップボードへコピー
+window.createDropLink = async function() {
+    const label = prompt('訪問者に表示する説明（任意）', '');
+    if (label === null) return;
+    const expiresIn = prompt('有効期間（例: 24h、7d は 168h。空欄はサーバーの既定）', '168h');
+    if (expiresIn === null) return;
+    const maxFiles = prompt('ファイル数の上限（0 は無制限）', '10');
+    if (maxFiles === null) return;
+    const maxMB = prompt('合計サイズの上限（MB、0 は無制限）', '1024');
+    if (maxMB === null) return;
+
+    try {
+        const response = await fetch('/api/drops', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                directory: state.selectedDirectory,
+                label: label.trim(),
+                expires_in: expiresIn.trim(),
+                max_files: parseInt(maxFiles, 10) || 0,
+                max_bytes: (parseInt(maxMB, 10) || 0) * 1024 * 1024
+            })
+        });
+
+        if (response.ok) {
+            const data = await response.json();
+            await navigator.clipboard.writeText(window.location.origin + data.drop.url);
+            if (window.toast) toast.success('アップロードリンクをコピーしました');
+        } else {
+            const error = await response.text();
+            if (window.toast) toast.error(`アップロードリンクの作成に失敗しました: ${error}`);
+        }
+    } catch (error) {
+        console.error('アップロードリンク作成エラー:', error);
+        if (window.toast) toast.error('アップロードリンクの作成に失敗しました');
+    }
+};
+
 // Server-Sent Events接続
 function connectSSE() {
     if (state.eventSource) {
@@ -1038,6 +1225,39 @@ function connectSSE() {
         }
     });
 
+    // 一括アップロードイベント（1リクエスト分をまとめて1件で届く）
+    eventSource.addEventListener('batch_upload', (e) => {
+        const data = JSON.parse(e.data);
+        addActivityLog('upload', `${data.username} が ${data.count} 件のファイルを ${data.directory} にアップロードしました`, true);
+
+        // 保存先かその配下を表示中なら再読み込み（サブディレクトリが増えている場合がある）
+        const selected = state.selectedDirectory;
+        if (selected && (selected === data.directory || selected.startsWith(data.directory + '/'))) {
+            loadFiles(selected);
+        }
+    });
+
+    // 他のメンバーのチャンク・tus アップロードの開始・進捗・終了（自分のものは手元で表示している）
+    eventSource.addEventListener('upload_progress', (e) => {
+        const data = JSON.parse(e.data);
+        if (state.user && data.user_id === state.user.id) return;
+
+        if (data.state === 'started' || data.state === 'progress') {
+            state.remoteUploads[data.upload_id] = data;
+        } else {
+            delete state.remoteUploads[data.upload_id];
+        }
+        if (data.state === 'started') {
+            addActivityLog('upload', `${escapeHtml(data.username || data.user_id)} が ${escapeHtml(data.filename)} のアップロードを開始しました`, true);
+        }
+        renderRemoteUploads();
+    });
+
+    // URLからの取り込みの進捗（取り込みを開始した本人にのみ届く）
+    eventSource.addEventListener('fetch_progress', (e) => {
+        updateFetchJob(JSON.parse(e.data));
+    });
+
     // ファイルダウンロードイベント
     eventSource.addEventListener('file_download', (e) => {
         const data = JSON.parse(e.data);
@@ -1073,6 +1293,7 @@ async function handlePermissionsUpdated() {
 
     // ちらつきを避けるためSkeletonなしで一覧を取り直す。
     await loadDirectories(false);
+    loadSharedWithMe();
 
     if (previous) {
         const stillAccessible = state.directories.some(d => d.path === previous);
@@ -1091,6 +1312,30 @@ async function handlePermissionsUpdated() {
     addActivityLog('permission', '権限が更新されました', true);
 }
 
+// 表示中のディレクトリで他のメンバーが進行中のアップロードを表示
+function renderRemoteUploads() {
+    const container = document.getElementById('remote-uploads');
+    if (!container) return;
+
+    const uploads = Object.values(state.remoteUploads).filter(u => u.directory === state.selectedDirectory);
+    if (uploads.length === 0) {
+        container.classList.add('hidden');
+        container.innerHTML = '';
+        return;
+    }
+    container.classList.remove('hidden');
+    container.innerHTML = uploads.map(u => `
+        <div class="p-3 bg-blue-50 dark:bg-gray-700/50 border border-blue-100 dark:border-gray-600 rounded-lg">
+            <p class="text-sm text-gray-700 dark:text-gray-200 truncate">
+                ${escapeHtml(u.username || u.user_id)} が ${escapeHtml(u.filename)} をアップロード中（${u.percent}%）
+            </p>
+            <div class="mt-2 h-1.5 bg-blue-100 dark:bg-gray-600 rounded-full overflow-hidden">
+                <div class="h-full bg-primary-500 transition-all" style="width: ${u.percent}%"></div>
+            </div>
+        </div>
+    `).join('');
+}
+
 // アクティビティログ追加
 function addActivityLog(type, message, fromSSE = false) {
     const logContainer = document.getElementById('activity-log');
@@ -1283,8 +1528,9 @@ window.addEventListener('beforeunload', () => {
         state.eventSource.close();
     }
     // 進行中のアップロードをキャンセル
+    // （URLからの取り込みはサーバー側で続くため対象外）
     Object.values(activeUploads).forEach(upload => {
-        if (upload.status === 'uploading') {
+        if (upload.status === 'uploading' && !upload.fetchJobId) {
             cancelUpload(upload.id);
         }
     });
@@ -1311,6 +1557,72 @@ function addActiveUpload(file, directory) {
     return id;
 }
 
+// URLからの取り込みジョブを進行中リストへ反映（開始時の応答と fetch_progress イベントの両方から呼ぶ）
+function updateFetchJob(job) {
+    const id = `fetch_${job.job_id}`;
+    const previous = activeUploads[id];
+    const statuses = {
+        running: 'uploading',
+        completed: 'completed',
+        failed: 'failed',
+        quarantined: 'failed'
+    };
+    activeUploads[id] = {
+        id,
+        file: { name: job.filename || job.url, size: job.total || job.received },
+        directory: job.directory,
+        status: statuses[job.status] || 'uploading',
+        progress: job.total > 0 ? Math.round((job.received / job.total) * 100) : 0,
+        uploadId: null,
+        fetchJobId: job.job_id,
+        abortController: new AbortController()
+    };
+    renderActiveUploads();
+    updateUploadBadge();
+
+    // 終了の通知は一度だけ出す
+    if (previous && previous.status !== 'uploading') return;
+    if (job.status === 'completed') {
+        addActivityLog('upload', `${escapeHtml(job.url)} を取り込みました`);
+        if (window.toast) toast.success(`${activeUploads[id].file.name} の取り込みが完了しました`);
+    } else if (job.status === 'failed' || job.status === 'quarantined') {
+        addActivityLog('error', `取り込み失敗: ${escapeHtml(job.error || job.scan_status)}`);
+        if (window.toast) toast.error('URLからの取り込みに失敗しました');
+    }
+}
+
+// URLを指定してサーバー側で取り込む
+window.fetchFromURL = async function() {
+    if (!state.selectedDirectory) {
+        if (window.toast) toast.warning('ディレクトリを選択してください');
+        return;
+    }
+    const selectedDir = state.directories.find(d => d.path === state.selectedDirectory);
+    if (!selectedDir || !selectedDir.permissions.includes('write')) {
+        if (window.toast) toast.error('このディレクトリへの書き込み権限がありません');
+        return;
+    }
+
+    const url = prompt('取り込むファイルのURLを入力してください');
+    if (!url) return;
+
+    try {
+        const response = await fetch('/files/fetch', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ url, directory: state.selectedDirectory })
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        updateFetchJob(await response.json());
+    } catch (error) {
+        console.error('取り込みエラー:', error);
+        if (window.toast) toast.error(`取り込みを開始できませんでした: ${error.message}`);
+    }
+};
+
 // アップロード更新
 function updateUploadProgress(id, progress, status = 'uploading') {
     if (activeUploads[id]) {
@@ -1400,13 +1712,13 @@ function renderActiveUploads() {
                     <div class="flex-1 min-w-0">
                         <div class="flex items-center gap-2">
                             <span class="text-lg">${statusIcons[upload.status]}</span>
-                            <p class="text-sm font-semibold text-gray-800 dark:text-white truncate">${upload.file.name}</p>
+                            <p class="text-sm font-semibold text-gray-800 dark:text-white truncate">${escapeHtml(upload.file.name)}</p>
                         </div>
                         <p class="text-xs text-gray-500 dark:text-gray-400 mt-1">
-                            ${upload.directory} • ${formatFileSize(upload.file.size)}
+                            ${escapeHtml(upload.directory)} • ${formatFileSize(upload.file.size)}
                         </p>
                     </div>
-                    ${upload.status === 'uploading' ? `
+                    ${upload.status === 'uploading' && !upload.fetchJobId ? `
                         <button onclick="cancelUpload('${upload.id}')" class="ml-2 p-1.5 hover:bg-red-100 dark:hover:bg-red-900/30 text-red-500 rounded transition-colors" title="キャンセル">
                             <svg class="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
                                 <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M6 18L18 6M6 6l12 12"/>